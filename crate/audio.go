@@ -0,0 +1,818 @@
+// Meta data struct specifically for music and voice recordings
+
+package crate
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+const (
+	ID3v1Size   = 128 // Size of the ID3v1 tag at the end of an MP3
+	ID3v2Header = 10  // Size of the ID3v2 header (and footer)
+)
+
+// The ID3v1 genres, which ID3v2 genres may also refer to by number, e.g. (17)
+var ID3Genres = []string{
+	"Blues", "Classic Rock", "Country", "Dance", "Disco", "Funk", "Grunge",
+	"Hip-Hop", "Jazz", "Metal", "New Age", "Oldies", "Other", "Pop", "R&B",
+	"Rap", "Reggae", "Rock", "Techno", "Industrial", "Alternative", "Ska",
+	"Death Metal", "Pranks", "Soundtrack", "Euro-Techno", "Ambient",
+	"Trip-Hop", "Vocal", "Jazz+Funk", "Fusion", "Trance", "Classical",
+	"Instrumental", "Acid", "House", "Game", "Sound Clip", "Gospel", "Noise",
+	"AlternRock", "Bass", "Soul", "Punk", "Space", "Meditative",
+	"Instrumental Pop", "Instrumental Rock", "Ethnic", "Gothic", "Darkwave",
+	"Techno-Industrial", "Electronic", "Pop-Folk", "Eurodance", "Dream",
+	"Southern Rock", "Comedy", "Cult", "Gangsta", "Top 40", "Christian Rap",
+	"Pop/Funk", "Jungle", "Native American", "Cabaret", "New Wave",
+	"Psychadelic", "Rave", "Showtunes", "Trailer", "Lo-Fi", "Tribal",
+	"Acid Punk", "Acid Jazz", "Polka", "Retro", "Musical", "Rock & Roll",
+	"Hard Rock",
+}
+
+// Maps the ID3v2 (v2.2 and v2.3+), Vorbis comment and MP4 atom names to tags
+var audioTagNames = map[string]string{
+	"TIT2": "Title", "TT2": "Title", "TITLE": "Title", "\xa9nam": "Title",
+	"TPE1": "Artist", "TP1": "Artist", "ARTIST": "Artist", "\xa9ART": "Artist",
+	"TALB": "Album", "TAL": "Album", "ALBUM": "Album", "\xa9alb": "Album",
+	"TRCK": "Track", "TRK": "Track", "TRACKNUMBER": "Track", "trkn": "Track",
+	"TYER": "Year", "TYE": "Year", "TDRC": "Year", "DATE": "Year", "\xa9day": "Year",
+	"TCON": "Genre", "TCO": "Genre", "GENRE": "Genre", "\xa9gen": "Genre",
+}
+
+// Bit rates in kbps of MPEG audio frames by version, layer and index
+var mpegBitrates = map[[2]int][]int{
+	{1, 1}: {0, 32, 64, 96, 128, 160, 192, 224, 256, 288, 320, 352, 384, 416, 448},
+	{1, 2}: {0, 32, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 384},
+	{1, 3}: {0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320},
+	{2, 1}: {0, 32, 48, 56, 64, 80, 96, 112, 128, 144, 160, 176, 192, 224, 256},
+	{2, 2}: {0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},
+	{2, 3}: {0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},
+}
+
+// Sample rates of MPEG audio frames by version (2.5 is stored as 3)
+var mpegSampleRates = map[int][]int{
+	1: {44100, 48000, 32000},
+	2: {22050, 24000, 16000},
+	3: {11025, 12000, 8000},
+}
+
+var errNoAudioFrame = errors.New("no MPEG audio frame found")
+
+//=============================================================================
+
+type AudioMeta struct {
+	FileMeta
+	Duration   float64 // Duration of the recording in seconds
+	Bitrate    int     // Average bit rate in kbps
+	SampleRate int     // Samples per second, e.g. 44100
+	Channels   int     // Number of channels, e.g. 2 for stereo
+	Tags       TagMap  // Title, Artist, Album, Track, Year, Genre and CoverArt
+}
+
+// Converts a FileMeta into an AudioMeta
+func ConvertAudioMeta(fm *FileMeta) (*AudioMeta, bool) {
+	if !new(AudioExtractor).Claims(fm.MimeType) {
+		return nil, false
+	}
+
+	audio := new(AudioMeta)
+	audio.FileMeta = *fm
+
+	return audio, true
+}
+
+// Populates the fields on the AudioMeta
+func (audio *AudioMeta) Populate() {
+	audio.FileMeta.populateFile()
+	extract(audio)
+}
+
+// Returns the value of a tag or an empty string if it isn't set
+func (audio *AudioMeta) Tag(name string) string {
+	return audio.Tags[name]
+}
+
+// Recordings have no location, but may be searched like other tagged records
+func (audio *AudioMeta) Location() (float64, float64, bool) {
+	return audio.Tags.Location()
+}
+
+// Returns the time the recording was made, if tagged
+func (audio *AudioMeta) Taken() (time.Time, bool) {
+	return audio.Tags.Taken()
+}
+
+// Writes the AudioMeta to the database, where the key is the SHA1 hash
+func (audio *AudioMeta) Store() error {
+	if !audio.populated {
+		audio.Populate()
+	}
+
+	return storeRecord(audio)
+}
+
+// Returns the byte serialization of the audio meta for storage
+func (audio *AudioMeta) Byte() []byte {
+	data, err := json.Marshal(audio)
+	if err != nil {
+		return nil
+	}
+
+	return data
+}
+
+// Prints out the info as a JSON indented pretty string
+func (audio *AudioMeta) Info() string {
+	if !audio.populated {
+		audio.Populate()
+	}
+
+	info, err := json.MarshalIndent(audio, "", "  ")
+	if err != nil {
+		return ""
+	}
+
+	return string(info)
+}
+
+//=============================================================================
+
+// Extracts the tags and stream properties of MP3 (ID3v1 and ID3v2), FLAC
+// (Vorbis comments) and MP4 audio (iTunes atoms). The embedded cover art is
+// recorded by its signature in the CoverArt tag rather than stored.
+type AudioExtractor struct{}
+
+func init() {
+	RegisterExtractor(new(AudioExtractor))
+}
+
+func (ext *AudioExtractor) Name() string {
+	return "audio"
+}
+
+func (ext *AudioExtractor) Version() string {
+	return "1"
+}
+
+func (ext *AudioExtractor) Claims(mimetype string) bool {
+	return MimePrefixes{"audio/mpeg", "audio/flac", "audio/x-flac", "audio/mp4", "audio/x-m4a"}.Claims(mimetype)
+}
+
+func (ext *AudioExtractor) Convert(fm *FileMeta) FilePath {
+	if audio, ok := ConvertAudioMeta(fm); ok {
+		return audio
+	}
+
+	return nil
+}
+
+func (ext *AudioExtractor) Extract(record FilePath) error {
+	audio, ok := record.(*AudioMeta)
+	if !ok {
+		return errors.New("record is not an AudioMeta")
+	}
+
+	file, err := os.Open(audio.Path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	finfo, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	magic := make([]byte, 12)
+	if _, err := file.ReadAt(magic, 0); err != nil && err != io.EOF {
+		return err
+	}
+
+	audio.Tags = make(TagMap)
+
+	switch {
+	case bytes.HasPrefix(magic, []byte("fLaC")):
+		err = audio.parseFLAC(file, finfo.Size())
+	case string(magic[4:8]) == "ftyp":
+		err = audio.parseMP4(file, finfo.Size())
+	default:
+		err = audio.parseMP3(file, finfo.Size())
+	}
+
+	if err != nil {
+		return err
+	}
+
+	// Normalize the track to its number, e.g. "3/12" is stored as 3
+	if track := audio.Tags["Track"]; track != "" {
+		track = strings.TrimSpace(strings.SplitN(track, "/", 2)[0])
+		if num, err := strconv.Atoi(track); err == nil && num > 0 {
+			audio.Tags["Track"] = strconv.Itoa(num)
+		} else {
+			delete(audio.Tags, "Track")
+		}
+	}
+
+	// Normalize the year to its four digits, e.g. 2015-06-14 is stored as 2015
+	if year := audio.Tags["Year"]; len(year) > 4 {
+		if _, err := strconv.Atoi(year[:4]); err == nil {
+			audio.Tags["Year"] = year[:4]
+		}
+	}
+
+	return nil
+}
+
+// Sets the tag named by a frame, comment or atom name if it isn't yet set
+func (audio *AudioMeta) setTag(name, value string) {
+	if tag, ok := audioTagNames[name]; ok {
+		value = strings.TrimSpace(strings.TrimRight(value, "\x00"))
+		if value != "" && audio.Tags[tag] == "" {
+			audio.Tags[tag] = value
+		}
+	}
+}
+
+//=============================================================================
+
+// Parses the ID3v2 tag at the start of an MP3, the first MPEG audio frame for
+// the stream properties, and the ID3v1 tag at the end for any missing tags.
+func (audio *AudioMeta) parseMP3(r io.ReaderAt, size int64) error {
+	start := int64(0)
+	header := make([]byte, ID3v2Header)
+	if _, err := r.ReadAt(header, 0); err == nil && bytes.HasPrefix(header, []byte("ID3")) {
+		tagSize := int64(syncsafe(header[6:10])) + ID3v2Header
+		if header[5]&0x10 != 0 {
+			tagSize += ID3v2Header
+		}
+
+		if tagSize <= size && tagSize <= MaxBoxRead {
+			tag := make([]byte, tagSize)
+			if _, err := r.ReadAt(tag, 0); err == nil {
+				audio.parseID3v2(tag)
+			}
+		}
+
+		start = tagSize
+	}
+
+	end := size
+	if size-start >= ID3v1Size {
+		tag := make([]byte, ID3v1Size)
+		if _, err := r.ReadAt(tag, size-ID3v1Size); err == nil && bytes.HasPrefix(tag, []byte("TAG")) {
+			audio.parseID3v1(tag)
+			end -= ID3v1Size
+		}
+	}
+
+	// Keep the tags of files without a recognizable audio stream
+	if err := audio.parseMPEGFrame(r, start, end); err != nil && len(audio.Tags) == 0 {
+		return err
+	}
+
+	return nil
+}
+
+// Parses the frames of an ID3v2.2, v2.3 or v2.4 tag including its header
+func (audio *AudioMeta) parseID3v2(tag []byte) {
+	version := tag[3]
+	flags := tag[5]
+	data := tag[ID3v2Header:]
+	if len(data) > int(syncsafe(tag[6:10])) {
+		data = data[:syncsafe(tag[6:10])]
+	}
+
+	// Before v2.4 unsynchronisation applies to the whole tag
+	if flags&0x80 != 0 && version < 4 {
+		data = unsynchronise(data)
+	}
+
+	// Skip the extended header, the size of which excludes itself in v2.3
+	if flags&0x40 != 0 && len(data) >= 4 {
+		skip := int(binary.BigEndian.Uint32(data[:4])) + 4
+		if version == 4 {
+			skip = int(syncsafe(data[:4]))
+		}
+
+		if skip > len(data) {
+			return
+		}
+		data = data[skip:]
+	}
+
+	idlen, hlen := 4, 10
+	if version == 2 {
+		idlen, hlen = 3, 6
+	}
+
+	for pos := 0; pos+hlen <= len(data); {
+		id := string(data[pos : pos+idlen])
+		if id[0] == 0 {
+			break // Reached the padding
+		}
+
+		var fsize int
+		var fflags byte
+		switch version {
+		case 2:
+			fsize = int(data[pos+3])<<16 | int(data[pos+4])<<8 | int(data[pos+5])
+		case 3:
+			fsize = int(binary.BigEndian.Uint32(data[pos+4 : pos+8]))
+			fflags = data[pos+9]
+		default:
+			fsize = int(syncsafe(data[pos+4 : pos+8]))
+			fflags = data[pos+9]
+		}
+
+		pos += hlen
+		if fsize < 0 || pos+fsize > len(data) {
+			break
+		}
+
+		frame := data[pos : pos+fsize]
+		pos += fsize
+
+		// Compressed and encrypted frames can't be read without decoding
+		if version == 3 && fflags&0xc0 != 0 || version == 4 && fflags&0x0c != 0 {
+			continue
+		}
+
+		if version == 4 {
+			if fflags&0x01 != 0 && len(frame) >= 4 {
+				frame = frame[4:] // Data length indicator
+			}
+			if fflags&0x02 != 0 {
+				frame = unsynchronise(frame)
+			}
+		}
+
+		audio.parseID3Frame(id, frame)
+	}
+}
+
+// Parses a single ID3v2 frame for text and attached pictures
+func (audio *AudioMeta) parseID3Frame(id string, frame []byte) {
+	if len(frame) == 0 {
+		return
+	}
+
+	switch {
+	case id == "APIC" || id == "PIC":
+		if audio.Tags["CoverArt"] != "" {
+			return
+		}
+
+		enc := frame[0]
+		rest := frame[1:]
+
+		// The MIME type is null terminated, v2.2 has a 3 character format
+		if id == "PIC" {
+			if len(rest) < 3 {
+				return
+			}
+			rest = rest[3:]
+		} else {
+			idx := bytes.IndexByte(rest, 0)
+			if idx < 0 {
+				return
+			}
+			rest = rest[idx+1:]
+		}
+
+		if len(rest) < 1 {
+			return
+		}
+
+		// Skip the picture type and the description in the text encoding
+		_, pic := splitID3Text(enc, rest[1:])
+		if len(pic) > 0 {
+			audio.Tags["CoverArt"] = Hash(pic)
+		}
+
+	case id == "TCON" || id == "TCO":
+		audio.setTag(id, id3Genre(decodeID3Text(frame[0], frame[1:])))
+
+	case id[0] == 'T':
+		audio.setTag(id, decodeID3Text(frame[0], frame[1:]))
+	}
+}
+
+// Parses a 128 byte ID3v1 or v1.1 tag, which only fills missing tags
+func (audio *AudioMeta) parseID3v1(tag []byte) {
+	latin1 := func(data []byte) string {
+		return decodeID3Text(0, bytes.SplitN(data, []byte{0}, 2)[0])
+	}
+
+	audio.setTag("TIT2", latin1(tag[3:33]))
+	audio.setTag("TPE1", latin1(tag[33:63]))
+	audio.setTag("TALB", latin1(tag[63:93]))
+	audio.setTag("TYER", latin1(tag[93:97]))
+
+	// ID3v1.1 stores the track in the last byte of the comment
+	if tag[125] == 0 && tag[126] != 0 {
+		audio.setTag("TRCK", strconv.Itoa(int(tag[126])))
+	}
+
+	if int(tag[127]) < len(ID3Genres) {
+		audio.setTag("TCON", ID3Genres[tag[127]])
+	}
+}
+
+// Finds the first MPEG audio frame between start and end and computes the
+// duration from its Xing or Info header (VBR) or from its bit rate (CBR).
+func (audio *AudioMeta) parseMPEGFrame(r io.ReaderAt, start, end int64) error {
+	buf := make([]byte, 64<<10)
+	n, err := r.ReadAt(buf, start)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	buf = buf[:n]
+
+	for idx := 0; idx+4 <= len(buf); idx++ {
+		if buf[idx] != 0xff || buf[idx+1]&0xe0 != 0xe0 {
+			continue
+		}
+
+		header := binary.BigEndian.Uint32(buf[idx:])
+		version := [4]int{3, 0, 2, 1}[header>>19&3]
+		layer := [4]int{0, 3, 2, 1}[header>>17&3]
+		bitrateIdx := int(header >> 12 & 0xf)
+		rateIdx := int(header >> 10 & 3)
+		if version == 0 || layer == 0 || bitrateIdx == 0 || bitrateIdx == 15 || rateIdx == 3 {
+			continue
+		}
+
+		table := version
+		if table == 3 {
+			table = 2
+		}
+
+		bitrate := mpegBitrates[[2]int{table, layer}][bitrateIdx]
+		audio.SampleRate = mpegSampleRates[version][rateIdx]
+		audio.Channels = 2
+		if header>>6&3 == 3 {
+			audio.Channels = 1
+		}
+
+		samples := 1152
+		switch {
+		case layer == 1:
+			samples = 384
+		case layer == 3 && version != 1:
+			samples = 576
+		}
+
+		// The Xing header follows the side information of the first frame
+		side := 32
+		switch {
+		case version == 1 && audio.Channels == 1:
+			side = 17
+		case version != 1 && audio.Channels == 2:
+			side = 17
+		case version != 1:
+			side = 9
+		}
+
+		length := end - start - int64(idx)
+		if xing := idx + 4 + side; xing+12 <= len(buf) {
+			tag := string(buf[xing : xing+4])
+			flags := binary.BigEndian.Uint32(buf[xing+4:])
+			if (tag == "Xing" || tag == "Info") && flags&1 != 0 {
+				frames := binary.BigEndian.Uint32(buf[xing+8:])
+				audio.Duration = float64(frames) * float64(samples) / float64(audio.SampleRate)
+				if audio.Duration > 0 {
+					audio.Bitrate = int(float64(length) * 8 / audio.Duration / 1000)
+				}
+				return nil
+			}
+		}
+
+		audio.Bitrate = bitrate
+		audio.Duration = float64(length) * 8 / float64(bitrate*1000)
+		return nil
+	}
+
+	return errNoAudioFrame
+}
+
+//=============================================================================
+
+// Parses the STREAMINFO, VORBIS_COMMENT and PICTURE blocks of a FLAC file
+func (audio *AudioMeta) parseFLAC(r io.ReaderAt, size int64) error {
+	header := make([]byte, 4)
+	offset := int64(4)
+
+	for {
+		if _, err := r.ReadAt(header, offset); err != nil {
+			return err
+		}
+
+		last := header[0]&0x80 != 0
+		kind := header[0] & 0x7f
+		length := int64(header[1])<<16 | int64(header[2])<<8 | int64(header[3])
+		offset += 4
+
+		if offset+length > size {
+			return errors.New("malformed FLAC metadata block")
+		}
+
+		if kind == 0 || kind == 4 || kind == 6 && audio.Tags["CoverArt"] == "" {
+			block := make([]byte, length)
+			if _, err := r.ReadAt(block, offset); err != nil {
+				return err
+			}
+
+			switch kind {
+			case 0:
+				audio.parseStreamInfo(block)
+			case 4:
+				audio.parseVorbisComment(block)
+			case 6:
+				audio.parseFLACPicture(block)
+			}
+		}
+
+		offset += length
+		if last {
+			break
+		}
+	}
+
+	if audio.Duration > 0 {
+		audio.Bitrate = int(float64(size-offset) * 8 / audio.Duration / 1000)
+	}
+
+	return nil
+}
+
+// Parses the sample rate, channels and total samples of a FLAC stream
+func (audio *AudioMeta) parseStreamInfo(block []byte) {
+	if len(block) < 18 {
+		return
+	}
+
+	audio.SampleRate = int(block[10])<<12 | int(block[11])<<4 | int(block[12])>>4
+	audio.Channels = int(block[12]>>1&7) + 1
+
+	total := uint64(block[13]&0xf)<<32 | uint64(binary.BigEndian.Uint32(block[14:18]))
+	if audio.SampleRate > 0 {
+		audio.Duration = float64(total) / float64(audio.SampleRate)
+	}
+}
+
+// Parses the little endian KEY=value comments of a Vorbis comment block
+func (audio *AudioMeta) parseVorbisComment(block []byte) {
+	read := func(pos int) (string, int, bool) {
+		if pos+4 > len(block) {
+			return "", pos, false
+		}
+
+		length := int(binary.LittleEndian.Uint32(block[pos:]))
+		pos += 4
+		if length < 0 || pos+length > len(block) {
+			return "", pos, false
+		}
+
+		return string(block[pos : pos+length]), pos + length, true
+	}
+
+	// Skip the vendor string
+	_, pos, ok := read(0)
+	if !ok || pos+4 > len(block) {
+		return
+	}
+
+	count := int(binary.LittleEndian.Uint32(block[pos:]))
+	pos += 4
+
+	for idx := 0; idx < count; idx++ {
+		var comment string
+		if comment, pos, ok = read(pos); !ok {
+			return
+		}
+
+		if parts := strings.SplitN(comment, "=", 2); len(parts) == 2 {
+			audio.setTag(strings.ToUpper(parts[0]), parts[1])
+		}
+	}
+}
+
+// Parses a FLAC PICTURE block for the signature of the picture data
+func (audio *AudioMeta) parseFLACPicture(block []byte) {
+	pos := 4 // Skip the picture type
+
+	// Skip the MIME type and description
+	for idx := 0; idx < 2; idx++ {
+		if pos+4 > len(block) {
+			return
+		}
+		pos += 4 + int(binary.BigEndian.Uint32(block[pos:]))
+	}
+
+	// Skip the width, height, depth and colors
+	pos += 16
+	if pos+4 > len(block) {
+		return
+	}
+
+	length := int(binary.BigEndian.Uint32(block[pos:]))
+	pos += 4
+	if length > 0 && pos+length <= len(block) {
+		audio.Tags["CoverArt"] = Hash(block[pos : pos+length])
+	}
+}
+
+//=============================================================================
+
+// Parses the movie header, the sound track and the iTunes item list of an
+// MP4 audio file (e.g. M4A)
+func (audio *AudioMeta) parseMP4(r io.ReaderAt, size int64) error {
+	boxes, err := ReadBoxes(r, 0, size)
+	if err != nil && len(boxes) == 0 {
+		return err
+	}
+
+	moov, ok := FindBox(boxes, "moov")
+	if !ok {
+		return errors.New("no moov box in the file")
+	}
+
+	children, err := moov.Children(r, 0)
+	if err != nil {
+		return err
+	}
+
+	if mvhd, ok := FindBox(children, "mvhd"); ok {
+		if data, err := mvhd.Read(r); err == nil {
+			_, timescale, duration := parseMediaHeader(data)
+			if timescale > 0 {
+				audio.Duration = float64(duration) / float64(timescale)
+			}
+		}
+	}
+
+	if mdat, ok := FindBox(boxes, "mdat"); ok && audio.Duration > 0 {
+		audio.Bitrate = int(float64(mdat.Size) * 8 / audio.Duration / 1000)
+	}
+
+	// The audio sample entry holds the channels and 16.16 sample rate
+	for _, trak := range children {
+		if trak.Type != "trak" {
+			continue
+		}
+
+		stsd, ok := FindPath(r, []Box{trak}, "trak", "mdia", "minf", "stbl", "stsd")
+		if !ok {
+			continue
+		}
+
+		entries, err := stsd.Children(r, 8)
+		if err != nil || len(entries) == 0 || entries[0].Type != "mp4a" {
+			continue
+		}
+
+		if data, err := entries[0].Read(r); err == nil && len(data) >= 28 {
+			audio.Channels = int(binary.BigEndian.Uint16(data[16:18]))
+			audio.SampleRate = int(binary.BigEndian.Uint32(data[24:28]) >> 16)
+		}
+		break
+	}
+
+	meta, ok := FindPath(r, children, "udta", "meta")
+	if !ok {
+		return nil
+	}
+
+	for name, item := range ReadItemList(r, meta) {
+		switch name {
+		case "trkn":
+			// Track number and total are big endian after two bytes of padding
+			if len(item.Value) >= 4 {
+				audio.setTag(name, strconv.Itoa(int(binary.BigEndian.Uint16(item.Value[2:4]))))
+			}
+		case "gnre":
+			// Genre by its ID3v1 number plus one
+			if len(item.Value) >= 2 {
+				if idx := int(binary.BigEndian.Uint16(item.Value)) - 1; idx >= 0 && idx < len(ID3Genres) {
+					audio.setTag("\xa9gen", ID3Genres[idx])
+				}
+			}
+		case "covr":
+			if len(item.Value) > 0 {
+				audio.Tags["CoverArt"] = Hash(item.Value)
+			}
+		default:
+			audio.setTag(name, item.String())
+		}
+	}
+
+	return nil
+}
+
+//=============================================================================
+
+// Decodes a 28 bit syncsafe integer, which has the high bit of each byte unset
+func syncsafe(data []byte) uint32 {
+	var num uint32
+	for _, b := range data[:4] {
+		num = num<<7 | uint32(b&0x7f)
+	}
+
+	return num
+}
+
+// Removes the zero bytes inserted after 0xff bytes by unsynchronisation
+func unsynchronise(data []byte) []byte {
+	return bytes.Replace(data, []byte{0xff, 0x00}, []byte{0xff}, -1)
+}
+
+// Decodes the text of an ID3v2 frame in the encoding, keeping the first value
+func decodeID3Text(enc byte, data []byte) string {
+	text, _ := splitID3Text(enc, data)
+	return text
+}
+
+// Splits a terminated string in the encoding off the data, returning the
+// decoded string and the remaining data
+func splitID3Text(enc byte, data []byte) (string, []byte) {
+	// UTF-16 strings are terminated by two zero bytes on a character boundary
+	if enc == 1 || enc == 2 {
+		end := len(data)
+		rest := []byte(nil)
+		for idx := 0; idx+1 < len(data); idx += 2 {
+			if data[idx] == 0 && data[idx+1] == 0 {
+				end, rest = idx, data[idx+2:]
+				break
+			}
+		}
+
+		return decodeUTF16(enc, data[:end]), rest
+	}
+
+	end := bytes.IndexByte(data, 0)
+	rest := []byte(nil)
+	if end < 0 {
+		end = len(data)
+	} else {
+		rest = data[end+1:]
+	}
+
+	// ISO-8859-1 maps each byte to the code point of the same value
+	if enc == 0 {
+		runes := make([]rune, end)
+		for idx, b := range data[:end] {
+			runes[idx] = rune(b)
+		}
+		return string(runes), rest
+	}
+
+	return string(data[:end]), rest
+}
+
+// Decodes UTF-16 with a byte order mark (1) or big endian UTF-16 (2)
+func decodeUTF16(enc byte, data []byte) string {
+	var order binary.ByteOrder = binary.BigEndian
+	if enc == 1 && len(data) >= 2 {
+		if data[0] == 0xff && data[1] == 0xfe {
+			order = binary.LittleEndian
+		}
+		if data[0] == 0xff && data[1] == 0xfe || data[0] == 0xfe && data[1] == 0xff {
+			data = data[2:]
+		}
+	}
+
+	units := make([]uint16, len(data)/2)
+	for idx := range units {
+		units[idx] = order.Uint16(data[idx*2:])
+	}
+
+	return string(utf16.Decode(units))
+}
+
+// Resolves ID3v1 genre numbers in an ID3v2 genre, e.g. "(17)" or "17"
+func id3Genre(genre string) string {
+	trimmed := genre
+	if strings.HasPrefix(trimmed, "(") {
+		if end := strings.Index(trimmed, ")"); end > 0 {
+			if end < len(trimmed)-1 {
+				return trimmed[end+1:] // Refinement, e.g. (4)Eurodisco
+			}
+			trimmed = trimmed[1:end]
+		}
+	}
+
+	if idx, err := strconv.Atoi(trimmed); err == nil && idx >= 0 && idx < len(ID3Genres) {
+		return ID3Genres[idx]
+	}
+
+	return genre
+}
@@ -0,0 +1,201 @@
+package crate_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/bbengfort/crate/crate"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// Cover art embedded in the synthetic recordings
+var coverArt = []byte("\x89PNG\r\n\x1a\ncover art")
+
+// Builds an ID3v2.3 frame with the id and data
+func mkframe(id string, data ...[]byte) []byte {
+	payload := bytes.Join(data, nil)
+	return append(append([]byte(id), mkints(uint32(len(payload)), uint16(0))...), payload...)
+}
+
+// Builds an MP3 with an ID3v2.3 tag, ten 128 kbps frames and an ID3v1 tag
+func mkmp3() []byte {
+	frames := bytes.Join([][]byte{
+		mkframe("TIT2", []byte("\x00Here Comes the Sun")),
+		mkframe("TPE1", []byte("\x01\xff\xfeB\x00e\x00a\x00t\x00l\x00e\x00s\x00")),
+		mkframe("TRCK", []byte("\x007/17")),
+		mkframe("TCON", []byte("\x00(17)")),
+		mkframe("APIC", []byte("\x00image/png\x00\x03cover\x00"), coverArt),
+	}, nil)
+
+	size := len(frames)
+	header := []byte{'I', 'D', '3', 3, 0, 0,
+		byte(size >> 21 & 0x7f), byte(size >> 14 & 0x7f), byte(size >> 7 & 0x7f), byte(size & 0x7f)}
+
+	data := append(header, frames...)
+	for idx := 0; idx < 10; idx++ {
+		frame := make([]byte, 417)
+		copy(frame, []byte{0xff, 0xfb, 0x90, 0x00})
+		data = append(data, frame...)
+	}
+
+	v1 := make([]byte, 128)
+	copy(v1, "TAG")
+	copy(v1[3:], "Ignored Title")
+	copy(v1[63:], "Abbey Road")
+	copy(v1[93:], "1969")
+	v1[127] = 255
+	return append(data, v1...)
+}
+
+// Builds a FLAC with STREAMINFO, VORBIS_COMMENT and PICTURE blocks
+func mkflac() []byte {
+	block := func(kind byte, data []byte) []byte {
+		return append([]byte{kind, byte(len(data) >> 16), byte(len(data) >> 8), byte(len(data))}, data...)
+	}
+
+	// 48 kHz, 2 channels, 16 bits and 144000 samples
+	info := make([]byte, 34)
+	info[10], info[11], info[12], info[13] = 0x0b, 0xb8, 0x02, 0xf0
+	binary.BigEndian.PutUint32(info[14:], 144000)
+
+	comments := new(bytes.Buffer)
+	write := func(text string) {
+		binary.Write(comments, binary.LittleEndian, uint32(len(text)))
+		comments.WriteString(text)
+	}
+	write("reference libFLAC 1.3.1")
+	binary.Write(comments, binary.LittleEndian, uint32(4))
+	write("TITLE=Voice Memo")
+	write("artist=Benjamin")
+	write("TRACKNUMBER=2")
+	write("DATE=2015-06-14")
+
+	picture := bytes.Join([][]byte{
+		mkints(uint32(3), uint32(9)), []byte("image/png"),
+		mkints(uint32(0), uint32(1), uint32(1), uint32(24), uint32(0), uint32(len(coverArt))), coverArt,
+	}, nil)
+
+	data := append([]byte("fLaC"), block(0, info)...)
+	data = append(data, block(4, comments.Bytes())...)
+	data = append(data, block(0x80|6, picture)...)
+	return append(data, make([]byte, 12000)...)
+}
+
+// Builds an M4A with a movie header, an mp4a track and an iTunes item list
+func mkm4a() []byte {
+	mvhd := mkbox("mvhd", mkints(uint32(0), uint32(0), uint32(0), uint32(44100), uint32(441000)), make([]byte, 80))
+	mp4a := mkbox("mp4a", make([]byte, 16), mkints(uint16(2), uint16(16), uint32(0), uint32(44100<<16)))
+	stsd := mkbox("stsd", mkints(uint32(0), uint32(1)), mp4a)
+	trak := mkbox("trak", mkbox("mdia", mkbox("minf", mkbox("stbl", stsd))))
+
+	ilst := mkbox("ilst",
+		mkbox("\xa9nam", mkdata("Blackbird")),
+		mkbox("\xa9ART", mkdata("The Beatles")),
+		mkbox("trkn", mkbox("data", mkints(uint32(0), uint32(0), uint16(0), uint16(11), uint16(30), uint16(0)))),
+		mkbox("covr", mkbox("data", mkints(uint32(14), uint32(0)), coverArt)))
+	meta := mkbox("meta", mkints(uint32(0)), mkbox("hdlr", make([]byte, 25)), ilst)
+
+	data := mkbox("ftyp", []byte("M4A "), mkints(uint32(0)), []byte("M4A mp42isom"))
+	data = append(data, mkbox("moov", mvhd, trak, mkbox("udta", meta))...)
+	return append(data, mkbox("mdat", make([]byte, 160000-8))...)
+}
+
+var _ = Describe("Audio", func() {
+
+	var testRoot string // Temporary directory for the synthetic recordings
+
+	// Writes the data to the temporary directory and extracts it
+	extract := func(name, mimetype string, data []byte) *AudioMeta {
+		fm := new(FileMeta)
+		fm.Path = writeFixture(testRoot, name, data)
+		fm.MimeType = mimetype
+
+		audio, ok := ConvertAudioMeta(fm)
+		Ω(ok).Should(BeTrue())
+		Ω(new(AudioExtractor).Extract(audio)).Should(Succeed())
+		return audio
+	}
+
+	BeforeEach(func() {
+		var err error
+		testRoot, err = ioutil.TempDir("", "ginkgo-")
+		Ω(err).Should(BeNil())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(testRoot)
+	})
+
+	It("should create an AudioMeta record for MP3 files", func() {
+		path := filepath.Join(testRoot, "song.mp3")
+		Ω(ioutil.WriteFile(path, mkmp3(), 0644)).Should(Succeed())
+
+		fm := new(FileMeta)
+		fm.Path = path
+		Ω(NewRecord(fm)).Should(BeAssignableToTypeOf(new(AudioMeta)))
+	})
+
+	It("should extract ID3 tags and the MPEG stream properties", func() {
+		audio := extract("song.mp3", "audio/mpeg", mkmp3())
+
+		Ω(audio.Tag("Title")).Should(Equal("Here Comes the Sun"))
+		Ω(audio.Tag("Artist")).Should(Equal("Beatles"))
+		Ω(audio.Tag("Album")).Should(Equal("Abbey Road"))
+		Ω(audio.Tag("Track")).Should(Equal("7"))
+		Ω(audio.Tag("Year")).Should(Equal("1969"))
+		Ω(audio.Tag("Genre")).Should(Equal("Rock"))
+		Ω(audio.Tag("CoverArt")).Should(Equal(Hash(coverArt)))
+
+		Ω(audio.Bitrate).Should(Equal(128))
+		Ω(audio.SampleRate).Should(Equal(44100))
+		Ω(audio.Channels).Should(Equal(2))
+		Ω(audio.Duration).Should(BeNumerically("~", 0.2606, 0.001))
+	})
+
+	It("should extract FLAC Vorbis comments and stream info", func() {
+		audio := extract("memo.flac", "audio/flac", mkflac())
+
+		Ω(audio.Tag("Title")).Should(Equal("Voice Memo"))
+		Ω(audio.Tag("Artist")).Should(Equal("Benjamin"))
+		Ω(audio.Tag("Track")).Should(Equal("2"))
+		Ω(audio.Tag("Year")).Should(Equal("2015"))
+		Ω(audio.Tag("CoverArt")).Should(Equal(Hash(coverArt)))
+
+		Ω(audio.SampleRate).Should(Equal(48000))
+		Ω(audio.Channels).Should(Equal(2))
+		Ω(audio.Duration).Should(Equal(3.0))
+		Ω(audio.Bitrate).Should(Equal(32))
+	})
+
+	It("should extract MP4 audio atoms", func() {
+		audio := extract("song.m4a", "audio/mp4", mkm4a())
+
+		Ω(audio.Tag("Title")).Should(Equal("Blackbird"))
+		Ω(audio.Tag("Artist")).Should(Equal("The Beatles"))
+		Ω(audio.Tag("Track")).Should(Equal("11"))
+		Ω(audio.Tag("CoverArt")).Should(Equal(Hash(coverArt)))
+
+		Ω(audio.Duration).Should(Equal(10.0))
+		Ω(audio.Bitrate).Should(Equal(127))
+		Ω(audio.SampleRate).Should(Equal(44100))
+		Ω(audio.Channels).Should(Equal(2))
+	})
+
+	It("should be queryable by its tags", func() {
+		audio := extract("song.m4a", "audio/mp4", mkm4a())
+
+		query, err := ParseQuery("Artist:beatles Title:blackbird")
+		Ω(err).Should(BeNil())
+		Ω(query.Match(audio)).Should(BeTrue())
+
+		query, err = ParseQuery("Artist:stones")
+		Ω(err).Should(BeNil())
+		Ω(query.Match(audio)).Should(BeFalse())
+	})
+
+})
@@ -0,0 +1,251 @@
+// Reads the box (atom) structure of ISO base media files such as MP4,
+// QuickTime MOV, M4A and HEIF without decoding any of the media they contain
+
+package crate
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strconv"
+	"time"
+)
+
+const (
+	MaxBoxRead = 64 << 20 // Largest box payload that will be read into memory
+)
+
+// Epoch of the times in the mvhd, mdhd and tkhd boxes
+var QuickTimeEpoch = time.Date(1904, 1, 1, 0, 0, 0, 0, time.UTC)
+
+var ErrMalformedBox = errors.New("malformed ISO base media box")
+
+//=============================================================================
+
+// A box in an ISO base media file, the payload excludes the box header
+type Box struct {
+	Type   string // Four character code of the box, e.g. moov or "\xa9xyz"
+	Offset int64  // Offset of the payload in the file or parent payload
+	Size   int64  // Size of the payload in bytes
+}
+
+// Reads the boxes stored one after the other between the start and end offsets
+func ReadBoxes(r io.ReaderAt, start, end int64) ([]Box, error) {
+	boxes := make([]Box, 0)
+	header := make([]byte, 16)
+
+	for offset := start; offset+8 <= end; {
+		if _, err := r.ReadAt(header[:8], offset); err != nil {
+			return boxes, err
+		}
+
+		size := int64(binary.BigEndian.Uint32(header[:4]))
+		hlen := int64(8)
+
+		switch size {
+		case 0:
+			// The box extends to the end of its container
+			size = end - offset
+		case 1:
+			// The size is stored in a 64 bit field after the type
+			if _, err := r.ReadAt(header[8:16], offset+8); err != nil {
+				return boxes, err
+			}
+
+			size = int64(binary.BigEndian.Uint64(header[8:16]))
+			hlen = 16
+		}
+
+		if size < hlen || offset+size > end {
+			return boxes, ErrMalformedBox
+		}
+
+		boxes = append(boxes, Box{string(header[4:8]), offset + hlen, size - hlen})
+		offset += size
+	}
+
+	return boxes, nil
+}
+
+// Reads the payload of the box into memory
+func (box Box) Read(r io.ReaderAt) ([]byte, error) {
+	if box.Size > MaxBoxRead {
+		return nil, errors.New("box " + strconv.Quote(box.Type) + " is too large to read")
+	}
+
+	data := make([]byte, box.Size)
+	if _, err := r.ReadAt(data, box.Offset); err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+// Returns the child boxes of a container box, skip is the number of bytes of
+// fields before the first child (e.g. 4 for the version and flags of a meta)
+func (box Box) Children(r io.ReaderAt, skip int64) ([]Box, error) {
+	return ReadBoxes(r, box.Offset+skip, box.Offset+box.Size)
+}
+
+// Returns the first box with the type, if any
+func FindBox(boxes []Box, typ string) (Box, bool) {
+	for _, box := range boxes {
+		if box.Type == typ {
+			return box, true
+		}
+	}
+
+	return Box{}, false
+}
+
+// Follows the path of box types down from the boxes, e.g. "moov", "udta"
+func FindPath(r io.ReaderAt, boxes []Box, path ...string) (Box, bool) {
+	var box Box
+	var ok bool
+
+	for idx, typ := range path {
+		if box, ok = FindBox(boxes, typ); !ok {
+			return box, false
+		}
+
+		if idx < len(path)-1 {
+			var err error
+			if boxes, err = box.Children(r, containerSkip(r, box)); err != nil {
+				return box, false
+			}
+		}
+	}
+
+	return box, ok
+}
+
+// Returns the bytes to skip before the children of a container box. The meta
+// box is a full box in ISO files but not in QuickTime, where the hdlr follows
+// the header directly.
+func containerSkip(r io.ReaderAt, box Box) int64 {
+	if box.Type != "meta" {
+		return 0
+	}
+
+	peek := make([]byte, 4)
+	if _, err := r.ReadAt(peek, box.Offset+4); err == nil && string(peek) == "hdlr" {
+		return 0
+	}
+
+	return 4
+}
+
+//=============================================================================
+
+// A value in an iTunes style item list (ilst), e.g. the title of a track
+type ItemData struct {
+	Type  uint32 // The well-known type of the value, 1 is UTF-8 text
+	Value []byte // The raw value
+}
+
+// Returns the value as a string if it is text, or as a number for integers
+func (item ItemData) String() string {
+	switch item.Type {
+	case 1, 2:
+		return string(item.Value)
+	case 21, 22:
+		var num int64
+		for _, b := range item.Value {
+			num = num<<8 | int64(b)
+		}
+		return strconv.FormatInt(num, 10)
+	default:
+		return ""
+	}
+}
+
+// Reads the item list of a meta box into a map keyed by the item type or, for
+// QuickTime metadata with a keys box, by the key name (e.g. com.apple...make)
+func ReadItemList(r io.ReaderAt, meta Box) map[string]ItemData {
+	items := make(map[string]ItemData)
+
+	children, err := meta.Children(r, containerSkip(r, meta))
+	if err != nil {
+		return items
+	}
+
+	// Read the QuickTime key names that the ilst item types index into
+	keys := make([]string, 0)
+	if box, ok := FindBox(children, "keys"); ok {
+		if data, err := box.Read(r); err == nil && len(data) >= 8 {
+			count := int(binary.BigEndian.Uint32(data[4:8]))
+			for pos := 8; len(keys) < count && pos+8 <= len(data); {
+				size := int(binary.BigEndian.Uint32(data[pos : pos+4]))
+				if size < 8 || pos+size > len(data) {
+					break
+				}
+
+				keys = append(keys, string(data[pos+8:pos+size]))
+				pos += size
+			}
+		}
+	}
+
+	ilst, ok := FindBox(children, "ilst")
+	if !ok {
+		return items
+	}
+
+	entries, err := ilst.Children(r, 0)
+	if err != nil {
+		return items
+	}
+
+	for _, entry := range entries {
+		name := entry.Type
+		if len(keys) > 0 {
+			idx := int(binary.BigEndian.Uint32([]byte(entry.Type)))
+			if idx >= 1 && idx <= len(keys) {
+				name = keys[idx-1]
+			}
+		}
+
+		values, err := entry.Children(r, 0)
+		if err != nil {
+			continue
+		}
+
+		if box, ok := FindBox(values, "data"); ok {
+			if data, err := box.Read(r); err == nil && len(data) >= 8 {
+				items[name] = ItemData{binary.BigEndian.Uint32(data[:4]) & 0xffffff, data[8:]}
+			}
+		}
+	}
+
+	return items
+}
+
+// Reads a QuickTime user data text atom (e.g. "\xa9xyz") with its length and
+// language prefix, falling back to an item list style data box.
+func ReadUserText(r io.ReaderAt, box Box) string {
+	data, err := box.Read(r)
+	if err != nil || len(data) < 4 {
+		return ""
+	}
+
+	if len(data) >= 16 && string(data[4:8]) == "data" {
+		return string(bytes.TrimRight(data[16:], "\x00"))
+	}
+
+	size := int(binary.BigEndian.Uint16(data[:2]))
+	if size > len(data)-4 {
+		size = len(data) - 4
+	}
+
+	return string(bytes.TrimRight(data[4:4+size], "\x00"))
+}
+
+// Converts seconds since the QuickTime epoch to a time, zero is unknown
+func QuickTime(seconds uint64) time.Time {
+	if seconds == 0 {
+		return time.Time{}
+	}
+
+	return QuickTimeEpoch.Add(time.Duration(seconds) * time.Second)
+}
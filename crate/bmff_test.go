@@ -0,0 +1,121 @@
+package crate_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"time"
+
+	. "github.com/bbengfort/crate/crate"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// Builds a box with the type and the concatenated payloads
+func mkbox(typ string, payloads ...[]byte) []byte {
+	payload := bytes.Join(payloads, nil)
+	data := make([]byte, 8, 8+len(payload))
+	binary.BigEndian.PutUint32(data, uint32(8+len(payload)))
+	copy(data[4:], typ)
+	return append(data, payload...)
+}
+
+// Encodes big endian unsigned integers of the sizes of the values
+func mkints(values ...interface{}) []byte {
+	buf := new(bytes.Buffer)
+	for _, value := range values {
+		binary.Write(buf, binary.BigEndian, value)
+	}
+	return buf.Bytes()
+}
+
+// Builds an item list data box holding UTF-8 text
+func mkdata(text string) []byte {
+	return mkbox("data", mkints(uint32(1), uint32(0)), []byte(text))
+}
+
+var _ = Describe("BMFF", func() {
+
+	It("should read sibling and child boxes", func() {
+		data := append(mkbox("ftyp", []byte("isom")), mkbox("moov", mkbox("udta", mkbox("\xa9mak", []byte("text"))))...)
+		r := bytes.NewReader(data)
+
+		boxes, err := ReadBoxes(r, 0, int64(len(data)))
+		Ω(err).Should(BeNil())
+		Ω(boxes).Should(HaveLen(2))
+		Ω(boxes[0]).Should(Equal(Box{"ftyp", 8, 4}))
+		Ω(boxes[1].Type).Should(Equal("moov"))
+
+		box, ok := FindPath(r, boxes, "moov", "udta", "\xa9mak")
+		Ω(ok).Should(BeTrue())
+		Ω(box.Size).Should(Equal(int64(4)))
+
+		_, ok = FindPath(r, boxes, "moov", "trak")
+		Ω(ok).Should(BeFalse())
+	})
+
+	It("should read boxes with large and open ended sizes", func() {
+		large := append(mkints(uint32(1)), []byte("free")...)
+		large = append(large, mkints(uint64(20))...)
+		large = append(large, []byte("abcd")...)
+
+		open := append(mkints(uint32(0)), []byte("mdat")...)
+		open = append(open, []byte("media")...)
+
+		data := append(large, open...)
+		boxes, err := ReadBoxes(bytes.NewReader(data), 0, int64(len(data)))
+		Ω(err).Should(BeNil())
+		Ω(boxes).Should(Equal([]Box{{"free", 16, 4}, {"mdat", 28, 5}}))
+	})
+
+	It("should report malformed boxes", func() {
+		data := mkbox("moov", []byte("data"))
+		binary.BigEndian.PutUint32(data, 64)
+
+		_, err := ReadBoxes(bytes.NewReader(data), 0, int64(len(data)))
+		Ω(err).Should(Equal(ErrMalformedBox))
+	})
+
+	It("should read QuickTime metadata keys and item lists", func() {
+		keys := mkbox("keys", mkints(uint32(0), uint32(2)),
+			mkbox("mdta", []byte("com.apple.quicktime.make")),
+			mkbox("mdta", []byte("com.apple.quicktime.model")))
+		ilst := mkbox("ilst",
+			mkbox(string(mkints(uint32(1))), mkdata("Apple")),
+			mkbox(string(mkints(uint32(2))), mkdata("iPhone 6")))
+		meta := mkbox("meta", mkbox("hdlr", make([]byte, 25)), keys, ilst)
+
+		r := bytes.NewReader(meta)
+		boxes, _ := ReadBoxes(r, 0, int64(len(meta)))
+		items := ReadItemList(r, boxes[0])
+
+		Ω(items).Should(HaveLen(2))
+		Ω(items["com.apple.quicktime.make"].String()).Should(Equal("Apple"))
+		Ω(items["com.apple.quicktime.model"].String()).Should(Equal("iPhone 6"))
+	})
+
+	It("should read iTunes item lists in a full meta box", func() {
+		ilst := mkbox("ilst", mkbox("\xa9nam", mkdata("Title")), mkbox("tmpo", mkbox("data", mkints(uint32(21), uint32(0), uint16(120)))))
+		meta := mkbox("meta", mkints(uint32(0)), mkbox("hdlr", make([]byte, 25)), ilst)
+
+		r := bytes.NewReader(meta)
+		boxes, _ := ReadBoxes(r, 0, int64(len(meta)))
+		items := ReadItemList(r, boxes[0])
+
+		Ω(items["\xa9nam"].String()).Should(Equal("Title"))
+		Ω(items["tmpo"].String()).Should(Equal("120"))
+	})
+
+	It("should read QuickTime user data text", func() {
+		data := mkbox("\xa9xyz", mkints(uint16(18), uint16(0x15c7)), []byte("+37.7858-122.4064/"))
+		r := bytes.NewReader(data)
+		boxes, _ := ReadBoxes(r, 0, int64(len(data)))
+		Ω(ReadUserText(r, boxes[0])).Should(Equal("+37.7858-122.4064/"))
+	})
+
+	It("should convert QuickTime timestamps", func() {
+		Ω(QuickTime(0).IsZero()).Should(BeTrue())
+		Ω(QuickTime(3502915200)).Should(Equal(time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)))
+	})
+
+})
@@ -0,0 +1,296 @@
+// Dominant colors of images and the color predicate that finds images by an
+// approximate color, e.g. color:#3366cc~20
+
+package crate
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	PaletteSize          = 5    // Most dominant colors kept for an image
+	DefaultColorDistance = 15.0 // Distance of a color predicate without a distance
+	minPaletteDistance   = 20.0 // Distance between the colors of a palette
+	minPaletteWeight     = 0.02 // Fraction of the image a palette color must cover
+)
+
+//=============================================================================
+
+// The colors of an image as hex RGB, e.g. #3366cc
+type ImageColors struct {
+	Average string          // The mean color of the image
+	Palette []*PaletteColor // The dominant colors, ordered by their weight
+}
+
+// A dominant color of an image
+type PaletteColor struct {
+	Color  string  // The color as hex RGB
+	Weight float64 // Fraction of the image that is closest to the color
+}
+
+// A color in the sRGB space, with channels from 0 to 255
+type RGB struct {
+	R, G, B uint8
+}
+
+// Parses a hex color, e.g. #3366cc, 3366cc or #36c
+func ParseColor(value string) (RGB, error) {
+	hex := strings.TrimPrefix(strings.TrimSpace(value), "#")
+	if len(hex) == 3 {
+		hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+	}
+
+	num, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil || len(hex) != 6 {
+		return RGB{}, fmt.Errorf("could not parse color \"%s\", use #rrggbb", value)
+	}
+
+	return RGB{uint8(num >> 16), uint8(num >> 8), uint8(num)}, nil
+}
+
+// Formats the color as hex RGB, e.g. #3366cc
+func (c RGB) String() string {
+	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+}
+
+// Returns the perceptual distance between two colors, the CIE76 difference
+// of their CIELAB coordinates. Colors a distance of 2 apart are barely
+// distinguishable and 100 is the distance between black and white.
+func (c RGB) Distance(other RGB) float64 {
+	l1, a1, b1 := c.Lab()
+	l2, a2, b2 := other.Lab()
+	return math.Sqrt((l1-l2)*(l1-l2) + (a1-a2)*(a1-a2) + (b1-b2)*(b1-b2))
+}
+
+// Converts the color to CIELAB coordinates with the D65 white point
+func (c RGB) Lab() (float64, float64, float64) {
+	linear := func(v uint8) float64 {
+		f := float64(v) / 255
+		if f <= 0.04045 {
+			return f / 12.92
+		}
+		return math.Pow((f+0.055)/1.055, 2.4)
+	}
+
+	r, g, b := linear(c.R), linear(c.G), linear(c.B)
+	x := (0.4124*r + 0.3576*g + 0.1805*b) / 0.95047
+	y := (0.2126*r + 0.7152*g + 0.0722*b) / 1.0
+	z := (0.0193*r + 0.1192*g + 0.9505*b) / 1.08883
+
+	f := func(t float64) float64 {
+		if t > 216.0/24389 {
+			return math.Cbrt(t)
+		}
+		return (24389.0/27*t + 16) / 116
+	}
+
+	fx, fy, fz := f(x), f(y), f(z)
+	return 116*fy - 16, 500 * (fx - fy), 200 * (fy - fz)
+}
+
+//=============================================================================
+
+// Computes the average color and the palette of dominant colors of an image.
+// The colors are binned by the top 3 bits of their channels and the most
+// common bins that are distinct from each other form the palette.
+func ComputeColors(src image.Image) *ImageColors {
+	src = ResizeImage(src, SampleSize)
+	bounds := src.Bounds()
+
+	type bin struct {
+		r, g, b, count float64
+	}
+
+	bins := make(map[int]*bin)
+	var r, g, b, total float64
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			cr, cg, cb, ca := src.At(x, y).RGBA()
+			if ca == 0 {
+				continue
+			}
+
+			// Colors are unpremultiplied, transparent pixels don't count
+			pr, pg, pb := float64(cr*0xffff/ca)/257, float64(cg*0xffff/ca)/257, float64(cb*0xffff/ca)/257
+			key := int(pr)>>5<<6 | int(pg)>>5<<3 | int(pb)>>5
+			if bins[key] == nil {
+				bins[key] = new(bin)
+			}
+
+			bins[key].r += pr
+			bins[key].g += pg
+			bins[key].b += pb
+			bins[key].count++
+
+			r, g, b, total = r+pr, g+pg, b+pb, total+1
+		}
+	}
+
+	colors := &ImageColors{Palette: make([]*PaletteColor, 0)}
+	if total == 0 {
+		return colors
+	}
+
+	colors.Average = RGB{uint8(r / total), uint8(g / total), uint8(b / total)}.String()
+
+	// The mean color of each bin, ordered by the number of pixels in it
+	means := make([]RGB, 0, len(bins))
+	counts := make(map[RGB]float64)
+	for _, bin := range bins {
+		mean := RGB{uint8(bin.r / bin.count), uint8(bin.g / bin.count), uint8(bin.b / bin.count)}
+		if _, ok := counts[mean]; !ok {
+			means = append(means, mean)
+		}
+		counts[mean] += bin.count
+	}
+
+	sort.Slice(means, func(i, j int) bool {
+		if counts[means[i]] != counts[means[j]] {
+			return counts[means[i]] > counts[means[j]]
+		}
+		return means[i].String() < means[j].String()
+	})
+
+	palette := make([]RGB, 0, PaletteSize)
+	for _, mean := range means {
+		if len(palette) == PaletteSize || counts[mean]/total < minPaletteWeight {
+			break
+		}
+
+		distinct := true
+		for _, color := range palette {
+			if mean.Distance(color) < minPaletteDistance {
+				distinct = false
+				break
+			}
+		}
+
+		if distinct {
+			palette = append(palette, mean)
+		}
+	}
+
+	// Each bin is weighed to the palette color closest to it
+	weights := make([]float64, len(palette))
+	for _, mean := range means {
+		closest := 0
+		for idx, color := range palette {
+			if mean.Distance(color) < mean.Distance(palette[closest]) {
+				closest = idx
+			}
+		}
+
+		if len(palette) > 0 {
+			weights[closest] += counts[mean] / total
+		}
+	}
+
+	for idx, color := range palette {
+		colors.Palette = append(colors.Palette, &PaletteColor{color.String(), weights[idx]})
+	}
+
+	sort.SliceStable(colors.Palette, func(i, j int) bool {
+		return colors.Palette[i].Weight > colors.Palette[j].Weight
+	})
+
+	return colors
+}
+
+//=============================================================================
+
+// Computes the colors of images that can be decoded
+type ColorExtractor struct {
+	MimePrefixes
+}
+
+func init() {
+	RegisterExtractor(&ColorExtractor{MimePrefixes{"image/"}})
+}
+
+func (ext *ColorExtractor) Name() string {
+	return "colors"
+}
+
+func (ext *ColorExtractor) Version() string {
+	return "1"
+}
+
+// Images that can't be decoded have no colors but aren't failures, since
+// re-extracting them would not change that
+func (ext *ColorExtractor) Extract(record FilePath) error {
+	img, ok := record.(*ImageMeta)
+	if !ok {
+		return nil
+	}
+
+	img.Colors = nil
+	src, err := img.sample()
+	if err == ErrNotDecodable {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	img.Colors = ComputeColors(src)
+	return nil
+}
+
+//=============================================================================
+
+// Matches images whose average color or one of whose dominant colors is
+// within Distance of Color, see RGB.Distance
+type ColorPredicate struct {
+	Color    RGB     // The color to find
+	Distance float64 // The largest CIE76 difference from the color
+}
+
+func (pred *ColorPredicate) Match(record FilePath) bool {
+	img, ok := record.(*ImageMeta)
+	if !ok || img.Colors == nil {
+		return false
+	}
+
+	candidates := []string{img.Colors.Average}
+	for _, color := range img.Colors.Palette {
+		candidates = append(candidates, color.Color)
+	}
+
+	for _, candidate := range candidates {
+		if color, err := ParseColor(candidate); err == nil && pred.Color.Distance(color) <= pred.Distance {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Parses #rrggbb~distance, the distance defaults to DefaultColorDistance
+func parseColor(value string) (*ColorPredicate, error) {
+	distance := DefaultColorDistance
+
+	if idx := strings.Index(value, "~"); idx >= 0 {
+		var err error
+		if distance, err = strconv.ParseFloat(value[idx+1:], 64); err != nil {
+			return nil, fmt.Errorf("could not parse color distance \"%s\"", value[idx+1:])
+		}
+
+		if distance < 0 {
+			return nil, errors.New("color distance must not be negative")
+		}
+		value = value[:idx]
+	}
+
+	color, err := ParseColor(value)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ColorPredicate{color, distance}, nil
+}
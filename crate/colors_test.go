@@ -0,0 +1,135 @@
+package crate_test
+
+import (
+	"image"
+	"image/color"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/bbengfort/crate/crate"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// Draws an image whose left three quarters are one color and the rest another
+func mktwotone(w, h int, left, right color.Color) image.Image {
+	src := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			if x < w*3/4 {
+				src.Set(x, y, left)
+			} else {
+				src.Set(x, y, right)
+			}
+		}
+	}
+
+	return src
+}
+
+var _ = Describe("Colors", func() {
+
+	It("should parse and format hex colors", func() {
+		c, err := ParseColor("#3366cc")
+		Ω(err).Should(BeNil())
+		Ω(c).Should(Equal(RGB{0x33, 0x66, 0xcc}))
+		Ω(c.String()).Should(Equal("#3366cc"))
+
+		short, err := ParseColor("36C")
+		Ω(err).Should(BeNil())
+		Ω(short).Should(Equal(c))
+
+		for _, value := range []string{"#3366c", "blue", "#3366zz"} {
+			_, err := ParseColor(value)
+			Ω(err).Should(HaveOccurred(), "parsed \"%s\"", value)
+		}
+	})
+
+	It("should measure the perceptual distance between colors", func() {
+		black, white := RGB{0, 0, 0}, RGB{255, 255, 255}
+		Ω(black.Distance(white)).Should(BeNumerically("~", 100, 0.1))
+		Ω(black.Distance(black)).Should(BeZero())
+
+		blue := RGB{0x33, 0x66, 0xcc}
+		Ω(blue.Distance(RGB{0x30, 0x60, 0xd0})).Should(BeNumerically("~", 7, 0.5))
+		Ω(blue.Distance(RGB{0xcc, 0x66, 0x33})).Should(BeNumerically(">", 50))
+	})
+
+	It("should compute the average and dominant colors of an image", func() {
+		colors := ComputeColors(mktwotone(400, 200, color.RGBA{0x33, 0x66, 0xcc, 255}, color.RGBA{0xee, 0xcc, 0x22, 255}))
+
+		Ω(colors.Palette).Should(HaveLen(2))
+		Ω(colors.Palette[0].Color).Should(Equal("#3366cc"))
+		Ω(colors.Palette[0].Weight).Should(BeNumerically("~", 0.75, 0.01))
+		Ω(colors.Palette[1].Color).Should(Equal("#eecc22"))
+		Ω(colors.Palette[1].Weight).Should(BeNumerically("~", 0.25, 0.01))
+
+		average, err := ParseColor(colors.Average)
+		Ω(err).Should(BeNil())
+		Ω(average.Distance(RGB{0x5e, 0x7f, 0xa3})).Should(BeNumerically("<", 2))
+	})
+
+	It("should match images by an approximate color", func() {
+		img := &ImageMeta{Colors: &ImageColors{
+			Average: "#5e7fa3",
+			Palette: []*PaletteColor{{"#3366cc", 0.75}, {"#eecc22", 0.25}},
+		}}
+
+		for text, matched := range map[string]bool{
+			"color:#3366cc":     true,
+			"color:#3060d0~10":  true,
+			"color:#3060d0~5":   false,
+			"color:#eecc22":     true,
+			"color:#5e7fa3~1":   true,
+			"color:#cc6633~20":  false,
+			"color:#ffffff~20":  false,
+			"color:#ffffff~100": true,
+		} {
+			query, err := ParseQuery(text)
+			Ω(err).Should(BeNil())
+			Ω(query.Match(img)).Should(Equal(matched), "query \"%s\"", text)
+		}
+
+		query, _ := ParseQuery("color:#3366cc~100")
+		Ω(query.Match(new(ImageMeta))).Should(BeFalse())
+		Ω(query.Match(new(FileMeta))).Should(BeFalse())
+
+		for _, text := range []string{"color:blue", "color:#3366cc~far", "color:#3366cc~-5"} {
+			_, err := ParseQuery(text)
+			Ω(err).Should(HaveOccurred(), "parsed \"%s\"", text)
+		}
+	})
+
+	It("should extract the colors of decodable images", func() {
+		testRoot, err := ioutil.TempDir("", "ginkgo-")
+		Ω(err).Should(BeNil())
+		defer os.RemoveAll(testRoot)
+
+		path := filepath.Join(testRoot, "IMG_0001.jpg")
+		data := mkpatternjpeg(mktwotone(320, 240, color.RGBA{0x33, 0x66, 0xcc, 255}, color.White), 95)
+		Ω(ioutil.WriteFile(path, data, 0644)).Should(Succeed())
+
+		img := ImageFromPath(path)
+		img.Populate()
+		Ω(img.Extractors).Should(HaveKeyWithValue("colors", "1"))
+		Ω(img.Colors).ShouldNot(BeNil())
+		Ω(img.Colors.Palette).ShouldNot(BeEmpty())
+
+		dominant, err := ParseColor(img.Colors.Palette[0].Color)
+		Ω(err).Should(BeNil())
+		Ω(dominant.Distance(RGB{0x33, 0x66, 0xcc})).Should(BeNumerically("<", 5))
+
+		// Images whose header claims too many pixels have no colors
+		path = filepath.Join(testRoot, "oversize.jpg")
+		Ω(ioutil.WriteFile(path, mkoversizejpeg(), 0644)).Should(Succeed())
+
+		img = ImageFromPath(path)
+		img.Populate()
+		Ω(img.Extractors).Should(HaveKey("colors"))
+		Ω(img.Failures).Should(BeEmpty())
+		Ω(img.Colors).Should(BeNil())
+	})
+
+})
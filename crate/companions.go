@@ -0,0 +1,582 @@
+// Links the files that make up one logical asset, e.g. the RAW and JPEG of a
+// shot, the XMP, AAE or THM sidecars of an image or video and the still and
+// video of a Live Photo, so they can be exported and deduplicated together.
+
+package crate
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rwcarlsen/goexif/exif"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+const (
+	AssetNamespace     = "asset"     // Namespace of the stored assets
+	CompanionNamespace = "companion" // Namespace of the links from members to their asset
+	CompanionWindow    = 2 * time.Second
+	CompanionBatchSize = 1000 // Most operations written in one batch when linking
+)
+
+// Roles of the members of an asset
+const (
+	RoleRaw     = "raw"     // A camera RAW image
+	RoleImage   = "image"   // A JPEG, HEIC or other rendered image
+	RoleVideo   = "video"   // A video, e.g. with a THM thumbnail sidecar
+	RoleLive    = "live"    // The video of a Live Photo
+	RoleSidecar = "sidecar" // An XMP, AAE or THM file describing another member
+)
+
+// Extensions of the files that only describe the file with the same basename
+var SidecarExtensions = map[string]bool{".xmp": true, ".aae": true, ".thm": true}
+
+// Apple maker notes are a header followed by a big endian IFD whose offsets
+// are from the start of the maker note. Tag 0x11 is the content identifier
+// that is shared by the still and the video of a Live Photo.
+var appleMakerNoteHeader = []byte("Apple iOS\x00")
+
+const appleContentIdentifier = 0x0011
+
+var ErrNoAsset = errors.New("record is not part of an asset")
+
+//=============================================================================
+
+// A file that is a member of an asset
+type Companion struct {
+	Signature string // The signature of the member
+	Path      string // The path of the member when the asset was found
+	Role      string // The role of the member, e.g. raw or sidecar
+}
+
+// Files that make up one logical asset, the primary first: the RAW if there
+// is one, otherwise the image, otherwise the video.
+type Asset struct {
+	ID      string       // The signature of the primary member
+	Members []*Companion // The members of the asset, the primary first
+}
+
+// Returns the primary member of the asset
+func (asset *Asset) Primary() *Companion {
+	return asset.Members[0]
+}
+
+// Whether the record of the signature is a member of the asset
+func (asset *Asset) Contains(signature string) bool {
+	for _, member := range asset.Members {
+		if member.Signature == signature {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Returns the members of the asset other than the record of the signature
+func (asset *Asset) Companions(signature string) []*Companion {
+	companions := make([]*Companion, 0, len(asset.Members))
+	for _, member := range asset.Members {
+		if member.Signature != signature {
+			companions = append(companions, member)
+		}
+	}
+
+	return companions
+}
+
+//=============================================================================
+
+// Returns the content identifier in the Apple maker note of the EXIF, which
+// links the still of a Live Photo to the com.apple.quicktime.content.identifier
+// of its video, or an empty string if there is none.
+func (ew *ExifHandler) ContentIdentifier() string {
+	tag, err := ew.exif.Get(exif.MakerNote)
+	if err != nil {
+		return ""
+	}
+
+	return ParseAppleContentIdentifier(tag.Val)
+}
+
+// Reads the content identifier from the data of an Apple maker note
+func ParseAppleContentIdentifier(data []byte) string {
+	if !bytes.HasPrefix(data, appleMakerNoteHeader) || len(data) < 16 {
+		return ""
+	}
+
+	var order binary.ByteOrder = binary.BigEndian
+	if string(data[12:14]) == "II" {
+		order = binary.LittleEndian
+	}
+
+	count := int(order.Uint16(data[14:16]))
+	for idx := 0; idx < count; idx++ {
+		entry := 16 + 12*idx
+		if entry+12 > len(data) {
+			break
+		}
+
+		if order.Uint16(data[entry:]) != appleContentIdentifier || order.Uint16(data[entry+2:]) != 2 {
+			continue
+		}
+
+		// ASCII values longer than four bytes are stored at an offset
+		length := int(order.Uint32(data[entry+4:]))
+		value := data[entry+8 : entry+12]
+		if length > 4 {
+			offset := int(order.Uint32(data[entry+8:]))
+			if offset < 0 || length < 0 || offset+length > len(data) {
+				return ""
+			}
+			value = data[offset : offset+length]
+		} else if length < 4 {
+			value = value[:length]
+		}
+
+		return strings.TrimSpace(strings.TrimRight(string(value), "\x00"))
+	}
+
+	return ""
+}
+
+//=============================================================================
+
+// Returns the directory and the basename without extensions that companions
+// share, in lower case. Sidecars may append their extension to the name of
+// the file they describe, e.g. IMG_0001.CR2.xmp, so both are removed.
+func companionStem(path string) string {
+	stem, _ := splitCompanionName(strings.ToLower(filepath.Base(path)))
+	return filepath.Join(filepath.Dir(path), stem)
+}
+
+// Splits a file name into the basename that companions share and the
+// extensions, e.g. IMG_0001.CR2.xmp into IMG_0001 and .CR2.xmp
+func splitCompanionName(name string) (string, string) {
+	ext := filepath.Ext(name)
+	stem := strings.TrimSuffix(name, ext)
+
+	if SidecarExtensions[strings.ToLower(ext)] {
+		stem = strings.TrimSuffix(stem, filepath.Ext(stem))
+	}
+
+	return stem, name[len(stem):]
+}
+
+// Returns the role of a record in an asset, or an empty string if it can't
+// be a member of one
+func companionRole(record FilePath) string {
+	if SidecarExtensions[strings.ToLower(filepath.Ext(record.File().Path))] {
+		return RoleSidecar
+	}
+
+	switch record := record.(type) {
+	case *ImageMeta:
+		if record.IsRaw() {
+			return RoleRaw
+		}
+		return RoleImage
+	case *VideoMeta:
+		return RoleVideo
+	}
+
+	return ""
+}
+
+// The fields of a record that its companions are found by, so that assets
+// can be found without holding on to whole records
+type candidate struct {
+	signature string    // The signature of the record
+	path      string    // The path of the record
+	role      string    // The role of the record, empty if it can't be a member
+	content   string    // The content identifier of the record, if any
+	taken     time.Time // The capture time of the record, if dated
+	dated     bool      // Whether the capture time of the record is known
+}
+
+// Creates the candidate of a record
+func newCandidate(record FilePath) *candidate {
+	fm := record.File()
+	cand := &candidate{signature: fm.Signature, path: fm.Path, role: companionRole(record)}
+
+	if tagged, ok := record.(TaggedPath); ok {
+		cand.content = tagged.Tag("ContentIdentifier")
+		cand.taken, cand.dated = tagged.Taken()
+	}
+
+	return cand
+}
+
+// Creates the candidates of the records
+func newCandidates(records []FilePath) []*candidate {
+	candidates := make([]*candidate, 0, len(records))
+	for _, record := range records {
+		candidates = append(candidates, newCandidate(record))
+	}
+
+	return candidates
+}
+
+// Checks if two records were captured together. Records whose content
+// identifiers differ were not, otherwise their capture times must be within
+// the CompanionWindow when both are known. Times are compared on the wall
+// clock, since EXIF times have no zone but QuickTime creation dates do.
+func captured(a, b *candidate) bool {
+	if a.content != "" && b.content != "" {
+		return a.content == b.content
+	}
+
+	if !a.dated || !b.dated {
+		return true
+	}
+
+	gap := WallClock(a.taken).Sub(WallClock(b.taken))
+	return gap <= CompanionWindow && gap >= -CompanionWindow
+}
+
+// Finds the assets among the records: files in the same directory with the
+// same basename, other than their extension, that were captured together,
+// and their sidecars. Only assets of more than one file are returned.
+func FindAssets(records []FilePath) []*Asset {
+	return findAssets(newCandidates(records))
+}
+
+// Finds the assets among the candidates of records
+func findAssets(candidates []*candidate) []*Asset {
+	stems := make(map[string][]*candidate)
+	keys := make([]string, 0)
+
+	for _, cand := range candidates {
+		if cand.role == "" {
+			continue
+		}
+
+		stem := companionStem(cand.path)
+		if _, ok := stems[stem]; !ok {
+			keys = append(keys, stem)
+		}
+		stems[stem] = append(stems[stem], cand)
+	}
+
+	sort.Strings(keys)
+	assets := make([]*Asset, 0)
+
+	for _, stem := range keys {
+		if asset := findAsset(stems[stem]); asset != nil {
+			assets = append(assets, asset)
+		}
+	}
+
+	return assets
+}
+
+// Creates the asset of candidates that share a basename, if they form one
+func findAsset(candidates []*candidate) *Asset {
+	if len(candidates) < 2 {
+		return nil
+	}
+
+	rank := map[string]int{RoleRaw: 0, RoleImage: 1, RoleVideo: 2, RoleSidecar: 3}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		ri, rj := rank[candidates[i].role], rank[candidates[j].role]
+		if ri != rj {
+			return ri < rj
+		}
+		return candidates[i].path < candidates[j].path
+	})
+
+	primary := candidates[0]
+	if primary.role == RoleSidecar {
+		return nil
+	}
+
+	asset := &Asset{ID: primary.signature}
+	asset.Members = []*Companion{{primary.signature, primary.path, primary.role}}
+
+	for _, cand := range candidates[1:] {
+		role := cand.role
+		if role != RoleSidecar && !captured(primary, cand) {
+			continue
+		}
+
+		// A video next to an image is the video of a Live Photo
+		if role == RoleVideo && primary.role != RoleVideo {
+			role = RoleLive
+		}
+
+		asset.Members = append(asset.Members, &Companion{cand.signature, cand.path, role})
+	}
+
+	if len(asset.Members) < 2 {
+		return nil
+	}
+
+	return asset
+}
+
+//=============================================================================
+
+// Finds the assets among the records and stores them, replacing the assets
+// that any of the records were a member of before, so that finding them
+// again, e.g. on the next backup, reflects files that were added or removed.
+func LinkCompanions(records []FilePath) ([]*Asset, error) {
+	return linkCandidates(newCandidates(records))
+}
+
+// Finds and stores the assets among the candidates of records, writing the
+// changes in batches of at most CompanionBatchSize operations
+func linkCandidates(candidates []*candidate) ([]*Asset, error) {
+	assets := findAssets(candidates)
+	batch := new(leveldb.Batch)
+
+	flush := func(force bool) error {
+		if batch.Len() == 0 || (!force && batch.Len() < CompanionBatchSize) {
+			return nil
+		}
+
+		err := db.Write(batch, nil)
+		batch.Reset()
+		return err
+	}
+
+	for _, cand := range candidates {
+		if err := unlinkAssets(batch, cand.signature); err != nil {
+			return nil, err
+		}
+
+		if err := flush(false); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, asset := range assets {
+		data, err := json.Marshal(asset)
+		if err != nil {
+			return nil, err
+		}
+
+		batch.Put(indexKey(AssetNamespace, asset.ID), data)
+		for _, member := range asset.Members {
+			batch.Put(indexKey(CompanionNamespace, member.Signature, asset.ID), nil)
+		}
+
+		if err := flush(false); err != nil {
+			return nil, err
+		}
+	}
+
+	return assets, flush(true)
+}
+
+// Links the companions among the records of a walk one directory at a time,
+// as the walk leaves it, since the members of an asset share a directory.
+// Only the candidates of the directories still being walked are kept.
+type CompanionLinker struct {
+	Assets  int                     // The number of assets linked
+	pending map[string][]*candidate // The candidates by their directory
+}
+
+// Creates a linker for the records of a walk
+func NewCompanionLinker() *CompanionLinker {
+	return &CompanionLinker{pending: make(map[string][]*candidate)}
+}
+
+// Adds the stored record of a walk, first linking the directories the walk
+// has left: those that are neither the directory of the record nor one of
+// its parents, since a walk visits the whole tree of a directory at once.
+func (linker *CompanionLinker) Add(record FilePath) error {
+	dir := filepath.Dir(record.File().Path)
+
+	for pending := range linker.pending {
+		if pending != dir && !strings.HasPrefix(dir, pending+string(filepath.Separator)) {
+			if err := linker.link(pending); err != nil {
+				return err
+			}
+		}
+	}
+
+	linker.pending[dir] = append(linker.pending[dir], newCandidate(record))
+	return nil
+}
+
+// Links the directories that are still pending once the walk is finished
+func (linker *CompanionLinker) Close() error {
+	dirs := make([]string, 0, len(linker.pending))
+	for dir := range linker.pending {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+
+	for _, dir := range dirs {
+		if err := linker.link(dir); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Links the candidates of a directory and forgets them
+func (linker *CompanionLinker) link(dir string) error {
+	candidates := linker.pending[dir]
+	delete(linker.pending, dir)
+
+	assets, err := linkCandidates(candidates)
+	linker.Assets += len(assets)
+	return err
+}
+
+// Deletes the assets the record of the signature is a member of
+func unlinkAssets(batch *leveldb.Batch, signature string) error {
+	iter := db.NewIterator(indexRange(CompanionNamespace, signature, ""), nil)
+	defer iter.Release()
+
+	for iter.Next() {
+		asset, err := FetchAsset(indexSignature(iter.Key()))
+		if err == ErrNoAsset {
+			batch.Delete(append([]byte(nil), iter.Key()...))
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		batch.Delete(indexKey(AssetNamespace, asset.ID))
+		for _, member := range asset.Members {
+			batch.Delete(indexKey(CompanionNamespace, member.Signature, asset.ID))
+		}
+	}
+
+	return iter.Error()
+}
+
+// Fetches the stored asset with the id, the signature of its primary member
+func FetchAsset(id string) (*Asset, error) {
+	data, err := db.Get(indexKey(AssetNamespace, id), nil)
+	if err == leveldb.ErrNotFound {
+		return nil, ErrNoAsset
+	} else if err != nil {
+		return nil, err
+	}
+
+	asset := new(Asset)
+	return asset, json.Unmarshal(data, asset)
+}
+
+// Fetches the stored asset that the record of the signature is a member of
+func AssetOf(signature string) (*Asset, error) {
+	iter := db.NewIterator(indexRange(CompanionNamespace, signature, ""), nil)
+	defer iter.Release()
+
+	if iter.Next() {
+		return FetchAsset(indexSignature(iter.Key()))
+	}
+
+	if err := iter.Error(); err != nil {
+		return nil, err
+	}
+
+	return nil, ErrNoAsset
+}
+
+// Replaces the members of assets among the records with the record of the
+// primary member of their asset, so that each asset appears once, and
+// returns the assets by their id. The order of the records is kept.
+func CollapseCompanions(records []FilePath) ([]FilePath, map[string]*Asset, error) {
+	collapsed := make([]FilePath, 0, len(records))
+	assets := make(map[string]*Asset)
+	seen := make(map[string]bool)
+
+	for _, record := range records {
+		signature := record.File().Signature
+
+		asset, err := AssetOf(signature)
+		if err == ErrNoAsset {
+			if !seen[signature] {
+				seen[signature] = true
+				collapsed = append(collapsed, record)
+			}
+			continue
+		} else if err != nil {
+			return nil, nil, err
+		}
+
+		if seen[asset.ID] {
+			continue
+		}
+		seen[asset.ID] = true
+		assets[asset.ID] = asset
+
+		// The primary may not have matched, e.g. when a query found a sidecar
+		if asset.ID != signature {
+			if primary, err := Fetch(asset.ID); err == nil {
+				record = primary
+			}
+		}
+
+		collapsed = append(collapsed, record)
+	}
+
+	return collapsed, assets, nil
+}
+
+// Keeps the first match of each asset in a cluster of near duplicates, since
+// the members of an asset, e.g. a RAW and its JPEG, are not duplicates
+func distinctAssets(matches []*HashMatch) ([]*HashMatch, error) {
+	distinct := make([]*HashMatch, 0, len(matches))
+	seen := make(map[string]bool)
+
+	for _, match := range matches {
+		id := match.Signature
+		if asset, err := AssetOf(match.Signature); err == nil {
+			id = asset.ID
+		} else if err != ErrNoAsset {
+			return nil, err
+		}
+
+		if !seen[id] {
+			seen[id] = true
+			distinct = append(distinct, match)
+		}
+	}
+
+	return distinct, nil
+}
+
+// Adds the records of the members of the stored assets of the records that
+// aren't among them, e.g. the sidecar of an image that matched a query
+func WithCompanions(records []FilePath) ([]FilePath, error) {
+	result := append(make([]FilePath, 0, len(records)), records...)
+	seen := make(map[string]bool)
+	for _, record := range records {
+		seen[record.File().Signature] = true
+	}
+
+	for _, record := range records {
+		asset, err := AssetOf(record.File().Signature)
+		if err == ErrNoAsset {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		for _, member := range asset.Members {
+			if seen[member.Signature] {
+				continue
+			}
+			seen[member.Signature] = true
+
+			companion, err := Fetch(member.Signature)
+			if err != nil {
+				continue
+			}
+			result = append(result, companion)
+		}
+	}
+
+	return result, nil
+}
@@ -0,0 +1,307 @@
+package crate_test
+
+import (
+	"bytes"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	. "github.com/bbengfort/crate/crate"
+	"github.com/bbengfort/crate/crate/config"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// Builds an Apple maker note with the content identifier of a Live Photo
+func mkapplenote(identifier string) []byte {
+	value := append([]byte(identifier), 0)
+	note := append([]byte("Apple iOS\x00"), 0, 1, 'M', 'M')
+	note = append(note, mkints(uint16(1), uint16(0x0011), uint16(2), uint32(len(value)))...)
+
+	// Values of up to four bytes are stored in the entry
+	if len(value) <= 4 {
+		return append(note, append(value, make([]byte, 8-len(value))...)...)
+	}
+
+	note = append(note, mkints(uint32(32), uint32(0))...)
+	return append(note, value...)
+}
+
+// Builds a QuickTime movie with the Apple creation date and content identifier
+func mklivemov(created, identifier string) []byte {
+	mvhd := mkbox("mvhd", mkints(uint32(0), uint32(0), uint32(0), uint32(600), uint32(1800)), make([]byte, 80))
+	keys := mkbox("keys", mkints(uint32(0), uint32(2)),
+		mkbox("mdta", []byte("com.apple.quicktime.creationdate")),
+		mkbox("mdta", []byte("com.apple.quicktime.content.identifier")))
+	ilst := mkbox("ilst",
+		mkbox(string(mkints(uint32(1))), mkdata(created)),
+		mkbox(string(mkints(uint32(2))), mkdata(identifier)))
+	meta := mkbox("meta", mkbox("hdlr", make([]byte, 25)), keys, ilst)
+
+	data := mkbox("ftyp", []byte("qt  "), mkints(uint32(0)), []byte("qt  "))
+	return append(data, mkbox("moov", mvhd, meta)...)
+}
+
+var _ = Describe("Companions", func() {
+
+	// Creates a record of the type at the path with the tags
+	record := func(path string, mimetype string, tags TagMap) FilePath {
+		fm := FileMeta{Signature: path, MimeType: mimetype}
+		fm.Path = path
+		fm.Name = filepath.Base(path)
+
+		switch {
+		case mimetype == "video/quicktime":
+			video := &VideoMeta{FileMeta: fm}
+			video.Tags = tags
+			return video
+		case mimetype != "" && mimetype[:6] == "image/":
+			img := &ImageMeta{FileMeta: fm}
+			img.Tags = tags
+			return img
+		}
+
+		return &fm
+	}
+
+	// Returns the roles of the members of an asset by their path
+	roles := func(asset *Asset) map[string]string {
+		result := make(map[string]string)
+		for _, member := range asset.Members {
+			result[member.Path] = member.Role
+		}
+		return result
+	}
+
+	It("should read the content identifier of an Apple maker note", func() {
+		Ω(ParseAppleContentIdentifier(mkapplenote("9F0A6CBB-3DB6-4D5E"))).Should(Equal("9F0A6CBB-3DB6-4D5E"))
+		Ω(ParseAppleContentIdentifier(mkapplenote("AB"))).Should(Equal("AB"))
+		Ω(ParseAppleContentIdentifier([]byte("Nikon\x00\x02\x10\x00\x00MM"))).Should(BeEmpty())
+		Ω(ParseAppleContentIdentifier(mkapplenote("9F0A6CBB-3DB6-4D5E")[:30])).Should(BeEmpty())
+	})
+
+	It("should extract the content identifiers of Live Photos and their videos", func() {
+		testRoot, err := ioutil.TempDir("", "ginkgo-")
+		Ω(err).Should(BeNil())
+		defer os.RemoveAll(testRoot)
+
+		path := filepath.Join(testRoot, "IMG_0001.JPG")
+		data := mktaggedjpeg(8, 8, tascii(0x010f, "Apple"), tundef(0x927c, mkapplenote("9F0A6CBB-3DB6-4D5E")))
+		Ω(ioutil.WriteFile(path, data, 0644)).Should(Succeed())
+
+		img := ImageFromPath(path)
+		img.Populate()
+		Ω(img.Tag("ContentIdentifier")).Should(Equal("9F0A6CBB-3DB6-4D5E"))
+
+		path = filepath.Join(testRoot, "IMG_0001.MOV")
+		Ω(ioutil.WriteFile(path, mklivemov("2015-01-05T09:57:20-0800", "9F0A6CBB-3DB6-4D5E"), 0644)).Should(Succeed())
+
+		fm := mkvideo(path)
+		fm.MimeType = "video/quicktime"
+		video, ok := ConvertVideoMeta(fm)
+		Ω(ok).Should(BeTrue())
+		video.Populate()
+		Ω(video.Tag("ContentIdentifier")).Should(Equal("9F0A6CBB-3DB6-4D5E"))
+	})
+
+	It("should find the RAW+JPEG pairs, sidecars and Live Photos in a directory", func() {
+		records := []FilePath{
+			record("/photos/IMG_0001.JPG", "image/jpeg", TagMap{"DateTaken": "2015-01-05T09:57:21+00:00"}),
+			record("/photos/IMG_0001.CR2", "image/x-canon-cr2", TagMap{"DateTaken": "2015-01-05T09:57:20+00:00"}),
+			record("/photos/IMG_0001.CR2.xmp", "text/xml", nil),
+			record("/photos/IMG_0002.HEIC", "image/heic", TagMap{"ContentIdentifier": "A", "DateTaken": "2015-01-05T10:00:00+00:00"}),
+			record("/photos/IMG_0002.MOV", "video/quicktime", TagMap{"ContentIdentifier": "A"}),
+			record("/photos/IMG_0002.AAE", "text/xml", nil),
+			record("/photos/IMG_0003.JPG", "image/jpeg", TagMap{"ContentIdentifier": "B"}),
+			record("/photos/IMG_0003.MOV", "video/quicktime", TagMap{"ContentIdentifier": "C"}),
+			record("/photos/IMG_0004.JPG", "image/jpeg", TagMap{"DateTaken": "2015-01-05T11:00:00+00:00"}),
+			record("/photos/IMG_0004.CR2", "image/x-canon-cr2", TagMap{"DateTaken": "2015-01-05T12:00:00+00:00"}),
+			record("/photos/IMG_0005.HEIC", "image/heic", TagMap{"DateTaken": "2015-01-05T09:57:20+00:00"}),
+			record("/photos/IMG_0005.MOV", "video/quicktime", TagMap{"DateTaken": "2015-01-05T09:57:21-08:00"}),
+			record("/photos/MVI_0006.MOV", "video/quicktime", nil),
+			record("/photos/MVI_0006.THM", "image/jpeg", nil),
+			record("/photos/notes.txt", "text/plain", nil),
+			record("/photos/IMG_0007.xmp", "text/xml", nil),
+			record("/backup/IMG_0001.JPG", "image/jpeg", nil),
+		}
+
+		assets := FindAssets(records)
+		Ω(assets).Should(HaveLen(4))
+
+		Ω(assets[0].ID).Should(Equal("/photos/IMG_0001.CR2"))
+		Ω(roles(assets[0])).Should(Equal(map[string]string{
+			"/photos/IMG_0001.CR2":     RoleRaw,
+			"/photos/IMG_0001.JPG":     RoleImage,
+			"/photos/IMG_0001.CR2.xmp": RoleSidecar,
+		}))
+
+		Ω(assets[1].Primary().Path).Should(Equal("/photos/IMG_0002.HEIC"))
+		Ω(roles(assets[1])).Should(Equal(map[string]string{
+			"/photos/IMG_0002.HEIC": RoleImage,
+			"/photos/IMG_0002.MOV":  RoleLive,
+			"/photos/IMG_0002.AAE":  RoleSidecar,
+		}))
+
+		// Times are compared on the wall clock since EXIF has no time zone
+		Ω(roles(assets[2])).Should(Equal(map[string]string{
+			"/photos/IMG_0005.HEIC": RoleImage,
+			"/photos/IMG_0005.MOV":  RoleLive,
+		}))
+
+		Ω(roles(assets[3])).Should(Equal(map[string]string{
+			"/photos/MVI_0006.MOV": RoleVideo,
+			"/photos/MVI_0006.THM": RoleSidecar,
+		}))
+
+		Ω(assets[0].Contains("/photos/IMG_0001.JPG")).Should(BeTrue())
+		Ω(assets[0].Contains("/backup/IMG_0001.JPG")).Should(BeFalse())
+		Ω(assets[0].Companions("/photos/IMG_0001.JPG")).Should(HaveLen(2))
+	})
+
+	Describe("Storage", func() {
+
+		var (
+			err      error  // Any errors in directory creation
+			testRoot string // Test directory to store temp fixtures
+			testHome string // Fake home directory in temp directory
+		)
+
+		// Writes the data to the temporary directory and stores its record
+		store := func(name string, data []byte) FilePath {
+			path := filepath.Join(testRoot, name)
+			Ω(ioutil.WriteFile(path, data, 0644)).Should(Succeed())
+
+			node, err := NewPath(path)
+			Ω(err).Should(BeNil())
+
+			record := NewRecord(node.(*FileMeta))
+			Ω(record.Store()).Should(Succeed())
+			return record
+		}
+
+		BeforeEach(func() {
+			testRoot, err = ioutil.TempDir("", "ginkgo-")
+			Ω(err).Should(BeNil())
+
+			testHome = filepath.Join(testRoot, "Users", "jdoe")
+			err = os.MkdirAll(testHome, 0755)
+			Ω(err).Should(BeNil())
+
+			if runtime.GOOS == "windows" {
+				Ω(os.Setenv("USERPROFILE", testHome)).Should(BeNil())
+			} else {
+				Ω(os.Setenv("HOME", testHome)).Should(BeNil())
+			}
+
+			Ω(InitializeDatabase()).Should(BeNil())
+		})
+
+		AfterEach(func() {
+			CloseDatabase()
+			Ω(os.RemoveAll(testRoot)).Should(BeNil())
+
+			if runtime.GOOS == "windows" {
+				Ω(os.Unsetenv("USERPROFILE")).Should(BeNil())
+			} else {
+				Ω(os.Unsetenv("HOME")).Should(BeNil())
+			}
+
+			config.ClearPathCache()
+		})
+
+		It("should link companions and keep them together", func() {
+			pattern := mkpattern(320, 240, 2)
+			buf := new(bytes.Buffer)
+			Ω(png.Encode(buf, pattern)).Should(Succeed())
+
+			jpg := store("IMG_0001.jpg", mkpatternjpeg(pattern, 95))
+			rendered := store("IMG_0001.png", buf.Bytes())
+			sidecar := store("IMG_0001.xmp", []byte("<x:xmpmeta xmlns:x=\"adobe:ns:meta/\"></x:xmpmeta>"))
+			other := store("IMG_0002.jpg", mkpatternjpeg(mkpattern(320, 240, 5), 95))
+
+			// Unlinked, the rendered PNG is a near duplicate of the JPEG
+			clusters, err := NearDuplicates(DefaultSimilarDistance)
+			Ω(err).Should(BeNil())
+			Ω(clusters).Should(HaveLen(1))
+
+			records := []FilePath{jpg, rendered, sidecar, other}
+			assets, err := LinkCompanions(records)
+			Ω(err).Should(BeNil())
+			Ω(assets).Should(HaveLen(1))
+			Ω(assets[0].ID).Should(Equal(jpg.File().Signature))
+			Ω(assets[0].Members).Should(HaveLen(3))
+
+			asset, err := AssetOf(sidecar.File().Signature)
+			Ω(err).Should(BeNil())
+			Ω(asset.ID).Should(Equal(jpg.File().Signature))
+
+			_, err = AssetOf(other.File().Signature)
+			Ω(err).Should(Equal(ErrNoAsset))
+
+			clusters, err = NearDuplicates(DefaultSimilarDistance)
+			Ω(err).Should(BeNil())
+			Ω(clusters).Should(BeEmpty())
+
+			// The assets are not records
+			Ω(FetchKeys(100)).Should(HaveLen(4))
+
+			// Matching a companion exports the primary of its asset once
+			collapsed, byID, err := CollapseCompanions([]FilePath{sidecar, other, rendered})
+			Ω(err).Should(BeNil())
+			Ω(collapsed).Should(HaveLen(2))
+			Ω(collapsed[0].File().Signature).Should(Equal(jpg.File().Signature))
+			Ω(collapsed[1].File().Signature).Should(Equal(other.File().Signature))
+			Ω(byID).Should(HaveKey(jpg.File().Signature))
+
+			// Linking again replaces the assets of the records
+			assets, err = LinkCompanions([]FilePath{jpg, sidecar, other})
+			Ω(err).Should(BeNil())
+			Ω(assets).Should(HaveLen(1))
+			Ω(assets[0].Members).Should(HaveLen(2))
+
+			_, err = AssetOf(rendered.File().Signature)
+			Ω(err).Should(Equal(ErrNoAsset))
+
+			asset, err = FetchAsset(jpg.File().Signature)
+			Ω(err).Should(BeNil())
+			Ω(asset.Contains(rendered.File().Signature)).Should(BeFalse())
+		})
+
+		It("should link the companions of a walk as it leaves each directory", func() {
+			pattern := mkpatternjpeg(mkpattern(64, 48, 2), 95)
+			jpg := store("IMG_0001.jpg", pattern)
+			sidecar := store("IMG_0001.xmp", []byte("<x:xmpmeta xmlns:x=\"adobe:ns:meta/\"></x:xmpmeta>"))
+
+			Ω(os.Mkdir(filepath.Join(testRoot, "sub"), 0755)).Should(Succeed())
+			nested := store(filepath.Join("sub", "IMG_0002.jpg"), mkpatternjpeg(mkpattern(64, 48, 5), 95))
+			nestedSidecar := store(filepath.Join("sub", "IMG_0002.xmp"), []byte("<x:xmpmeta xmlns:x=\"adobe:ns:meta/\"></x:xmpmeta>"))
+
+			linker := NewCompanionLinker()
+			Ω(linker.Add(jpg)).Should(Succeed())
+			Ω(linker.Add(nested)).Should(Succeed())
+			Ω(linker.Add(nestedSidecar)).Should(Succeed())
+
+			// The parent of the walk is still pending
+			_, err := AssetOf(jpg.File().Signature)
+			Ω(err).Should(Equal(ErrNoAsset))
+
+			// Returning to the parent links the directory the walk has left
+			Ω(linker.Add(sidecar)).Should(Succeed())
+			asset, err := AssetOf(nestedSidecar.File().Signature)
+			Ω(err).Should(BeNil())
+			Ω(asset.ID).Should(Equal(nested.File().Signature))
+
+			Ω(linker.Close()).Should(Succeed())
+			Ω(linker.Assets).Should(Equal(2))
+
+			asset, err = AssetOf(sidecar.File().Signature)
+			Ω(err).Should(BeNil())
+			Ω(asset.ID).Should(Equal(jpg.File().Signature))
+		})
+
+	})
+
+})
@@ -5,6 +5,7 @@ package config
 import (
 	"errors"
 	"io/ioutil"
+	"time"
 
 	"gopkg.in/yaml.v2"
 )
@@ -12,11 +13,18 @@ import (
 //=============================================================================
 
 type Config struct {
-	Debug  bool     `yaml:debug,omitempty`  // default false
-	Notify []string `yaml:notify,omitempty` // default []
-	Level  string   `yaml:level,omitempty`  // default INFO
+	Debug            bool          `yaml:debug,omitempty`               // default false
+	Notify           []string      `yaml:notify,omitempty`              // default []
+	Level            string        `yaml:level,omitempty`               // default INFO
+	BurstGap         time.Duration `yaml:"burst_gap,omitempty"`         // default 2s
+	EventGap         time.Duration `yaml:"event_gap,omitempty"`         // default 3h
+	EventRadius      float64       `yaml:"event_radius,omitempty"`      // default 1 (km)
+	OrganizeTemplate string        `yaml:"organize_template,omitempty"` // default DefaultOrganizeTemplate
 }
 
+// Where organize places a file in the target, see crate.ParseTemplate
+const DefaultOrganizeTemplate = "{year}/{month:02}/{year}-{month:02}-{day:02}_{camera}_{name}"
+
 //=============================================================================
 
 // Create a New Config with default values, one of two ways to create a config
@@ -29,6 +37,10 @@ func New() *Config {
 	config.Debug = false
 	config.Notify = make([]string, 0, 0)
 	config.Level = "INFO"
+	config.BurstGap = 2 * time.Second
+	config.EventGap = 3 * time.Hour
+	config.EventRadius = 1.0
+	config.OrganizeTemplate = DefaultOrganizeTemplate
 
 	return config
 }
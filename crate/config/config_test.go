@@ -4,6 +4,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"time"
 
 	. "github.com/bbengfort/crate/crate/config"
 
@@ -67,4 +68,16 @@ var _ = Describe("Config", func() {
 		Ω(config.Notify).Should(ContainElement("joe@example.com"))
 	})
 
+	It("should load the grouping thresholds with defaults for those unset", func() {
+		out := filepath.Join(testRoot, "config.yaml")
+		Ω(ioutil.WriteFile(out, []byte("burst_gap: 5s\nevent_radius: 2.5\n"), 0644)).Should(Succeed())
+
+		config, err := Load(out)
+		Ω(err).Should(BeNil())
+		Ω(config.BurstGap).Should(Equal(5 * time.Second))
+		Ω(config.EventGap).Should(Equal(3 * time.Hour))
+		Ω(config.EventRadius).Should(Equal(2.5))
+		Ω(config.OrganizeTemplate).Should(Equal(DefaultOrganizeTemplate))
+	})
+
 })
@@ -21,6 +21,8 @@ const (
 	ConfigName       = "config.yaml"
 	LogDirName       = "logs"
 	LogFileName      = "events.log"
+	ThumbnailDirName = "thumbnails"
+	JournalDirName   = "journals"
 )
 
 var (
@@ -28,6 +30,8 @@ var (
 	crateDBPath string // The path to the database storing the metadata
 	configPath  string // The path to the YAML configuration file
 	loggingPath string // The path to store the log files
+	thumbsPath  string // The path of the thumbnail cache directory
+	journalPath string // The path of the directory of the organize journals
 )
 
 //=============================================================================
@@ -52,6 +56,8 @@ func ClearPathCache() {
 	crateDBPath = ""
 	configPath = ""
 	loggingPath = ""
+	thumbsPath = ""
+	journalPath = ""
 }
 
 //=============================================================================
@@ -157,6 +163,53 @@ func CrateLoggingPath() (string, error) {
 
 }
 
+// Returns the thumbnail cache directory and creates it if it doesn't exist
+func CrateThumbnailPath() (string, error) {
+
+	// Ensure that there is a cratePath instantiated
+	if cratePath == "" {
+		if _, err := CrateDirectory(); err != nil {
+			return "", err
+		}
+	}
+
+	// Cache the crate thumbnail path
+	if thumbsPath == "" {
+		path := filepath.Join(cratePath, ThumbnailDirName)
+		if err := InitializeCrateDirectory(path); err != nil {
+			return "", err
+		}
+
+		thumbsPath = path
+	}
+
+	return thumbsPath, nil
+}
+
+// Returns the directory of the journals that undo the organize runs and
+// creates it if it doesn't exist
+func CrateJournalPath() (string, error) {
+
+	// Ensure that there is a cratePath instantiated
+	if cratePath == "" {
+		if _, err := CrateDirectory(); err != nil {
+			return "", err
+		}
+	}
+
+	// Cache the crate journal path
+	if journalPath == "" {
+		path := filepath.Join(cratePath, JournalDirName)
+		if err := InitializeCrateDirectory(path); err != nil {
+			return "", err
+		}
+
+		journalPath = path
+	}
+
+	return journalPath, nil
+}
+
 //=============================================================================
 
 // Creates the Crate directory and initializes it with default files
@@ -127,6 +127,32 @@ var _ = Describe("Config Paths", func() {
 		Ω(PathExists(logPath)).ShouldNot(BeTrue())
 	})
 
+	It("should correctly get and initialize the thumbnail cache directory", func() {
+		var thumbDir string
+		if runtime.GOOS == "windows" {
+			thumbDir = filepath.Join(testHome, "AppData", "Roaming", "Crate", "thumbnails")
+		} else {
+			thumbDir = filepath.Join(testHome, ".crate", "thumbnails")
+		}
+
+		Ω(PathExists(thumbDir)).Should(BeFalse())
+		Ω(CrateThumbnailPath()).Should(Equal(thumbDir))
+		Ω(PathExists(thumbDir)).Should(BeTrue())
+	})
+
+	It("should correctly get and initialize the organize journal directory", func() {
+		var journalDir string
+		if runtime.GOOS == "windows" {
+			journalDir = filepath.Join(testHome, "AppData", "Roaming", "Crate", "journals")
+		} else {
+			journalDir = filepath.Join(testHome, ".crate", "journals")
+		}
+
+		Ω(PathExists(journalDir)).Should(BeFalse())
+		Ω(CrateJournalPath()).Should(Equal(journalDir))
+		Ω(PathExists(journalDir)).Should(BeTrue())
+	})
+
 	It("should not overwite an existing crate configuration", func() {
 
 		path, err := CrateDirectory()
@@ -3,15 +3,45 @@
 package crate
 
 import (
+	"bytes"
 	"encoding/json"
+	"strings"
 
 	"github.com/bbengfort/crate/crate/config"
 	"github.com/syndtr/goleveldb/leveldb"
-	// dbutil "github.com/syndtr/goleveldb/leveldb/util"
+	dbutil "github.com/syndtr/goleveldb/leveldb/util"
 )
 
+// Index keys are namespaced with a separator that cannot appear in the
+// base64 encoded signatures used as the keys of the meta data records.
+const IndexSeparator = ":"
+
 var db *leveldb.DB // Global var for the storage
 
+var indexes []Index // The registered indexes in order of registration
+
+//=============================================================================
+
+// Maintains index entries derived from the records, which are written in the
+// same batch as the record so that the indexes never disagree with the data.
+type Index interface {
+	Name() string                                 // Unique name of the index
+	Add(batch *leveldb.Batch, record FilePath)    // Adds the entries of the record
+	Remove(batch *leveldb.Batch, record FilePath) // Deletes the entries of the record
+}
+
+// Registers an index, replacing any registered index with its name
+func RegisterIndex(index Index) {
+	for idx, registered := range indexes {
+		if registered.Name() == index.Name() {
+			indexes[idx] = index
+			return
+		}
+	}
+
+	indexes = append(indexes, index)
+}
+
 //=============================================================================
 
 // Initialize the database in the config location
@@ -44,7 +74,7 @@ func (fm *FileMeta) Store() error {
 		fm.Populate()
 	}
 
-	return db.Put([]byte(fm.Signature), fm.Byte(), nil)
+	return storeRecord(fm)
 
 }
 
@@ -55,13 +85,55 @@ func (img *ImageMeta) Store() error {
 		img.Populate()
 	}
 
-	return db.Put([]byte(img.Signature), img.Byte(), nil)
+	return storeRecord(img)
 
 }
 
+// Writes a populated record and its index entries in a single batch, any
+// index entries of a previously stored version of the record are replaced.
+func storeRecord(record FilePath) error {
+	signature := record.File().Signature
+	batch := new(leveldb.Batch)
+
+	if stored, err := Fetch(signature); err == nil {
+		if img, ok := record.(*ImageMeta); ok {
+			if prev, ok := stored.(*ImageMeta); ok {
+				img.preserveInferredLocation(prev)
+				img.preserveQuality(prev)
+			}
+		}
+
+		unindexRecord(batch, stored)
+	}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	batch.Put([]byte(signature), data)
+	indexRecord(batch, record)
+
+	return db.Write(batch, nil)
+}
+
+// Adds the index entries of a record to the write batch
+func indexRecord(batch *leveldb.Batch, record FilePath) {
+	for _, index := range indexes {
+		index.Add(batch, record)
+	}
+}
+
+// Adds the deletion of the index entries of a record to the write batch
+func unindexRecord(batch *leveldb.Batch, record FilePath) {
+	for _, index := range indexes {
+		index.Remove(batch, record)
+	}
+}
+
 //=============================================================================
 
-// Fetch the FileMeta or ImageMeta from the specified hash
+// Fetch the record stored with the specified hash
 func Fetch(key string) (FilePath, error) {
 
 	data, err := db.Get([]byte(key), nil)
@@ -69,27 +141,29 @@ func Fetch(key string) (FilePath, error) {
 		return nil, err
 	}
 
+	return decodeRecord(data)
+}
+
+// Unmarshals the stored JSON of a record into the record type defined by the
+// extractors registered for its MIME type (a FileMeta if there are none)
+func decodeRecord(data []byte) (FilePath, error) {
+
 	meta := new(FileMeta)
-	err = json.Unmarshal(data, &meta)
+	err := json.Unmarshal(data, &meta)
 	if err != nil {
 		return nil, err
 	}
 
 	meta.populated = true
 
-	if meta.IsImage() {
-
-		img := new(ImageMeta)
-		err = json.Unmarshal(data, &img)
-		if err != nil {
+	record := NewRecord(meta)
+	if record != meta {
+		if err := json.Unmarshal(data, record); err != nil {
 			return nil, err
 		}
-
-		img.populated = true
-		return img, nil
 	}
 
-	return meta, nil
+	return record, nil
 
 }
 
@@ -101,6 +175,10 @@ func FetchKeys(limit int) []string {
 	idx := 0
 
 	for iter.Next() {
+		if isIndexKey(iter.Key()) {
+			continue
+		}
+
 		result = append(result, string(iter.Key()))
 
 		idx++
@@ -110,5 +188,53 @@ func FetchKeys(limit int) []string {
 
 	}
 
+	iter.Release()
 	return result
 }
+
+// Calls the function on every record in the database, skipping index keys
+func EachRecord(fn func(record FilePath) error) error {
+
+	iter := db.NewIterator(nil, nil)
+	defer iter.Release()
+
+	for iter.Next() {
+		if isIndexKey(iter.Key()) {
+			continue
+		}
+
+		record, err := decodeRecord(iter.Value())
+		if err != nil {
+			return err
+		}
+
+		if err := fn(record); err != nil {
+			return err
+		}
+	}
+
+	return iter.Error()
+}
+
+//=============================================================================
+
+// Creates a namespaced index key from the namespace and key parts
+func indexKey(namespace string, parts ...string) []byte {
+	return []byte(namespace + IndexSeparator + strings.Join(parts, IndexSeparator))
+}
+
+// Returns the range of all index keys that begin with the given parts
+func indexRange(namespace string, parts ...string) *dbutil.Range {
+	return dbutil.BytesPrefix(indexKey(namespace, parts...))
+}
+
+// Returns the last part of an index key, which by convention is the signature
+func indexSignature(key []byte) string {
+	idx := bytes.LastIndex(key, []byte(IndexSeparator))
+	return string(key[idx+1:])
+}
+
+// Checks if a key belongs to an index rather than to a meta data record
+func isIndexKey(key []byte) bool {
+	return bytes.Contains(key, []byte(IndexSeparator))
+}
@@ -120,7 +120,10 @@ var _ = Describe("Db", func() {
 
 		test, err := Fetch(dracula.Signature)
 		Ω(err).Should(BeNil())
-		_, ok := test.(*FileMeta)
+		Ω(test.File().Path).Should(Equal(dracula.Path))
+
+		// Text files are decoded as the record type of the text extractor
+		_, ok := test.(*TextMeta)
 		Ω(ok).Should(BeTrue())
 
 	})
@@ -0,0 +1,743 @@
+// Meta data struct specifically for PDF, Office Open XML and OpenDocument files
+
+package crate
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/zlib"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	MaxDocumentRead = 64 << 20 // Largest part of a PDF that will be read into memory
+)
+
+var (
+	pdfObjectPattern = regexp.MustCompile(`(\d+)\s+(\d+)\s+obj\b`)
+	pdfRefPattern    = `\s+(\d+)\s+\d+\s+R`
+	pdfPagePattern   = regexp.MustCompile(`/Type\s*/Page[^s]`)
+)
+
+//=============================================================================
+
+// The document properties are stored as tags, so the Author tag holds the
+// author recorded by the document rather than the owner of the file (which
+// is the Author of the FileMeta).
+type DocumentMeta struct {
+	FileMeta
+	Pages int    // Number of pages (or slides) in the document
+	Tags  TagMap // Title, Author, Creator, DateCreated and other properties
+}
+
+// Converts a FileMeta into a DocumentMeta
+func ConvertDocumentMeta(fm *FileMeta) (*DocumentMeta, bool) {
+	if !new(DocumentExtractor).Claims(fm.MimeType) {
+		return nil, false
+	}
+
+	doc := new(DocumentMeta)
+	doc.FileMeta = *fm
+
+	return doc, true
+}
+
+// Populates the fields on the DocumentMeta
+func (doc *DocumentMeta) Populate() {
+	doc.FileMeta.populateFile()
+	extract(doc)
+}
+
+// Returns the value of a tag or an empty string if it isn't set
+func (doc *DocumentMeta) Tag(name string) string {
+	return doc.Tags[name]
+}
+
+// Documents have no location, but may be searched like other tagged records
+func (doc *DocumentMeta) Location() (float64, float64, bool) {
+	return doc.Tags.Location()
+}
+
+// Documents have no capture time, see the DateCreated tag instead
+func (doc *DocumentMeta) Taken() (time.Time, bool) {
+	return doc.Tags.Taken()
+}
+
+// Writes the DocumentMeta to the database, where the key is the SHA1 hash
+func (doc *DocumentMeta) Store() error {
+	if !doc.populated {
+		doc.Populate()
+	}
+
+	return storeRecord(doc)
+}
+
+// Returns the byte serialization of the document meta for storage
+func (doc *DocumentMeta) Byte() []byte {
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return nil
+	}
+
+	return data
+}
+
+// Prints out the info as a JSON indented pretty string
+func (doc *DocumentMeta) Info() string {
+	if !doc.populated {
+		doc.Populate()
+	}
+
+	info, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return ""
+	}
+
+	return string(info)
+}
+
+// Sets the tag if the value isn't empty and the tag isn't yet set
+func (doc *DocumentMeta) setTag(name, value string) {
+	value = strings.TrimSpace(value)
+	if value != "" && doc.Tags[name] == "" {
+		doc.Tags[name] = value
+	}
+}
+
+// Sets the date tag as a JSON timestamp if the value parses as a date
+func (doc *DocumentMeta) setDate(name, value string, parse func(string) (time.Time, bool)) {
+	if date, ok := parse(value); ok {
+		doc.setTag(name, JSONStamp(date))
+	}
+}
+
+//=============================================================================
+
+// Extracts the document properties of PDFs from their info dictionary and
+// XMP packet, and of Office Open XML (docx, xlsx, pptx) and OpenDocument
+// (odt, ods, odp) files from the property parts of their zip archives.
+type DocumentExtractor struct{}
+
+func init() {
+	RegisterExtractor(new(DocumentExtractor))
+}
+
+func (ext *DocumentExtractor) Name() string {
+	return "document"
+}
+
+func (ext *DocumentExtractor) Version() string {
+	return "1"
+}
+
+func (ext *DocumentExtractor) Claims(mimetype string) bool {
+	return MimePrefixes{
+		"application/pdf",
+		"application/vnd.openxmlformats-officedocument.",
+		"application/vnd.oasis.opendocument.",
+	}.Claims(mimetype)
+}
+
+func (ext *DocumentExtractor) Convert(fm *FileMeta) FilePath {
+	if doc, ok := ConvertDocumentMeta(fm); ok {
+		return doc
+	}
+
+	return nil
+}
+
+func (ext *DocumentExtractor) Extract(record FilePath) error {
+	doc, ok := record.(*DocumentMeta)
+	if !ok {
+		return errors.New("record is not a DocumentMeta")
+	}
+
+	doc.Tags = make(TagMap)
+	if doc.MimeType == "application/pdf" {
+		return doc.parsePDF()
+	}
+
+	return doc.parseArchive()
+}
+
+//=============================================================================
+
+// Parses the info dictionary, XMP packet and page tree of a PDF, including
+// objects compressed in the object streams of PDF 1.5 and later.
+func (doc *DocumentMeta) parsePDF() error {
+	data, err := readDocument(doc.Path)
+	if err != nil {
+		return err
+	}
+
+	if !bytes.HasPrefix(data, []byte("%PDF-")) {
+		return errors.New("missing the PDF header")
+	}
+
+	objects := pdfObjects(data)
+
+	if ref := pdfLastRef(data, "Info"); ref > 0 {
+		if info, ok := objects[ref]; ok {
+			for _, key := range []string{"Title", "Author", "Subject", "Keywords", "Creator", "Producer"} {
+				doc.setTag(key, pdfString(pdfValue(info, key, objects)))
+			}
+
+			doc.setDate("DateCreated", pdfString(pdfValue(info, "CreationDate", objects)), ParsePDFDate)
+			doc.setDate("DateModified", pdfString(pdfValue(info, "ModDate", objects)), ParsePDFDate)
+		}
+	}
+
+	// The XMP metadata stream fills the properties missing from the info
+	if packet := FindXMP(data); packet != nil {
+		if props, err := ParseXMP(packet); err == nil {
+			doc.setTag("Title", props["dc:title"])
+			doc.setTag("Author", props["dc:creator"])
+			doc.setTag("Subject", props["dc:description"])
+			doc.setTag("Keywords", props["pdf:Keywords"])
+			doc.setTag("Creator", props["xmp:CreatorTool"])
+			doc.setTag("Producer", props["pdf:Producer"])
+			doc.setDate("DateCreated", props["xmp:CreateDate"], ParseXMPDate)
+			doc.setDate("DateModified", props["xmp:ModifyDate"], ParseXMPDate)
+		}
+	}
+
+	// The root of the page tree counts the pages of the whole document
+	if catalog, ok := objects[pdfLastRef(data, "Root")]; ok {
+		if pages, ok := objects[pdfLastRef(catalog, "Pages")]; ok {
+			doc.Pages, _ = strconv.Atoi(string(pdfValue(pages, "Count", objects)))
+		}
+	}
+
+	if doc.Pages == 0 {
+		for _, body := range objects {
+			if pdfPagePattern.Match(body) {
+				doc.Pages++
+			}
+		}
+	}
+
+	return nil
+}
+
+// Returns the bodies of the indirect objects of the PDF by object number,
+// where later objects replace earlier ones as in incremental updates.
+func pdfObjects(data []byte) map[int][]byte {
+	objects := make(map[int][]byte)
+	streams := make([][]byte, 0)
+
+	matches := pdfObjectPattern.FindAllSubmatchIndex(data, -1)
+	for idx, match := range matches {
+		num, _ := strconv.Atoi(string(data[match[2]:match[3]]))
+
+		end := len(data)
+		if idx+1 < len(matches) {
+			end = matches[idx+1][0]
+		}
+
+		body := data[match[1]:end]
+		if stop := bytes.Index(body, []byte("endobj")); stop >= 0 {
+			body = body[:stop]
+		}
+
+		objects[num] = body
+		if bytes.Contains(body, []byte("/ObjStm")) {
+			streams = append(streams, body)
+		}
+	}
+
+	// Objects in object streams are stored after a header of number and
+	// offset pairs, with the offsets relative to the First entry
+	for _, body := range streams {
+		count, _ := strconv.Atoi(string(pdfValue(body, "N", nil)))
+		first, _ := strconv.Atoi(string(pdfValue(body, "First", nil)))
+
+		decoded := pdfStream(body)
+		if decoded == nil || first > len(decoded) {
+			continue
+		}
+
+		header := strings.Fields(string(decoded[:first]))
+		for idx := 0; idx < count && 2*idx+1 < len(header); idx++ {
+			num, _ := strconv.Atoi(header[2*idx])
+			start, _ := strconv.Atoi(header[2*idx+1])
+
+			end := len(decoded) - first
+			if 2*idx+3 < len(header) {
+				end, _ = strconv.Atoi(header[2*idx+3])
+			}
+
+			if _, ok := objects[num]; !ok && start <= end && first+end <= len(decoded) {
+				objects[num] = decoded[first+start : first+end]
+			}
+		}
+	}
+
+	return objects
+}
+
+// Returns the decoded data of a stream object, if it is Flate encoded or
+// not encoded at all
+func pdfStream(body []byte) []byte {
+	start := bytes.Index(body, []byte("stream"))
+	if start < 0 {
+		return nil
+	}
+
+	stream := bytes.TrimLeft(body[start+len("stream"):], "\r")
+	stream = bytes.TrimPrefix(stream, []byte("\n"))
+	if end := bytes.Index(stream, []byte("endstream")); end >= 0 {
+		stream = stream[:end]
+	}
+
+	if !bytes.Contains(body[:start], []byte("/Filter")) {
+		return stream
+	}
+
+	if !bytes.Contains(body[:start], []byte("/FlateDecode")) {
+		return nil
+	}
+
+	reader, err := zlib.NewReader(bytes.NewReader(stream))
+	if err != nil {
+		return nil
+	}
+	defer reader.Close()
+
+	// Streams often include an end of line before endstream
+	decoded, err := ioutil.ReadAll(reader)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil
+	}
+
+	return decoded
+}
+
+// Extracts the text shown by the content streams of a PDF in the order of
+// their objects. Text in fonts with custom encodings (e.g. most CID fonts)
+// can't be decoded without the font, so it is skipped.
+func PDFText(data []byte) string {
+	objects := pdfObjects(data)
+	nums := make([]int, 0, len(objects))
+	for num := range objects {
+		nums = append(nums, num)
+	}
+	sort.Ints(nums)
+
+	text := new(bytes.Buffer)
+	for _, num := range nums {
+		body := objects[num]
+		if bytes.Contains(body, []byte("/ObjStm")) || bytes.Contains(body, []byte("/Subtype")) {
+			continue // Object streams, images, fonts and metadata
+		}
+
+		if content := pdfStream(body); bytes.Contains(content, []byte("BT")) {
+			pdfShowText(text, content)
+		}
+	}
+
+	return text.String()
+}
+
+// Writes the strings shown by the text operators of a content stream,
+// separating lines by newlines and widely spaced strings by spaces
+func pdfShowText(w *bytes.Buffer, content []byte) {
+	delimited := func(idx int) bool {
+		return idx < 0 || idx >= len(content) || strings.IndexByte(" \t\r\n[]()<>/", content[idx]) >= 0
+	}
+
+	for idx := 0; idx < len(content); idx++ {
+		switch c := content[idx]; {
+		case c == '(':
+			str := pdfLiteral(content[idx:])
+			w.WriteString(pdfString(str))
+			idx += len(str) - 1
+
+		case c == '<' && idx+1 < len(content) && content[idx+1] == '<':
+			idx++ // Skip the start of a dictionary
+
+		case c == '<':
+			end := bytes.IndexByte(content[idx:], '>')
+			if end < 0 {
+				return
+			}
+
+			// Hex strings are usually glyph ids, only keep printable text
+			if str := pdfString(content[idx : idx+end+1]); isPrintable(str) {
+				w.WriteString(str)
+			}
+			idx += end
+
+		case c == '-' && !delimited(idx-1):
+			continue
+
+		case c == '-':
+			// Large negative adjustments in TJ arrays separate words
+			end := idx + 1
+			for end < len(content) && (content[end] >= '0' && content[end] <= '9' || content[end] == '.') {
+				end++
+			}
+			if num, err := strconv.ParseFloat(string(content[idx+1:end]), 64); err == nil && num >= 200 {
+				w.WriteByte(' ')
+			}
+			idx = end - 1
+
+		case c == 'T' && delimited(idx-1) && idx+2 <= len(content) && delimited(idx+2):
+			switch content[idx+1] {
+			case 'd', 'D', 'm', '*':
+				w.WriteByte('\n')
+			}
+
+		case c == 'E' && delimited(idx-1) && idx+2 <= len(content) && content[idx+1] == 'T' && delimited(idx+2):
+			w.WriteByte('\n')
+
+		case c == '\'' || c == '"':
+			w.WriteByte('\n')
+		}
+	}
+}
+
+// Checks if the string only holds printable characters (or whitespace)
+func isPrintable(str string) bool {
+	for _, char := range str {
+		if !unicode.IsPrint(char) && !unicode.IsSpace(char) {
+			return false
+		}
+	}
+
+	return str != ""
+}
+
+// Returns the object number of the last reference to the key, e.g. /Info
+func pdfLastRef(data []byte, key string) int {
+	pattern := regexp.MustCompile(`/` + key + pdfRefPattern)
+	matches := pattern.FindAllSubmatch(data, -1)
+	if len(matches) == 0 {
+		return 0
+	}
+
+	num, _ := strconv.Atoi(string(matches[len(matches)-1][1]))
+	return num
+}
+
+// Returns the raw value of the key in the dictionary, resolving indirect
+// references to the objects (if given)
+func pdfValue(dict []byte, key string, objects map[int][]byte) []byte {
+	pattern := regexp.MustCompile(`/` + key + `(?:[\s/(<\[]|$)`)
+	loc := pattern.FindIndex(dict)
+	if loc == nil {
+		return nil
+	}
+
+	// The match includes the delimiter that starts the value, if any
+	value := bytes.TrimLeft(dict[loc[0]+len(key)+1:], " \t\r\n")
+	if len(value) == 0 {
+		return nil
+	}
+
+	switch value[0] {
+	case '(':
+		return pdfLiteral(value)
+
+	case '<':
+		if end := bytes.IndexByte(value, '>'); end >= 0 {
+			return value[:end+1]
+		}
+		return value
+	}
+
+	end := bytes.IndexAny(value, "/>]\r\n")
+	if end < 0 {
+		end = len(value)
+	}
+	token := bytes.TrimSpace(value[:end])
+
+	if objects != nil {
+		if fields := strings.Fields(string(token)); len(fields) == 3 && fields[2] == "R" {
+			num, _ := strconv.Atoi(fields[0])
+			return bytes.TrimSpace(objects[num])
+		}
+	}
+
+	return token
+}
+
+// Returns the literal string, including its balanced parentheses, that the
+// data starts with
+func pdfLiteral(data []byte) []byte {
+	depth := 0
+	for idx := 0; idx < len(data); idx++ {
+		switch data[idx] {
+		case '\\':
+			idx++
+		case '(':
+			depth++
+		case ')':
+			if depth--; depth == 0 {
+				return data[:idx+1]
+			}
+		}
+	}
+
+	return data
+}
+
+// Decodes a PDF literal (...) or hex <...> string, which is either UTF-16
+// with a byte order mark, UTF-8 with a byte order mark or PDFDocEncoding.
+func pdfString(value []byte) string {
+	if len(value) < 2 {
+		return ""
+	}
+
+	var raw []byte
+	switch value[0] {
+	case '(':
+		raw = pdfUnescape(value[1 : len(value)-1])
+	case '<':
+		hex := make([]byte, 0, len(value))
+		for _, c := range value[1 : len(value)-1] {
+			if strings.IndexByte("0123456789abcdefABCDEF", c) >= 0 {
+				hex = append(hex, c)
+			}
+		}
+		if len(hex)%2 == 1 {
+			hex = append(hex, '0')
+		}
+
+		for idx := 0; idx < len(hex); idx += 2 {
+			num, _ := strconv.ParseUint(string(hex[idx:idx+2]), 16, 8)
+			raw = append(raw, byte(num))
+		}
+	default:
+		return ""
+	}
+
+	switch {
+	case bytes.HasPrefix(raw, []byte{0xfe, 0xff}):
+		return decodeUTF16(2, raw[2:])
+	case bytes.HasPrefix(raw, []byte{0xef, 0xbb, 0xbf}):
+		return string(raw[3:])
+	default:
+		// PDFDocEncoding matches ISO-8859-1 for the printable characters
+		return decodeID3Text(0, raw)
+	}
+}
+
+// Resolves the escape sequences of a PDF literal string
+func pdfUnescape(data []byte) []byte {
+	escapes := map[byte]byte{'n': '\n', 'r': '\r', 't': '\t', 'b': '\b', 'f': '\f'}
+	raw := make([]byte, 0, len(data))
+
+	for idx := 0; idx < len(data); idx++ {
+		if data[idx] != '\\' || idx+1 == len(data) {
+			raw = append(raw, data[idx])
+			continue
+		}
+
+		idx++
+		switch c := data[idx]; {
+		case escapes[c] != 0:
+			raw = append(raw, escapes[c])
+		case c >= '0' && c <= '7':
+			end := idx + 1
+			for end < len(data) && end < idx+3 && data[end] >= '0' && data[end] <= '7' {
+				end++
+			}
+			num, _ := strconv.ParseUint(string(data[idx:end]), 8, 8)
+			raw = append(raw, byte(num))
+			idx = end - 1
+		case c == '\r' || c == '\n':
+			// A line continuation, which also consumes a CRLF
+			if c == '\r' && idx+1 < len(data) && data[idx+1] == '\n' {
+				idx++
+			}
+		default:
+			raw = append(raw, c)
+		}
+	}
+
+	return raw
+}
+
+// Parses a PDF date, e.g. D:20150614093000+02'00', which may omit any of
+// its trailing parts
+func ParsePDFDate(value string) (time.Time, bool) {
+	value = strings.TrimPrefix(strings.TrimSpace(value), "D:")
+
+	digits := value
+	if idx := strings.IndexAny(value, "Z+-"); idx >= 0 {
+		digits = value[:idx]
+	}
+
+	if len(digits) < 4 || len(digits)%2 != 0 || len(digits) > 14 {
+		return time.Time{}, false
+	}
+
+	// Pad the omitted month and day with ones and the time with zeros
+	padded := digits + "0101000000"[len(digits)-4:]
+	date, err := time.Parse("20060102150405", padded)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	zone := strings.Replace(strings.TrimSuffix(value[len(digits):], "'"), "'", "", -1)
+	if len(zone) == 5 {
+		if offset, err := time.Parse("-0700", zone); err == nil {
+			_, secs := offset.Zone()
+			date = date.Add(-time.Duration(secs) * time.Second)
+		}
+	}
+
+	return date.UTC(), true
+}
+
+// Reads the document into memory, or its beginning and end if it is larger
+// than MaxDocumentRead since that's where the metadata is usually written.
+func readDocument(path string) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	finfo, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	if finfo.Size() <= MaxDocumentRead {
+		return ioutil.ReadAll(file)
+	}
+
+	data := make([]byte, MaxDocumentRead)
+	half := MaxDocumentRead / 2
+	if _, err := file.ReadAt(data[:half], 0); err != nil {
+		return nil, err
+	}
+
+	if _, err := file.ReadAt(data[half:], finfo.Size()-int64(half)); err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+//=============================================================================
+
+// Parses the core and extended properties of an Office Open XML package or
+// the meta.xml of an OpenDocument package
+func (doc *DocumentMeta) parseArchive() error {
+	archive, err := zip.OpenReader(doc.Path)
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+
+	parts := make(map[string]map[string]string)
+	for _, file := range archive.File {
+		switch file.Name {
+		case "docProps/core.xml", "docProps/app.xml", "meta.xml":
+			reader, err := file.Open()
+			if err != nil {
+				return err
+			}
+
+			parts[file.Name] = readXMLProperties(reader)
+			reader.Close()
+		}
+	}
+
+	if core, ok := parts["docProps/core.xml"]; ok {
+		doc.setTag("Title", core["title"])
+		doc.setTag("Author", core["creator"])
+		doc.setTag("LastModifiedBy", core["lastModifiedBy"])
+		doc.setTag("Subject", core["subject"])
+		doc.setTag("Keywords", core["keywords"])
+		doc.setDate("DateCreated", core["created"], ParseXMPDate)
+		doc.setDate("DateModified", core["modified"], ParseXMPDate)
+
+		app := parts["docProps/app.xml"]
+		doc.setTag("Creator", strings.TrimSpace(app["Application"]+" "+app["AppVersion"]))
+		for _, key := range []string{"Pages", "Slides"} {
+			if pages, err := strconv.Atoi(app[key]); err == nil && pages > 0 {
+				doc.Pages = pages
+			}
+		}
+
+		return nil
+	}
+
+	if meta, ok := parts["meta.xml"]; ok {
+		doc.setTag("Title", meta["title"])
+		doc.setTag("Author", meta["initial-creator"])
+		doc.setTag("LastModifiedBy", meta["creator"])
+		doc.setTag("Subject", meta["subject"])
+		doc.setTag("Keywords", meta["keyword"])
+		doc.setTag("Creator", meta["generator"])
+		doc.setDate("DateCreated", meta["creation-date"], ParseXMPDate)
+		doc.setDate("DateModified", meta["date"], ParseXMPDate)
+		doc.Pages, _ = strconv.Atoi(meta["page-count"])
+
+		return nil
+	}
+
+	return errors.New("no document properties in the archive")
+}
+
+// Reads the text and attributes of the elements of an XML document into a
+// map keyed by their local names, keeping the first value of each name and
+// joining repeated elements (e.g. keywords) with "; "
+func readXMLProperties(r io.Reader) map[string]string {
+	props := make(map[string]string)
+	seen := make(map[string]bool)
+	stack := make([]string, 0)
+
+	decoder := xml.NewDecoder(r)
+	decoder.Strict = false
+
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return props
+		}
+
+		switch token := token.(type) {
+		case xml.StartElement:
+			for _, attr := range token.Attr {
+				if _, ok := props[attr.Name.Local]; !ok && attr.Name.Space != "xmlns" {
+					props[attr.Name.Local] = attr.Value
+				}
+			}
+			stack = append(stack, token.Name.Local)
+
+		case xml.EndElement:
+			if len(stack) > 0 {
+				seen[stack[len(stack)-1]] = true
+				stack = stack[:len(stack)-1]
+			}
+
+		case xml.CharData:
+			value := strings.TrimSpace(string(token))
+			if value == "" || len(stack) == 0 {
+				continue
+			}
+
+			name := stack[len(stack)-1]
+			if prev, ok := props[name]; ok && seen[name] {
+				props[name] = prev + "; " + value
+			} else {
+				props[name] = prev + value
+			}
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package crate_test
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/bbengfort/crate/crate"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// Builds a two page PDF with an info dictionary and an XMP packet
+func mkpdf() []byte {
+	xmp := `<x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+<rdf:Description rdf:about="" xmlns:xmp="http://ns.adobe.com/xap/1.0/" xmp:CreatorTool="Writer">
+<xmp:ModifyDate>2015-06-15T10:00:00Z</xmp:ModifyDate></rdf:Description></rdf:RDF></x:xmpmeta>`
+
+	return []byte(`%PDF-1.4
+1 0 obj << /Type /Catalog /Pages 2 0 R /Metadata 6 0 R >> endobj
+2 0 obj << /Type /Pages /Kids [3 0 R 4 0 R] /Count 2 >> endobj
+3 0 obj << /Type /Page /Parent 2 0 R >> endobj
+4 0 obj << /Type /Page /Parent 2 0 R >> endobj
+5 0 obj << /Title <FEFF00440072006100630075006C0061> /Author (Bram Stoker \(1897\)) /Creator 7 0 R
+/CreationDate (D:20150614093000+02'00') >> endobj
+6 0 obj << /Type /Metadata /Subtype /XML /Length ` + fmt.Sprint(len(xmp)) + ` >> stream
+` + xmp + `
+endstream endobj
+7 0 obj (Caf\351) endobj
+trailer << /Size 8 /Root 1 0 R /Info 5 0 R >>
+%%EOF
+`)
+}
+
+// Builds a PDF 1.5 with its info dictionary in a compressed object stream
+func mkpdfObjStm() []byte {
+	objects := "<< /Title (Compressed) /Author (Mina Harker) >> << /Type /Pages /Count 5 >>"
+	header := fmt.Sprintf("3 0 4 %d ", len("<< /Title (Compressed) /Author (Mina Harker) >> "))
+	stream := new(bytes.Buffer)
+	writer := zlib.NewWriter(stream)
+	writer.Write([]byte(header + objects))
+	writer.Close()
+
+	return []byte(fmt.Sprintf(`%%PDF-1.5
+1 0 obj << /Type /Catalog /Pages 4 0 R >> endobj
+2 0 obj << /Type /ObjStm /N 2 /First %d /Filter /FlateDecode /Length %d >> stream
+%s
+endstream endobj
+5 0 obj << /Type /XRef /Root 1 0 R /Info 3 0 R >> stream
+endstream endobj
+%%%%EOF
+`, len(header), stream.Len(), stream.String()))
+}
+
+// Builds a zip archive of the named parts
+func mkzip(parts ...string) []byte {
+	buf := new(bytes.Buffer)
+	archive := zip.NewWriter(buf)
+	for idx := 0; idx+1 < len(parts); idx += 2 {
+		writer, _ := archive.Create(parts[idx])
+		writer.Write([]byte(parts[idx+1]))
+	}
+	archive.Close()
+	return buf.Bytes()
+}
+
+var _ = Describe("Document", func() {
+
+	var testRoot string // Temporary directory for the synthetic documents
+
+	// Writes the data to the temporary directory and extracts it
+	extract := func(name, mimetype string, data []byte) *DocumentMeta {
+		fm := new(FileMeta)
+		fm.Path = writeFixture(testRoot, name, data)
+		fm.MimeType = mimetype
+
+		doc, ok := ConvertDocumentMeta(fm)
+		Ω(ok).Should(BeTrue())
+		Ω(new(DocumentExtractor).Extract(doc)).Should(Succeed())
+		return doc
+	}
+
+	BeforeEach(func() {
+		var err error
+		testRoot, err = ioutil.TempDir("", "ginkgo-")
+		Ω(err).Should(BeNil())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(testRoot)
+	})
+
+	It("should parse PDF dates", func() {
+		date, ok := ParsePDFDate("D:20150614093000+02'00'")
+		Ω(ok).Should(BeTrue())
+		Ω(date).Should(Equal(time.Date(2015, 6, 14, 7, 30, 0, 0, time.UTC)))
+
+		date, ok = ParsePDFDate("D:201506")
+		Ω(ok).Should(BeTrue())
+		Ω(date).Should(Equal(time.Date(2015, 6, 1, 0, 0, 0, 0, time.UTC)))
+
+		_, ok = ParsePDFDate("yesterday")
+		Ω(ok).Should(BeFalse())
+	})
+
+	It("should create a DocumentMeta record for PDF files", func() {
+		path := filepath.Join(testRoot, "dracula.pdf")
+		Ω(ioutil.WriteFile(path, mkpdf(), 0644)).Should(Succeed())
+
+		fm := new(FileMeta)
+		fm.Path = path
+		Ω(NewRecord(fm)).Should(BeAssignableToTypeOf(new(DocumentMeta)))
+	})
+
+	It("should extract the PDF info dictionary, XMP and page count", func() {
+		doc := extract("dracula.pdf", "application/pdf", mkpdf())
+
+		Ω(doc.Pages).Should(Equal(2))
+		Ω(doc.Tag("Title")).Should(Equal("Dracula"))
+		Ω(doc.Tag("Author")).Should(Equal("Bram Stoker (1897)"))
+		Ω(doc.Tag("Creator")).Should(Equal("Café"))
+		Ω(doc.Tag("DateCreated")).Should(Equal("2015-06-14T07:30:00+00:00"))
+		Ω(doc.Tag("DateModified")).Should(Equal("2015-06-15T10:00:00+00:00"))
+	})
+
+	It("should extract PDF objects from compressed object streams", func() {
+		doc := extract("compressed.pdf", "application/pdf", mkpdfObjStm())
+
+		Ω(doc.Pages).Should(Equal(5))
+		Ω(doc.Tag("Title")).Should(Equal("Compressed"))
+		Ω(doc.Tag("Author")).Should(Equal("Mina Harker"))
+	})
+
+	It("should extract Office Open XML document properties", func() {
+		data := mkzip(
+			"docProps/core.xml", `<?xml version="1.0" encoding="UTF-8"?>
+<cp:coreProperties xmlns:cp="http://schemas.openxmlformats.org/package/2006/metadata/core-properties"
+  xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:dcterms="http://purl.org/dc/terms/">
+  <dc:title>Quarterly Report</dc:title><dc:creator>Jonathan Harker</dc:creator>
+  <cp:lastModifiedBy>Van Helsing</cp:lastModifiedBy>
+  <dcterms:created>2015-06-14T09:30:00Z</dcterms:created>
+</cp:coreProperties>`,
+			"docProps/app.xml", `<Properties><Application>Microsoft Office Word</Application><Pages>12</Pages></Properties>`)
+
+		doc := extract("report.docx", "application/vnd.openxmlformats-officedocument.wordprocessingml.document", data)
+
+		Ω(doc.Pages).Should(Equal(12))
+		Ω(doc.Tag("Title")).Should(Equal("Quarterly Report"))
+		Ω(doc.Tag("Author")).Should(Equal("Jonathan Harker"))
+		Ω(doc.Tag("LastModifiedBy")).Should(Equal("Van Helsing"))
+		Ω(doc.Tag("Creator")).Should(Equal("Microsoft Office Word"))
+		Ω(doc.Tag("DateCreated")).Should(Equal("2015-06-14T09:30:00+00:00"))
+	})
+
+	It("should extract OpenDocument meta data", func() {
+		data := mkzip(
+			"mimetype", "application/vnd.oasis.opendocument.text",
+			"meta.xml", `<office:document-meta xmlns:office="urn:oasis:names:tc:opendocument:xmlns:office:1.0"
+  xmlns:meta="urn:oasis:names:tc:opendocument:xmlns:meta:1.0" xmlns:dc="http://purl.org/dc/elements/1.1/">
+  <office:meta><meta:generator>LibreOffice/5.0</meta:generator><dc:title>Journal</dc:title>
+  <meta:initial-creator>Mina Harker</meta:initial-creator><dc:creator>Lucy</dc:creator>
+  <meta:keyword>vampires</meta:keyword><meta:keyword>travel</meta:keyword>
+  <meta:creation-date>2015-06-14T09:30:00</meta:creation-date>
+  <meta:document-statistic meta:page-count="3" meta:word-count="812"/></office:meta>
+</office:document-meta>`)
+
+		doc := extract("journal.odt", "application/vnd.oasis.opendocument.text", data)
+
+		Ω(doc.Pages).Should(Equal(3))
+		Ω(doc.Tag("Title")).Should(Equal("Journal"))
+		Ω(doc.Tag("Author")).Should(Equal("Mina Harker"))
+		Ω(doc.Tag("LastModifiedBy")).Should(Equal("Lucy"))
+		Ω(doc.Tag("Keywords")).Should(Equal("vampires; travel"))
+		Ω(doc.Tag("Creator")).Should(Equal("LibreOffice/5.0"))
+		Ω(doc.Tag("DateCreated")).Should(Equal("2015-06-14T09:30:00+00:00"))
+
+		query, err := ParseQuery("Author:harker")
+		Ω(err).Should(BeNil())
+		Ω(query.Match(doc)).Should(BeTrue())
+	})
+
+})
@@ -0,0 +1,294 @@
+// Exports the locations of geotagged records as GeoJSON or KML
+
+package crate
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	FormatGeoJSON = "geojson" // RFC 7946 FeatureCollection of Points
+	FormatKML     = "kml"     // KML 2.2 Document of Placemarks
+	UndatedDay    = "undated" // The cluster of records without a DateTaken
+)
+
+//=============================================================================
+
+// A located record (or the centroid of a day of records) to be exported
+type Placemark struct {
+	Latitude   float64   // Latitude of the record or cluster centroid
+	Longitude  float64   // Longitude of the record or cluster centroid
+	Name       string    // The base name of the file or the day of the cluster
+	Path       string    // The path of the file (empty for clusters)
+	Signature  string    // The signature of the file (empty for clusters)
+	Taken      time.Time // The DateTaken of the file (zero for clusters)
+	Camera     string    // The camera make and model
+	Thumbnail  [2]int64  // Offset and length of the embedded EXIF thumbnail
+	Day        string    // The day the record was taken, e.g. 2015-01-05
+	Count      int       // The number of records in the placemark
+	Signatures []string  // The signatures of the clustered records
+	Companions []string  // The paths of the other files of the record's asset
+}
+
+// Creates the placemarks for the located records, ordered by date taken.
+// Records without a location are skipped since they can't be put on a map.
+// The members of the assets, by their id, are listed as their companions.
+func Placemarks(records []FilePath, assets map[string]*Asset) []*Placemark {
+	marks := make([]*Placemark, 0, len(records))
+
+	for _, record := range records {
+		tagged, ok := record.(TaggedPath)
+		if !ok {
+			continue
+		}
+
+		lat, lon, ok := tagged.Location()
+		if !ok {
+			continue
+		}
+
+		fm := record.File()
+		mark := &Placemark{Latitude: lat, Longitude: lon, Count: 1}
+		mark.Name = fm.Name
+		mark.Path = fm.Path
+		mark.Signature = fm.Signature
+		mark.Camera = strings.TrimSpace(tagged.Tag("CameraMake") + " " + tagged.Tag("CameraModel"))
+		mark.Signatures = []string{fm.Signature}
+		mark.Day = UndatedDay
+
+		if img, ok := record.(*ImageMeta); ok && img.ThumbnailLength > 0 {
+			mark.Thumbnail = [2]int64{img.ThumbnailOffset, img.ThumbnailLength}
+		}
+
+		if taken, ok := tagged.Taken(); ok {
+			mark.Taken = taken
+			mark.Day = taken.UTC().Format("2006-01-02")
+		}
+
+		if asset, ok := assets[fm.Signature]; ok {
+			for _, companion := range asset.Companions(fm.Signature) {
+				mark.Companions = append(mark.Companions, companion.Path)
+			}
+		}
+
+		marks = append(marks, mark)
+	}
+
+	sort.Sort(byTaken(marks))
+	return marks
+}
+
+// Groups placemarks by the day they were taken into a placemark per day at
+// the centroid of the day's locations.
+func ClusterByDay(marks []*Placemark) []*Placemark {
+	clusters := make([]*Placemark, 0)
+	index := make(map[string]*Placemark)
+
+	for _, mark := range marks {
+		cluster, ok := index[mark.Day]
+		if !ok {
+			cluster = &Placemark{Name: mark.Day, Day: mark.Day}
+			index[mark.Day] = cluster
+			clusters = append(clusters, cluster)
+		}
+
+		// Keep a running mean of the locations as the centroid
+		cluster.Count++
+		cluster.Latitude += (mark.Latitude - cluster.Latitude) / float64(cluster.Count)
+		cluster.Longitude += (mark.Longitude - cluster.Longitude) / float64(cluster.Count)
+		cluster.Signatures = append(cluster.Signatures, mark.Signature)
+	}
+
+	return clusters
+}
+
+// Checks that the format is one that records can be exported to
+func CheckExportFormat(format string) error {
+	switch strings.ToLower(format) {
+	case FormatGeoJSON, FormatKML:
+		return nil
+	default:
+		return fmt.Errorf("unknown export format \"%s\", use %s or %s", format, FormatGeoJSON, FormatKML)
+	}
+}
+
+// Writes the located records to the writer in the specified format, with
+// the companions of the records in the assets, see CollapseCompanions
+func Export(w io.Writer, records []FilePath, assets map[string]*Asset, format string, clustered bool) error {
+	if err := CheckExportFormat(format); err != nil {
+		return err
+	}
+
+	marks := Placemarks(records, assets)
+	if clustered {
+		marks = ClusterByDay(marks)
+	}
+
+	if strings.ToLower(format) == FormatKML {
+		return WriteKML(w, marks)
+	}
+
+	return WriteGeoJSON(w, marks)
+}
+
+//=============================================================================
+
+type geoJSONCollection struct {
+	Type     string            `json:"type"`
+	Features []*geoJSONFeature `json:"features"`
+}
+
+type geoJSONFeature struct {
+	Type       string                 `json:"type"`
+	Geometry   geoJSONPoint           `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+type geoJSONPoint struct {
+	Type        string    `json:"type"`
+	Coordinates []float64 `json:"coordinates"`
+}
+
+// Writes the placemarks as a GeoJSON FeatureCollection of Points
+func WriteGeoJSON(w io.Writer, marks []*Placemark) error {
+	collection := &geoJSONCollection{"FeatureCollection", make([]*geoJSONFeature, 0, len(marks))}
+
+	for _, mark := range marks {
+		feature := &geoJSONFeature{Type: "Feature"}
+		feature.Geometry = geoJSONPoint{"Point", []float64{mark.Longitude, mark.Latitude}}
+		feature.Properties = mark.properties()
+		collection.Features = append(collection.Features, feature)
+	}
+
+	data, err := json.MarshalIndent(collection, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+//=============================================================================
+
+type kmlRoot struct {
+	XMLName  xml.Name    `xml:"http://www.opengis.net/kml/2.2 kml"`
+	Document kmlDocument `xml:"Document"`
+}
+
+type kmlDocument struct {
+	Name       string          `xml:"name"`
+	Placemarks []*kmlPlacemark `xml:"Placemark"`
+}
+
+type kmlPlacemark struct {
+	Name        string    `xml:"name"`
+	Description string    `xml:"description,omitempty"`
+	When        string    `xml:"TimeStamp>when,omitempty"`
+	Data        []kmlData `xml:"ExtendedData>Data"`
+	Coordinates string    `xml:"Point>coordinates"`
+}
+
+type kmlData struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value"`
+}
+
+// Writes the placemarks as a KML Document of Placemarks
+func WriteKML(w io.Writer, marks []*Placemark) error {
+	root := new(kmlRoot)
+	root.Document.Name = "crate"
+
+	for _, mark := range marks {
+		pm := &kmlPlacemark{Name: mark.Name, Description: mark.Path}
+		pm.When = JSONStamp(mark.Taken)
+		pm.Coordinates = strconv.FormatFloat(mark.Longitude, 'f', -1, 64) + "," +
+			strconv.FormatFloat(mark.Latitude, 'f', -1, 64)
+
+		props := mark.properties()
+		keys := make([]string, 0, len(props))
+		for key := range props {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			value := props[key]
+			if list, ok := value.([]string); ok {
+				value = strings.Join(list, " ")
+			}
+			pm.Data = append(pm.Data, kmlData{key, fmt.Sprint(value)})
+		}
+
+		root.Document.Placemarks = append(root.Document.Placemarks, pm)
+	}
+
+	data, err := xml.MarshalIndent(root, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+//=============================================================================
+
+// Returns the exported properties of a placemark, omitting empty values
+func (mark *Placemark) properties() map[string]interface{} {
+	props := make(map[string]interface{})
+
+	// Clusters are the only placemarks without a signature
+	if mark.Signature == "" {
+		props["day"] = mark.Day
+		props["count"] = mark.Count
+		props["signatures"] = mark.Signatures
+		return props
+	}
+
+	props["path"] = mark.Path
+	props["signature"] = mark.Signature
+	if !mark.Taken.IsZero() {
+		props["DateTaken"] = JSONStamp(mark.Taken)
+	}
+	if mark.Camera != "" {
+		props["camera"] = mark.Camera
+	}
+	if mark.Thumbnail[1] > 0 {
+		props["thumbnail_offset"] = mark.Thumbnail[0]
+		props["thumbnail_length"] = mark.Thumbnail[1]
+	}
+	if len(mark.Companions) > 0 {
+		props["companions"] = mark.Companions
+	}
+
+	return props
+}
+
+// Sorts placemarks by their date taken, undated placemarks last
+type byTaken []*Placemark
+
+func (s byTaken) Len() int      { return len(s) }
+func (s byTaken) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byTaken) Less(i, j int) bool {
+	if s[i].Taken.IsZero() != s[j].Taken.IsZero() {
+		return !s[i].Taken.IsZero()
+	}
+
+	if !s[i].Taken.Equal(s[j].Taken) {
+		return s[i].Taken.Before(s[j].Taken)
+	}
+
+	return s[i].Path < s[j].Path
+}
@@ -0,0 +1,124 @@
+package crate_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+
+	. "github.com/bbengfort/crate/crate"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Export", func() {
+
+	var records []FilePath // Located and unlocated records to export
+
+	located := func(name, signature, taken, lat, lon string) *ImageMeta {
+		img := new(ImageMeta)
+		img.Path = "/photos/" + name
+		img.Name = name
+		img.Signature = signature
+		img.Tags = map[string]string{
+			"DateTaken":   taken,
+			"Latitude":    lat,
+			"Longitude":   lon,
+			"CameraMake":  "LGE",
+			"CameraModel": "Nexus 5",
+		}
+		return img
+	}
+
+	BeforeEach(func() {
+		notes := new(FileMeta)
+		notes.Path = "/documents/notes.txt"
+		notes.Signature = "notes"
+
+		records = []FilePath{
+			located("c.jpg", "c", "2015-01-06T10:00:00+00:00", "32", "-9"),
+			located("b.jpg", "b", "2015-01-05T12:00:00+00:00", "31.6", "-9.6"),
+			located("a.jpg", "a", "2015-01-05T09:00:00+00:00", "31.4", "-9.8"),
+			located("d.jpg", "d", "", "30", "-8"),
+			ImageFromPath("../fixtures/ferry.jpg"),
+			notes,
+		}
+	})
+
+	It("should create placemarks for located records by date taken", func() {
+		marks := Placemarks(records, nil)
+		Ω(marks).Should(HaveLen(4))
+		Ω(marks[0].Signature).Should(Equal("a"))
+		Ω(marks[0].Camera).Should(Equal("LGE Nexus 5"))
+		Ω(marks[2].Day).Should(Equal("2015-01-06"))
+		Ω(marks[3].Day).Should(Equal(UndatedDay))
+	})
+
+	It("should cluster placemarks per day at the centroid", func() {
+		clusters := ClusterByDay(Placemarks(records, nil))
+		Ω(clusters).Should(HaveLen(3))
+		Ω(clusters[0].Count).Should(Equal(2))
+		Ω(clusters[0].Latitude).Should(BeNumerically("~", 31.5, 1e-9))
+		Ω(clusters[0].Longitude).Should(BeNumerically("~", -9.7, 1e-9))
+		Ω(clusters[0].Signatures).Should(Equal([]string{"a", "b"}))
+	})
+
+	It("should export a GeoJSON feature collection", func() {
+		records[2].(*ImageMeta).ThumbnailOffset = 1024
+		records[2].(*ImageMeta).ThumbnailLength = 4096
+
+		buf := new(bytes.Buffer)
+		Ω(Export(buf, records, nil, "GeoJSON", false)).Should(BeNil())
+
+		var collection map[string]interface{}
+		Ω(json.Unmarshal(buf.Bytes(), &collection)).Should(BeNil())
+		Ω(collection["type"]).Should(Equal("FeatureCollection"))
+
+		features := collection["features"].([]interface{})
+		Ω(features).Should(HaveLen(4))
+
+		feature := features[0].(map[string]interface{})
+		geometry := feature["geometry"].(map[string]interface{})
+		Ω(geometry["coordinates"]).Should(Equal([]interface{}{-9.8, 31.4}))
+
+		props := feature["properties"].(map[string]interface{})
+		Ω(props["path"]).Should(Equal("/photos/a.jpg"))
+		Ω(props["DateTaken"]).Should(Equal("2015-01-05T09:00:00+00:00"))
+		Ω(props["thumbnail_offset"]).Should(Equal(1024.0))
+		Ω(props["thumbnail_length"]).Should(Equal(4096.0))
+
+		props = features[1].(map[string]interface{})["properties"].(map[string]interface{})
+		Ω(props).ShouldNot(HaveKey("thumbnail_offset"))
+	})
+
+	It("should list the companions of the records in their placemarks", func() {
+		assets := map[string]*Asset{"a": {ID: "a", Members: []*Companion{
+			{"a", "/photos/a.jpg", RoleImage},
+			{"a-mov", "/photos/a.mov", RoleLive},
+		}}}
+
+		marks := Placemarks(records, assets)
+		Ω(marks[0].Companions).Should(Equal([]string{"/photos/a.mov"}))
+		Ω(marks[1].Companions).Should(BeEmpty())
+
+		buf := new(bytes.Buffer)
+		Ω(Export(buf, records, assets, FormatKML, false)).Should(BeNil())
+		Ω(buf.String()).Should(ContainSubstring("<Data name=\"companions\">"))
+	})
+
+	It("should export clustered KML placemarks", func() {
+		buf := new(bytes.Buffer)
+		Ω(Export(buf, records, nil, FormatKML, true)).Should(BeNil())
+		Ω(buf.String()).Should(HavePrefix(xml.Header))
+		Ω(buf.String()).Should(ContainSubstring("<coordinates>-9.7,31.5</coordinates>"))
+		Ω(buf.String()).Should(ContainSubstring("<Data name=\"count\">"))
+		Ω(bytes.Count(buf.Bytes(), []byte("<Placemark>"))).Should(Equal(3))
+	})
+
+	It("should not export an unknown format", func() {
+		Ω(Export(new(bytes.Buffer), records, nil, "shapefile", false)).ShouldNot(BeNil())
+		Ω(CheckExportFormat("shapefile")).ShouldNot(BeNil())
+		Ω(CheckExportFormat("KML")).Should(BeNil())
+	})
+
+})
@@ -0,0 +1,157 @@
+// Registry of meta data extractors keyed by the MIME types they claim
+
+package crate
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Returned when re-extracting a record whose file contents have changed
+var ErrFileChanged = errors.New("file has changed since the record was stored")
+
+//=============================================================================
+
+// Contributes typed meta data to the records of the MIME types it claims
+type Extractor interface {
+	Name() string                  // Unique name recorded on the records it extracts
+	Version() string               // Bumped whenever the extracted fields change
+	Claims(mimetype string) bool   // Whether the extractor handles the MIME type
+	Extract(record FilePath) error // Contributes meta data to the record
+}
+
+// An Extractor that also defines the record type for the MIME types it claims
+type Converter interface {
+	Extractor
+	Convert(fm *FileMeta) FilePath // Wraps the FileMeta in the typed record
+}
+
+// Claims every MIME type with one of the prefixes, e.g. "image/"
+type MimePrefixes []string
+
+func (prefixes MimePrefixes) Claims(mimetype string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(mimetype, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+var extractors []Extractor // The registered extractors in order of registration
+
+//=============================================================================
+
+// Registers an extractor, replacing any registered extractor with its name.
+// Extractors are run in the order they are registered.
+func RegisterExtractor(ext Extractor) {
+	for idx, registered := range extractors {
+		if registered.Name() == ext.Name() {
+			extractors[idx] = ext
+			return
+		}
+	}
+
+	extractors = append(extractors, ext)
+}
+
+// Returns the registered extractors that claim the MIME type
+func Extractors(mimetype string) []Extractor {
+	claimed := make([]Extractor, 0)
+	for _, ext := range extractors {
+		if ext.Claims(mimetype) {
+			claimed = append(claimed, ext)
+		}
+	}
+
+	return claimed
+}
+
+// Returns an unpopulated record for the file, the type of which is defined by
+// the first Converter that claims its MIME type (a FileMeta if none do).
+func NewRecord(fm *FileMeta) FilePath {
+	if fm.MimeType == "" {
+		fm.MimeType, _ = MimeType(fm.Path)
+	}
+
+	for _, ext := range Extractors(fm.MimeType) {
+		if conv, ok := ext.(Converter); ok {
+			if record := conv.Convert(fm); record != nil {
+				return record
+			}
+		}
+	}
+
+	return fm
+}
+
+// Runs the extractors that claim the MIME type of the record on it, noting
+// the name and version of each extractor that ran on the record. Extractors
+// that fail are noted too, with their error, so that the record is only
+// stale again once a new version of the extractor could do better.
+func extract(record FilePath) {
+	fm := record.File()
+	fm.Extractors = make(map[string]string)
+	fm.Failures = nil
+
+	for _, ext := range Extractors(fm.MimeType) {
+		fm.Extractors[ext.Name()] = ext.Version()
+
+		if err := ext.Extract(record); err != nil {
+			if eventLogger != nil {
+				eventLogger.Warn("%s extractor failed on \"%s\": %s", ext.Name(), fm.Path, err)
+			}
+
+			if fm.Failures == nil {
+				fm.Failures = make(map[string]string)
+			}
+			fm.Failures[ext.Name()] = err.Error()
+		}
+	}
+}
+
+// Checks if the record was produced by different extractors or versions of
+// them than are now registered for its MIME type, e.g. after an upgrade.
+func Stale(record FilePath) bool {
+	fm := record.File()
+	claimed := Extractors(fm.MimeType)
+
+	if len(claimed) != len(fm.Extractors) {
+		return true
+	}
+
+	for _, ext := range claimed {
+		if version, ok := fm.Extractors[ext.Name()]; !ok || version != ext.Version() {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Extracts the record again from the file at its path, returning the fresh
+// record. Returns ErrFileChanged if the file has changed since the record was
+// stored, since its contents (and signature) now belong to a different record.
+func Reextract(record FilePath) (FilePath, error) {
+	prev := record.File()
+	if exists, err := PathExists(prev.Path); !exists {
+		if err == nil {
+			err = fmt.Errorf("no file at \"%s\"", prev.Path)
+		}
+		return nil, err
+	}
+
+	fm := new(FileMeta)
+	fm.Path = prev.Path
+
+	fresh := NewRecord(fm)
+	fresh.Populate()
+
+	if fresh.File().Signature != prev.Signature {
+		return nil, ErrFileChanged
+	}
+
+	return fresh, nil
+}
@@ -0,0 +1,130 @@
+package crate_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/bbengfort/crate/crate"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// Extractor for a MIME type no fixture has, to test the registry
+type ginkgoExtractor struct {
+	MimePrefixes
+	version string
+}
+
+func (ext *ginkgoExtractor) Name() string    { return "ginkgo" }
+func (ext *ginkgoExtractor) Version() string { return ext.version }
+
+func (ext *ginkgoExtractor) Extract(record FilePath) error {
+	return nil
+}
+
+var _ = Describe("Extractor", func() {
+
+	var ginkgo *FileMeta // A record of the MIME type claimed by the test extractor
+
+	BeforeEach(func() {
+		RegisterExtractor(&ginkgoExtractor{MimePrefixes{"application/x-ginkgo"}, "1"})
+
+		ginkgo = new(FileMeta)
+		ginkgo.Path = "/ginkgo/record.gkgo"
+		ginkgo.MimeType = "application/x-ginkgo"
+	})
+
+	It("should claim MIME types by prefix", func() {
+		prefixes := MimePrefixes{"image/", "video/mp4"}
+		Ω(prefixes.Claims("image/jpeg")).Should(BeTrue())
+		Ω(prefixes.Claims("video/mp4")).Should(BeTrue())
+		Ω(prefixes.Claims("video/quicktime")).Should(BeFalse())
+	})
+
+	It("should return the extractors that claim a MIME type", func() {
+		names := func(mimetype string) []string {
+			result := make([]string, 0)
+			for _, ext := range Extractors(mimetype) {
+				result = append(result, ext.Name())
+			}
+			return result
+		}
+
+		Ω(names("image/jpeg")).Should(ContainElement("image"))
+		Ω(names("image/jpeg")).ShouldNot(ContainElement("ginkgo"))
+		Ω(names("application/x-ginkgo")).Should(Equal([]string{"ginkgo"}))
+	})
+
+	It("should replace an extractor registered with the same name", func() {
+		RegisterExtractor(&ginkgoExtractor{MimePrefixes{"application/x-ginkgo"}, "2"})
+		claimed := Extractors("application/x-ginkgo")
+		Ω(claimed).Should(HaveLen(1))
+		Ω(claimed[0].Version()).Should(Equal("2"))
+	})
+
+	It("should create the record type of the converter claiming the file", func() {
+		node, _ := NewPath("../fixtures/ferry.jpg")
+		Ω(NewRecord(node.(*FileMeta))).Should(BeAssignableToTypeOf(new(ImageMeta)))
+
+		node, _ = NewPath("../fixtures/dracula.txt")
+		Ω(NewRecord(node.(*FileMeta))).Should(BeAssignableToTypeOf(new(TextMeta)))
+
+		Ω(NewRecord(ginkgo)).Should(Equal(ginkgo))
+	})
+
+	It("should note the extractors that produced a record", func() {
+		img := ImageFromPath("../fixtures/ferry.jpg")
+		img.Populate()
+		Ω(img.Extractors).Should(HaveKeyWithValue("image", "11"))
+		Ω(Stale(img)).Should(BeFalse())
+	})
+
+	It("should note the extractors that failed on a record", func() {
+		testRoot, err := ioutil.TempDir("", "ginkgo-")
+		Ω(err).Should(BeNil())
+		defer os.RemoveAll(testRoot)
+
+		// A movie without a moov box can't be parsed
+		path := filepath.Join(testRoot, "broken.mp4")
+		Ω(ioutil.WriteFile(path, mkbox("ftyp", []byte("isom\x00\x00\x02\x00isommp41")), 0644)).Should(Succeed())
+
+		node, err := NewPath(path)
+		Ω(err).Should(BeNil())
+		record := NewRecord(node.(*FileMeta))
+		record.Populate()
+
+		Ω(record.File().Extractors).Should(HaveKey("video"))
+		Ω(record.File().Failures).Should(HaveKeyWithValue("video", "no moov box in the file"))
+		Ω(Stale(record)).Should(BeFalse())
+	})
+
+	It("should detect records produced by other extractor versions", func() {
+		ginkgo.Extractors = map[string]string{"ginkgo": "1"}
+		Ω(Stale(ginkgo)).Should(BeFalse())
+
+		RegisterExtractor(&ginkgoExtractor{MimePrefixes{"application/x-ginkgo"}, "2"})
+		Ω(Stale(ginkgo)).Should(BeTrue())
+
+		ginkgo.Extractors = map[string]string{"ginkgo": "2", "other": "1"}
+		Ω(Stale(ginkgo)).Should(BeTrue())
+	})
+
+	It("should re-extract a record from its file", func() {
+		img := ImageFromPath("../fixtures/ferry.jpg")
+		img.Populate()
+		img.Extractors = map[string]string{"image": "0"}
+		Ω(Stale(img)).Should(BeTrue())
+
+		fresh, err := Reextract(img)
+		Ω(err).Should(BeNil())
+		Ω(Stale(fresh)).Should(BeFalse())
+		Ω(fresh.File().Signature).Should(Equal(img.Signature))
+
+		img.Signature = "changed"
+		_, err = Reextract(img)
+		Ω(err).Should(Equal(ErrFileChanged))
+	})
+
+})
@@ -39,12 +39,13 @@ type Path interface {
 }
 
 type FilePath interface {
-	IsImage() bool // The File is an image
-	Ext() string   // The extension (if a file, empty string if not)
-	Base() string  // The base name of the path
-	Populate()     // Populates the info on the file path (does a lot of work)
-	Info() string  // Returns a JSON serialized print of the file info
-	Store() error  // Store the meta data to a database
+	IsImage() bool   // The File is an image
+	Ext() string     // The extension (if a file, empty string if not)
+	Base() string    // The base name of the path
+	Populate()       // Populates the info on the file path (does a lot of work)
+	Info() string    // Returns a JSON serialized print of the file info
+	Store() error    // Store the meta data to a database
+	File() *FileMeta // The underlying file meta data of the record
 }
 
 type DirPath interface {
@@ -174,15 +175,17 @@ func (node *Node) Byte() []byte {
 
 type FileMeta struct {
 	Node
-	MimeType  string    // The mimetype of the file
-	Name      string    // The base name of the file
-	Size      int64     // The size of the file in bytes
-	Modified  time.Time // The last modified time
-	LastSeen  time.Time // The last time that Crate saw the file
-	Signature string    // Base64 encoded SHA1 hash of the file
-	Host      string    // The hostname of the computer
-	Author    string    // The User or username of the file creator
-	populated bool      // Indicates if the FileMeta has been populated
+	MimeType   string            // The mimetype of the file
+	Name       string            // The base name of the file
+	Size       int64             // The size of the file in bytes
+	Modified   time.Time         // The last modified time
+	LastSeen   time.Time         // The last time that Crate saw the file
+	Signature  string            // Base64 encoded SHA1 hash of the file
+	Host       string            // The hostname of the computer
+	Author     string            // The User or username of the file creator
+	Extractors map[string]string // Name and version of the extractors that produced the record
+	Failures   map[string]string // Name and error of the extractors that failed on the record
+	populated  bool              // Indicates if the FileMeta has been populated
 }
 
 // Checks if a FileMeta is an image
@@ -194,8 +197,14 @@ func (fm *FileMeta) IsImage() bool {
 	return strings.HasPrefix(fm.MimeType, "image/")
 }
 
-// Populates the fields on the FileMeta
+// Populates the fields on the FileMeta and runs any extractors that claim it
 func (fm *FileMeta) Populate() {
+	fm.populateFile()
+	extract(fm)
+}
+
+// Populates the file system fields common to every record
+func (fm *FileMeta) populateFile() {
 
 	if fi, err := fm.Stat(); err == nil {
 		fm.Name = fi.Name()
@@ -220,6 +229,11 @@ func (fm *FileMeta) Populate() {
 	fm.populated = true
 }
 
+// Returns the FileMeta itself, records that embed it return their FileMeta
+func (fm *FileMeta) File() *FileMeta {
+	return fm
+}
+
 // Returns the extension of the file
 func (fm *FileMeta) Ext() string {
 	return filepath.Ext(fm.Path)
@@ -273,6 +287,37 @@ func (fm *FileMeta) Info() string {
 
 //=============================================================================
 
+// Tags from the embedded meta data of a file (e.g. EXIF), where the capture
+// time and location of any media are stored as DateTaken, Latitude, Longitude
+type TagMap map[string]string
+
+// Returns the latitude and longitude if tagged with a location
+func (tags TagMap) Location() (float64, float64, bool) {
+	latitude, err := strconv.ParseFloat(tags["Latitude"], 64)
+	if err != nil {
+		return 0, 0, false
+	}
+
+	longitude, err := strconv.ParseFloat(tags["Longitude"], 64)
+	if err != nil {
+		return 0, 0, false
+	}
+
+	return latitude, longitude, true
+}
+
+// Returns the capture time if tagged with a DateTaken
+func (tags TagMap) Taken() (time.Time, bool) {
+	taken, err := time.Parse(JSONLayout, tags["DateTaken"])
+	if err != nil {
+		return taken, false
+	}
+
+	return taken, true
+}
+
+//=============================================================================
+
 type Dir struct {
 	Node
 	Name      string    // The base name of the directory
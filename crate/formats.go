@@ -0,0 +1,452 @@
+// Reads the dimensions and animation of GIF, WebP, BMP, ICO and SVG images
+// from their headers, which the image package can't decode, and the metadata
+// embedded in the headers of these and PNG images
+
+package crate
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	MaxChunkRead = 16 << 20 // Largest WebP EXIF or XMP chunk read into memory
+	SVGDPI       = 96.0     // Pixels per inch of the absolute units of SVG lengths
+)
+
+// Readers of the image headers by the mimetypes of the formats
+var ImageHeaderReaders = map[string]func(io.Reader) (*ImageHeader, error){
+	"image/gif":                ReadGIF,
+	"image/png":                ReadPNG,
+	"image/webp":               ReadWebP,
+	"image/bmp":                ReadBMP,
+	"image/x-ms-bmp":           ReadBMP,
+	"image/x-icon":             ReadICO,
+	"image/vnd.microsoft.icon": ReadICO,
+	"image/svg+xml":            ReadSVG,
+}
+
+// Lengths with their units in SVG width and height attributes
+var SVGLengthPattern = regexp.MustCompile(`^\s*([0-9]*\.?[0-9]+)\s*(px|pt|pc|mm|cm|in)?\s*$`)
+
+// Pixels per unit of the absolute SVG length units
+var svgUnits = map[string]float64{
+	"": 1, "px": 1, "pt": SVGDPI / 72, "pc": SVGDPI / 6,
+	"mm": SVGDPI / 25.4, "cm": SVGDPI / 2.54, "in": SVGDPI,
+}
+
+var ErrUnknownDimensions = errors.New("Could not decode Image dimensions")
+
+//=============================================================================
+
+// The format, dimensions and animation of an image read from its header
+type ImageHeader struct {
+	Format   string            // Name of the format, e.g. GIF
+	Width    int               // Width of the image (or largest icon)
+	Height   int               // Height of the image (or largest icon)
+	Frames   int               // Number of frames of an animation, else 1
+	Duration float64           // Seconds of one loop of an animation
+	Exif     []byte            // EXIF data embedded in the image
+	XMP      []byte            // XMP packet embedded in the image
+	Text     map[string]string // Textual chunks of PNG images by keyword
+}
+
+// Reads the header of the image if its format has a header reader
+func (img *ImageMeta) ReadHeader() (*ImageHeader, error) {
+	read, ok := ImageHeaderReaders[img.MimeType]
+	if !ok {
+		return nil, errors.New("no header reader for " + img.MimeType)
+	}
+
+	file, err := os.Open(img.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return read(file)
+}
+
+// Reads the format, animation and PNG text of the image header into the
+// ImageMeta. EXIF is read along with the EXIF of the other formats and takes
+// precedence, so the text only fills in the unset tags.
+func (img *ImageMeta) extractHeader() error {
+	header, err := img.ReadHeader()
+	if err != nil {
+		return err
+	}
+
+	img.Tags["Format"] = header.Format
+	if header.Frames > 1 {
+		img.Frames = header.Frames
+		img.Duration = header.Duration
+	}
+
+	fill := func(tag, value string) {
+		if img.Tags[tag] == "" && value != "" {
+			img.Tags[tag] = strings.TrimSpace(value)
+			img.Sources[tag] = TagSourcePNG
+		}
+	}
+
+	for tag, keyword := range pngImageTags {
+		fill(tag, header.Text[keyword])
+	}
+
+	if ts, ok := ParsePNGTime(header.Text["Creation Time"]); ok {
+		fill("DateTaken", JSONStamp(ts))
+	}
+
+	return nil
+}
+
+// The PNG keywords of the image tags they fill in
+var pngImageTags = map[string]string{
+	"Title":            "Title",
+	"ImageDescription": "Description",
+	"Artist":           "Author",
+	"Copyright":        "Copyright",
+	"Software":         "Software",
+	"Comment":          "Comment",
+}
+
+//=============================================================================
+
+// Reads the dimensions of a GIF and counts its frames and their delays
+func ReadGIF(r io.Reader) (*ImageHeader, error) {
+	reader := bufio.NewReader(r)
+	data := make([]byte, 13)
+	if _, err := io.ReadFull(reader, data); err != nil {
+		return nil, err
+	}
+
+	if string(data[:6]) != "GIF87a" && string(data[:6]) != "GIF89a" {
+		return nil, errors.New("not a GIF image")
+	}
+
+	header := &ImageHeader{Format: "GIF"}
+	header.Width = int(binary.LittleEndian.Uint16(data[6:8]))
+	header.Height = int(binary.LittleEndian.Uint16(data[8:10]))
+
+	if data[10]&0x80 != 0 {
+		if _, err := reader.Discard(3 << (data[10]&0x07 + 1)); err != nil {
+			return header, nil
+		}
+	}
+
+	delay := 0
+	for {
+		kind, err := reader.ReadByte()
+		if err != nil {
+			break
+		}
+
+		switch kind {
+		case 0x21: // Extension, the graphic control extension sets the delay
+			label, err := reader.ReadByte()
+			if err != nil {
+				return header, nil
+			}
+
+			// The block size, packed fields and delay, the terminator is skipped
+			if label == 0xf9 {
+				if _, err := io.ReadFull(reader, data[:5]); err != nil {
+					return header, nil
+				}
+				delay = int(binary.LittleEndian.Uint16(data[2:4]))
+			}
+
+			if err := skipSubBlocks(reader); err != nil {
+				return header, nil
+			}
+
+		case 0x2c: // Image descriptor, followed by the frame data
+			if _, err := io.ReadFull(reader, data[:9]); err != nil {
+				return header, nil
+			}
+
+			skip := 1 // LZW minimum code size
+			if data[8]&0x80 != 0 {
+				skip += 3 << (data[8]&0x07 + 1)
+			}
+
+			if _, err := reader.Discard(skip); err != nil {
+				return header, nil
+			}
+
+			if err := skipSubBlocks(reader); err != nil {
+				return header, nil
+			}
+
+			header.Frames++
+			header.Duration += float64(delay) / 100
+			delay = 0
+
+		default: // The trailer or corrupt data
+			return header, nil
+		}
+	}
+
+	return header, nil
+}
+
+// Skips the data sub-blocks of a GIF up to and including the terminator
+func skipSubBlocks(reader *bufio.Reader) error {
+	for {
+		size, err := reader.ReadByte()
+		if err != nil {
+			return err
+		}
+
+		if size == 0 {
+			return nil
+		}
+
+		if _, err := reader.Discard(int(size)); err != nil {
+			return err
+		}
+	}
+}
+
+//=============================================================================
+
+// Reads the dimensions, animation frames and EXIF and XMP chunks of a WebP
+func ReadWebP(r io.Reader) (*ImageHeader, error) {
+	data := make([]byte, 12)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+
+	if string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return nil, errors.New("not a WebP image")
+	}
+
+	header := &ImageHeader{Format: "WEBP"}
+	for {
+		if _, err := io.ReadFull(r, data[:8]); err != nil {
+			break
+		}
+
+		fourcc := string(data[:4])
+		size := int64(binary.LittleEndian.Uint32(data[4:8]))
+		size += size % 2
+
+		// Only the start of the image chunks is needed
+		read := int64(0)
+		switch fourcc {
+		case "VP8 ", "VP8L", "VP8X", "ANMF":
+			read = 16
+		case "EXIF", "XMP ":
+			read = MaxChunkRead
+		}
+
+		if read > size {
+			read = size
+		}
+
+		payload := make([]byte, read)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			break
+		}
+
+		if err := discard(r, size-read); err != nil {
+			break
+		}
+
+		switch {
+		case fourcc == "VP8X" && len(payload) >= 10:
+			header.Width = int(uint24(payload[4:7])) + 1
+			header.Height = int(uint24(payload[7:10])) + 1
+
+		case fourcc == "VP8 " && len(payload) >= 10 && header.Width == 0:
+			header.Width = int(binary.LittleEndian.Uint16(payload[6:8]) & 0x3fff)
+			header.Height = int(binary.LittleEndian.Uint16(payload[8:10]) & 0x3fff)
+
+		case fourcc == "VP8L" && len(payload) >= 5 && payload[0] == 0x2f && header.Width == 0:
+			bits := binary.LittleEndian.Uint32(payload[1:5])
+			header.Width = int(bits&0x3fff) + 1
+			header.Height = int(bits>>14&0x3fff) + 1
+
+		case fourcc == "ANMF" && len(payload) >= 16:
+			header.Frames++
+			header.Duration += float64(uint24(payload[12:15])) / 1000
+
+		case fourcc == "EXIF":
+			header.Exif = payload
+
+		case fourcc == "XMP ":
+			header.XMP = payload
+		}
+	}
+
+	if header.Frames == 0 {
+		header.Frames = 1
+	}
+
+	return header, nil
+}
+
+// Skips bytes of the reader, seeking past them if it is a file
+func discard(r io.Reader, n int64) error {
+	if seeker, ok := r.(io.Seeker); ok {
+		_, err := seeker.Seek(n, io.SeekCurrent)
+		return err
+	}
+
+	_, err := io.CopyN(ioutil.Discard, r, n)
+	return err
+}
+
+// Reads a little endian 24 bit unsigned integer
+func uint24(data []byte) uint32 {
+	return uint32(data[0]) | uint32(data[1])<<8 | uint32(data[2])<<16
+}
+
+//=============================================================================
+
+// Reads the dimensions of a BMP from its DIB header, the height is negative
+// for images stored top down
+func ReadBMP(r io.Reader) (*ImageHeader, error) {
+	data := make([]byte, 26)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+
+	if string(data[:2]) != "BM" {
+		return nil, errors.New("not a BMP image")
+	}
+
+	header := &ImageHeader{Format: "BMP", Frames: 1}
+	if binary.LittleEndian.Uint32(data[14:18]) == 12 {
+		// The OS/2 BITMAPCOREHEADER has 16 bit dimensions
+		header.Width = int(binary.LittleEndian.Uint16(data[18:20]))
+		header.Height = int(binary.LittleEndian.Uint16(data[20:22]))
+		return header, nil
+	}
+
+	header.Width = int(int32(binary.LittleEndian.Uint32(data[18:22])))
+	header.Height = int(int32(binary.LittleEndian.Uint32(data[22:26])))
+	if header.Height < 0 {
+		header.Height = -header.Height
+	}
+
+	return header, nil
+}
+
+//=============================================================================
+
+// Reads the dimensions of the largest image in an ICO (or CUR) directory
+func ReadICO(r io.Reader) (*ImageHeader, error) {
+	data := make([]byte, 16)
+	if _, err := io.ReadFull(r, data[:6]); err != nil {
+		return nil, err
+	}
+
+	kind := binary.LittleEndian.Uint16(data[2:4])
+	if binary.LittleEndian.Uint16(data[0:2]) != 0 || (kind != 1 && kind != 2) {
+		return nil, errors.New("not an ICO image")
+	}
+
+	header := &ImageHeader{Format: "ICO", Frames: 1}
+	count := int(binary.LittleEndian.Uint16(data[4:6]))
+	for idx := 0; idx < count; idx++ {
+		if _, err := io.ReadFull(r, data); err != nil {
+			break
+		}
+
+		// Dimensions of 256 pixels are stored as zero
+		width, height := int(data[0]), int(data[1])
+		if width == 0 {
+			width = 256
+		}
+		if height == 0 {
+			height = 256
+		}
+
+		if width*height > header.Width*header.Height {
+			header.Width, header.Height = width, height
+		}
+	}
+
+	return header, nil
+}
+
+//=============================================================================
+
+// Reads the dimensions of an SVG from the width and height of its root
+// element, converting absolute units to pixels and using the viewBox for
+// relative units or when they aren't set.
+func ReadSVG(r io.Reader) (*ImageHeader, error) {
+	decoder := xml.NewDecoder(r)
+	decoder.Strict = false
+
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+
+		root, ok := token.(xml.StartElement)
+		if !ok {
+			continue
+		}
+
+		if root.Name.Local != "svg" {
+			return nil, errors.New("not an SVG image")
+		}
+
+		var width, height, boxWidth, boxHeight float64
+		for _, attr := range root.Attr {
+			switch attr.Name.Local {
+			case "width":
+				width = svgLength(attr.Value)
+			case "height":
+				height = svgLength(attr.Value)
+			case "viewBox":
+				fields := strings.FieldsFunc(attr.Value, func(c rune) bool {
+					return c == ',' || c == ' ' || c == '\t' || c == '\n' || c == '\r'
+				})
+				if len(fields) == 4 {
+					boxWidth, _ = strconv.ParseFloat(fields[2], 64)
+					boxHeight, _ = strconv.ParseFloat(fields[3], 64)
+				}
+			}
+		}
+
+		// Scale a missing dimension by the aspect ratio of the viewBox
+		if boxWidth > 0 && boxHeight > 0 {
+			switch {
+			case width == 0 && height == 0:
+				width, height = boxWidth, boxHeight
+			case width == 0:
+				width = height * boxWidth / boxHeight
+			case height == 0:
+				height = width * boxHeight / boxWidth
+			}
+		}
+
+		header := &ImageHeader{Format: "SVG", Frames: 1}
+		header.Width = int(width + 0.5)
+		header.Height = int(height + 0.5)
+		return header, nil
+	}
+}
+
+// Returns the length in pixels, or zero if it is relative (e.g. % or em)
+func svgLength(value string) float64 {
+	match := SVGLengthPattern.FindStringSubmatch(value)
+	if match == nil {
+		return 0
+	}
+
+	length, _ := strconv.ParseFloat(match[1], 64)
+	return length * svgUnits[match[2]]
+}
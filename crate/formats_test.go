@@ -0,0 +1,200 @@
+package crate_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color/palette"
+	"image/gif"
+	"io/ioutil"
+	"os"
+
+	. "github.com/bbengfort/crate/crate"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// Encodes an animated GIF with a frame for each of the delays
+func mkgif(width, height int, delays ...int) []byte {
+	anim := &gif.GIF{Delay: delays}
+	for range delays {
+		anim.Image = append(anim.Image, image.NewPaletted(image.Rect(0, 0, width, height), palette.Plan9))
+	}
+
+	buf := new(bytes.Buffer)
+	gif.EncodeAll(buf, anim)
+	return buf.Bytes()
+}
+
+// Builds a RIFF chunk of a WebP, sizes are little endian
+func mkchunk(fourcc string, payload ...[]byte) []byte {
+	data := bytes.Join(payload, nil)
+	chunk := append([]byte(fourcc), make([]byte, 4)...)
+	binary.LittleEndian.PutUint32(chunk[4:], uint32(len(data)))
+	chunk = append(chunk, data...)
+	if len(data)%2 == 1 {
+		chunk = append(chunk, 0)
+	}
+	return chunk
+}
+
+// Builds a WebP from the chunks
+func mkwebp(chunks ...[]byte) []byte {
+	data := bytes.Join(chunks, nil)
+	header := append([]byte("RIFF"), make([]byte, 4)...)
+	binary.LittleEndian.PutUint32(header[4:], uint32(len(data)+4))
+	return append(append(header, []byte("WEBP")...), data...)
+}
+
+// Builds an animated extended WebP with EXIF and XMP chunks
+func mkwebpx() []byte {
+	canvas := []byte{0x3e, 0, 0, 0, 0x8f, 0x01, 0x00, 0x2b, 0x01, 0x00} // 400x300
+	frame := func(ms int) []byte {
+		return mkchunk("ANMF", make([]byte, 12), []byte{byte(ms), byte(ms >> 8), 0, 0},
+			mkchunk("VP8L", []byte{0x2f, 0, 0, 0, 0}))
+	}
+
+	exif := mktiff(binary.BigEndian, nil,
+		tiffBlock{name: "ifd0", entries: []tiffEntry{
+			tascii(0x010f, "Google"),
+			tref(0x8769, "exif"),
+		}},
+		tiffBlock{name: "exif", entries: []tiffEntry{
+			tascii(0x9003, "2019:03:08 12:00:00"),
+		}},
+	)
+
+	xmp := `<x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+<rdf:Description rdf:about="" xmlns:dc="http://purl.org/dc/elements/1.1/">
+<dc:creator><rdf:Seq><rdf:li>Lucy Westenra</rdf:li></rdf:Seq></dc:creator>
+</rdf:Description></rdf:RDF></x:xmpmeta>`
+
+	return mkwebp(mkchunk("VP8X", canvas), mkchunk("ANIM", make([]byte, 6)),
+		frame(100), frame(150), mkchunk("EXIF", exif), mkchunk("XMP ", []byte(xmp)))
+}
+
+// Builds a BMP with a BITMAPINFOHEADER, top down if the height is negative
+func mkbmp(width, height int32) []byte {
+	data := append([]byte("BM"), make([]byte, 52)...)
+	binary.LittleEndian.PutUint32(data[14:], 40)
+	binary.LittleEndian.PutUint32(data[18:], uint32(width))
+	binary.LittleEndian.PutUint32(data[22:], uint32(height))
+	return data
+}
+
+var _ = Describe("Formats", func() {
+
+	var testRoot string // Temporary directory for the synthetic images
+
+	BeforeEach(func() {
+		var err error
+		testRoot, err = ioutil.TempDir("", "ginkgo-")
+		Ω(err).Should(BeNil())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(testRoot)
+	})
+
+	It("should read the dimensions, frames and duration of a GIF", func() {
+		header, err := ReadGIF(bytes.NewReader(mkgif(20, 10, 10, 20, 30)))
+		Ω(err).Should(BeNil())
+		Ω(header.Width).Should(Equal(20))
+		Ω(header.Height).Should(Equal(10))
+		Ω(header.Frames).Should(Equal(3))
+		Ω(header.Duration).Should(BeNumerically("~", 0.6, 0.0001))
+
+		img := extractImage(testRoot, "spinner.gif", mkgif(20, 10, 10, 20, 30))
+		Ω(img.Width).Should(Equal(20))
+		Ω(img.Frames).Should(Equal(3))
+		Ω(img.Tag("Format")).Should(Equal("GIF"))
+		Ω(img.Extractors).Should(HaveKey("image"))
+
+		img = extractImage(testRoot, "still.gif", mkgif(8, 8, 0))
+		Ω(img.Width).Should(Equal(8))
+		Ω(img.Frames).Should(Equal(0))
+	})
+
+	It("should read the dimensions of lossy and lossless WebP", func() {
+		lossy := mkwebp(mkchunk("VP8 ", []byte{0, 0, 0, 0x9d, 0x01, 0x2a, 0x80, 0x02, 0xe0, 0x01}))
+		header, err := ReadWebP(bytes.NewReader(lossy))
+		Ω(err).Should(BeNil())
+		Ω([]int{header.Width, header.Height}).Should(Equal([]int{640, 480}))
+
+		// 64x32 is stored as 63 and 31 in two 14 bit fields
+		bits := uint32(63) | uint32(31)<<14
+		lossless := mkwebp(mkchunk("VP8L", []byte{0x2f, byte(bits), byte(bits >> 8), byte(bits >> 16), byte(bits >> 24)}))
+		header, err = ReadWebP(bytes.NewReader(lossless))
+		Ω(err).Should(BeNil())
+		Ω([]int{header.Width, header.Height}).Should(Equal([]int{64, 32}))
+		Ω(header.Frames).Should(Equal(1))
+	})
+
+	It("should read the animation, EXIF and XMP of an extended WebP", func() {
+		header, err := ReadWebP(bytes.NewReader(mkwebpx()))
+		Ω(err).Should(BeNil())
+		Ω([]int{header.Width, header.Height}).Should(Equal([]int{400, 300}))
+		Ω(header.Frames).Should(Equal(2))
+		Ω(header.Duration).Should(BeNumerically("~", 0.25, 0.0001))
+		Ω(header.Exif).ShouldNot(BeEmpty())
+		Ω(header.XMP).ShouldNot(BeEmpty())
+
+		img := extractImage(testRoot, "sticker.webp", mkwebpx())
+		Ω(img.Width).Should(Equal(400))
+		Ω(img.Height).Should(Equal(300))
+		Ω(img.Frames).Should(Equal(2))
+		Ω(img.Tag("Format")).Should(Equal("WEBP"))
+		Ω(img.Tag("CameraMake")).Should(Equal("Google"))
+		Ω(img.Tag("DateTaken")).Should(Equal("2019-03-08T12:00:00+00:00"))
+		Ω(img.Tag("Artist")).Should(Equal("Lucy Westenra"))
+	})
+
+	It("should read the dimensions of a BMP", func() {
+		header, err := ReadBMP(bytes.NewReader(mkbmp(30, -20)))
+		Ω(err).Should(BeNil())
+		Ω([]int{header.Width, header.Height}).Should(Equal([]int{30, 20}))
+
+		img := extractImage(testRoot, "icon.bmp", mkbmp(30, 20))
+		Ω([]int{img.Width, img.Height}).Should(Equal([]int{30, 20}))
+	})
+
+	It("should read the dimensions of the largest icon of an ICO", func() {
+		data := []byte{0, 0, 1, 0, 2, 0}
+		data = append(data, 16, 16, 0, 0, 1, 0, 32, 0, 0, 0, 0, 0, 38, 0, 0, 0)
+		data = append(data, 0, 0, 0, 0, 1, 0, 32, 0, 0, 0, 0, 0, 38, 0, 0, 0)
+
+		header, err := ReadICO(bytes.NewReader(data))
+		Ω(err).Should(BeNil())
+		Ω([]int{header.Width, header.Height}).Should(Equal([]int{256, 256}))
+	})
+
+	It("should read the dimensions of an SVG from its size and viewBox", func() {
+		svg := `<?xml version="1.0"?><svg xmlns="http://www.w3.org/2000/svg" width="2in" viewBox="0 0 100 50"/>`
+		header, err := ReadSVG(bytes.NewReader([]byte(svg)))
+		Ω(err).Should(BeNil())
+		Ω([]int{header.Width, header.Height}).Should(Equal([]int{192, 96}))
+
+		svg = `<svg xmlns="http://www.w3.org/2000/svg" width="100%" height="100%" viewBox="0,0,320,240"></svg>`
+		header, err = ReadSVG(bytes.NewReader([]byte(svg)))
+		Ω(err).Should(BeNil())
+		Ω([]int{header.Width, header.Height}).Should(Equal([]int{320, 240}))
+
+		_, err = ReadSVG(bytes.NewReader([]byte(`<html></html>`)))
+		Ω(err).ShouldNot(BeNil())
+
+		img := extractImage(testRoot, "logo.svg", []byte(`<svg xmlns="http://www.w3.org/2000/svg" width="48" height="24mm"></svg>`))
+		Ω([]int{img.Width, img.Height}).Should(Equal([]int{48, 91}))
+	})
+
+	It("should extract images without dimensions", func() {
+		img := extractImage(testRoot, "broken.gif", []byte("GIF89a\x10"))
+		Ω(img.Width).Should(Equal(0))
+		Ω(img.Extractors).Should(HaveKey("image"))
+		Ω(new(ImageExtractor).Extract(img)).Should(Succeed())
+
+		_, _, err := img.Dimensions()
+		Ω(err).Should(Equal(ErrUnknownDimensions))
+	})
+
+})
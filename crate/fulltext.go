@@ -0,0 +1,418 @@
+// Full-text inverted index of the names, paths, tags and text of records
+
+package crate
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+const (
+	FullTextNamespace    = "fts"    // Namespace of the term posting keys
+	FullTextDocNamespace = "ftsdoc" // Namespace of the indexed terms of each record
+	MinTermLength        = 2        // Shorter words are not indexed
+	MaxTermLength        = 40       // Longer words are not indexed (e.g. base64)
+	MaxSnippets          = 3        // Number of snippets returned for a match
+	SnippetContext       = 40       // Characters of context on each side of a match
+	MaxSnippetLine       = 1 << 20  // Longest line of content searched for snippets
+)
+
+// Weights of the occurrences of a term by the part of the record it occurs in
+const (
+	nameWeight    = 8
+	tagWeight     = 4
+	pathWeight    = 2
+	contentWeight = 1
+)
+
+// The text tags of records that are indexed, e.g. the EXIF ImageDescription
+var FullTextTags = []string{
+	"Title", "Author", "Artist", "Album", "Subject", "Keywords", "Creator",
+	"ImageDescription", "Copyright", "CameraMake", "CameraModel", "Software",
+	"Headline", "City", "Sublocation", "State", "Country",
+}
+
+// Common English words that are neither indexed nor searched for
+var stopwords = map[string]bool{
+	"an": true, "and": true, "are": true, "as": true, "at": true, "be": true,
+	"but": true, "by": true, "for": true, "if": true, "in": true, "into": true,
+	"is": true, "it": true, "no": true, "not": true, "of": true, "on": true,
+	"or": true, "such": true, "that": true, "the": true, "their": true,
+	"then": true, "there": true, "these": true, "they": true, "this": true,
+	"to": true, "was": true, "will": true, "with": true,
+}
+
+//=============================================================================
+
+// A record matching a full-text search with snippets of the matching text
+type GrepMatch struct {
+	Record   FilePath // The matching record
+	Score    float64  // The relevance of the record to the search
+	Snippets []string // Excerpts of the text around the searched terms
+}
+
+// Searches the full-text index for the records containing all of the words
+// in the text, ranked by the frequency of the words weighted by their rarity
+// (and by whether they occur in the name, tags or path of the record).
+func Grep(text string, limit int) ([]*GrepMatch, error) {
+	terms := Terms(text)
+	if len(terms) == 0 {
+		return nil, errors.New("no searchable words in the query")
+	}
+
+	total := float64(countIndexed())
+	scores := make(map[string]float64)
+
+	for idx, term := range terms {
+		postings := make(map[string]float64)
+		iter := db.NewIterator(indexRange(FullTextNamespace, term, ""), nil)
+		for iter.Next() {
+			freq, _ := strconv.Atoi(string(iter.Value()))
+			postings[indexSignature(iter.Key())] = float64(freq)
+		}
+		iter.Release()
+
+		if err := iter.Error(); err != nil {
+			return nil, err
+		}
+
+		// Records must contain every term, so intersect with the prior terms
+		idf := math.Log(1 + total/float64(len(postings)+1))
+		next := make(map[string]float64)
+		for signature, freq := range postings {
+			if score, ok := scores[signature]; ok || idx == 0 {
+				next[signature] = score + (1+math.Log(freq))*idf
+			}
+		}
+
+		scores = next
+	}
+
+	// Only fetch the best scoring records
+	signatures := make([]string, 0, len(scores))
+	for signature := range scores {
+		signatures = append(signatures, signature)
+	}
+
+	sort.Slice(signatures, func(i, j int) bool {
+		if scores[signatures[i]] != scores[signatures[j]] {
+			return scores[signatures[i]] > scores[signatures[j]]
+		}
+		return signatures[i] < signatures[j]
+	})
+
+	if limit > 0 && len(signatures) > limit {
+		signatures = signatures[:limit]
+	}
+
+	matches := make([]*GrepMatch, 0, len(signatures))
+	for _, signature := range signatures {
+		record, err := Fetch(signature)
+		if err != nil {
+			continue
+		}
+
+		match := &GrepMatch{Record: record, Score: scores[signature]}
+		match.Snippets = Snippets(record, terms)
+		matches = append(matches, match)
+	}
+
+	sort.Stable(byScore(matches))
+	return matches, nil
+}
+
+// Returns the distinct searchable words of the text, in order
+func Terms(text string) []string {
+	terms := make([]string, 0)
+	seen := make(map[string]bool)
+
+	tokenize(strings.NewReader(text), func(term string) {
+		if !seen[term] {
+			seen[term] = true
+			terms = append(terms, term)
+		}
+	})
+
+	return terms
+}
+
+// Returns up to MaxSnippets excerpts of the content of the record around the
+// terms, or the name, path or tags of the record that contain the terms.
+func Snippets(record FilePath, terms []string) []string {
+	snippets := make([]string, 0, MaxSnippets)
+
+	if content, ok := contentReader(record); ok {
+		defer content.Close()
+
+		reader := bufio.NewReader(content)
+		for len(snippets) < MaxSnippets {
+			line, err := reader.ReadString('\n')
+			if len(line) > MaxSnippetLine {
+				line = line[:MaxSnippetLine]
+			}
+
+			if excerpt, ok := snippet(line, terms); ok {
+				snippets = append(snippets, excerpt)
+			}
+
+			if err != nil {
+				break
+			}
+		}
+
+		if len(snippets) > 0 {
+			return snippets
+		}
+	}
+
+	fm := record.File()
+	fields := []string{fm.Name, fm.Path}
+	if tagged, ok := record.(TaggedPath); ok {
+		for _, name := range FullTextTags {
+			if value := tagged.Tag(name); value != "" {
+				fields = append(fields, name+": "+value)
+			}
+		}
+	}
+
+	for _, field := range fields {
+		if excerpt, ok := snippet(field, terms); ok && len(snippets) < MaxSnippets {
+			snippets = append(snippets, excerpt)
+		}
+	}
+
+	return snippets
+}
+
+//=============================================================================
+
+// Indexes the words of the name, path, text tags and the text content of
+// plain text and PDF files in the records, see Grep
+type FullTextIndex struct{}
+
+func init() {
+	RegisterIndex(new(FullTextIndex))
+}
+
+func (index *FullTextIndex) Name() string {
+	return FullTextNamespace
+}
+
+// Adds a posting for each term of the record with its weighted frequency,
+// and the list of the terms so that the postings can be removed again.
+func (index *FullTextIndex) Add(batch *leveldb.Batch, record FilePath) {
+	signature := record.File().Signature
+	freqs := recordTerms(record)
+	if len(freqs) == 0 {
+		return
+	}
+
+	terms := make([]string, 0, len(freqs))
+	for term, freq := range freqs {
+		batch.Put(indexKey(FullTextNamespace, term, signature), []byte(strconv.Itoa(freq)))
+		terms = append(terms, term)
+	}
+
+	sort.Strings(terms)
+	if data, err := json.Marshal(terms); err == nil {
+		batch.Put(indexKey(FullTextDocNamespace, signature), data)
+	}
+}
+
+func (index *FullTextIndex) Remove(batch *leveldb.Batch, record FilePath) {
+	signature := record.File().Signature
+	data, err := db.Get(indexKey(FullTextDocNamespace, signature), nil)
+	if err != nil {
+		return
+	}
+
+	var terms []string
+	if err := json.Unmarshal(data, &terms); err != nil {
+		return
+	}
+
+	for _, term := range terms {
+		batch.Delete(indexKey(FullTextNamespace, term, signature))
+	}
+
+	batch.Delete(indexKey(FullTextDocNamespace, signature))
+}
+
+//=============================================================================
+
+// Returns the weighted frequencies of the terms of the record
+func recordTerms(record FilePath) map[string]int {
+	freqs := make(map[string]int)
+	add := func(weight int) func(string) {
+		return func(term string) {
+			freqs[term] += weight
+		}
+	}
+
+	fm := record.File()
+	tokenize(strings.NewReader(fm.Name), add(nameWeight))
+	tokenize(strings.NewReader(filepath.Dir(fm.Path)), add(pathWeight))
+
+	if tagged, ok := record.(TaggedPath); ok {
+		for _, name := range FullTextTags {
+			tokenize(strings.NewReader(tagged.Tag(name)), add(tagWeight))
+		}
+	}
+
+	if content, ok := contentReader(record); ok {
+		tokenize(content, add(contentWeight))
+		content.Close()
+	}
+
+	return freqs
+}
+
+// Returns a UTF-8 reader of the text content of plain text and PDF records
+func contentReader(record FilePath) (io.ReadCloser, bool) {
+	switch record := record.(type) {
+	case *TextMeta:
+		file, err := os.Open(record.Path)
+		if err != nil {
+			return nil, false
+		}
+
+		return struct {
+			io.Reader
+			io.Closer
+		}{NewTextReader(file, record.Encoding), file}, true
+
+	case *DocumentMeta:
+		if record.MimeType != "application/pdf" {
+			return nil, false
+		}
+
+		data, err := readDocument(record.Path)
+		if err != nil {
+			return nil, false
+		}
+
+		return ioutil.NopCloser(strings.NewReader(PDFText(data))), true
+	}
+
+	return nil, false
+}
+
+// Streams the searchable words of the text to the function, lower cased
+func tokenize(r io.Reader, fn func(term string)) {
+	reader := bufio.NewReader(r)
+	word := make([]rune, 0, MaxTermLength)
+	length := 0
+
+	emit := func() {
+		if length >= MinTermLength && length <= MaxTermLength {
+			if term := string(word); !stopwords[term] {
+				fn(term)
+			}
+		}
+		word = word[:0]
+		length = 0
+	}
+
+	for {
+		char, _, err := reader.ReadRune()
+		if err != nil {
+			emit()
+			return
+		}
+
+		if unicode.IsLetter(char) || unicode.IsDigit(char) {
+			if length < MaxTermLength {
+				word = append(word, unicode.ToLower(char))
+			}
+			length++
+			continue
+		}
+
+		emit()
+	}
+}
+
+// Returns an excerpt of the line around the first of the terms it contains
+func snippet(line string, terms []string) (string, bool) {
+	runes := []rune(strings.Join(strings.Fields(line), " "))
+	lower := make([]rune, len(runes))
+	for idx, char := range runes {
+		lower[idx] = unicode.ToLower(char)
+	}
+
+	// Find the first whole word of the line that is one of the terms
+	start, end := -1, -1
+	for idx := 0; idx < len(lower) && start < 0; {
+		if !unicode.IsLetter(lower[idx]) && !unicode.IsDigit(lower[idx]) {
+			idx++
+			continue
+		}
+
+		stop := idx
+		for stop < len(lower) && (unicode.IsLetter(lower[stop]) || unicode.IsDigit(lower[stop])) {
+			stop++
+		}
+
+		word := string(lower[idx:stop])
+		for _, term := range terms {
+			if word == term {
+				start, end = idx, stop
+				break
+			}
+		}
+
+		idx = stop
+	}
+
+	if start < 0 {
+		return "", false
+	}
+
+	from, to := start-SnippetContext, end+SnippetContext
+	prefix, suffix := "...", "..."
+	if from <= 0 {
+		from, prefix = 0, ""
+	}
+	if to >= len(runes) {
+		to, suffix = len(runes), ""
+	}
+
+	return prefix + string(runes[from:to]) + suffix, true
+}
+
+// Counts the records in the full-text index
+func countIndexed() int {
+	count := 0
+	iter := db.NewIterator(indexRange(FullTextDocNamespace, ""), nil)
+	for iter.Next() {
+		count++
+	}
+
+	iter.Release()
+	return count
+}
+
+// Sorts matches by their score, highest first, then by path
+type byScore []*GrepMatch
+
+func (s byScore) Len() int      { return len(s) }
+func (s byScore) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byScore) Less(i, j int) bool {
+	if s[i].Score != s[j].Score {
+		return s[i].Score > s[j].Score
+	}
+
+	return s[i].Record.File().Path < s[j].Record.File().Path
+}
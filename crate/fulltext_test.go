@@ -0,0 +1,173 @@
+package crate_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	. "github.com/bbengfort/crate/crate"
+	"github.com/bbengfort/crate/crate/config"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("FullText", func() {
+
+	It("should split text into distinct lower case terms", func() {
+		Ω(Terms("The Count and the COUNT of Transylvania, 1897")).Should(Equal([]string{"count", "transylvania", "1897"}))
+		Ω(Terms("a I to")).Should(BeEmpty())
+	})
+
+	It("should extract the text shown by PDF content streams", func() {
+		content := "BT /F1 12 Tf (Hello World) Tj 0 -14 Td [(Vam) -20 (pire) -300 (hunters)] TJ ET"
+		data := []byte(fmt.Sprintf("%%PDF-1.4\n1 0 obj << /Length %d >> stream\n%s\nendstream endobj\n%%%%EOF\n",
+			len(content), content))
+
+		text := PDFText(data)
+		Ω(text).Should(ContainSubstring("Hello World"))
+		Ω(text).Should(ContainSubstring("Vampire hunters"))
+	})
+
+	It("should transcode legacy encodings to UTF-8", func() {
+		read := func(data, encoding string) string {
+			text, err := ioutil.ReadAll(NewTextReader(strings.NewReader(data), encoding))
+			Ω(err).Should(BeNil())
+			return string(text)
+		}
+
+		Ω(read("caf\xe9", "iso-8859-1")).Should(Equal("café"))
+		Ω(read("\x93quoted\x94", "windows-1252")).Should(Equal("“quoted”"))
+		Ω(read("\xff\xfeh\x00i\x00", "utf-16le")).Should(Equal("hi"))
+		Ω(read("\xef\xbb\xbfhi", "utf-8")).Should(Equal("hi"))
+	})
+
+	Describe("Index", func() {
+
+		var (
+			err      error  // Any errors in directory creation
+			testRoot string // Test directory to store temp fixtures
+			testHome string // Fake home directory in temp directory
+		)
+
+		// Writes the text to the temporary directory and stores its record
+		store := func(name, text string) FilePath {
+			path := filepath.Join(testRoot, name)
+			Ω(ioutil.WriteFile(path, []byte(text), 0644)).Should(Succeed())
+
+			node, err := NewPath(path)
+			Ω(err).Should(BeNil())
+
+			record := NewRecord(node.(*FileMeta))
+			record.Populate()
+			Ω(record.Store()).Should(Succeed())
+			return record
+		}
+
+		BeforeEach(func() {
+			testRoot, err = ioutil.TempDir("", "ginkgo-")
+			Ω(err).Should(BeNil())
+
+			testHome = filepath.Join(testRoot, "Users", "jdoe")
+			err = os.MkdirAll(testHome, 0755)
+			Ω(err).Should(BeNil())
+
+			if runtime.GOOS == "windows" {
+				Ω(os.Setenv("USERPROFILE", testHome)).Should(BeNil())
+			} else {
+				Ω(os.Setenv("HOME", testHome)).Should(BeNil())
+			}
+
+			Ω(InitializeDatabase()).Should(BeNil())
+		})
+
+		AfterEach(func() {
+			CloseDatabase()
+			Ω(os.RemoveAll(testRoot)).Should(BeNil())
+
+			if runtime.GOOS == "windows" {
+				Ω(os.Unsetenv("USERPROFILE")).Should(BeNil())
+			} else {
+				Ω(os.Unsetenv("HOME")).Should(BeNil())
+			}
+
+			config.ClearPathCache()
+		})
+
+		It("should find text files by their content with snippets", func() {
+			store("journal.txt", "3 May. Bistritz.\nLeft Munich at 8:35 P.M.\nThe vampire came at night.\n")
+			store("letter.txt", "My dearest Lucy, the vampire is gone.\n")
+
+			matches, err := Grep("vampire night", 10)
+			Ω(err).Should(BeNil())
+			Ω(matches).Should(HaveLen(1))
+			Ω(matches[0].Record.File().Name).Should(Equal("journal.txt"))
+			Ω(matches[0].Snippets).Should(Equal([]string{"The vampire came at night."}))
+
+			matches, err = Grep("VAMPIRE", 10)
+			Ω(err).Should(BeNil())
+			Ω(matches).Should(HaveLen(2))
+
+			_, err = Grep("the of", 10)
+			Ω(err).ShouldNot(BeNil())
+		})
+
+		It("should rank matches in the name above matches in the content", func() {
+			store("journal.txt", "The vampire came at night.\n")
+			store("vampire.txt", "Garlic and stakes.\n")
+
+			matches, err := Grep("vampire", 10)
+			Ω(err).Should(BeNil())
+			Ω(matches).Should(HaveLen(2))
+			Ω(matches[0].Record.File().Name).Should(Equal("vampire.txt"))
+			Ω(matches[0].Score).Should(BeNumerically(">", matches[1].Score))
+			Ω(matches[0].Snippets).Should(ContainElement("vampire.txt"))
+
+			matches, err = Grep("vampire", 1)
+			Ω(err).Should(BeNil())
+			Ω(matches).Should(HaveLen(1))
+		})
+
+		It("should search the text tags of images", func() {
+			coast := ImageFromPath(filepath.Join("..", "fixtures", "coast.jpg"))
+			Ω(coast.Store()).Should(Succeed())
+
+			matches, err := Grep(strings.ToLower(coast.Tag("CameraMake")), 10)
+			Ω(err).Should(BeNil())
+			Ω(matches).Should(HaveLen(1))
+			Ω(matches[0].Record.File().Signature).Should(Equal(coast.Signature))
+		})
+
+		It("should not duplicate postings when a record is stored again", func() {
+			record := store("journal.txt", "The vampire came at night.\n")
+			Ω(record.Store()).Should(Succeed())
+
+			matches, err := Grep("vampire", 10)
+			Ω(err).Should(BeNil())
+			Ω(matches).Should(HaveLen(1))
+			Ω(FetchKeys(100)).Should(HaveLen(1))
+		})
+
+		It("should index the dracula fixture", func() {
+			node, err := NewPath(filepath.Join("..", "fixtures", "dracula.txt"))
+			Ω(err).Should(BeNil())
+
+			record := NewRecord(node.(*FileMeta))
+			record.Populate()
+			Ω(record.Store()).Should(Succeed())
+
+			matches, err := Grep("vampire", 10)
+			Ω(err).Should(BeNil())
+			Ω(matches).Should(HaveLen(1))
+			Ω(matches[0].Snippets).Should(HaveLen(MaxSnippets))
+			for _, excerpt := range matches[0].Snippets {
+				Ω(strings.ToLower(excerpt)).Should(ContainSubstring("vampire"))
+			}
+		})
+
+	})
+
+})
@@ -0,0 +1,378 @@
+// Geohash index of image coordinates for location based queries
+
+package crate
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+const (
+	GeoNamespace     = "geo"     // Namespace of the geohash index keys
+	GeohashPrecision = 12        // Characters of the geohash stored in the index
+	EarthRadius      = 6371.0088 // Mean radius of the earth in kilometers
+	maxCoverCells    = 32        // Maximum number of cells to scan for a query
+)
+
+const geohashAlphabet = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+//=============================================================================
+
+// A rectangular region bounded by latitude and longitude in degrees
+type BoundingBox struct {
+	MinLat float64 // Southern edge of the box
+	MinLon float64 // Western edge of the box
+	MaxLat float64 // Northern edge of the box
+	MaxLon float64 // Eastern edge of the box
+}
+
+// Create a BoundingBox from its western corner at lat1, lon1 and its eastern
+// corner at lat2, lon2. The latitudes may be in any order, but a western edge
+// east of the eastern edge is a box that wraps around the antimeridian.
+func NewBoundingBox(lat1, lon1, lat2, lon2 float64) (*BoundingBox, error) {
+	for _, lat := range []float64{lat1, lat2} {
+		if math.IsNaN(lat) || math.IsInf(lat, 0) || lat < -90 || lat > 90 {
+			return nil, errors.New("latitude must be between -90 and 90")
+		}
+	}
+
+	for _, lon := range []float64{lon1, lon2} {
+		if math.IsNaN(lon) || math.IsInf(lon, 0) || lon < -180 || lon > 180 {
+			return nil, errors.New("longitude must be between -180 and 180")
+		}
+	}
+
+	box := new(BoundingBox)
+	box.MinLat = math.Min(lat1, lat2)
+	box.MaxLat = math.Max(lat1, lat2)
+	box.MinLon = lon1
+	box.MaxLon = lon2
+	return box, nil
+}
+
+// Create the BoundingBox that encloses a circle of radius km around a point.
+// Boxes that would cross a pole are clamped to the edge, boxes that cross the
+// antimeridian wrap around it, so their MinLon is east of their MaxLon.
+func RadiusBox(lat, lon, radius float64) *BoundingBox {
+	dlat := radius / EarthRadius * 180 / math.Pi
+	dlon := 180.0
+	if coslat := math.Cos(lat * math.Pi / 180); coslat > 0 {
+		dlon = math.Min(dlat/coslat, 180)
+	}
+
+	box := new(BoundingBox)
+	box.MinLat = math.Max(lat-dlat, -90)
+	box.MaxLat = math.Min(lat+dlat, 90)
+
+	if dlon >= 180 {
+		box.MinLon, box.MaxLon = -180, 180
+		return box
+	}
+
+	box.MinLon, box.MaxLon = lon-dlon, lon+dlon
+	if box.MinLon < -180 {
+		box.MinLon += 360
+	}
+	if box.MaxLon > 180 {
+		box.MaxLon -= 360
+	}
+
+	return box
+}
+
+// Checks if the point is inside of the bounding box (edges inclusive)
+func (box *BoundingBox) Contains(lat, lon float64) bool {
+	if lat < box.MinLat || lat > box.MaxLat {
+		return false
+	}
+
+	if box.MinLon > box.MaxLon {
+		return lon >= box.MinLon || lon <= box.MaxLon
+	}
+
+	return lon >= box.MinLon && lon <= box.MaxLon
+}
+
+// Splits a box that wraps around the antimeridian into the boxes on either
+// side of it, any other box is returned as is
+func (box *BoundingBox) split() []*BoundingBox {
+	if box.MinLon <= box.MaxLon {
+		return []*BoundingBox{box}
+	}
+
+	return []*BoundingBox{
+		{box.MinLat, box.MinLon, box.MaxLat, 180},
+		{box.MinLat, -180, box.MaxLat, box.MaxLon},
+	}
+}
+
+// Returns the set of geohash prefixes whose cells together cover the box
+func (box *BoundingBox) Cover() []string {
+	seen := make(map[string]bool)
+	cells := make([]string, 0)
+
+	for _, part := range box.split() {
+		for _, cell := range part.cover() {
+			if !seen[cell] {
+				seen[cell] = true
+				cells = append(cells, cell)
+			}
+		}
+	}
+
+	sort.Strings(cells)
+	return cells
+}
+
+// Returns the geohash prefixes covering a box that doesn't wrap around
+func (box *BoundingBox) cover() []string {
+
+	// Find the longest prefix that covers the box with few enough cells
+	var latStep, lonStep float64
+	var latCells, lonCells int
+
+	precision := GeohashPrecision
+	for {
+		latStep, lonStep = geohashCellSize(precision)
+		latCells = int((box.MaxLat-box.MinLat)/latStep) + 2
+		lonCells = int((box.MaxLon-box.MinLon)/lonStep) + 2
+
+		if latCells*lonCells <= maxCoverCells || precision == 1 {
+			break
+		}
+
+		precision--
+	}
+
+	// Step across the box by the cell size, clamping the last step to the edge
+	seen := make(map[string]bool)
+	cells := make([]string, 0, latCells*lonCells)
+
+	for i := 0; i < latCells; i++ {
+		lat := math.Min(box.MinLat+float64(i)*latStep, box.MaxLat)
+		for j := 0; j < lonCells; j++ {
+			lon := math.Min(box.MinLon+float64(j)*lonStep, box.MaxLon)
+			cell := Geohash(lat, lon, precision)
+			if !seen[cell] {
+				seen[cell] = true
+				cells = append(cells, cell)
+			}
+		}
+	}
+
+	return cells
+}
+
+//=============================================================================
+
+// Encodes a latitude and longitude into a geohash of the given precision
+func Geohash(lat, lon float64, precision int) string {
+	minLat, maxLat := -90.0, 90.0
+	minLon, maxLon := -180.0, 180.0
+
+	hash := make([]byte, 0, precision)
+	even := true
+	bit := 0
+	ch := 0
+
+	for len(hash) < precision {
+		if even {
+			mid := (minLon + maxLon) / 2
+			if lon >= mid {
+				ch |= 1 << uint(4-bit)
+				minLon = mid
+			} else {
+				maxLon = mid
+			}
+		} else {
+			mid := (minLat + maxLat) / 2
+			if lat >= mid {
+				ch |= 1 << uint(4-bit)
+				minLat = mid
+			} else {
+				maxLat = mid
+			}
+		}
+
+		even = !even
+		if bit < 4 {
+			bit++
+		} else {
+			hash = append(hash, geohashAlphabet[ch])
+			bit = 0
+			ch = 0
+		}
+	}
+
+	return string(hash)
+}
+
+// Decodes a geohash into the bounding box of the cell that it describes
+func GeohashBox(hash string) (*BoundingBox, error) {
+	box := &BoundingBox{-90, -180, 90, 180}
+	even := true
+
+	for _, c := range hash {
+		idx := strings.IndexRune(geohashAlphabet, c)
+		if idx < 0 {
+			return nil, errors.New("invalid character in geohash")
+		}
+
+		for bit := 4; bit >= 0; bit-- {
+			on := idx&(1<<uint(bit)) != 0
+			if even {
+				mid := (box.MinLon + box.MaxLon) / 2
+				if on {
+					box.MinLon = mid
+				} else {
+					box.MaxLon = mid
+				}
+			} else {
+				mid := (box.MinLat + box.MaxLat) / 2
+				if on {
+					box.MinLat = mid
+				} else {
+					box.MaxLat = mid
+				}
+			}
+			even = !even
+		}
+	}
+
+	return box, nil
+}
+
+// Returns the height and width in degrees of a geohash cell at a precision
+func geohashCellSize(precision int) (float64, float64) {
+	bits := uint(5 * precision)
+	lonBits := (bits + 1) / 2
+	latBits := bits / 2
+
+	return 180 / math.Exp2(float64(latBits)), 360 / math.Exp2(float64(lonBits))
+}
+
+// Computes the great circle distance in kilometers between two points
+func Distance(lat1, lon1, lat2, lon2 float64) float64 {
+	rad := math.Pi / 180
+	dlat := (lat2 - lat1) * rad
+	dlon := (lon2 - lon1) * rad
+
+	a := math.Sin(dlat/2)*math.Sin(dlat/2) +
+		math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Sin(dlon/2)*math.Sin(dlon/2)
+
+	return 2 * EarthRadius * math.Asin(math.Min(1, math.Sqrt(a)))
+}
+
+//=============================================================================
+
+// Indexes the locations of records by their geohash, see FindNear
+type GeoIndex struct{}
+
+func init() {
+	RegisterIndex(new(GeoIndex))
+}
+
+func (index *GeoIndex) Name() string {
+	return GeoNamespace
+}
+
+func (index *GeoIndex) Add(batch *leveldb.Batch, record FilePath) {
+	if tagged, ok := record.(TaggedPath); ok {
+		indexLocation(batch, record.File().Signature, tagged)
+	}
+}
+
+func (index *GeoIndex) Remove(batch *leveldb.Batch, record FilePath) {
+	if tagged, ok := record.(TaggedPath); ok {
+		unindexLocation(batch, record.File().Signature, tagged)
+	}
+}
+
+// Adds the geohash index entry for a located record to the write batch
+func indexLocation(batch *leveldb.Batch, signature string, record TaggedPath) {
+	if lat, lon, ok := record.Location(); ok {
+		hash := Geohash(lat, lon, GeohashPrecision)
+		batch.Put(indexKey(GeoNamespace, hash, signature), nil)
+	}
+}
+
+// Adds the deletion of the geohash index entry of a record to the write batch
+func unindexLocation(batch *leveldb.Batch, signature string, record TaggedPath) {
+	if lat, lon, ok := record.Location(); ok {
+		hash := Geohash(lat, lon, GeohashPrecision)
+		batch.Delete(indexKey(GeoNamespace, hash, signature))
+	}
+}
+
+// Returns the signatures of the records indexed inside the bounding box. The
+// index is only coarse, the records must still be checked against the box.
+func geoCandidates(box *BoundingBox) []string {
+	seen := make(map[string]bool)
+	result := make([]string, 0)
+
+	for _, cell := range box.Cover() {
+		iter := db.NewIterator(indexRange(GeoNamespace, cell), nil)
+
+		for iter.Next() {
+			signature := indexSignature(iter.Key())
+			if !seen[signature] {
+				seen[signature] = true
+				result = append(result, signature)
+			}
+		}
+
+		iter.Release()
+	}
+
+	return result
+}
+
+//=============================================================================
+
+// Find the records within radius km of the point, taken in the date range.
+// Zero times leave that end of the date range open, results are by distance.
+func FindNear(lat, lon, radius float64, after, before time.Time) ([]FilePath, error) {
+	query := new(Query)
+	query.Add(&NearPredicate{lat, lon, radius})
+	query.Add(&DatePredicate{after, before})
+
+	return Search(query)
+}
+
+// Find the records inside of the bounding box, taken in the date range.
+// Zero times leave that end of the date range open.
+func FindWithin(box *BoundingBox, after, before time.Time) ([]FilePath, error) {
+	query := new(Query)
+	query.Add(&BoxPredicate{box})
+	query.Add(&DatePredicate{after, before})
+
+	return Search(query)
+}
+
+// Sorts located records by their distance from a point
+type byDistance struct {
+	records []FilePath
+	lat     float64
+	lon     float64
+}
+
+func (s byDistance) Len() int      { return len(s.records) }
+func (s byDistance) Swap(i, j int) { s.records[i], s.records[j] = s.records[j], s.records[i] }
+func (s byDistance) Less(i, j int) bool {
+	return s.distance(s.records[i]) < s.distance(s.records[j])
+}
+
+func (s byDistance) distance(record FilePath) float64 {
+	if tagged, ok := record.(TaggedPath); ok {
+		if lat, lon, ok := tagged.Location(); ok {
+			return Distance(s.lat, s.lon, lat, lon)
+		}
+	}
+
+	return math.Inf(1)
+}
@@ -0,0 +1,231 @@
+package crate_test
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+
+	. "github.com/bbengfort/crate/crate"
+	"github.com/bbengfort/crate/crate/config"
+	"github.com/syndtr/goleveldb/leveldb"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Geo", func() {
+
+	Describe("Geohash", func() {
+
+		It("should encode a point as a geohash", func() {
+			Ω(Geohash(57.64911, 10.40744, 11)).Should(Equal("u4pruydqqvj"))
+			Ω(Geohash(31.510427472222222, -9.774266222222224, 5)).Should(Equal("ev953"))
+		})
+
+		It("should decode a geohash into a box containing the point", func() {
+			box, err := GeohashBox("u4pruydqqvj")
+			Ω(err).Should(BeNil())
+			Ω(box.Contains(57.64911, 10.40744)).Should(BeTrue())
+			Ω(box.MaxLat - box.MinLat).Should(BeNumerically("<", 0.0001))
+		})
+
+		It("should not decode an invalid geohash", func() {
+			_, err := GeohashBox("u4pa")
+			Ω(err).Should(HaveOccurred())
+		})
+
+	})
+
+	Describe("BoundingBox", func() {
+
+		It("should normalize the corners of a box", func() {
+			box, err := NewBoundingBox(32, -10, 31, -9)
+			Ω(err).Should(BeNil())
+			Ω(box.MinLat).Should(Equal(31.0))
+			Ω(box.MaxLat).Should(Equal(32.0))
+			Ω(box.MinLon).Should(Equal(-10.0))
+			Ω(box.MaxLon).Should(Equal(-9.0))
+		})
+
+		It("should wrap a box whose western edge is east of its eastern edge", func() {
+			box, err := NewBoundingBox(-20, 170, -10, -170)
+			Ω(err).Should(BeNil())
+			Ω(box.Contains(-15, 179)).Should(BeTrue())
+			Ω(box.Contains(-15, -179)).Should(BeTrue())
+			Ω(box.Contains(-15, 0)).Should(BeFalse())
+		})
+
+		It("should not create a box with invalid coordinates", func() {
+			_, err := NewBoundingBox(91, 0, 0, 0)
+			Ω(err).Should(HaveOccurred())
+
+			_, err = NewBoundingBox(0, 0, 0, -181)
+			Ω(err).Should(HaveOccurred())
+
+			_, err = NewBoundingBox(math.NaN(), 0, 1, 1)
+			Ω(err).Should(HaveOccurred())
+
+			_, err = NewBoundingBox(0, math.Inf(1), 1, 1)
+			Ω(err).Should(HaveOccurred())
+		})
+
+		It("should enclose a radius around a point", func() {
+			box := RadiusBox(31.51, -9.77, 5)
+			Ω(box.Contains(31.51, -9.77)).Should(BeTrue())
+			Ω(box.Contains(31.54, -9.80)).Should(BeTrue())
+			Ω(box.Contains(31.60, -9.77)).Should(BeFalse())
+		})
+
+		It("should wrap a radius around the antimeridian", func() {
+			box := RadiusBox(-17.5, 179.9, 50)
+			Ω(box.MinLon).Should(BeNumerically(">", box.MaxLon))
+			Ω(box.Contains(-17.5, 179.9)).Should(BeTrue())
+			Ω(box.Contains(-17.5, -179.9)).Should(BeTrue())
+			Ω(box.Contains(-17.5, 0)).Should(BeFalse())
+
+			cover := box.Cover()
+			for _, lon := range []float64{179.9, -179.9} {
+				hash := Geohash(-17.5, lon, GeohashPrecision)
+				covered := false
+				for _, cell := range cover {
+					if hash[:len(cell)] == cell {
+						covered = true
+					}
+				}
+				Ω(covered).Should(BeTrue(), "%v is not covered", lon)
+			}
+		})
+
+		It("should be covered by cells containing its corners and center", func() {
+			box := RadiusBox(31.51, -9.77, 5)
+			cover := box.Cover()
+			Ω(len(cover)).Should(BeNumerically("<=", 32))
+
+			for _, point := range [][]float64{
+				{box.MinLat, box.MinLon}, {box.MaxLat, box.MaxLon},
+				{box.MinLat, box.MaxLon}, {box.MaxLat, box.MinLon},
+				{31.51, -9.77},
+			} {
+				hash := Geohash(point[0], point[1], GeohashPrecision)
+				covered := false
+				for _, cell := range cover {
+					if hash[:len(cell)] == cell {
+						covered = true
+					}
+				}
+				Ω(covered).Should(BeTrue(), "%v is not covered", point)
+			}
+		})
+
+	})
+
+	It("should compute the distance between two points", func() {
+		// Essaouira to Marrakech is about 170km as the crow flies
+		dist := Distance(31.5085, -9.7595, 31.6295, -7.9811)
+		Ω(dist).Should(BeNumerically("~", 169.3, 0.5))
+		Ω(Distance(31.5, -9.7, 31.5, -9.7)).Should(BeZero())
+	})
+
+	Describe("Index", func() {
+
+		var (
+			err      error      // Any errors in directory creation
+			testRoot string     // Test directory to store temp fixtures
+			testHome string     // Fake home directory in temp directory
+			coast    *ImageMeta // An ImageMeta with GPS data
+			ferry    *ImageMeta // An ImageMeta without GPS data
+		)
+
+		BeforeEach(func() {
+			testRoot, err = ioutil.TempDir("", "ginkgo-")
+			Ω(err).Should(BeNil())
+
+			testHome = filepath.Join(testRoot, "Users", "jdoe")
+			err = os.MkdirAll(testHome, 0755)
+			Ω(err).Should(BeNil())
+
+			if runtime.GOOS == "windows" {
+				Ω(os.Setenv("USERPROFILE", testHome)).Should(BeNil())
+			} else {
+				Ω(os.Setenv("HOME", testHome)).Should(BeNil())
+			}
+
+			coast = ImageFromPath(filepath.Join("..", "fixtures", "coast.jpg"))
+			ferry = ImageFromPath(filepath.Join("..", "fixtures", "ferry.jpg"))
+
+			Ω(InitializeDatabase()).Should(BeNil())
+			Ω(coast.Store()).Should(BeNil())
+			Ω(ferry.Store()).Should(BeNil())
+		})
+
+		AfterEach(func() {
+			CloseDatabase()
+			Ω(os.RemoveAll(testRoot)).Should(BeNil())
+
+			if runtime.GOOS == "windows" {
+				Ω(os.Unsetenv("USERPROFILE")).Should(BeNil())
+			} else {
+				Ω(os.Unsetenv("HOME")).Should(BeNil())
+			}
+
+			config.ClearPathCache()
+		})
+
+		It("should not return index keys as records", func() {
+			Ω(FetchKeys(100)).Should(HaveLen(2))
+		})
+
+		It("should find images near a point", func() {
+			results, err := FindNear(31.5, -9.77, 5, time.Time{}, time.Time{})
+			Ω(err).Should(BeNil())
+			Ω(results).Should(HaveLen(1))
+			Ω(results[0].File().Signature).Should(Equal(coast.Signature))
+
+			results, err = FindNear(31.6295, -7.9811, 5, time.Time{}, time.Time{})
+			Ω(err).Should(BeNil())
+			Ω(results).Should(BeEmpty())
+		})
+
+		It("should skip index keys of records that no longer exist", func() {
+			path, err := config.CrateDatabasePath()
+			Ω(err).Should(BeNil())
+
+			// Delete the record but leave its geohash index keys
+			Ω(CloseDatabase()).Should(Succeed())
+			store, err := leveldb.OpenFile(path, nil)
+			Ω(err).Should(BeNil())
+			Ω(store.Delete([]byte(coast.Signature), nil)).Should(Succeed())
+			Ω(store.Close()).Should(Succeed())
+			Ω(InitializeDatabase()).Should(Succeed())
+
+			results, err := FindNear(31.5, -9.77, 5, time.Time{}, time.Time{})
+			Ω(err).Should(BeNil())
+			Ω(results).Should(BeEmpty())
+		})
+
+		It("should find images inside of a bounding box", func() {
+			box, _ := NewBoundingBox(31, -10, 32, -9)
+			results, err := FindWithin(box, time.Time{}, time.Time{})
+			Ω(err).Should(BeNil())
+			Ω(results).Should(HaveLen(1))
+		})
+
+		It("should combine location with a date range", func() {
+			after, _ := time.Parse("2006-01-02", "2015-01-01")
+			before, _ := time.Parse("2006-01-02", "2015-01-05")
+
+			results, err := FindNear(31.5, -9.77, 5, after, time.Time{})
+			Ω(err).Should(BeNil())
+			Ω(results).Should(HaveLen(1))
+
+			results, err = FindNear(31.5, -9.77, 5, after, before)
+			Ω(err).Should(BeNil())
+			Ω(results).Should(BeEmpty())
+		})
+
+	})
+
+})
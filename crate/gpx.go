@@ -0,0 +1,223 @@
+// Geotags images by matching their capture time to GPX track logs
+
+package crate
+
+import (
+	"encoding/xml"
+	"errors"
+	"os"
+	"sort"
+	"time"
+)
+
+const (
+	GeoSourceExif = "exif" // Location was recorded by the camera in the EXIF or movie
+	GeoSourceGPX  = "gpx"  // Location was inferred from a GPX track log
+)
+
+//=============================================================================
+
+// A single timestamped location from a GPS logger
+type TrackPoint struct {
+	Latitude  float64   // Latitude in degrees
+	Longitude float64   // Longitude in degrees
+	Elevation float64   // Elevation in meters
+	Time      time.Time // The UTC time the point was logged
+}
+
+// A time ordered series of points from one or more GPX files
+type Track struct {
+	Points []TrackPoint // The points ordered by time
+}
+
+// Structs for unmarshaling the subset of GPX that crate uses
+type gpxFile struct {
+	Tracks []gpxTrack `xml:"trk"`
+}
+
+type gpxTrack struct {
+	Segments []gpxSegment `xml:"trkseg"`
+}
+
+type gpxSegment struct {
+	Points []gpxPoint `xml:"trkpt"`
+}
+
+type gpxPoint struct {
+	Latitude  float64 `xml:"lat,attr"`
+	Longitude float64 `xml:"lon,attr"`
+	Elevation float64 `xml:"ele"`
+	Time      string  `xml:"time"`
+}
+
+//=============================================================================
+
+// Load one or more GPX files into a single Track
+func LoadTrack(paths ...string) (*Track, error) {
+	track := new(Track)
+
+	for _, path := range paths {
+		if err := track.Load(path); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(track.Points) == 0 {
+		return nil, errors.New("no timestamped track points in the GPX files")
+	}
+
+	return track, nil
+}
+
+// Add the track points in a GPX file to the Track, points without a time are
+// ignored since they can't be matched to an image.
+func (track *Track) Load(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	gpx := new(gpxFile)
+	if err := xml.NewDecoder(file).Decode(gpx); err != nil {
+		return err
+	}
+
+	for _, trk := range gpx.Tracks {
+		for _, seg := range trk.Segments {
+			for _, pt := range seg.Points {
+				ts, err := time.Parse(time.RFC3339, pt.Time)
+				if err != nil {
+					continue
+				}
+
+				track.Add(TrackPoint{pt.Latitude, pt.Longitude, pt.Elevation, ts.UTC()})
+			}
+		}
+	}
+
+	return nil
+}
+
+// Add a point to the track, keeping the points in time order
+func (track *Track) Add(point TrackPoint) {
+	idx := sort.Search(len(track.Points), func(i int) bool {
+		return track.Points[i].Time.After(point.Time)
+	})
+
+	track.Points = append(track.Points, TrackPoint{})
+	copy(track.Points[idx+1:], track.Points[idx:])
+	track.Points[idx] = point
+}
+
+// Find the location at a UTC time by interpolating between the surrounding
+// track points. If the points are more than maxGap apart, only a point within
+// maxGap of the time is used; returns false if there is no such point.
+func (track *Track) Locate(ts time.Time, maxGap time.Duration) (float64, float64, bool) {
+	points := track.Points
+	if len(points) == 0 {
+		return 0, 0, false
+	}
+
+	idx := sort.Search(len(points), func(i int) bool {
+		return !points[i].Time.Before(ts)
+	})
+
+	// Before the start or after the end of the track
+	if idx == 0 || idx == len(points) {
+		if idx == len(points) {
+			idx--
+		}
+
+		if absDuration(points[idx].Time.Sub(ts)) <= maxGap {
+			return points[idx].Latitude, points[idx].Longitude, true
+		}
+
+		return 0, 0, false
+	}
+
+	prev, next := points[idx-1], points[idx]
+	span := next.Time.Sub(prev.Time)
+
+	// Interpolate linearly between the points if they are close enough
+	if span <= maxGap {
+		if span == 0 {
+			return next.Latitude, next.Longitude, true
+		}
+
+		frac := float64(ts.Sub(prev.Time)) / float64(span)
+		lat := prev.Latitude + frac*(next.Latitude-prev.Latitude)
+		lon := prev.Longitude + frac*(next.Longitude-prev.Longitude)
+		return lat, lon, true
+	}
+
+	// Otherwise use the nearest point if it is close enough
+	nearest := prev
+	if next.Time.Sub(ts) < ts.Sub(prev.Time) {
+		nearest = next
+	}
+
+	if absDuration(nearest.Time.Sub(ts)) <= maxGap {
+		return nearest.Latitude, nearest.Longitude, true
+	}
+
+	return 0, 0, false
+}
+
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
+
+//=============================================================================
+
+// Geotag the image from the track if it has no location recorded by the
+// camera. The offset is the camera clock minus UTC (e.g. 2h for a camera set
+// to CEST) and is subtracted from DateTaken before matching. Returns true if
+// the image was tagged with an inferred location.
+func (img *ImageMeta) Geotag(track *Track, offset, maxGap time.Duration) bool {
+	if !img.populated {
+		img.Populate()
+	}
+
+	if _, _, ok := img.Location(); ok && img.Tag("GeoSource") != GeoSourceGPX {
+		return false
+	}
+
+	taken, ok := img.Taken()
+	if !ok {
+		return false
+	}
+
+	lat, lon, ok := track.Locate(taken.Add(-offset), maxGap)
+	if !ok {
+		return false
+	}
+
+	if img.Tags == nil {
+		img.Tags = make(TagMap)
+	}
+
+	img.Tags["Latitude"] = Ftoa(lat)
+	img.Tags["Longitude"] = Ftoa(lon)
+	img.Tags["GeoSource"] = GeoSourceGPX
+	return true
+}
+
+// Keeps a location previously inferred from a track log when the image is
+// stored again without one, so a backup doesn't discard geotagging.
+func (img *ImageMeta) preserveInferredLocation(prev *ImageMeta) {
+	if _, _, ok := img.Location(); ok || prev.Tag("GeoSource") != GeoSourceGPX {
+		return
+	}
+
+	if img.Tags == nil {
+		img.Tags = make(TagMap)
+	}
+
+	img.Tags["Latitude"] = prev.Tag("Latitude")
+	img.Tags["Longitude"] = prev.Tag("Longitude")
+	img.Tags["GeoSource"] = GeoSourceGPX
+}
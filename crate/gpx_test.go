@@ -0,0 +1,127 @@
+package crate_test
+
+import (
+	"io/ioutil"
+	"os"
+	"time"
+
+	. "github.com/bbengfort/crate/crate"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+const gpxFixture = `<?xml version="1.0" encoding="UTF-8"?>
+<gpx version="1.1" creator="ginkgo" xmlns="http://www.topografix.com/GPX/1/1">
+  <trk>
+    <trkseg>
+      <trkpt lat="31.50" lon="-9.78"><ele>10</ele><time>2015-01-05T09:50:00Z</time></trkpt>
+      <trkpt lat="31.52" lon="-9.76"><ele>12</ele><time>2015-01-05T09:52:00Z</time></trkpt>
+      <trkpt lat="31.60" lon="-9.70"><time>2015-01-05T11:00:00Z</time></trkpt>
+      <trkpt lat="31.70" lon="-9.60"></trkpt>
+    </trkseg>
+  </trk>
+</gpx>`
+
+var _ = Describe("GPX", func() {
+
+	var (
+		gpxPath string // Path to the temporary GPX track log
+		track   *Track // The track loaded from the GPX fixture
+	)
+
+	stamp := func(value string) time.Time {
+		ts, err := time.Parse(time.RFC3339, value)
+		Ω(err).Should(BeNil())
+		return ts
+	}
+
+	BeforeEach(func() {
+		file, err := ioutil.TempFile("", "ginkgo-")
+		Ω(err).Should(BeNil())
+		file.WriteString(gpxFixture)
+		file.Close()
+
+		gpxPath = file.Name()
+		track, err = LoadTrack(gpxPath)
+		Ω(err).Should(BeNil())
+	})
+
+	AfterEach(func() {
+		os.Remove(gpxPath)
+	})
+
+	It("should load timestamped track points in order", func() {
+		Ω(track.Points).Should(HaveLen(3))
+		Ω(track.Points[0].Elevation).Should(Equal(10.0))
+		Ω(track.Points[2].Time).Should(Equal(stamp("2015-01-05T11:00:00Z")))
+	})
+
+	It("should keep points added out of order sorted by time", func() {
+		track.Add(TrackPoint{31.51, -9.77, 0, stamp("2015-01-05T09:51:00Z")})
+		Ω(track.Points).Should(HaveLen(4))
+		Ω(track.Points[1].Latitude).Should(Equal(31.51))
+	})
+
+	It("should not load a file without track points", func() {
+		_, err := LoadTrack()
+		Ω(err).Should(HaveOccurred())
+	})
+
+	It("should interpolate between close track points", func() {
+		lat, lon, ok := track.Locate(stamp("2015-01-05T09:51:00Z"), 5*time.Minute)
+		Ω(ok).Should(BeTrue())
+		Ω(lat).Should(BeNumerically("~", 31.51, 1e-9))
+		Ω(lon).Should(BeNumerically("~", -9.77, 1e-9))
+	})
+
+	It("should use the nearest point across a large gap", func() {
+		lat, _, ok := track.Locate(stamp("2015-01-05T09:55:00Z"), 5*time.Minute)
+		Ω(ok).Should(BeTrue())
+		Ω(lat).Should(Equal(31.52))
+
+		_, _, ok = track.Locate(stamp("2015-01-05T10:20:00Z"), 5*time.Minute)
+		Ω(ok).Should(BeFalse())
+	})
+
+	It("should only extend the ends of the track by the max gap", func() {
+		_, _, ok := track.Locate(stamp("2015-01-05T09:47:00Z"), 5*time.Minute)
+		Ω(ok).Should(BeTrue())
+
+		_, _, ok = track.Locate(stamp("2015-01-05T09:40:00Z"), 5*time.Minute)
+		Ω(ok).Should(BeFalse())
+
+		_, _, ok = track.Locate(stamp("2015-01-05T11:10:00Z"), 5*time.Minute)
+		Ω(ok).Should(BeFalse())
+	})
+
+	Describe("Geotag", func() {
+
+		var img *ImageMeta
+
+		BeforeEach(func() {
+			img = ImageFromPath("../fixtures/ferry.jpg")
+			img.Populate()
+			img.Tags["DateTaken"] = "2015-01-05T10:51:00+00:00"
+		})
+
+		It("should geotag an image with the camera offset", func() {
+			Ω(img.Geotag(track, 0, 5*time.Minute)).Should(BeFalse())
+			Ω(img.Geotag(track, time.Hour, 5*time.Minute)).Should(BeTrue())
+
+			lat, lon, ok := img.Location()
+			Ω(ok).Should(BeTrue())
+			Ω(lat).Should(BeNumerically("~", 31.51, 1e-9))
+			Ω(lon).Should(BeNumerically("~", -9.77, 1e-9))
+			Ω(img.Tag("GeoSource")).Should(Equal(GeoSourceGPX))
+		})
+
+		It("should not geotag an image located by the camera", func() {
+			coast := ImageFromPath("../fixtures/coast.jpg")
+			Ω(coast.Geotag(track, 0, 24*time.Hour)).Should(BeFalse())
+			Ω(coast.Tag("GeoSource")).Should(Equal(GeoSourceExif))
+		})
+
+	})
+
+})
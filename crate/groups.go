@@ -0,0 +1,320 @@
+// Groups images into bursts, shot by one camera within seconds of each other,
+// and events, shot without long breaks in time or moves in place. The groups
+// are stored in the database so that they can be listed and used as albums.
+
+package crate
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+const (
+	GroupNamespace = "group" // Namespace of the stored groups
+	GroupBurst     = "burst" // Kind of the groups of images shot in a burst
+	GroupEvent     = "event" // Kind of the groups of images shot at an event
+	groupIDLayout  = "20060102T150405"
+)
+
+var ErrNoGroup = errors.New("no group with that id")
+
+//=============================================================================
+
+// The thresholds that split the images into groups
+type GroupThresholds struct {
+	BurstGap    time.Duration // Longest time between the images of a burst
+	EventGap    time.Duration // Longest time between the images of an event
+	EventRadius float64       // Farthest in km between located images of an event
+}
+
+// A group of images, e.g. a burst or an event, ordered by when they were taken
+type Group struct {
+	ID        string    // Kind and start of the group, e.g. burst-20150105T095720
+	Kind      string    // Either burst or event
+	Start     time.Time // When the first image was taken
+	End       time.Time // When the last image was taken
+	Camera    string    // Make and model of the camera that shot a burst
+	Latitude  float64   // Mean latitude of the located images, if any
+	Longitude float64   // Mean longitude of the located images, if any
+	Located   bool      // Whether any of the images are located
+	Members   []string  // Signatures of the images in the group
+}
+
+// Whether the record of the signature is in the group
+func (group *Group) Contains(signature string) bool {
+	for _, member := range group.Members {
+		if member == signature {
+			return true
+		}
+	}
+
+	return false
+}
+
+// An image that can be grouped, i.e. it was taken at a known time
+type groupedImage struct {
+	signature string
+	taken     time.Time
+	camera    string
+	lat, lon  float64
+	located   bool
+}
+
+//=============================================================================
+
+// Splits the images into bursts of images shot by the same camera within the
+// gap of each other. Images without a DateTaken or camera aren't in bursts
+// and only bursts of more than one image are returned.
+func FindBursts(images []*ImageMeta, gap time.Duration) []*Group {
+	cameras := make(map[string][]*groupedImage)
+	for _, img := range groupable(images) {
+		if img.camera != "" {
+			cameras[img.camera] = append(cameras[img.camera], img)
+		}
+	}
+
+	bursts := make([]*Group, 0)
+	for _, shots := range cameras {
+		bursts = append(bursts, split(GroupBurst, shots, func(prev, next *groupedImage) bool {
+			return next.taken.Sub(prev.taken) > gap
+		})...)
+	}
+
+	return identify(bursts)
+}
+
+// Splits the images into events, which end when the time between two images
+// is longer than the gap or two located images are farther apart than the
+// radius in km. Only events of more than one image are returned.
+func FindEvents(images []*ImageMeta, gap time.Duration, radius float64) []*Group {
+	var last *groupedImage // The last located image of the event
+	events := split(GroupEvent, groupable(images), func(prev, next *groupedImage) bool {
+		if last == nil && prev.located {
+			last = prev
+		}
+
+		breaks := next.taken.Sub(prev.taken) > gap
+		if !breaks && last != nil && next.located {
+			breaks = Distance(last.lat, last.lon, next.lat, next.lon) > radius
+		}
+
+		if breaks {
+			last = nil
+		}
+
+		if next.located {
+			last = next
+		}
+
+		return breaks
+	})
+
+	return identify(events)
+}
+
+// Returns the images with a DateTaken ordered by it
+func groupable(images []*ImageMeta) []*groupedImage {
+	result := make([]*groupedImage, 0, len(images))
+	for _, img := range images {
+		taken, ok := img.Taken()
+		if !ok {
+			continue
+		}
+
+		grouped := &groupedImage{signature: img.Signature, taken: taken}
+		grouped.camera = strings.TrimSpace(img.Tag("CameraMake") + " " + img.Tag("CameraModel"))
+		grouped.lat, grouped.lon, grouped.located = img.Location()
+		result = append(result, grouped)
+	}
+
+	sort.SliceStable(result, func(i, j int) bool {
+		if !result[i].taken.Equal(result[j].taken) {
+			return result[i].taken.Before(result[j].taken)
+		}
+		return result[i].signature < result[j].signature
+	})
+
+	return result
+}
+
+// Splits the ordered images into groups where breaks returns true between
+// two consecutive images, dropping the groups of a single image
+func split(kind string, images []*groupedImage, breaks func(prev, next *groupedImage) bool) []*Group {
+	groups := make([]*Group, 0)
+	start := 0
+
+	for idx := 1; idx <= len(images); idx++ {
+		if idx < len(images) && !breaks(images[idx-1], images[idx]) {
+			continue
+		}
+
+		if idx-start > 1 {
+			groups = append(groups, newGroup(kind, images[start:idx]))
+		}
+		start = idx
+	}
+
+	return groups
+}
+
+// Creates the group of the ordered images
+func newGroup(kind string, images []*groupedImage) *Group {
+	group := &Group{Kind: kind, Start: images[0].taken, End: images[len(images)-1].taken}
+	group.Camera = images[0].camera
+
+	located := 0
+	for _, img := range images {
+		group.Members = append(group.Members, img.signature)
+		if img.camera != group.Camera {
+			group.Camera = ""
+		}
+
+		if img.located {
+			group.Latitude += img.lat
+			group.Longitude += img.lon
+			located++
+		}
+	}
+
+	if located > 0 {
+		group.Latitude /= float64(located)
+		group.Longitude /= float64(located)
+		group.Located = true
+	}
+
+	if kind != GroupBurst {
+		group.Camera = ""
+	}
+
+	return group
+}
+
+// Orders the groups by their start and sets their ids from their kind and
+// start, numbering the groups that start in the same second
+func identify(groups []*Group) []*Group {
+	sort.SliceStable(groups, func(i, j int) bool {
+		if !groups[i].Start.Equal(groups[j].Start) {
+			return groups[i].Start.Before(groups[j].Start)
+		}
+		return groups[i].Members[0] < groups[j].Members[0]
+	})
+
+	seen := make(map[string]int)
+	for _, group := range groups {
+		id := fmt.Sprintf("%s-%s", group.Kind, group.Start.UTC().Format(groupIDLayout))
+		seen[id]++
+		if seen[id] > 1 {
+			id = fmt.Sprintf("%s-%d", id, seen[id])
+		}
+		group.ID = id
+	}
+
+	return groups
+}
+
+//=============================================================================
+
+// Groups every image in the database into bursts and events, replacing the
+// stored groups, so that grouping can be run again with other thresholds.
+func RegroupImages(thresholds *GroupThresholds) ([]*Group, error) {
+	images := make([]*ImageMeta, 0)
+	err := EachRecord(func(record FilePath) error {
+		if img, ok := record.(*ImageMeta); ok {
+			images = append(images, img)
+		}
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	groups := FindBursts(images, thresholds.BurstGap)
+	groups = append(groups, FindEvents(images, thresholds.EventGap, thresholds.EventRadius)...)
+
+	batch := new(leveldb.Batch)
+	iter := db.NewIterator(indexRange(GroupNamespace), nil)
+	for iter.Next() {
+		batch.Delete(append([]byte(nil), iter.Key()...))
+	}
+	iter.Release()
+
+	if err := iter.Error(); err != nil {
+		return nil, err
+	}
+
+	for _, group := range groups {
+		data, err := json.Marshal(group)
+		if err != nil {
+			return nil, err
+		}
+		batch.Put(indexKey(GroupNamespace, group.ID), data)
+	}
+
+	return groups, db.Write(batch, nil)
+}
+
+// Returns the stored groups of the kind (or of every kind if it is empty)
+// ordered by their start
+func ListGroups(kind string) ([]*Group, error) {
+	groups := make([]*Group, 0)
+	iter := db.NewIterator(indexRange(GroupNamespace), nil)
+	defer iter.Release()
+
+	for iter.Next() {
+		group := new(Group)
+		if err := json.Unmarshal(iter.Value(), group); err != nil {
+			return nil, err
+		}
+
+		if kind == "" || group.Kind == kind {
+			groups = append(groups, group)
+		}
+	}
+
+	sort.SliceStable(groups, func(i, j int) bool {
+		return groups[i].Start.Before(groups[j].Start)
+	})
+
+	return groups, iter.Error()
+}
+
+// Fetches the stored group with the id
+func FetchGroup(id string) (*Group, error) {
+	data, err := db.Get(indexKey(GroupNamespace, id), nil)
+	if err == leveldb.ErrNotFound {
+		return nil, ErrNoGroup
+	} else if err != nil {
+		return nil, err
+	}
+
+	group := new(Group)
+	return group, json.Unmarshal(data, group)
+}
+
+//=============================================================================
+
+// Matches the records in a stored group, so that groups can be searched and
+// exported as albums, e.g. group:event-20150105T095720
+type GroupPredicate struct {
+	ID    string // The id of the group
+	group *Group // The group, fetched when the predicate is first matched
+}
+
+func (pred *GroupPredicate) Match(record FilePath) bool {
+	if pred.group == nil {
+		group, err := FetchGroup(pred.ID)
+		if err != nil {
+			return false
+		}
+		pred.group = group
+	}
+
+	return pred.group.Contains(record.File().Signature)
+}
@@ -0,0 +1,195 @@
+package crate_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+
+	. "github.com/bbengfort/crate/crate"
+	"github.com/bbengfort/crate/crate/config"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Groups", func() {
+
+	var start = time.Date(2015, 1, 5, 9, 57, 20, 0, time.UTC)
+
+	// Creates an image record taken seconds after the start with the camera
+	// and, unless they are zero, the coordinates
+	shot := func(signature string, seconds int, camera string, lat, lon float64) *ImageMeta {
+		img := new(ImageMeta)
+		img.Signature = signature
+		img.Tags = TagMap{
+			"DateTaken":   JSONStamp(start.Add(time.Duration(seconds) * time.Second)),
+			"CameraModel": camera,
+		}
+
+		if lat != 0 || lon != 0 {
+			img.Tags["Latitude"] = fmt.Sprintf("%f", lat)
+			img.Tags["Longitude"] = fmt.Sprintf("%f", lon)
+		}
+
+		return img
+	}
+
+	// Returns the members of each group
+	members := func(groups []*Group) [][]string {
+		result := make([][]string, 0)
+		for _, group := range groups {
+			result = append(result, group.Members)
+		}
+		return result
+	}
+
+	It("should group the images of a camera shot within seconds into bursts", func() {
+		images := []*ImageMeta{
+			shot("a1", 0, "Nexus 5", 0, 0),
+			shot("a3", 2, "Nexus 5", 0, 0),
+			shot("a2", 1, "Nexus 5", 0, 0),
+			shot("b1", 1, "EOS 5D", 0, 0),
+			shot("b2", 2, "EOS 5D", 0, 0),
+			shot("a4", 10, "Nexus 5", 0, 0),
+			shot("c1", 3, "", 0, 0),
+			shot("c2", 3, "", 0, 0),
+			new(ImageMeta),
+		}
+
+		bursts := FindBursts(images, 2*time.Second)
+		Ω(members(bursts)).Should(Equal([][]string{{"a1", "a2", "a3"}, {"b1", "b2"}}))
+
+		Ω(bursts[0].ID).Should(Equal("burst-20150105T095720"))
+		Ω(bursts[0].Kind).Should(Equal(GroupBurst))
+		Ω(bursts[0].Camera).Should(Equal("Nexus 5"))
+		Ω(bursts[0].End.Sub(bursts[0].Start)).Should(Equal(2 * time.Second))
+		Ω(bursts[1].ID).Should(Equal("burst-20150105T095721"))
+
+		// Tuning the threshold regroups the images
+		Ω(members(FindBursts(images, 10*time.Second))).Should(Equal([][]string{{"a1", "a2", "a3", "a4"}, {"b1", "b2"}}))
+	})
+
+	It("should split events on gaps in time and moves in place", func() {
+		hour := 3600
+		images := []*ImageMeta{
+			shot("m1", 0, "Nexus 5", 31.5085, -9.7595),
+			shot("m2", 600, "Nexus 5", 0, 0),
+			shot("m3", 1200, "EOS 5D", 31.5090, -9.7600),
+			shot("k1", 1800, "Nexus 5", 31.6295, -7.9811),
+			shot("k2", 2400, "Nexus 5", 0, 0),
+			shot("n1", 6*hour, "Nexus 5", 31.6295, -7.9811),
+			shot("n2", 6*hour+60, "Nexus 5", 31.6296, -7.9812),
+			shot("x1", 12*hour, "Nexus 5", 0, 0),
+		}
+
+		events := FindEvents(images, 3*time.Hour, 1.0)
+		Ω(members(events)).Should(Equal([][]string{{"m1", "m2", "m3"}, {"k1", "k2"}, {"n1", "n2"}}))
+
+		Ω(events[0].ID).Should(Equal("event-20150105T095720"))
+		Ω(events[0].Camera).Should(BeEmpty())
+		Ω(events[0].Located).Should(BeTrue())
+		Ω(events[0].Latitude).Should(BeNumerically("~", 31.50875, 1e-6))
+
+		Ω(members(FindEvents(images, 3*time.Hour, 500))).Should(Equal([][]string{
+			{"m1", "m2", "m3", "k1", "k2"}, {"n1", "n2"},
+		}))
+	})
+
+	Describe("Storage", func() {
+
+		var (
+			err      error  // Any errors in directory creation
+			testRoot string // Test directory to store temp fixtures
+			testHome string // Fake home directory in temp directory
+		)
+
+		// Writes a JPEG taken at the EXIF time to the temporary directory and stores it
+		store := func(name string, taken string) *ImageMeta {
+			path := filepath.Join(testRoot, name)
+			data := mktaggedjpeg(8, 8, tascii(0x0110, "EOS 5D"), tascii(0x0132, taken))
+			Ω(ioutil.WriteFile(path, data, 0644)).Should(Succeed())
+
+			img := ImageFromPath(path)
+			Ω(img.Store()).Should(Succeed())
+			return img
+		}
+
+		BeforeEach(func() {
+			testRoot, err = ioutil.TempDir("", "ginkgo-")
+			Ω(err).Should(BeNil())
+
+			testHome = filepath.Join(testRoot, "Users", "jdoe")
+			err = os.MkdirAll(testHome, 0755)
+			Ω(err).Should(BeNil())
+
+			if runtime.GOOS == "windows" {
+				Ω(os.Setenv("USERPROFILE", testHome)).Should(BeNil())
+			} else {
+				Ω(os.Setenv("HOME", testHome)).Should(BeNil())
+			}
+
+			Ω(InitializeDatabase()).Should(BeNil())
+		})
+
+		AfterEach(func() {
+			CloseDatabase()
+			Ω(os.RemoveAll(testRoot)).Should(BeNil())
+
+			if runtime.GOOS == "windows" {
+				Ω(os.Unsetenv("USERPROFILE")).Should(BeNil())
+			} else {
+				Ω(os.Unsetenv("HOME")).Should(BeNil())
+			}
+
+			config.ClearPathCache()
+		})
+
+		It("should store the groups and replace them when regrouping", func() {
+			first := store("IMG_0001.jpg", "2015:01:05 09:57:20")
+			second := store("IMG_0002.jpg", "2015:01:05 09:57:21")
+			third := store("IMG_0003.jpg", "2015:01:05 10:30:00")
+
+			groups, err := RegroupImages(&GroupThresholds{2 * time.Second, time.Hour, 1.0})
+			Ω(err).Should(BeNil())
+			Ω(groups).Should(HaveLen(2))
+
+			bursts, err := ListGroups(GroupBurst)
+			Ω(err).Should(BeNil())
+			Ω(bursts).Should(HaveLen(1))
+			Ω(bursts[0].Camera).Should(Equal("Canon EOS 5D"))
+			Ω(bursts[0].Members).Should(Equal([]string{first.Signature, second.Signature}))
+
+			events, err := ListGroups(GroupEvent)
+			Ω(err).Should(BeNil())
+			Ω(events).Should(HaveLen(1))
+			Ω(events[0].Members).Should(HaveLen(3))
+
+			// Groups can be searched as albums
+			query, err := ParseQuery("group:" + bursts[0].ID)
+			Ω(err).Should(BeNil())
+			results, err := Search(query)
+			Ω(err).Should(BeNil())
+			Ω(results).Should(HaveLen(2))
+
+			// The groups are not records
+			Ω(FetchKeys(100)).Should(HaveLen(3))
+
+			_, err = RegroupImages(&GroupThresholds{time.Second / 2, 10 * time.Minute, 1.0})
+			Ω(err).Should(BeNil())
+
+			all, err := ListGroups("")
+			Ω(err).Should(BeNil())
+			Ω(all).Should(HaveLen(1))
+			Ω(all[0].Kind).Should(Equal(GroupEvent))
+			Ω(all[0].Contains(third.Signature)).Should(BeFalse())
+
+			_, err = FetchGroup(bursts[0].ID)
+			Ω(err).Should(Equal(ErrNoGroup))
+		})
+
+	})
+
+})
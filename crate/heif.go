@@ -0,0 +1,514 @@
+// Reads the item structure of HEIF (HEIC) and AVIF images, which are ISO base
+// media files that store their images, EXIF and XMP as items of a meta box
+
+package crate
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// HEIF and AVIF images by their mimetype and their file extension
+var (
+	HEIFMimeTypes = map[string]bool{
+		"image/heic": true, "image/heif": true, "image/avif": true,
+		"image/heic-sequence": true, "image/heif-sequence": true,
+	}
+
+	HEIFExtensions = map[string]bool{
+		".heic": true, ".heif": true, ".hif": true, ".avif": true,
+	}
+)
+
+var ErrNoExifItem = errors.New("HEIF file has no Exif item")
+
+//=============================================================================
+
+// Checks if an Image is a HEIF (e.g. HEIC from a phone) or AVIF file
+func (img *ImageMeta) IsHEIF() bool {
+	if !img.IsImage() {
+		return false
+	}
+
+	return HEIFMimeTypes[img.MimeType] || HEIFExtensions[strings.ToLower(filepath.Ext(img.Path))]
+}
+
+// Reads the item structure of the HEIF image
+func (img *ImageMeta) ReadHEIF() (*HEIF, error) {
+	file, err := os.Open(img.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	finfo, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	return ReadHEIF(file, finfo.Size())
+}
+
+// Reads the format of the HEIF image into the ImageMeta
+func (img *ImageMeta) extractHEIF() error {
+	heif, err := img.ReadHEIF()
+	if err != nil {
+		return err
+	}
+
+	img.Tags["Format"] = heif.Format()
+
+	// HEIF images are displayed by their transformative properties, which
+	// take precedence over the orientation in their EXIF
+	if item, ok := heif.Items[heif.Primary]; ok {
+		img.Orientation = item.Orientation()
+	}
+
+	return nil
+}
+
+// Returns the TIFF data of the Exif item of the open HEIF file
+func readHEIFExif(file *os.File) ([]byte, error) {
+	finfo, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	heif, err := ReadHEIF(file, finfo.Size())
+	if err != nil {
+		return nil, err
+	}
+
+	return heif.Exif(file)
+}
+
+//=============================================================================
+
+// An item of a HEIF file, e.g. a coded image, a grid of images or EXIF data
+type HEIFItem struct {
+	ID      uint32    // The item ID referenced by the other boxes
+	Type    string    // Four character code of the item, e.g. hvc1, grid or Exif
+	Extents [][]int64 // Offset and length in the file of each extent of the item
+	Width   int       // Width from the image spatial extents (ispe) property
+	Height  int       // Height from the image spatial extents (ispe) property
+	Turns   int       // Counterclockwise quarter turns of the rotation (irot)
+	Mirror  int       // Mirroring (imir), 1 about the vertical axis, 2 the horizontal
+}
+
+// EXIF orientations by the quarter turns of a rotation and the mirroring that
+// follows it: none, about the vertical axis and about the horizontal axis
+var heifOrientations = [4][3]int{
+	{1, 2, 4},
+	{8, 7, 5},
+	{3, 4, 2},
+	{6, 5, 7},
+}
+
+// Returns the EXIF orientation of the rotation and mirroring of the item,
+// assuming the mirroring is applied after the rotation as encoders do
+func (item *HEIFItem) Orientation() int {
+	return heifOrientations[item.Turns&3][item.Mirror%3]
+}
+
+// The items of a HEIF file, the primary item is the image shown for the file
+type HEIF struct {
+	Brands  []string             // Major and compatible brands of the ftyp
+	Primary uint32               // ID of the primary item
+	Items   map[uint32]*HEIFItem // Items by their ID
+}
+
+// Reads the items of a HEIF file from the boxes of its meta box
+func ReadHEIF(r io.ReaderAt, size int64) (*HEIF, error) {
+	boxes, err := ReadBoxes(r, 0, size)
+	if err != nil && len(boxes) == 0 {
+		return nil, err
+	}
+
+	heif := &HEIF{Items: make(map[uint32]*HEIFItem)}
+	if ftyp, ok := FindBox(boxes, "ftyp"); ok {
+		if data, err := ftyp.Read(r); err == nil && len(data) >= 8 {
+			heif.Brands = append(heif.Brands, string(data[:4]))
+			for pos := 8; pos+4 <= len(data); pos += 4 {
+				heif.Brands = append(heif.Brands, string(data[pos:pos+4]))
+			}
+		}
+	}
+
+	meta, ok := FindBox(boxes, "meta")
+	if !ok {
+		return nil, errors.New("HEIF file has no meta box")
+	}
+
+	children, err := meta.Children(r, 4)
+	if err != nil {
+		return nil, err
+	}
+
+	if box, ok := FindBox(children, "pitm"); ok {
+		if data, err := box.Read(r); err == nil && len(data) >= 6 {
+			heif.Primary, _ = readUint(data, 4, heifIDSize(data[0]))
+		}
+	}
+
+	if box, ok := FindBox(children, "iinf"); ok {
+		heif.readItemInfo(r, box)
+	}
+
+	if box, ok := FindBox(children, "iloc"); ok {
+		idat, _ := FindBox(children, "idat")
+		if data, err := box.Read(r); err == nil {
+			heif.readLocations(data, idat)
+		}
+	}
+
+	if box, ok := FindBox(children, "iprp"); ok {
+		heif.readProperties(r, box)
+	}
+
+	return heif, nil
+}
+
+// Returns the format of the file, AVIF, HEIC or HEIF, from its brands
+func (heif *HEIF) Format() string {
+	for _, brand := range []string{"avif", "avis"} {
+		if heif.hasBrand(brand) {
+			return "AVIF"
+		}
+	}
+
+	for _, brand := range []string{"heic", "heix", "heim", "heis", "hevc", "hevx"} {
+		if heif.hasBrand(brand) {
+			return "HEIC"
+		}
+	}
+
+	return "HEIF"
+}
+
+// Returns the dimensions of the primary image, which for HEIC photos is
+// usually a grid of smaller tiles with the size of the whole image
+func (heif *HEIF) Dimensions() (int, int, bool) {
+	if item, ok := heif.Items[heif.Primary]; ok && item.Width > 0 && item.Height > 0 {
+		return item.Width, item.Height, true
+	}
+
+	return 0, 0, false
+}
+
+// Returns the TIFF data of the first Exif item, skipping the offset to the
+// TIFF header (and the "Exif\0\0" marker that usually precedes it)
+func (heif *HEIF) Exif(r io.ReaderAt) ([]byte, error) {
+	var exif *HEIFItem
+	for _, item := range heif.Items {
+		if item.Type == "Exif" && (exif == nil || item.ID < exif.ID) {
+			exif = item
+		}
+	}
+
+	if exif == nil {
+		return nil, ErrNoExifItem
+	}
+
+	data, err := exif.Read(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) < 4 {
+		return nil, ErrMalformedBox
+	}
+
+	offset := int(binary.BigEndian.Uint32(data[:4])) + 4
+	if offset > len(data) {
+		return nil, ErrMalformedBox
+	}
+
+	return data[offset:], nil
+}
+
+// Reads the extents of the item into memory
+func (item *HEIFItem) Read(r io.ReaderAt) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	for _, extent := range item.Extents {
+		if int64(buf.Len())+extent[1] > MaxBoxRead {
+			return nil, errors.New("HEIF item is too large to read")
+		}
+
+		data := make([]byte, extent[1])
+		if _, err := r.ReadAt(data, extent[0]); err != nil {
+			return nil, err
+		}
+
+		buf.Write(data)
+	}
+
+	return buf.Bytes(), nil
+}
+
+//=============================================================================
+
+// Reads the item IDs and types from the infe boxes of the item info box
+func (heif *HEIF) readItemInfo(r io.ReaderAt, iinf Box) {
+	peek := make([]byte, 1)
+	if _, err := r.ReadAt(peek, iinf.Offset); err != nil {
+		return
+	}
+
+	// The entry count is 16 bits in version 0 and 32 bits after
+	skip := int64(6)
+	if peek[0] > 0 {
+		skip = 8
+	}
+
+	entries, err := iinf.Children(r, skip)
+	if err != nil && len(entries) == 0 {
+		return
+	}
+
+	for _, entry := range entries {
+		if entry.Type != "infe" {
+			continue
+		}
+
+		data, err := entry.Read(r)
+		if err != nil || len(data) < 4 || data[0] < 2 {
+			continue // Versions 0 and 1 predate item types
+		}
+
+		size := heifIDSize(data[0] - 2)
+		id, ok := readUint(data, 4, size)
+		if !ok || len(data) < 4+size+6 {
+			continue
+		}
+
+		item := heif.item(id)
+		item.Type = string(data[4+size+2 : 4+size+6])
+	}
+}
+
+// Reads the extents of the items from the item location box, extents in the
+// item data box (construction method 1) are offset by its payload
+func (heif *HEIF) readLocations(data []byte, idat Box) {
+	if len(data) < 8 {
+		return
+	}
+
+	version := data[0]
+	offsetSize, lengthSize := int(data[4]>>4), int(data[4]&0x0f)
+	baseSize, indexSize := int(data[5]>>4), int(data[5]&0x0f)
+	if version == 0 {
+		indexSize = 0
+	}
+
+	pos := 6
+	countSize := 2
+	if version == 2 {
+		countSize = 4
+	}
+
+	count, ok := readUint(data, pos, countSize)
+	pos += countSize
+
+	for idx := uint32(0); ok && idx < count; idx++ {
+		var id, method, extents uint32
+		var base uint64
+
+		if id, ok = readUint(data, pos, countSize); !ok {
+			return
+		}
+		pos += countSize
+
+		if version > 0 {
+			if method, ok = readUint(data, pos, 2); !ok {
+				return
+			}
+			method &= 0x0f
+			pos += 2
+		}
+
+		pos += 2 // Data reference index
+		if base, ok = readUint64(data, pos, baseSize); !ok {
+			return
+		}
+		pos += baseSize
+
+		if extents, ok = readUint(data, pos, 2); !ok {
+			return
+		}
+		pos += 2
+
+		item := heif.item(id)
+		for edx := uint32(0); edx < extents; edx++ {
+			pos += indexSize
+
+			offset, ook := readUint64(data, pos, offsetSize)
+			length, lok := readUint64(data, pos+offsetSize, lengthSize)
+			if !ook || !lok {
+				return
+			}
+			pos += offsetSize + lengthSize
+
+			start := int64(base + offset)
+			switch method {
+			case 0:
+			case 1:
+				start += idat.Offset
+			default:
+				continue // Extents in other items aren't supported
+			}
+
+			item.Extents = append(item.Extents, []int64{start, int64(length)})
+		}
+	}
+}
+
+// Reads the image spatial extents, rotation and mirroring properties
+// associated with the items
+func (heif *HEIF) readProperties(r io.ReaderAt, iprp Box) {
+	children, err := iprp.Children(r, 0)
+	if err != nil && len(children) == 0 {
+		return
+	}
+
+	ipco, ok := FindBox(children, "ipco")
+	if !ok {
+		return
+	}
+
+	properties, err := ipco.Children(r, 0)
+	if err != nil && len(properties) == 0 {
+		return
+	}
+
+	for _, ipma := range children {
+		if ipma.Type != "ipma" {
+			continue
+		}
+
+		data, err := ipma.Read(r)
+		if err != nil || len(data) < 8 {
+			continue
+		}
+
+		idSize := heifIDSize(data[0])
+		wide := data[3]&1 != 0
+		count := binary.BigEndian.Uint32(data[4:8])
+
+		pos := 8
+		for idx := uint32(0); idx < count; idx++ {
+			id, iok := readUint(data, pos, idSize)
+			associations, aok := readUint(data, pos+idSize, 1)
+			if !iok || !aok {
+				break
+			}
+			pos += idSize + 1
+
+			for adx := uint32(0); adx < associations; adx++ {
+				var index uint32
+				var ok bool
+
+				if wide {
+					index, ok = readUint(data, pos, 2)
+					index &= 0x7fff
+					pos += 2
+				} else {
+					index, ok = readUint(data, pos, 1)
+					index &= 0x7f
+					pos++
+				}
+
+				// Property indices are one based, zero means no property
+				if !ok {
+					break
+				}
+
+				if index == 0 || int(index) > len(properties) {
+					continue
+				}
+
+				property := properties[index-1]
+				switch property.Type {
+				case "ispe":
+					if ispe, err := property.Read(r); err == nil && len(ispe) >= 12 {
+						item := heif.item(id)
+						item.Width = int(binary.BigEndian.Uint32(ispe[4:8]))
+						item.Height = int(binary.BigEndian.Uint32(ispe[8:12]))
+					}
+				case "irot":
+					if irot, err := property.Read(r); err == nil && len(irot) >= 1 {
+						heif.item(id).Turns = int(irot[0] & 3)
+					}
+				case "imir":
+					if imir, err := property.Read(r); err == nil && len(imir) >= 1 {
+						heif.item(id).Mirror = int(imir[0]&1) + 1
+					}
+				}
+			}
+		}
+	}
+}
+
+// Returns the item with the ID, adding it if it hasn't been seen yet
+func (heif *HEIF) item(id uint32) *HEIFItem {
+	item, ok := heif.Items[id]
+	if !ok {
+		item = &HEIFItem{ID: id}
+		heif.Items[id] = item
+	}
+
+	return item
+}
+
+// Checks if the file has the major or compatible brand
+func (heif *HEIF) hasBrand(brand string) bool {
+	for _, b := range heif.Brands {
+		if b == brand {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Returns the size of item IDs in the boxes, 16 bits in version 0 else 32
+func heifIDSize(version byte) int {
+	if version == 0 {
+		return 2
+	}
+
+	return 4
+}
+
+// Reads a big endian unsigned integer of 0, 1, 2 or 4 bytes at the position
+func readUint(data []byte, pos, size int) (uint32, bool) {
+	value, ok := readUint64(data, pos, size)
+	return uint32(value), ok && size <= 4
+}
+
+// Reads a big endian unsigned integer of 0, 1, 2, 4 or 8 bytes at the position
+func readUint64(data []byte, pos, size int) (uint64, bool) {
+	if pos < 0 || pos+size > len(data) {
+		return 0, false
+	}
+
+	field := data[pos : pos+size]
+	switch size {
+	case 0:
+		return 0, true
+	case 1:
+		return uint64(field[0]), true
+	case 2:
+		return uint64(binary.BigEndian.Uint16(field)), true
+	case 4:
+		return uint64(binary.BigEndian.Uint32(field)), true
+	case 8:
+		return binary.BigEndian.Uint64(field), true
+	default:
+		return 0, false
+	}
+}
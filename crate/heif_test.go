@@ -0,0 +1,176 @@
+package crate_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/bbengfort/crate/crate"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// Builds a HEIF with an hvc1 primary image of the dimensions and the extra
+// properties, and an Exif item with the camera, the date taken and a GPS
+// location if exif is set
+func mkheif(brand string, width, height uint32, exif bool, properties ...[]byte) []byte {
+	ftyp := mkbox("ftyp", []byte(brand), mkints(uint32(0)), []byte("mif1"+brand))
+	coded := []byte("not really an hevc bitstream")
+
+	payload := []byte{}
+	if exif {
+		tiff := mktiff(binary.BigEndian, nil,
+			tiffBlock{name: "ifd0", entries: []tiffEntry{
+				tascii(0x010f, "Apple"),
+				tascii(0x0110, "iPhone 12"),
+				tref(0x8769, "exif"),
+				tref(0x8825, "gps"),
+			}},
+			tiffBlock{name: "exif", entries: []tiffEntry{
+				tascii(0x9003, "2021:07:04 18:15:00"),
+			}},
+			tiffBlock{name: "gps", entries: []tiffEntry{
+				tascii(0x0001, "N"),
+				trational(0x0002, 40, 1, 41, 1, 2400, 100),
+				tascii(0x0003, "W"),
+				trational(0x0004, 74, 1, 2, 1, 4200, 100),
+			}},
+		)
+		payload = append(append(mkints(uint32(6)), []byte("Exif\x00\x00")...), tiff...)
+	}
+
+	meta := func(start uint32) []byte {
+		items := []byte{}
+		locations := []byte{}
+		count := uint16(1)
+
+		items = append(items, mkbox("infe", mkints(uint32(2<<24), uint16(1), uint16(0)), []byte("hvc1\x00"))...)
+		locations = append(locations, mkints(uint16(1), uint16(0), uint16(0), uint16(1), start, uint32(len(coded)))...)
+
+		if exif {
+			count++
+			items = append(items, mkbox("infe", mkints(uint32(2<<24), uint16(2), uint16(0)), []byte("Exif\x00"))...)
+			locations = append(locations, mkints(uint16(2), uint16(0), uint16(0), uint16(1),
+				start+uint32(len(coded)), uint32(len(payload)))...)
+		}
+
+		ipco := mkbox("ipco", append([][]byte{mkbox("ispe", mkints(uint32(0), width, height))}, properties...)...)
+		associations := []byte{uint8(len(properties) + 1)}
+		for idx := 0; idx <= len(properties); idx++ {
+			associations = append(associations, uint8(0x81+idx))
+		}
+		ipma := mkbox("ipma", mkints(uint32(0), uint32(1), uint16(1)), associations)
+
+		return mkbox("meta", mkints(uint32(0)),
+			mkbox("hdlr", mkints(uint32(0), uint32(0)), []byte("pict"), make([]byte, 13)),
+			mkbox("pitm", mkints(uint32(0), uint16(1))),
+			mkbox("iinf", mkints(uint32(0), count), items),
+			mkbox("iloc", mkints(uint32(1<<24), uint8(0x44), uint8(0), count), locations),
+			mkbox("iprp", ipco, ipma))
+	}
+
+	start := uint32(len(ftyp) + len(meta(0)) + 8)
+	data := append(ftyp, meta(start)...)
+	return append(data, mkbox("mdat", coded, payload)...)
+}
+
+var _ = Describe("HEIF", func() {
+
+	var testRoot string // Temporary directory for the synthetic images
+
+	BeforeEach(func() {
+		var err error
+		testRoot, err = ioutil.TempDir("", "ginkgo-")
+		Ω(err).Should(BeNil())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(testRoot)
+	})
+
+	It("should read the items and properties of a HEIF", func() {
+		data := mkheif("heic", 4032, 3024, true)
+		heif, err := ReadHEIF(bytes.NewReader(data), int64(len(data)))
+		Ω(err).Should(BeNil())
+
+		Ω(heif.Format()).Should(Equal("HEIC"))
+		Ω(heif.Primary).Should(Equal(uint32(1)))
+		Ω(heif.Items).Should(HaveLen(2))
+		Ω(heif.Items[1].Type).Should(Equal("hvc1"))
+		Ω(heif.Items[2].Type).Should(Equal("Exif"))
+
+		width, height, ok := heif.Dimensions()
+		Ω(ok).Should(BeTrue())
+		Ω([]int{width, height}).Should(Equal([]int{4032, 3024}))
+
+		exif, err := heif.Exif(bytes.NewReader(data))
+		Ω(err).Should(BeNil())
+		Ω(string(exif[:4])).Should(Equal("MM\x00*"))
+	})
+
+	It("should read the rotation and mirroring of the primary item", func() {
+		data := mkheif("heic", 4032, 3024, false, mkbox("irot", []byte{3}))
+		heif, err := ReadHEIF(bytes.NewReader(data), int64(len(data)))
+		Ω(err).Should(BeNil())
+		Ω(heif.Items[1].Turns).Should(Equal(3))
+		Ω(heif.Items[1].Orientation()).Should(Equal(6))
+
+		data = mkheif("heic", 4032, 3024, false, mkbox("irot", []byte{1}), mkbox("imir", []byte{0}))
+		heif, err = ReadHEIF(bytes.NewReader(data), int64(len(data)))
+		Ω(err).Should(BeNil())
+		Ω(heif.Items[1].Orientation()).Should(Equal(7))
+
+		path := filepath.Join(testRoot, "IMG_0002.HEIC")
+		Ω(ioutil.WriteFile(path, mkheif("heic", 4032, 3024, true, mkbox("irot", []byte{1})), 0644)).Should(Succeed())
+
+		img := ImageFromPath(path)
+		img.Populate()
+		Ω(img.Orientation).Should(Equal(8))
+		Ω([]int{img.Width, img.Height}).Should(Equal([]int{4032, 3024}))
+		Ω([]int{img.DisplayWidth, img.DisplayHeight}).Should(Equal([]int{3024, 4032}))
+	})
+
+	It("should read the dimensions of an AVIF without EXIF", func() {
+		data := mkheif("avif", 1920, 1080, false)
+		heif, err := ReadHEIF(bytes.NewReader(data), int64(len(data)))
+		Ω(err).Should(BeNil())
+		Ω(heif.Format()).Should(Equal("AVIF"))
+
+		width, height, ok := heif.Dimensions()
+		Ω(ok).Should(BeTrue())
+		Ω([]int{width, height}).Should(Equal([]int{1920, 1080}))
+
+		_, err = heif.Exif(bytes.NewReader(data))
+		Ω(err).Should(Equal(ErrNoExifItem))
+	})
+
+	It("should extract the same fields from a HEIC as from a JPEG", func() {
+		path := filepath.Join(testRoot, "IMG_0001.HEIC")
+		Ω(ioutil.WriteFile(path, mkheif("heic", 4032, 3024, true), 0644)).Should(Succeed())
+
+		node, err := NewPath(path)
+		Ω(err).Should(BeNil())
+
+		record := NewRecord(node.(*FileMeta))
+		Ω(record).Should(BeAssignableToTypeOf(new(ImageMeta)))
+		record.Populate()
+
+		img := record.(*ImageMeta)
+		Ω(img.IsHEIF()).Should(BeTrue())
+		Ω(img.Width).Should(Equal(4032))
+		Ω(img.Height).Should(Equal(3024))
+		Ω(img.Tag("Format")).Should(Equal("HEIC"))
+		Ω(img.Tag("CameraMake")).Should(Equal("Apple"))
+		Ω(img.Tag("CameraModel")).Should(Equal("iPhone 12"))
+		Ω(img.Tag("DateTaken")).Should(Equal("2021-07-04T18:15:00+00:00"))
+
+		latitude, longitude, ok := img.Location()
+		Ω(ok).Should(BeTrue())
+		Ω(latitude).Should(BeNumerically("~", 40.6900, 0.0001))
+		Ω(longitude).Should(BeNumerically("~", -74.0450, 0.0001))
+	})
+
+})
@@ -7,6 +7,11 @@ import (
 	"errors"
 	"image"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/rwcarlsen/goexif/mknote"
 
 	_ "image/jpeg"
 	_ "image/png"
@@ -16,11 +21,37 @@ import (
 
 type ImageMeta struct {
 	FileMeta
-	Width  int               // Width of the image
-	Height int               // Height of the image
-	Tags   map[string]string // Image tags from the Exif data
+	Width           int           // Width of the image as it is stored
+	Height          int           // Height of the image as it is stored
+	Orientation     int           // EXIF orientation from 1 (upright) to 8
+	DisplayWidth    int           // Width of the image displayed upright
+	DisplayHeight   int           // Height of the image displayed upright
+	PreviewWidth    int           // Width of the embedded JPEG preview of RAW images
+	PreviewHeight   int           // Height of the embedded JPEG preview of RAW images
+	ThumbnailOffset int64         // Offset of the EXIF thumbnail JPEG in the file
+	ThumbnailLength int64         // Length of the EXIF thumbnail JPEG, 0 if there is none
+	Frames          int           // Number of frames of animated GIF and WebP images
+	Duration        float64       // Seconds of one loop of animated GIF and WebP images
+	Tags            TagMap        // Image tags from the Exif data
+	Sources         TagMap        // Where each tag was read from, e.g. exif or sidecar
+	Hashes          *ImageHashes  // Perceptual hashes, nil if the image can't be decoded
+	Colors          *ImageColors  // Average and dominant colors, nil if the image can't be decoded
+	PixelSignature  string        // Base64 encoded SHA1 hash of the pixel data of JPEG and PNG images
+	Quality         *ImageQuality // Result of fully decoding the image, nil if it wasn't checked
+	sampled         image.Image   // Decoded sample of the image shared by the extractors
+	sampleErr       error         // Why the sample of the image couldn't be decoded
 }
 
+// Sources of the image tags, the XMP edits take precedence over the
+// EXIF recorded by the camera and a sidecar over the XMP embedded in the image
+const (
+	TagSourceExif    = "exif"    // Tag was read from the EXIF of the image
+	TagSourceIPTC    = "iptc"    // Tag was read from the IPTC datasets of a JPEG
+	TagSourcePNG     = "png"     // Tag was read from a PNG textual chunk
+	TagSourceXMP     = "xmp"     // Tag was read from the XMP embedded in the image
+	TagSourceSidecar = "sidecar" // Tag was read from an XMP sidecar of the image
+)
+
 // Converts a FileMeta into an ImageMeta
 func ConvertImageMeta(fm *FileMeta) (*ImageMeta, bool) {
 
@@ -37,47 +68,203 @@ func ConvertImageMeta(fm *FileMeta) (*ImageMeta, bool) {
 
 // Popluates the fields on the ImageMeta
 func (img *ImageMeta) Populate() {
-	img.FileMeta.Populate() // Populate the FileMeta
+	img.FileMeta.populateFile() // Populate the FileMeta
+	img.releaseSample()
+	extract(img)
+	img.releaseSample()
+}
+
+//=============================================================================
+
+// Extracts the dimensions and EXIF tags of images into an ImageMeta
+type ImageExtractor struct {
+	MimePrefixes
+}
+
+func init() {
+	RegisterExtractor(&ImageExtractor{MimePrefixes{"image/"}})
+}
+
+func (ext *ImageExtractor) Name() string {
+	return "image"
+}
+
+func (ext *ImageExtractor) Version() string {
+	return "11"
+}
+
+func (ext *ImageExtractor) Convert(fm *FileMeta) FilePath {
+	if img, ok := ConvertImageMeta(fm); ok {
+		return img
+	}
+
+	return nil
+}
+
+func (ext *ImageExtractor) Extract(record FilePath) error {
+	img, ok := record.(*ImageMeta)
+	if !ok {
+		return errors.New("record is not an ImageMeta")
+	}
+
+	// Images without dimensions are still tagged and only reported, since
+	// an error would leave the record stale and extracted again every run
+	width, height, err := img.Dimensions()
+	if err != nil && eventLogger != nil {
+		eventLogger.Warn("could not read the dimensions of \"%s\": %s", img.Path, err)
+	}
+	img.Width = width
+	img.Height = height
 
-	if width, height, err := img.Dimensions(); err == nil {
-		img.Width = width
-		img.Height = height
+	img.Orientation = 1
+	img.ThumbnailOffset, img.ThumbnailLength = 0, 0
+	img.Tags = make(TagMap)
+	img.Sources = make(TagMap)
+	set := func(tag, value string) {
+		img.Tags[tag] = value
+		if value != "" {
+			img.Sources[tag] = TagSourceExif
+		}
+	}
+
+	if img.IsTIFF() {
+		img.extractTIFF()
 	}
 
-	img.Tags = make(map[string]string)
 	if exif, ok := img.GetExif(); ok {
 		// Get the date taken time stamp
 		dt, _ := exif.DateTaken()
-		img.Tags["DateTaken"] = JSONStamp(dt)
+		set("DateTaken", JSONStamp(dt))
 
 		// Get the GPS data for the image
 		latitude, longitude, _ := exif.Coordinates()
 		img.Tags["Latitude"] = Ftoa(latitude)
 		img.Tags["Longitude"] = Ftoa(longitude)
+		if latitude != 0 || longitude != 0 {
+			img.Tags["GeoSource"] = GeoSourceExif
+		}
 
 		// Get the Camera information
-		img.Tags["CameraMake"] = exif.Get("Make")
-		img.Tags["CameraModel"] = exif.Get("Model")
-		img.Tags["Software"] = exif.Get("Software")
+		set("CameraMake", exif.Get("Make"))
+		set("CameraModel", exif.Get("Model"))
+		set("Software", exif.Get("Software"))
+
+		// Get the descriptive text fields
+		set("ImageDescription", strings.TrimSpace(exif.Get("ImageDescription")))
+		set("Artist", strings.TrimSpace(exif.Get("Artist")))
+		set("Copyright", strings.TrimSpace(exif.Get("Copyright")))
+
+		// Get the lens and the Canon and Nikon maker note fields
+		set("LensModel", exif.Get("LensModel"))
+		set("SerialNumber", exif.Get(mknote.SerialNumber))
+		set("ShutterCount", exif.Get(mknote.ShutterCount))
+
+		// The Apple maker note links a Live Photo to its video
+		set("ContentIdentifier", exif.ContentIdentifier())
+
+		// Keep a reference to the thumbnail to serve it as a preview
+		img.extractThumbnail(exif)
+		img.Orientation = exif.Orientation()
 	}
+
+	if img.IsHEIF() {
+		img.extractHEIF()
+	}
+
+	// Portrait photos are often stored landscape and rotated by orientation
+	img.DisplayWidth, img.DisplayHeight = OrientedSize(img.Width, img.Height, img.Orientation)
+
+	// IPTC and the text embedded in the header only fill in the tags left unset
+	if img.IsJPEG() {
+		img.extractIPTC()
+	}
+
+	if _, ok := ImageHeaderReaders[img.MimeType]; ok {
+		img.extractHeader()
+	}
+
+	// The embedded XMP and sidecars hold the edits made after the capture
+	img.extractXMP()
+
+	return nil
 }
 
+//=============================================================================
+
 // Returns the width, hight of the image
 func (img *ImageMeta) Dimensions() (int, int, error) {
 
 	if file, err := os.Open(img.Path); err == nil {
 		defer file.Close()
 
+		// The image package can't decode the headers of TIFF based images
+		if img.IsTIFF() {
+			if tiff, err := ReadTIFF(file, filepath.Ext(img.Path)); err == nil {
+				if width, height, ok := tiff.Dimensions(); ok {
+					return width, height, nil
+				}
+			}
+
+			return 0, 0, ErrUnknownDimensions
+		}
+
+		// Nor of HEIF images, which store them as a property of the image item
+		if img.IsHEIF() {
+			if finfo, err := file.Stat(); err == nil {
+				if heif, err := ReadHEIF(file, finfo.Size()); err == nil {
+					if width, height, ok := heif.Dimensions(); ok {
+						return width, height, nil
+					}
+				}
+			}
+
+			return 0, 0, ErrUnknownDimensions
+		}
+
+		// Nor of the formats that are read from their headers
+		if read, ok := ImageHeaderReaders[img.MimeType]; ok {
+			if header, err := read(file); err == nil && header.Width > 0 && header.Height > 0 {
+				return header.Width, header.Height, nil
+			}
+
+			return 0, 0, ErrUnknownDimensions
+		}
+
 		if config, _, err := image.DecodeConfig(file); err == nil {
 			return config.Width, config.Height, nil
 		}
 
-		return 0, 0, errors.New("Could not decode Image dimensions")
+		return 0, 0, ErrUnknownDimensions
 	}
 
 	return 0, 0, errors.New("Could not open Image for reading")
 }
 
+// Returns the width and height of an image displayed in the EXIF orientation,
+// which transposes the image for the orientations from 5 to 8
+func OrientedSize(width, height, orientation int) (int, int) {
+	if orientation >= 5 && orientation <= 8 {
+		return height, width
+	}
+
+	return width, height
+}
+
+// Returns the value of a tag or an empty string if it isn't set
+func (img *ImageMeta) Tag(name string) string {
+	return img.Tags[name]
+}
+
+// Returns the latitude and longitude of the image if tagged with a location
+func (img *ImageMeta) Location() (float64, float64, bool) {
+	return img.Tags.Location()
+}
+
+// Returns the time the image was taken if tagged with a DateTaken
+func (img *ImageMeta) Taken() (time.Time, bool) {
+	return img.Tags.Taken()
+}
+
 // Returns the byte serialization of the file meta for storage
 func (img *ImageMeta) Byte() []byte {
 	data, err := json.Marshal(img)
@@ -0,0 +1,278 @@
+// Reads the IPTC-IIM datasets that news agencies and archives store in the
+// Photoshop image resources of the APP13 segment of JPEG images
+
+package crate
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	PhotoshopSignature = "Photoshop 3.0\x00" // Start of the APP13 segment
+	iptcResourceID     = 0x0404              // Image resource of the IIM datasets
+	iptcTagMarker      = 0x1c                // Start of every IIM dataset
+	iptcCharsetDataset = 0x015a              // 1:90 Coded Character Set
+)
+
+// Names of the IIM datasets that are read by their record and dataset number
+var IPTCDatasets = map[uint16]string{
+	0x0205: "ObjectName",
+	0x020f: "Category",
+	0x0214: "SupplementalCategories",
+	0x0219: "Keywords",
+	0x0237: "DateCreated",
+	0x023c: "TimeCreated",
+	0x0250: "Byline",
+	0x0255: "BylineTitle",
+	0x025a: "City",
+	0x025c: "Sublocation",
+	0x025f: "ProvinceState",
+	0x0264: "CountryCode",
+	0x0265: "CountryName",
+	0x0267: "OriginalTransmissionReference",
+	0x0269: "Headline",
+	0x026e: "Credit",
+	0x0273: "Source",
+	0x0274: "CopyrightNotice",
+	0x0278: "Caption",
+	0x027a: "Writer",
+}
+
+// The IIM datasets of the image tags they fill in
+var iptcImageTags = map[string]string{
+	"Title":            "ObjectName",
+	"Headline":         "Headline",
+	"ImageDescription": "Caption",
+	"Artist":           "Byline",
+	"Copyright":        "CopyrightNotice",
+	"Credit":           "Credit",
+	"City":             "City",
+	"Sublocation":      "Sublocation",
+	"State":            "ProvinceState",
+	"Country":          "CountryName",
+}
+
+// Escape sequences of the 1:90 Coded Character Set by the encoding they select
+var iptcCharsets = map[string]string{
+	"\x1b%G": "utf-8",
+	"\x1b.A": "iso-8859-1",
+	"\x1b-A": "iso-8859-1",
+}
+
+var ErrNoIPTC = errors.New("no IPTC datasets in the image")
+
+//=============================================================================
+
+// Reads the IPTC datasets of a JPEG into the tags of the image that the EXIF
+// left unset, the keywords are joined by "; " as the XMP keywords are.
+func (img *ImageMeta) extractIPTC() error {
+	iptc, err := img.GetIPTC()
+	if err != nil {
+		return err
+	}
+
+	fill := func(tag, value string) {
+		if img.Tags[tag] == "" && value != "" {
+			img.Tags[tag] = value
+			img.Sources[tag] = TagSourceIPTC
+		}
+	}
+
+	for tag, name := range iptcImageTags {
+		fill(tag, iptc.Get(name))
+	}
+
+	fill("Keywords", strings.Join(iptc.Datasets["Keywords"], "; "))
+	if ts, ok := iptc.DateCreated(); ok {
+		fill("DateTaken", JSONStamp(ts))
+	}
+
+	return nil
+}
+
+// Get the IPTC datasets from the APP13 segment of the JPEG
+func (img *ImageMeta) GetIPTC() (*IPTC, error) {
+	if !img.IsJPEG() {
+		return nil, ErrNoIPTC
+	}
+
+	file, err := os.Open(img.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return ReadIPTC(file)
+}
+
+//=============================================================================
+
+// The IIM datasets of an image by their name, repeatable datasets such as the
+// keywords keep all of their values. Text is decoded to UTF-8 from Encoding.
+type IPTC struct {
+	Encoding string              // Encoding of the text, e.g. utf-8 or windows-1252
+	Datasets map[string][]string // Values of the datasets by name
+}
+
+// Returns the first value of the dataset or an empty string
+func (iptc *IPTC) Get(name string) string {
+	if values := iptc.Datasets[name]; len(values) > 0 {
+		return values[0]
+	}
+
+	return ""
+}
+
+// Returns the date and time the image was created, the time (HHMMSS with an
+// optional zone) defaults to midnight UTC when only the CCYYMMDD date is set
+func (iptc *IPTC) DateCreated() (time.Time, bool) {
+	date := iptc.Get("DateCreated")
+	if len(date) != 8 {
+		return time.Time{}, false
+	}
+
+	clock := iptc.Get("TimeCreated")
+	for _, layout := range []string{"150405-0700", "150405"} {
+		if ts, err := time.Parse("20060102"+layout, date+clock); err == nil {
+			return ts, true
+		}
+	}
+
+	ts, err := time.Parse("20060102", date)
+	return ts, err == nil
+}
+
+// Reads the IPTC datasets from the APP13 segments of a JPEG
+func ReadIPTC(r io.Reader) (*IPTC, error) {
+	segments, err := readJPEGSegments(r, 0xed)
+	if err != nil {
+		return nil, err
+	}
+
+	// Large resource blocks are split across consecutive APP13 segments
+	irb := new(bytes.Buffer)
+	for _, segment := range segments {
+		irb.Write(bytes.TrimPrefix(segment.data, []byte(PhotoshopSignature)))
+	}
+
+	data := photoshopResource(irb.Bytes(), iptcResourceID)
+	if data == nil {
+		return nil, ErrNoIPTC
+	}
+
+	return ParseIPTC(data)
+}
+
+// Parses IIM datasets, the text is decoded from the 1:90 Coded Character
+// Set or, since few writers set it, as UTF-8 if it is valid and otherwise as
+// Windows-1252, a superset of the ISO-8859-1 that legacy software writes.
+func ParseIPTC(data []byte) (*IPTC, error) {
+	raw := make(map[string][][]byte)
+	names := make([]string, 0)
+	charset := ""
+
+	for pos := 0; pos+5 <= len(data) && data[pos] == iptcTagMarker; {
+		id := binary.BigEndian.Uint16(data[pos+1 : pos+3])
+		size := int(binary.BigEndian.Uint16(data[pos+3 : pos+5]))
+		pos += 5
+
+		// Extended datasets give the number of bytes of their length instead
+		if size&0x8000 != 0 {
+			count := size & 0x7fff
+			if count > 4 || pos+count > len(data) {
+				break
+			}
+
+			value, ok := readUint(data, pos, count)
+			if !ok {
+				break
+			}
+
+			size = int(value)
+			pos += count
+		}
+
+		if pos+size > len(data) {
+			break
+		}
+
+		value := data[pos : pos+size]
+		pos += size
+
+		if id == iptcCharsetDataset {
+			charset = string(value)
+		}
+
+		if name, ok := IPTCDatasets[id]; ok {
+			if _, ok := raw[name]; !ok {
+				names = append(names, name)
+			}
+			raw[name] = append(raw[name], value)
+		}
+	}
+
+	if len(raw) == 0 {
+		return nil, ErrNoIPTC
+	}
+
+	iptc := &IPTC{Encoding: iptcCharsets[charset], Datasets: make(map[string][]string)}
+	if iptc.Encoding == "" {
+		iptc.Encoding = "utf-8"
+		for _, name := range names {
+			for _, value := range raw[name] {
+				if !utf8.Valid(value) {
+					iptc.Encoding = "windows-1252"
+				}
+			}
+		}
+	}
+
+	for _, name := range names {
+		for _, value := range raw[name] {
+			text, _ := ioutil.ReadAll(NewTextReader(bytes.NewReader(value), iptc.Encoding))
+			if text := strings.TrimSpace(strings.TrimRight(string(text), "\x00")); text != "" {
+				iptc.Datasets[name] = append(iptc.Datasets[name], text)
+			}
+		}
+	}
+
+	return iptc, nil
+}
+
+//=============================================================================
+
+// Returns the data of the Photoshop image resource with the id, each resource
+// is "8BIM", its id, a padded Pascal string name and its padded data.
+func photoshopResource(data []byte, id uint16) []byte {
+	for pos := 0; pos+7 <= len(data) && string(data[pos:pos+4]) == "8BIM"; {
+		rid := binary.BigEndian.Uint16(data[pos+4 : pos+6])
+
+		// The name and its length byte are padded to an even size
+		name := int(data[pos+6]) + 1
+		pos += 6 + name + name%2
+		if pos+4 > len(data) {
+			break
+		}
+
+		size := int(binary.BigEndian.Uint32(data[pos : pos+4]))
+		pos += 4
+		if size < 0 || pos+size > len(data) {
+			break
+		}
+
+		if rid == id {
+			return data[pos : pos+size]
+		}
+		pos += size + size%2
+	}
+
+	return nil
+}
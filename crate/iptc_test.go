@@ -0,0 +1,132 @@
+package crate_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"time"
+
+	. "github.com/bbengfort/crate/crate"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// Builds an IIM dataset with the record and dataset number of the id
+func mkiim(id uint16, value string) []byte {
+	return append(append([]byte{0x1c}, mkints(id, uint16(len(value)))...), value...)
+}
+
+// Builds a Photoshop image resource with a padded Pascal string name
+func mkirb(id uint16, name string, data []byte) []byte {
+	block := append([]byte("8BIM"), mkints(id)...)
+	block = append(block, byte(len(name)))
+	block = append(block, name...)
+	if (len(name)+1)%2 != 0 {
+		block = append(block, 0)
+	}
+
+	block = append(block, mkints(uint32(len(data)))...)
+	block = append(block, data...)
+	if len(data)%2 != 0 {
+		block = append(block, 0)
+	}
+	return block
+}
+
+// Inserts an APP13 segment with the image resources after the SOI of a JPEG
+func mkiptcjpeg(resources ...[]byte) []byte {
+	payload := append([]byte(PhotoshopSignature), bytes.Join(resources, nil)...)
+	segment := append([]byte{0xff, 0xed}, mkints(uint16(len(payload)+2))...)
+
+	data := mkjpeg(8, 8)
+	return append(append(append([]byte{}, data[:2]...), append(segment, payload...)...), data[2:]...)
+}
+
+var _ = Describe("IPTC", func() {
+
+	var testRoot string // Temporary directory for the synthetic images
+
+	BeforeEach(func() {
+		var err error
+		testRoot, err = ioutil.TempDir("", "ginkgo-")
+		Ω(err).Should(BeNil())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(testRoot)
+	})
+
+	It("should read the IIM datasets from the APP13 segment", func() {
+		data := mkiptcjpeg(
+			mkirb(0x0425, "", make([]byte, 16)),
+			mkirb(0x0404, "IPTC", bytes.Join([][]byte{
+				mkiim(0x015a, "\x1b%G"),
+				mkiim(0x0205, "Harbour"),
+				mkiim(0x0219, "boats"),
+				mkiim(0x0219, "Zürich"),
+				mkiim(0x0237, "19640312"),
+				mkiim(0x023c, "143000+0100"),
+			}, nil)),
+		)
+
+		iptc, err := ReadIPTC(bytes.NewReader(data))
+		Ω(err).Should(BeNil())
+		Ω(iptc.Encoding).Should(Equal("utf-8"))
+		Ω(iptc.Get("ObjectName")).Should(Equal("Harbour"))
+		Ω(iptc.Datasets["Keywords"]).Should(Equal([]string{"boats", "Zürich"}))
+
+		created, ok := iptc.DateCreated()
+		Ω(ok).Should(BeTrue())
+		Ω(created.UTC()).Should(Equal(time.Date(1964, 3, 12, 13, 30, 0, 0, time.UTC)))
+	})
+
+	It("should decode legacy text without a coded character set", func() {
+		iptc, err := ParseIPTC(bytes.Join([][]byte{
+			mkiim(0x0278, "Caf\xe9 \x93Le D\xf4me\x94"),
+			mkiim(0x0250, "Brassa\xef"),
+		}, nil))
+
+		Ω(err).Should(BeNil())
+		Ω(iptc.Encoding).Should(Equal("windows-1252"))
+		Ω(iptc.Get("Caption")).Should(Equal("Café “Le Dôme”"))
+		Ω(iptc.Get("Byline")).Should(Equal("Brassaï"))
+
+		iptc, err = ParseIPTC(append(mkiim(0x015a, "\x1b.A"), mkiim(0x025a, "K\xf6ln")...))
+		Ω(err).Should(BeNil())
+		Ω(iptc.Encoding).Should(Equal("iso-8859-1"))
+		Ω(iptc.Get("City")).Should(Equal("Köln"))
+
+		_, err = ParseIPTC([]byte("not IIM"))
+		Ω(err).Should(Equal(ErrNoIPTC))
+	})
+
+	It("should fill in the image tags from the IPTC datasets", func() {
+		img := extractImage(testRoot, "scan_0001.jpg", mkiptcjpeg(mkirb(0x0404, "", bytes.Join([][]byte{
+			mkiim(0x0205, "Harbour"),
+			mkiim(0x0219, "boats"),
+			mkiim(0x0219, "harbour"),
+			mkiim(0x0250, "A. Photographer"),
+			mkiim(0x025a, "Marseille"),
+			mkiim(0x0265, "France"),
+			mkiim(0x0237, "19640312"),
+		}, nil))))
+
+		Ω(img.Tag("Title")).Should(Equal("Harbour"))
+		Ω(img.Tag("Keywords")).Should(Equal("boats; harbour"))
+		Ω(img.Tag("Artist")).Should(Equal("A. Photographer"))
+		Ω(img.Tag("City")).Should(Equal("Marseille"))
+		Ω(img.Tag("Country")).Should(Equal("France"))
+		Ω(img.Tag("DateTaken")).Should(Equal("1964-03-12T00:00:00+00:00"))
+		Ω(img.Sources).Should(HaveKeyWithValue("City", TagSourceIPTC))
+	})
+
+	It("should not find IPTC in images without an APP13 segment", func() {
+		_, err := ReadIPTC(bytes.NewReader(mkjpeg(8, 8)))
+		Ω(err).Should(Equal(ErrNoIPTC))
+
+		_, err = ReadIPTC(bytes.NewReader([]byte("not a JPEG")))
+		Ω(err).Should(HaveOccurred())
+	})
+
+})
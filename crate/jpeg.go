@@ -1,9 +1,13 @@
-// Handles exif data from JPEG files
+// Handles exif data from JPEG, TIFF based, HEIF, WebP and PNG files
 
 package crate
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
 	"errors"
+	"io"
 	"os"
 	"regexp"
 	"strings"
@@ -19,9 +23,16 @@ const (
 )
 
 var (
-	GPSTimePattern = regexp.MustCompile("\"(\\d+)/\\d+\"")
+	GPSTimePattern   = regexp.MustCompile("\"(\\d+)/\\d+\"")
+	ErrNoThumbnail   = errors.New("no embedded JPEG thumbnail")
+	ErrMalformedExif = errors.New("malformed EXIF or maker note")
 )
 
+func init() {
+	// Register the maker note parsers once rather than on every decode
+	exif.RegisterParsers(mknote.All...)
+}
+
 //=============================================================================
 
 // Checks if an Image is a JPEG file
@@ -33,22 +44,44 @@ func (img *ImageMeta) IsJPEG() bool {
 	return false
 }
 
-// Get the EXIF Data from the JPEG
+// Get the EXIF Data from the JPEG, TIFF, camera RAW, HEIF, WebP or PNG file
 func (img *ImageMeta) GetExif() (*ExifHandler, bool) {
 
-	// Ensure that this is a JPEG
-	if !img.IsJPEG() {
+	// Ensure that this is a JPEG, TIFF based, HEIF or a header read file
+	read, headed := ImageHeaderReaders[img.MimeType]
+	if !img.IsJPEG() && !img.IsTIFF() && !img.IsHEIF() && !headed {
 		return nil, false
 	}
 
 	if f, err := os.Open(img.Path); err == nil {
 		defer f.Close()
-		exif.RegisterParsers(mknote.All...)
+
+		// HEIF files store the EXIF as an item rather than in a header
+		var r io.Reader = f
+		if img.IsHEIF() {
+			data, err := readHEIFExif(f)
+			if err != nil {
+				return nil, false
+			}
+
+			r = bytes.NewReader(data)
+		}
+
+		// As do WebP and PNG files, as an EXIF chunk
+		if headed {
+			header, err := read(f)
+			if err != nil || len(header.Exif) == 0 {
+				return nil, false
+			}
+
+			r = bytes.NewReader(header.Exif)
+		}
 
 		walker := new(ExifHandler)
 		walker.tags = make(map[string]string)
 
-		if x, err := exif.Decode(f); err == nil {
+		// RAW files often have sub-IFDs that can't be read, which isn't critical
+		if x, err := decodeExif(r); x != nil && (err == nil || !exif.IsCriticalError(err)) {
 			walker.exif = x
 			x.Walk(walker)
 
@@ -59,6 +92,85 @@ func (img *ImageMeta) GetExif() (*ExifHandler, bool) {
 	return nil, false
 }
 
+// Decodes the EXIF, recovering from the panics of the maker note parsers on
+// malformed maker notes, e.g. a Nikon maker note that is cut short
+func decodeExif(r io.Reader) (x *exif.Exif, err error) {
+	defer func() {
+		if recover() != nil {
+			x, err = nil, ErrMalformedExif
+		}
+	}()
+
+	return exif.Decode(r)
+}
+
+// Stores a reference to the EXIF thumbnail of JPEG and TIFF based images as
+// its offset and length in the file, so it can be read without the EXIF
+func (img *ImageMeta) extractThumbnail(ew *ExifHandler) error {
+	start, size, ok := ew.ThumbnailRange()
+	if !ok {
+		return ErrNoThumbnail
+	}
+
+	file, err := os.Open(img.Path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// The EXIF of a JPEG follows the "Exif\x00\x00" header of the APP1 segment
+	base := int64(0)
+	if img.IsJPEG() {
+		segments, err := readJPEGSegments(file, 0xe1)
+		if err != nil {
+			return err
+		}
+
+		found := false
+		for _, segment := range segments {
+			if bytes.HasPrefix(segment.data, []byte("Exif\x00\x00")) {
+				base, found = segment.offset+6, true
+				break
+			}
+		}
+
+		if !found {
+			return ErrNoThumbnail
+		}
+	} else if !img.IsTIFF() {
+		return ErrNoThumbnail
+	}
+
+	soi := make([]byte, 2)
+	if _, err := file.ReadAt(soi, base+start); err != nil || soi[0] != 0xff || soi[1] != 0xd8 {
+		return ErrNoThumbnail
+	}
+
+	img.ThumbnailOffset = base + start
+	img.ThumbnailLength = size
+	return nil
+}
+
+// Reads the embedded EXIF thumbnail by the reference stored in the record
+func (img *ImageMeta) Thumbnail() ([]byte, error) {
+	if img.ThumbnailLength == 0 {
+		return nil, ErrNoThumbnail
+	}
+
+	file, err := os.Open(img.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	data := make([]byte, img.ThumbnailLength)
+	if _, err := file.ReadAt(data, img.ThumbnailOffset); err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
 //=============================================================================
 
 // Implements the Walker interface to retrieve all tags
@@ -155,4 +267,134 @@ func (ew *ExifHandler) Coordinates() (float64, float64, error) {
 	return ew.exif.LatLong()
 }
 
+// Returns the EXIF orientation of the image from 1 (upright) to 8, which is
+// how the image must be rotated and mirrored to be displayed upright
+func (ew *ExifHandler) Orientation() int {
+	tag, err := ew.exif.Get(exif.Orientation)
+	if err != nil {
+		return 1
+	}
+
+	value, err := tag.Int(0)
+	if err != nil || value < 1 || value > 8 {
+		return 1
+	}
+
+	return value
+}
+
+// Returns the offset and length of the JPEG thumbnail of IFD1, the offset is
+// from the start of the EXIF TIFF header, i.e. of the file for TIFF images
+// and of the APP1 segment (after "Exif\x00\x00") for JPEG images.
+func (ew *ExifHandler) ThumbnailRange() (int64, int64, bool) {
+	offset, err := ew.exif.Get(exif.ThumbJPEGInterchangeFormat)
+	if err != nil {
+		return 0, 0, false
+	}
+
+	length, err := ew.exif.Get(exif.ThumbJPEGInterchangeFormatLength)
+	if err != nil {
+		return 0, 0, false
+	}
+
+	start, serr := offset.Int64(0)
+	size, lerr := length.Int64(0)
+	if serr != nil || lerr != nil || start <= 0 || size <= 0 || start+size > int64(len(ew.exif.Raw)) {
+		return 0, 0, false
+	}
+
+	return start, size, true
+}
+
+// Returns the embedded JPEG thumbnail without decoding the image
+func (ew *ExifHandler) Thumbnail() ([]byte, error) {
+	start, size, ok := ew.ThumbnailRange()
+	if !ok {
+		return nil, ErrNoThumbnail
+	}
+
+	data := ew.exif.Raw[start : start+size]
+	if !bytes.HasPrefix(data, []byte{0xff, 0xd8}) {
+		return nil, ErrNoThumbnail
+	}
+
+	return data, nil
+}
+
 //=============================================================================
+
+// A segment of a JPEG and the offset of its payload in the file
+type jpegSegment struct {
+	offset int64  // Offset of the payload, after the marker and length
+	data   []byte // The payload of the segment
+}
+
+// Returns the JPEG segments with the marker, reading the segments up to the
+// start of the scan where the metadata segments end
+func readJPEGSegments(r io.Reader, marker byte) ([]jpegSegment, error) {
+	reader := bufio.NewReader(r)
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(reader, head); err != nil {
+		return nil, err
+	}
+
+	if head[0] != 0xff || head[1] != 0xd8 {
+		return nil, errors.New("not a JPEG image")
+	}
+
+	segments := make([]jpegSegment, 0)
+	offset := int64(2)
+	for {
+		if _, err := io.ReadFull(reader, head); err != nil {
+			return segments, nil
+		}
+		offset += 2
+
+		// Markers may be preceded by any number of fill bytes
+		for head[0] == 0xff && head[1] == 0xff {
+			b, err := reader.ReadByte()
+			if err != nil {
+				return segments, nil
+			}
+			head[1] = b
+			offset++
+		}
+
+		if head[0] != 0xff {
+			return segments, nil
+		}
+
+		kind := head[1]
+		switch {
+		case kind == 0xda || kind == 0xd9:
+			return segments, nil
+		case kind == 0x01 || kind >= 0xd0 && kind <= 0xd8:
+			continue
+		}
+
+		if _, err := io.ReadFull(reader, head); err != nil {
+			return segments, nil
+		}
+
+		size := int(binary.BigEndian.Uint16(head)) - 2
+		if size < 0 {
+			return segments, nil
+		}
+
+		start := offset + 2
+		offset = start + int64(size)
+
+		if kind != marker {
+			if _, err := reader.Discard(size); err != nil {
+				return segments, nil
+			}
+			continue
+		}
+
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(reader, payload); err != nil {
+			return segments, nil
+		}
+		segments = append(segments, jpegSegment{start, payload})
+	}
+}
@@ -1,6 +1,12 @@
 package crate_test
 
 import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"time"
 
 	. "github.com/bbengfort/crate/crate"
@@ -21,6 +27,41 @@ func ImageFromPath(path string) *ImageMeta {
 	return img
 }
 
+// Writes the data to a file of the name in the directory, returning its path
+func writeFixture(dir, name string, data []byte) string {
+	path := filepath.Join(dir, name)
+	Ω(ioutil.WriteFile(path, data, 0644)).Should(Succeed())
+	return path
+}
+
+// Writes the data to a file of the name in the directory and extracts it
+func extractImage(dir, name string, data []byte) *ImageMeta {
+	img := ImageFromPath(writeFixture(dir, name, data))
+	img.Populate()
+	return img
+}
+
+// Inserts an APP1 segment with an EXIF that has a thumbnail in IFD1 after
+// the SOI of a JPEG of the dimensions
+func mkexifjpeg(width, height int, thumbnail []byte) []byte {
+	exif := mktiff(binary.BigEndian, nil,
+		tiffBlock{name: "ifd0", next: "ifd1", entries: []tiffEntry{
+			tascii(0x010f, "Canon"),
+		}},
+		tiffBlock{name: "ifd1", entries: []tiffEntry{
+			tref(0x0201, "thumbnail"),
+			tsize(0x0202, "thumbnail"),
+		}},
+		tiffBlock{name: "thumbnail", data: thumbnail},
+	)
+
+	payload := append([]byte("Exif\x00\x00"), exif...)
+	segment := append([]byte{0xff, 0xe1}, mkints(uint16(len(payload)+2))...)
+
+	data := mkjpeg(width, height)
+	return append(append(append([]byte{}, data[:2]...), append(segment, payload...)...), data[2:]...)
+}
+
 var _ = Describe("Jpeg", func() {
 
 	const (
@@ -138,4 +179,80 @@ var _ = Describe("Jpeg", func() {
 		Ω(lon).Should(Equal(-9.774266222222224))
 	})
 
+	Context("with an embedded thumbnail", func() {
+
+		var testRoot string // Temporary directory for the synthetic images
+
+		BeforeEach(func() {
+			var err error
+			testRoot, err = ioutil.TempDir("", "ginkgo-")
+			Ω(err).Should(BeNil())
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(testRoot)
+		})
+
+		It("should extract the thumbnail from the EXIF", func() {
+			path := filepath.Join(testRoot, "IMG_0001.jpg")
+			Ω(ioutil.WriteFile(path, mkexifjpeg(64, 48, mkjpeg(16, 12)), 0644)).Should(Succeed())
+
+			exif, ok := ImageFromPath(path).GetExif()
+			Ω(ok).Should(BeTrue())
+
+			data, err := exif.Thumbnail()
+			Ω(err).Should(BeNil())
+
+			config, _, err := image.DecodeConfig(bytes.NewReader(data))
+			Ω(err).Should(BeNil())
+			Ω([]int{config.Width, config.Height}).Should(Equal([]int{16, 12}))
+		})
+
+		It("should store a reference to the thumbnail", func() {
+			path := filepath.Join(testRoot, "IMG_0001.jpg")
+			thumbnail := mkjpeg(16, 12)
+			Ω(ioutil.WriteFile(path, mkexifjpeg(64, 48, thumbnail), 0644)).Should(Succeed())
+
+			img := ImageFromPath(path)
+			img.Populate()
+			Ω(img.Width).Should(Equal(64))
+			Ω(img.ThumbnailLength).Should(Equal(int64(len(thumbnail))))
+
+			data, err := img.Thumbnail()
+			Ω(err).Should(BeNil())
+			Ω(data).Should(Equal(thumbnail))
+		})
+
+		It("should record the orientation and display dimensions", func() {
+			for orientation, display := range map[int][]int{1: {64, 48}, 3: {64, 48}, 6: {48, 64}, 8: {48, 64}} {
+				path := filepath.Join(testRoot, "IMG_0002.jpg")
+				Ω(ioutil.WriteFile(path, mktaggedjpeg(64, 48, tshort(0x0112, uint16(orientation))), 0644)).Should(Succeed())
+
+				img := ImageFromPath(path)
+				img.Populate()
+				Ω(img.Orientation).Should(Equal(orientation))
+				Ω([]int{img.Width, img.Height}).Should(Equal([]int{64, 48}))
+				Ω([]int{img.DisplayWidth, img.DisplayHeight}).Should(Equal(display))
+			}
+
+			width, height := OrientedSize(64, 48, 5)
+			Ω([]int{width, height}).Should(Equal([]int{48, 64}))
+		})
+
+		It("should not find a thumbnail in images without one", func() {
+			coast.Populate()
+			Ω(coast.ThumbnailLength).Should(BeZero())
+
+			_, err := coast.Thumbnail()
+			Ω(err).Should(Equal(ErrNoThumbnail))
+
+			exif, ok := coast.GetExif()
+			Ω(ok).Should(BeTrue())
+
+			_, err = exif.Thumbnail()
+			Ω(err).Should(Equal(ErrNoThumbnail))
+		})
+
+	})
+
 })
@@ -0,0 +1,475 @@
+// Organizes images and videos into a target tree by the date they were taken,
+// copying or hard linking them to paths rendered from a template, and keeps
+// a journal of the files and directories it creates so a run can be undone.
+
+package crate
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Actions of the placements of an organize plan and entries of its journal
+const (
+	OrganizeCopy      = "copy"      // The file is copied to the target
+	OrganizeLink      = "link"      // The file is hard linked to the target
+	OrganizeExists    = "exists"    // The target already has the content of the file
+	OrganizeDuplicate = "duplicate" // Another file with the same signature is placed
+	OrganizeMissing   = "missing"   // The file of the record no longer exists
+	OrganizeMkdir     = "mkdir"     // A directory of the target was created
+	journalLayout     = "20060102T150405.000000000"
+)
+
+var (
+	ErrUndated      = errors.New("record has no DateTaken")
+	ErrOutsideRoot  = errors.New("template places files outside of the target")
+	templateField   = regexp.MustCompile(`\{([a-z]+)(?::0([1-9]))?\}`)
+	unsafeSegment   = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+	templateNumbers = map[string]bool{"year": true, "month": true, "day": true, "hour": true, "minute": true, "second": true}
+	templateStrings = map[string]bool{"camera": true, "name": true, "stem": true, "ext": true}
+)
+
+//=============================================================================
+
+// A template of the relative path of a file in the organized tree, e.g.
+// {year}/{month:02}/{year}-{month:02}-{day:02}_{camera}_{name}. The fields
+// are the year, month, day, hour, minute and second of the DateTaken, which
+// can be padded to a width with zeros, e.g. {month:02}, the camera make and
+// model, and the name, stem (name without extension) and ext of the file.
+type Template struct {
+	Text string // The text of the template
+}
+
+// Parses the template, checking that its fields are known
+func ParseTemplate(text string) (*Template, error) {
+	if strings.TrimSpace(text) == "" {
+		return nil, errors.New("template is empty")
+	}
+
+	if strings.ContainsAny(templateField.ReplaceAllString(text, ""), "{}") {
+		return nil, fmt.Errorf("could not parse template \"%s\", use {field} or {field:02}", text)
+	}
+
+	for _, match := range templateField.FindAllStringSubmatch(text, -1) {
+		name, width := match[1], match[2]
+		if !templateNumbers[name] && !templateStrings[name] {
+			return nil, fmt.Errorf("unknown template field \"%s\"", name)
+		}
+
+		if width != "" && !templateNumbers[name] {
+			return nil, fmt.Errorf("template field \"%s\" can't be padded", name)
+		}
+	}
+
+	return &Template{text}, nil
+}
+
+// Renders the relative path of the record in the organized tree. Records
+// without a DateTaken can't be placed by the template and return ErrUndated.
+func (tmpl *Template) Render(record FilePath) (string, error) {
+	tagged, ok := record.(TaggedPath)
+	if !ok {
+		return "", ErrUndated
+	}
+
+	taken, ok := tagged.Taken()
+	if !ok {
+		return "", ErrUndated
+	}
+
+	name := record.File().Name
+	if name == "" {
+		name = filepath.Base(record.File().Path)
+	}
+
+	stem := strings.TrimSuffix(name, filepath.Ext(name))
+	camera := strings.TrimSpace(tagged.Tag("CameraMake") + " " + tagged.Tag("CameraModel"))
+	camera = strings.Trim(unsafeSegment.ReplaceAllString(camera, "-"), "-")
+	if camera == "" {
+		camera = "unknown"
+	}
+
+	numbers := map[string]int{
+		"year": taken.Year(), "month": int(taken.Month()), "day": taken.Day(),
+		"hour": taken.Hour(), "minute": taken.Minute(), "second": taken.Second(),
+	}
+
+	strs := map[string]string{
+		"camera": camera, "name": name, "stem": stem,
+		"ext": strings.ToLower(strings.TrimPrefix(filepath.Ext(name), ".")),
+	}
+
+	path := templateField.ReplaceAllStringFunc(tmpl.Text, func(field string) string {
+		match := templateField.FindStringSubmatch(field)
+		if value, ok := strs[match[1]]; ok {
+			return value
+		}
+
+		width, _ := strconv.Atoi(match[2])
+		return fmt.Sprintf("%0*d", width, numbers[match[1]])
+	})
+
+	path = filepath.Clean(filepath.FromSlash(path))
+	if filepath.IsAbs(path) || path == ".." || strings.HasPrefix(path, ".."+string(filepath.Separator)) {
+		return "", ErrOutsideRoot
+	}
+
+	return path, nil
+}
+
+//=============================================================================
+
+// Where a file is placed in the organized tree
+type Placement struct {
+	Signature string // The signature of the file
+	Source    string // The path of the file
+	Target    string // The path in the organized tree
+	Action    string // What organizing does with the file, e.g. copy or exists
+}
+
+// The placements of the files to organize in the target, in order
+type OrganizePlan struct {
+	Root       string       // The root directory of the organized tree
+	Template   *Template    // The template of the paths in the tree
+	Placements []*Placement // Where each file is placed
+}
+
+// Plans where the images and videos among the records are placed in the
+// tree at the root. Files are placed once per signature, even if they are
+// found at several paths, and a target that already exists is kept if it
+// has the same signature or numbered, e.g. IMG_0001_1.jpg, if it doesn't.
+// Records without a DateTaken are placed in the undated directory and the
+// companions of an asset, e.g. sidecars, next to its primary, sharing its name.
+func PlanOrganize(records []FilePath, root string, tmpl *Template, link bool) (*OrganizePlan, error) {
+	plan := &OrganizePlan{Root: root, Template: tmpl, Placements: make([]*Placement, 0)}
+	placed := make(map[string]string)  // Targets by the signatures placed
+	targets := make(map[string]string) // Signatures by the targets planned
+
+	action := OrganizeCopy
+	if link {
+		action = OrganizeLink
+	}
+
+	// Finds a free target for the file or one that already has its content
+	place := func(record FilePath, target string) (*Placement, error) {
+		fm := record.File()
+		placement := &Placement{Signature: fm.Signature, Source: fm.Path, Action: action}
+
+		if exists, _ := PathExists(fm.Path); !exists {
+			placement.Action = OrganizeMissing
+		}
+
+		if prev, ok := placed[fm.Signature]; ok {
+			placement.Target = prev
+			placement.Action = OrganizeDuplicate
+			return placement, nil
+		}
+
+		dir := filepath.Dir(target)
+		stem, suffix := splitCompanionName(filepath.Base(target))
+		for num := 0; ; num++ {
+			placement.Target = target
+			if num > 0 {
+				placement.Target = filepath.Join(dir, fmt.Sprintf("%s_%d%s", stem, num, suffix))
+			}
+
+			if _, ok := targets[placement.Target]; ok {
+				continue
+			}
+
+			if exists, _ := PathExists(placement.Target); exists {
+				signature, err := fileSignature(placement.Target)
+				if err != nil {
+					return nil, err
+				}
+
+				if signature != fm.Signature {
+					continue
+				}
+				placement.Action = OrganizeExists
+			}
+
+			break
+		}
+
+		if placement.Action != OrganizeMissing {
+			placed[fm.Signature] = placement.Target
+			targets[placement.Target] = fm.Signature
+		}
+
+		return placement, nil
+	}
+
+	// The primaries of the assets and the images and videos on their own,
+	// by path since copies of a file in other directories have its signature
+	assets := make(map[string]*Asset)
+	members := make(map[string]bool)
+	for _, asset := range FindAssets(records) {
+		assets[asset.Primary().Path] = asset
+		for _, member := range asset.Members[1:] {
+			members[member.Path] = true
+		}
+	}
+
+	byPath := make(map[string]FilePath)
+	primaries := make([]FilePath, 0, len(records))
+	for _, record := range records {
+		path := record.File().Path
+		byPath[path] = record
+
+		role := companionRole(record)
+		if members[path] || (role != RoleRaw && role != RoleImage && role != RoleVideo) {
+			continue
+		}
+		primaries = append(primaries, record)
+	}
+
+	sort.SliceStable(primaries, func(i, j int) bool {
+		return primaries[i].File().Path < primaries[j].File().Path
+	})
+
+	for _, record := range primaries {
+		path, err := tmpl.Render(record)
+		if err == ErrUndated {
+			path = filepath.Join(UndatedDay, filepath.Base(record.File().Path))
+		} else if err != nil {
+			return nil, err
+		}
+
+		placement, err := place(record, filepath.Join(root, path))
+		if err != nil {
+			return nil, err
+		}
+		plan.Placements = append(plan.Placements, placement)
+
+		asset, ok := assets[record.File().Path]
+		if !ok {
+			continue
+		}
+
+		// Companions keep the name of the primary with their own extensions
+		dir := filepath.Dir(placement.Target)
+		stem, _ := splitCompanionName(filepath.Base(placement.Target))
+		for _, member := range asset.Members[1:] {
+			companion := byPath[member.Path]
+
+			_, suffix := splitCompanionName(filepath.Base(companion.File().Path))
+			placement, err := place(companion, filepath.Join(dir, stem+suffix))
+			if err != nil {
+				return nil, err
+			}
+			plan.Placements = append(plan.Placements, placement)
+		}
+	}
+
+	return plan, nil
+}
+
+// Counts the placements of the plan by their action
+func (plan *OrganizePlan) Count(action string) int {
+	count := 0
+	for _, placement := range plan.Placements {
+		if placement.Action == action {
+			count++
+		}
+	}
+
+	return count
+}
+
+//=============================================================================
+
+// An entry of the journal of an organize run, written once the file or
+// directory it records is created
+type JournalEntry struct {
+	Action    string // Either copy, link or mkdir
+	Target    string // The file or directory that was created
+	Source    string // The file that was copied or linked
+	Signature string // The signature of the copied or linked file
+}
+
+// Returns the path of a new journal in the directory, named by the time to
+// the nanosecond so that runs started in the same second have their own
+func JournalPath(dir string) string {
+	return filepath.Join(dir, fmt.Sprintf("organize-%s.jsonl", time.Now().Format(journalLayout)))
+}
+
+// Copies or links the files of the plan to their targets, creating their
+// directories, and writes each file and directory it creates to the journal
+// at the path as a line of JSON, so that the run can be undone even if it
+// fails part way. The journal must not exist yet, so that runs are never
+// mixed in one journal. Returns the number of files that were created.
+func (plan *OrganizePlan) Execute(journal string) (int, error) {
+	file, err := os.OpenFile(journal, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	encoder := json.NewEncoder(file)
+	record := func(entry *JournalEntry) error {
+		if err := encoder.Encode(entry); err != nil {
+			return err
+		}
+		return file.Sync()
+	}
+
+	created := 0
+	for _, placement := range plan.Placements {
+		if placement.Action != OrganizeCopy && placement.Action != OrganizeLink {
+			continue
+		}
+
+		// Directories are created one at a time so each can be removed
+		dirs := make([]string, 0)
+		for dir := filepath.Dir(placement.Target); ; dir = filepath.Dir(dir) {
+			if exists, _ := PathExists(dir); exists || dir == filepath.Dir(dir) {
+				break
+			}
+			dirs = append([]string{dir}, dirs...)
+		}
+
+		for _, dir := range dirs {
+			if err := os.Mkdir(dir, 0755); err != nil {
+				return created, err
+			}
+
+			if err := record(&JournalEntry{Action: OrganizeMkdir, Target: dir}); err != nil {
+				return created, err
+			}
+		}
+
+		if placement.Action == OrganizeLink {
+			err = os.Link(placement.Source, placement.Target)
+		} else {
+			err = copyFile(placement.Source, placement.Target)
+		}
+
+		if err != nil {
+			return created, err
+		}
+
+		entry := &JournalEntry{placement.Action, placement.Target, placement.Source, placement.Signature}
+		if err := record(entry); err != nil {
+			return created, err
+		}
+		created++
+	}
+
+	return created, nil
+}
+
+// Returns the signature of the content of the file at the path
+func fileSignature(path string) (string, error) {
+	fm := new(FileMeta)
+	fm.Path = path
+	return fm.Hash()
+}
+
+// Copies the file to a new file at the target with its mode and times. The
+// copy is removed if it can't be completed.
+func copyFile(source, target string) error {
+	info, err := os.Stat(source)
+	if err != nil {
+		return err
+	}
+
+	src, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+
+	if _, err = io.Copy(dst, src); err == nil {
+		err = dst.Sync()
+	}
+
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		os.Remove(target)
+		return err
+	}
+
+	return os.Chtimes(target, info.ModTime(), info.ModTime())
+}
+
+// Undoes the organize run of the journal at the path, removing the files it
+// created in reverse order and then its directories if they are empty. Files
+// whose content changed since are kept and returned. The journal is renamed
+// with an .undone extension so that it can't be undone twice.
+func UndoOrganize(journal string) ([]string, error) {
+	file, err := os.Open(journal)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]*JournalEntry, 0)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+
+		entry := new(JournalEntry)
+		if err := json.Unmarshal(scanner.Bytes(), entry); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("could not parse journal entry: %s", err)
+		}
+		entries = append(entries, entry)
+	}
+
+	file.Close()
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	kept := make([]string, 0)
+	for idx := len(entries) - 1; idx >= 0; idx-- {
+		entry := entries[idx]
+
+		switch entry.Action {
+		case OrganizeCopy, OrganizeLink:
+			if exists, _ := PathExists(entry.Target); !exists {
+				continue
+			}
+
+			signature, err := fileSignature(entry.Target)
+			if err != nil {
+				return kept, err
+			}
+
+			if signature != entry.Signature {
+				kept = append(kept, entry.Target)
+				continue
+			}
+
+			if err := os.Remove(entry.Target); err != nil {
+				return kept, err
+			}
+
+		case OrganizeMkdir:
+			// Directories that other files were added to are kept
+			os.Remove(entry.Target)
+		}
+	}
+
+	return kept, os.Rename(journal, journal+".undone")
+}
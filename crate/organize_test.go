@@ -0,0 +1,217 @@
+package crate_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/bbengfort/crate/crate"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Organize", func() {
+
+	// Creates an image record with the tags
+	shot := func(name string, tags TagMap) *ImageMeta {
+		img := new(ImageMeta)
+		img.Path = filepath.Join("/photos", name)
+		img.Name = name
+		img.Tags = tags
+		return img
+	}
+
+	It("should parse templates of known fields", func() {
+		tmpl, err := ParseTemplate("{year}/{month:02}/{year}-{month:02}-{day:02}_{camera}_{name}")
+		Ω(err).Should(BeNil())
+		Ω(tmpl.Text).Should(HavePrefix("{year}"))
+
+		for _, text := range []string{"", "{year", "{year}}/{name}", "{colour}/{name}", "{camera:02}/{name}", "{month:2}/{name}"} {
+			_, err := ParseTemplate(text)
+			Ω(err).Should(HaveOccurred(), "parsed \"%s\"", text)
+		}
+	})
+
+	It("should render the path of a record from its capture time and camera", func() {
+		img := shot("IMG_0001.JPG", TagMap{
+			"DateTaken":   "2015-01-05T09:57:20+00:00",
+			"CameraMake":  "Canon",
+			"CameraModel": "EOS 5D Mark II",
+		})
+
+		tmpl, _ := ParseTemplate("{year}/{month:02}/{year}-{month:02}-{day:02}_{camera}_{name}")
+		Ω(tmpl.Render(img)).Should(Equal(filepath.FromSlash("2015/01/2015-01-05_Canon-EOS-5D-Mark-II_IMG_0001.JPG")))
+
+		tmpl, _ = ParseTemplate("{year}/{month:02}/{year}-{month}-{day}_{camera}_{name}")
+		Ω(tmpl.Render(img)).Should(Equal(filepath.FromSlash("2015/01/2015-1-5_Canon-EOS-5D-Mark-II_IMG_0001.JPG")))
+
+		tmpl, _ = ParseTemplate("{hour:02}{minute:02}{second:02}_{stem}.{ext}")
+		Ω(tmpl.Render(img)).Should(Equal("095720_IMG_0001.jpg"))
+
+		tmpl, _ = ParseTemplate("{year}/{camera}/{name}")
+		Ω(tmpl.Render(shot("a.jpg", TagMap{"DateTaken": "2015-01-05T09:57:20+00:00"}))).Should(Equal(filepath.FromSlash("2015/unknown/a.jpg")))
+
+		_, err := tmpl.Render(shot("b.jpg", TagMap{}))
+		Ω(err).Should(Equal(ErrUndated))
+
+		tmpl, _ = ParseTemplate("../{year}/{name}")
+		_, err = tmpl.Render(img)
+		Ω(err).Should(Equal(ErrOutsideRoot))
+	})
+
+	Describe("Files", func() {
+
+		var (
+			testRoot string // Test directory of the source and target trees
+			source   string // The directory of the files to organize
+			target   string // The root of the organized tree
+			tmpl     *Template
+		)
+
+		// Writes the data to the source directory and returns its record
+		write := func(name string, data []byte) FilePath {
+			path := filepath.Join(source, filepath.FromSlash(name))
+			Ω(os.MkdirAll(filepath.Dir(path), 0755)).Should(Succeed())
+			Ω(ioutil.WriteFile(path, data, 0644)).Should(Succeed())
+
+			node, err := NewPath(path)
+			Ω(err).Should(BeNil())
+
+			record := NewRecord(node.(*FileMeta))
+			record.Populate()
+			return record
+		}
+
+		// Returns the path of the slash separated name in the target
+		organized := func(name string) string {
+			return filepath.Join(target, filepath.FromSlash(name))
+		}
+
+		BeforeEach(func() {
+			var err error
+			testRoot, err = ioutil.TempDir("", "ginkgo-")
+			Ω(err).Should(BeNil())
+
+			source = filepath.Join(testRoot, "source")
+			target = filepath.Join(testRoot, "target")
+			tmpl, err = ParseTemplate("{year}/{month:02}/{year}-{month:02}-{day:02}_{camera}_{name}")
+			Ω(err).Should(BeNil())
+		})
+
+		AfterEach(func() {
+			Ω(os.RemoveAll(testRoot)).Should(BeNil())
+		})
+
+		It("should plan, organize and undo the placement of the files", func() {
+			taken := tascii(0x0132, "2015:01:05 09:57:20")
+			photo := mktaggedjpeg(8, 8, tascii(0x0110, "EOS 5D"), taken)
+			scan := mkpng(4, 4)
+
+			records := []FilePath{
+				write("IMG_0001.jpg", photo),
+				write("IMG_0001.xmp", []byte("<x:xmpmeta xmlns:x=\"adobe:ns:meta/\"></x:xmpmeta>")),
+				write("copy/IMG_0001.jpg", photo),
+				write("other/IMG_0001.jpg", mktaggedjpeg(16, 8, tascii(0x0110, "EOS 5D"), taken)),
+				write("scan.png", scan),
+				write("notes.txt", []byte("not organized")),
+			}
+
+			// The scan is already in place from an earlier run
+			Ω(os.MkdirAll(organized("undated"), 0755)).Should(Succeed())
+			Ω(ioutil.WriteFile(organized("undated/scan.png"), scan, 0644)).Should(Succeed())
+
+			plan, err := PlanOrganize(records, target, tmpl, false)
+			Ω(err).Should(BeNil())
+			Ω(plan.Placements).Should(HaveLen(5))
+
+			expected := []struct{ action, target string }{
+				{OrganizeCopy, "2015/01/2015-01-05_Canon-EOS-5D_IMG_0001.jpg"},
+				{OrganizeCopy, "2015/01/2015-01-05_Canon-EOS-5D_IMG_0001.xmp"},
+				{OrganizeDuplicate, "2015/01/2015-01-05_Canon-EOS-5D_IMG_0001.jpg"},
+				{OrganizeCopy, "2015/01/2015-01-05_Canon-EOS-5D_IMG_0001_1.jpg"},
+				{OrganizeExists, "undated/scan.png"},
+			}
+
+			for idx, placement := range plan.Placements {
+				Ω(placement.Action).Should(Equal(expected[idx].action), "placement %d", idx)
+				Ω(placement.Target).Should(Equal(organized(expected[idx].target)), "placement %d", idx)
+			}
+
+			created, err := plan.Execute(filepath.Join(testRoot, "journal.jsonl"))
+			Ω(err).Should(BeNil())
+			Ω(created).Should(Equal(3))
+
+			data, err := ioutil.ReadFile(organized(expected[0].target))
+			Ω(err).Should(BeNil())
+			Ω(data).Should(Equal(photo))
+
+			journal, err := ioutil.ReadFile(filepath.Join(testRoot, "journal.jsonl"))
+			Ω(err).Should(BeNil())
+			Ω(strings.Count(string(journal), "\n")).Should(Equal(5))
+			Ω(string(journal)).Should(ContainSubstring(OrganizeMkdir))
+
+			// Organizing again finds every file in place
+			plan, err = PlanOrganize(records, target, tmpl, false)
+			Ω(err).Should(BeNil())
+			Ω(plan.Count(OrganizeCopy)).Should(BeZero())
+			Ω(plan.Count(OrganizeExists)).Should(Equal(4))
+
+			// Files changed since they were organized are kept by undo
+			changed := organized(expected[3].target)
+			Ω(ioutil.WriteFile(changed, []byte("edited"), 0644)).Should(Succeed())
+
+			kept, err := UndoOrganize(filepath.Join(testRoot, "journal.jsonl"))
+			Ω(err).Should(BeNil())
+			Ω(kept).Should(Equal([]string{changed}))
+
+			Ω(PathExists(organized(expected[0].target))).Should(BeFalse())
+			Ω(PathExists(organized(expected[1].target))).Should(BeFalse())
+			Ω(PathExists(changed)).Should(BeTrue())
+			Ω(PathExists(organized("undated/scan.png"))).Should(BeTrue())
+			Ω(PathExists(filepath.Join(testRoot, "journal.jsonl.undone"))).Should(BeTrue())
+
+			// Sources are never touched
+			Ω(PathExists(filepath.Join(source, "IMG_0001.jpg"))).Should(BeTrue())
+		})
+
+		It("should hard link files and remove the directories it created on undo", func() {
+			records := []FilePath{write("IMG_0001.jpg", mktaggedjpeg(8, 8, tascii(0x0132, "2015:01:05 09:57:20")))}
+
+			plan, err := PlanOrganize(records, target, tmpl, true)
+			Ω(err).Should(BeNil())
+			Ω(plan.Count(OrganizeLink)).Should(Equal(1))
+
+			journal := filepath.Join(testRoot, "journal.jsonl")
+			_, err = plan.Execute(journal)
+			Ω(err).Should(BeNil())
+
+			original, err := os.Stat(filepath.Join(source, "IMG_0001.jpg"))
+			Ω(err).Should(BeNil())
+			linked, err := os.Stat(plan.Placements[0].Target)
+			Ω(err).Should(BeNil())
+			Ω(os.SameFile(original, linked)).Should(BeTrue())
+
+			kept, err := UndoOrganize(journal)
+			Ω(err).Should(BeNil())
+			Ω(kept).Should(BeEmpty())
+			Ω(PathExists(target)).Should(BeFalse())
+		})
+
+		It("should never append to the journal of another run", func() {
+			Ω(JournalPath(testRoot)).ShouldNot(Equal(JournalPath(testRoot)))
+
+			journal := JournalPath(testRoot)
+			Ω(ioutil.WriteFile(journal, nil, 0644)).Should(Succeed())
+
+			plan, err := PlanOrganize([]FilePath{}, target, tmpl, false)
+			Ω(err).Should(BeNil())
+
+			_, err = plan.Execute(journal)
+			Ω(os.IsExist(err)).Should(BeTrue())
+		})
+
+	})
+
+})
@@ -0,0 +1,477 @@
+// Perceptual hashes of images and a BK-tree of them for finding similar
+// images and near duplicates, e.g. resized or re-encoded copies of a photo
+
+package crate
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"math"
+	"math/bits"
+	"sort"
+	"strconv"
+
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+const (
+	PerceptualHashNamespace = "phash" // Namespace of the perceptual hash index keys
+	DefaultSimilarDistance  = 10      // Most bits of the DCT hashes of similar images that differ
+	dctSize                 = 32      // Edge of the grayscale image of the DCT hash
+)
+
+var ErrNoHashes = errors.New("image has no perceptual hashes")
+
+//=============================================================================
+
+// The perceptual hashes of an image, which are 64 bit fingerprints of its
+// appearance, so images that look alike have hashes that differ in few bits
+type ImageHashes struct {
+	Average    uint64 // Pixels of the 8x8 grayscale image brighter than their mean
+	Difference uint64 // Pixels of the 9x8 grayscale image brighter than their right neighbor
+	DCT        uint64 // Low frequencies of the 32x32 grayscale image above their median
+}
+
+// Computes the perceptual hashes of an upright image
+func ComputeHashes(src image.Image) *ImageHashes {
+	src = ResizeImage(src, SampleSize)
+	return &ImageHashes{
+		Average:    AverageHash(src),
+		Difference: DifferenceHash(src),
+		DCT:        DCTHash(src),
+	}
+}
+
+// Computes the hash of the 8x8 grayscale image, whose bits are set for the
+// pixels that are brighter than the mean of the pixels
+func AverageHash(src image.Image) uint64 {
+	pixels := grayscale(src, 8, 8)
+
+	mean := 0.0
+	for _, px := range pixels {
+		mean += px
+	}
+	mean /= float64(len(pixels))
+
+	var hash uint64
+	for idx, px := range pixels {
+		if px > mean {
+			hash |= 1 << uint(idx)
+		}
+	}
+
+	return hash
+}
+
+// Computes the hash of the 9x8 grayscale image, whose bits are set for the
+// pixels that are brighter than the pixel to their right
+func DifferenceHash(src image.Image) uint64 {
+	pixels := grayscale(src, 9, 8)
+
+	var hash uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			if pixels[y*9+x] > pixels[y*9+x+1] {
+				hash |= 1 << uint(y*8+x)
+			}
+		}
+	}
+
+	return hash
+}
+
+// Computes the hash of the discrete cosine transform of the 32x32 grayscale
+// image, whose bits are set for the 8x8 lowest frequencies that are above the
+// median of them. The DC term, the mean brightness, isn't in the median.
+func DCTHash(src image.Image) uint64 {
+	pixels := grayscale(src, dctSize, dctSize)
+
+	// The cosines of the DCT-II of the 8 lowest frequencies
+	var cosines [8][dctSize]float64
+	for u := 0; u < 8; u++ {
+		for x := 0; x < dctSize; x++ {
+			cosines[u][x] = math.Cos(float64(2*x+1) * float64(u) * math.Pi / (2 * dctSize))
+		}
+	}
+
+	// The transform is separable, the columns are transformed then the rows
+	var columns [8][dctSize]float64
+	for v := 0; v < 8; v++ {
+		for x := 0; x < dctSize; x++ {
+			for y := 0; y < dctSize; y++ {
+				columns[v][x] += pixels[y*dctSize+x] * cosines[v][y]
+			}
+		}
+	}
+
+	coefficients := make([]float64, 64)
+	for v := 0; v < 8; v++ {
+		for u := 0; u < 8; u++ {
+			for x := 0; x < dctSize; x++ {
+				coefficients[v*8+u] += columns[v][x] * cosines[u][x]
+			}
+		}
+	}
+
+	sorted := append([]float64(nil), coefficients[1:]...)
+	sort.Float64s(sorted)
+	median := sorted[len(sorted)/2]
+
+	var hash uint64
+	for idx, coefficient := range coefficients {
+		if coefficient > median {
+			hash |= 1 << uint(idx)
+		}
+	}
+
+	return hash
+}
+
+// Returns the number of bits that differ between two hashes
+func HammingDistance(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
+
+// Returns the luminance of the image scaled to the width and height by
+// averaging the pixels that each pixel of the result covers, row by row
+func grayscale(src image.Image, width, height int) []float64 {
+	bounds := src.Bounds()
+	sw, sh := bounds.Dx(), bounds.Dy()
+	sums := make([]float64, width*height)
+	counts := make([]float64, width*height)
+
+	for y := 0; y < sh; y++ {
+		for x := 0; x < sw; x++ {
+			r, g, b, _ := src.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+			idx := (y*height/sh)*width + x*width/sw
+			sums[idx] += 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)
+			counts[idx]++
+		}
+	}
+
+	// Images smaller than the result are sampled from the nearest pixel
+	for idx := range sums {
+		if counts[idx] == 0 {
+			x := bounds.Min.X + (idx%width)*sw/width
+			y := bounds.Min.Y + (idx/width)*sh/height
+			r, g, b, _ := src.At(x, y).RGBA()
+			sums[idx], counts[idx] = 0.299*float64(r)+0.587*float64(g)+0.114*float64(b), 1
+		}
+
+		sums[idx] /= counts[idx] * 0xffff
+	}
+
+	return sums
+}
+
+//=============================================================================
+
+// Computes the perceptual hashes of images that can be decoded
+type PerceptualHashExtractor struct {
+	MimePrefixes
+}
+
+func init() {
+	RegisterExtractor(&PerceptualHashExtractor{MimePrefixes{"image/"}})
+	RegisterIndex(new(PerceptualHashIndex))
+}
+
+func (ext *PerceptualHashExtractor) Name() string {
+	return "phash"
+}
+
+func (ext *PerceptualHashExtractor) Version() string {
+	return "1"
+}
+
+// Images that can't be decoded have no hashes but aren't failures, since
+// re-extracting them would not change that
+func (ext *PerceptualHashExtractor) Extract(record FilePath) error {
+	img, ok := record.(*ImageMeta)
+	if !ok {
+		return nil
+	}
+
+	img.Hashes = nil
+	hashes, err := img.ComputeHashes()
+	if err == ErrNotDecodable {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	img.Hashes = hashes
+	return nil
+}
+
+// Decodes the image, or its preview, and computes its perceptual hashes
+// upright, so rotated copies of an image have the same hashes
+func (img *ImageMeta) ComputeHashes() (*ImageHashes, error) {
+	src, err := img.sample()
+	if err != nil {
+		return nil, err
+	}
+
+	return ComputeHashes(src), nil
+}
+
+//=============================================================================
+
+// Indexes the DCT hashes of images in hex, see LoadHashTree
+type PerceptualHashIndex struct{}
+
+func (index *PerceptualHashIndex) Name() string {
+	return PerceptualHashNamespace
+}
+
+func (index *PerceptualHashIndex) Add(batch *leveldb.Batch, record FilePath) {
+	if img, ok := record.(*ImageMeta); ok && img.Hashes != nil {
+		batch.Put(indexKey(PerceptualHashNamespace, FormatHash(img.Hashes.DCT), img.Signature), nil)
+	}
+}
+
+func (index *PerceptualHashIndex) Remove(batch *leveldb.Batch, record FilePath) {
+	if img, ok := record.(*ImageMeta); ok && img.Hashes != nil {
+		batch.Delete(indexKey(PerceptualHashNamespace, FormatHash(img.Hashes.DCT), img.Signature))
+	}
+}
+
+// Formats a hash as 16 hex digits
+func FormatHash(hash uint64) string {
+	return fmt.Sprintf("%016x", hash)
+}
+
+// Parses a hash from 16 hex digits
+func ParseHash(text string) (uint64, error) {
+	hash, err := strconv.ParseUint(text, 16, 64)
+	if err != nil || len(text) != 16 {
+		return 0, fmt.Errorf("invalid hash \"%s\"", text)
+	}
+
+	return hash, nil
+}
+
+//=============================================================================
+
+// A BK-tree of hashes, a metric tree whose children are keyed by their
+// Hamming distance from their parent, so that a search within a radius only
+// descends into the children whose distance can be within the radius.
+type BKTree struct {
+	root *bkNode
+	size int
+}
+
+type bkNode struct {
+	hash       uint64
+	signatures []string
+	children   map[int]*bkNode
+}
+
+// A signature found in a BKTree by its distance from the searched hash
+type HashMatch struct {
+	Signature string // Signature of the record with the hash
+	Hash      uint64 // The DCT hash of the record
+	Distance  int    // Bits that differ from the searched hash
+}
+
+// Adds the signature of a record with the hash to the tree
+func (tree *BKTree) Add(hash uint64, signature string) {
+	tree.size++
+	if tree.root == nil {
+		tree.root = &bkNode{hash: hash, signatures: []string{signature}}
+		return
+	}
+
+	node := tree.root
+	for {
+		distance := HammingDistance(node.hash, hash)
+		if distance == 0 {
+			node.signatures = append(node.signatures, signature)
+			return
+		}
+
+		child, ok := node.children[distance]
+		if !ok {
+			if node.children == nil {
+				node.children = make(map[int]*bkNode)
+			}
+			node.children[distance] = &bkNode{hash: hash, signatures: []string{signature}}
+			return
+		}
+
+		node = child
+	}
+}
+
+// Returns the number of signatures in the tree
+func (tree *BKTree) Len() int {
+	return tree.size
+}
+
+// Returns the signatures whose hashes are within the distance of the hash,
+// ordered by their distance and then by their signature
+func (tree *BKTree) Search(hash uint64, radius int) []*HashMatch {
+	matches := make([]*HashMatch, 0)
+	if tree.root == nil {
+		return matches
+	}
+
+	stack := []*bkNode{tree.root}
+	for len(stack) > 0 {
+		node := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		distance := HammingDistance(node.hash, hash)
+		if distance <= radius {
+			for _, signature := range node.signatures {
+				matches = append(matches, &HashMatch{signature, node.hash, distance})
+			}
+		}
+
+		// By the triangle inequality only these children can be in the radius
+		for d := distance - radius; d <= distance+radius; d++ {
+			if child, ok := node.children[d]; ok {
+				stack = append(stack, child)
+			}
+		}
+	}
+
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].Distance != matches[j].Distance {
+			return matches[i].Distance < matches[j].Distance
+		}
+		return matches[i].Signature < matches[j].Signature
+	})
+
+	return matches
+}
+
+// Loads the indexed DCT hashes of the records in the database into a tree
+func LoadHashTree() (*BKTree, error) {
+	tree := new(BKTree)
+	iter := db.NewIterator(indexRange(PerceptualHashNamespace), nil)
+	defer iter.Release()
+
+	prefix := len(PerceptualHashNamespace + IndexSeparator)
+	for iter.Next() {
+		key := iter.Key()
+		hash, err := ParseHash(string(key[prefix : prefix+16]))
+		if err != nil {
+			return nil, err
+		}
+
+		tree.Add(hash, indexSignature(key))
+	}
+
+	return tree, iter.Error()
+}
+
+//=============================================================================
+
+// Finds the records whose DCT hashes are within the distance of the hash,
+// ordered by their distance
+func FindSimilar(hash uint64, distance int) ([]*HashMatch, error) {
+	tree, err := LoadHashTree()
+	if err != nil {
+		return nil, err
+	}
+
+	return tree.Search(hash, distance), nil
+}
+
+// Groups the records whose DCT hashes are within the distance of each other,
+// directly or through other records of the group, into clusters of near
+// duplicates. Records without near duplicates, other than the companions in
+// their asset, aren't returned. Clusters are ordered by their size and
+// signatures in the clusters by their hash.
+func NearDuplicates(distance int) ([][]*HashMatch, error) {
+	tree, err := LoadHashTree()
+	if err != nil {
+		return nil, err
+	}
+
+	// Union-find of the signatures, each joined to the matches of its hash
+	parents := make(map[string]string)
+	var find func(signature string) string
+	find = func(signature string) string {
+		parent, ok := parents[signature]
+		if !ok || parent == signature {
+			return signature
+		}
+
+		root := find(parent)
+		parents[signature] = root
+		return root
+	}
+
+	hashes := make(map[string]uint64)
+	var visit func(node *bkNode)
+	visit = func(node *bkNode) {
+		for _, signature := range node.signatures {
+			hashes[signature] = node.hash
+		}
+
+		for _, match := range tree.Search(node.hash, distance) {
+			for _, signature := range node.signatures {
+				if a, b := find(signature), find(match.Signature); a != b {
+					parents[a] = b
+				}
+			}
+		}
+
+		for _, child := range node.children {
+			visit(child)
+		}
+	}
+
+	if tree.root != nil {
+		visit(tree.root)
+	}
+
+	groups := make(map[string][]*HashMatch)
+	for signature, hash := range hashes {
+		root := find(signature)
+		groups[root] = append(groups[root], &HashMatch{Signature: signature, Hash: hash})
+	}
+
+	clusters := make([][]*HashMatch, 0)
+	for _, group := range groups {
+		if len(group) < 2 {
+			continue
+		}
+
+		// Distances in a cluster are from its first hash
+		sort.Slice(group, func(i, j int) bool {
+			if group[i].Hash != group[j].Hash {
+				return group[i].Hash < group[j].Hash
+			}
+			return group[i].Signature < group[j].Signature
+		})
+
+		// Companions, e.g. a RAW and the JPEG shot with it, aren't duplicates
+		group, err := distinctAssets(group)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(group) < 2 {
+			continue
+		}
+
+		for _, match := range group {
+			match.Distance = HammingDistance(group[0].Hash, match.Hash)
+		}
+
+		clusters = append(clusters, group)
+	}
+
+	sort.Slice(clusters, func(i, j int) bool {
+		if len(clusters[i]) != len(clusters[j]) {
+			return len(clusters[i]) > len(clusters[j])
+		}
+		return clusters[i][0].Signature < clusters[j][0].Signature
+	})
+
+	return clusters, nil
+}
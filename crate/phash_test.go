@@ -0,0 +1,230 @@
+package crate_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	. "github.com/bbengfort/crate/crate"
+	"github.com/bbengfort/crate/crate/config"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// Draws a test pattern of the size, overlapping soft blobs placed by the
+// seed, so that like a photograph it has detail at every low frequency
+func mkpattern(w, h int, seed int64) image.Image {
+	random := rand.New(rand.NewSource(seed))
+	blobs := make([][4]float64, 24)
+	for idx := range blobs {
+		blobs[idx] = [4]float64{random.Float64(), random.Float64(), 0.05 + random.Float64()*0.2, random.Float64()*2 - 1}
+	}
+
+	src := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			v := 0.5
+			for _, blob := range blobs {
+				dx, dy := float64(x)/float64(w)-blob[0], float64(y)/float64(h)-blob[1]
+				v += blob[3] * 0.3 * math.Exp(-(dx*dx+dy*dy)/(blob[2]*blob[2]))
+			}
+
+			c := uint8(math.Max(0, math.Min(255, v*255)))
+			src.Set(x, y, color.RGBA{c, c / 2, 255 - c, 255})
+		}
+	}
+
+	return src
+}
+
+// Encodes the image as a JPEG of the quality
+func mkpatternjpeg(src image.Image, quality int) []byte {
+	buf := new(bytes.Buffer)
+	Ω(jpeg.Encode(buf, src, &jpeg.Options{Quality: quality})).Should(Succeed())
+	return buf.Bytes()
+}
+
+// Builds a JPEG whose SOF header claims the largest possible dimensions
+func mkoversizejpeg() []byte {
+	data := mkjpeg(8, 8)
+	sof := bytes.Index(data, []byte{0xff, 0xc0})
+	binary.BigEndian.PutUint16(data[sof+5:], 0xffff)
+	binary.BigEndian.PutUint16(data[sof+7:], 0xffff)
+	return data
+}
+
+var _ = Describe("PerceptualHash", func() {
+
+	It("should count the bits that differ between hashes", func() {
+		Ω(HammingDistance(0, 0)).Should(Equal(0))
+		Ω(HammingDistance(0xff, 0x0f)).Should(Equal(4))
+		Ω(HammingDistance(0, ^uint64(0))).Should(Equal(64))
+	})
+
+	It("should hash resized and re-encoded images alike", func() {
+		original := ComputeHashes(mkpattern(640, 480, 2))
+		resized := ComputeHashes(ResizeImage(mkpattern(640, 480, 2), 200))
+
+		decoded, err := jpeg.Decode(bytes.NewReader(mkpatternjpeg(mkpattern(640, 480, 2), 40)))
+		Ω(err).Should(BeNil())
+		encoded := ComputeHashes(decoded)
+
+		for _, hashes := range []*ImageHashes{resized, encoded} {
+			Ω(HammingDistance(original.Average, hashes.Average)).Should(BeNumerically("<=", 4))
+			Ω(HammingDistance(original.Difference, hashes.Difference)).Should(BeNumerically("<=", 4))
+			Ω(HammingDistance(original.DCT, hashes.DCT)).Should(BeNumerically("<=", 4))
+		}
+
+		different := ComputeHashes(mkpattern(640, 480, 5))
+		Ω(HammingDistance(original.DCT, different.DCT)).Should(BeNumerically(">", DefaultSimilarDistance))
+	})
+
+	It("should format and parse hashes as hex", func() {
+		Ω(FormatHash(0xabc)).Should(Equal("0000000000000abc"))
+
+		hash, err := ParseHash("fedcba9876543210")
+		Ω(err).Should(BeNil())
+		Ω(hash).Should(Equal(uint64(0xfedcba9876543210)))
+
+		_, err = ParseHash("abc")
+		Ω(err).Should(HaveOccurred())
+	})
+
+	It("should search a BK-tree as a scan of the hashes would", func() {
+		random := rand.New(rand.NewSource(42))
+		hashes := make([]uint64, 2000)
+		tree := new(BKTree)
+
+		for idx := range hashes {
+			// Flip a few bits of earlier hashes so there are near neighbors
+			if idx > 0 && idx%3 == 0 {
+				hashes[idx] = hashes[random.Intn(idx)] ^ (1 << uint(random.Intn(64)))
+			} else {
+				hashes[idx] = random.Uint64()
+			}
+			tree.Add(hashes[idx], FormatHash(uint64(idx)))
+		}
+
+		Ω(tree.Len()).Should(Equal(len(hashes)))
+
+		for _, query := range hashes[:50] {
+			expected := 0
+			for _, hash := range hashes {
+				if HammingDistance(query, hash) <= 8 {
+					expected++
+				}
+			}
+
+			matches := tree.Search(query, 8)
+			Ω(matches).Should(HaveLen(expected))
+			Ω(matches[0].Distance).Should(Equal(0))
+			for _, match := range matches {
+				Ω(HammingDistance(query, match.Hash)).Should(Equal(match.Distance))
+			}
+		}
+	})
+
+	Describe("Index", func() {
+
+		var (
+			err      error  // Any errors in directory creation
+			testRoot string // Test directory to store temp fixtures
+			testHome string // Fake home directory in temp directory
+		)
+
+		// Writes the data to the temporary directory and stores it
+		store := func(name string, data []byte) *ImageMeta {
+			path := filepath.Join(testRoot, name)
+			Ω(ioutil.WriteFile(path, data, 0644)).Should(Succeed())
+
+			img := ImageFromPath(path)
+			Ω(img.Store()).Should(Succeed())
+			return img
+		}
+
+		BeforeEach(func() {
+			testRoot, err = ioutil.TempDir("", "ginkgo-")
+			Ω(err).Should(BeNil())
+
+			testHome = filepath.Join(testRoot, "Users", "jdoe")
+			err = os.MkdirAll(testHome, 0755)
+			Ω(err).Should(BeNil())
+
+			if runtime.GOOS == "windows" {
+				Ω(os.Setenv("USERPROFILE", testHome)).Should(BeNil())
+			} else {
+				Ω(os.Setenv("HOME", testHome)).Should(BeNil())
+			}
+
+			Ω(InitializeDatabase()).Should(BeNil())
+		})
+
+		AfterEach(func() {
+			CloseDatabase()
+			Ω(os.RemoveAll(testRoot)).Should(BeNil())
+
+			if runtime.GOOS == "windows" {
+				Ω(os.Unsetenv("USERPROFILE")).Should(BeNil())
+			} else {
+				Ω(os.Unsetenv("HOME")).Should(BeNil())
+			}
+
+			config.ClearPathCache()
+		})
+
+		It("should compute the hashes of decodable images when extracting", func() {
+			img := store("IMG_0001.jpg", mkpatternjpeg(mkpattern(320, 240, 2), 90))
+			Ω(img.Hashes).ShouldNot(BeNil())
+			Ω(img.Extractors).Should(HaveKeyWithValue("phash", "1"))
+
+			broken := store("broken.jpg", []byte("\xff\xd8\xff\xe0 not really a JPEG"))
+			Ω(broken.Hashes).Should(BeNil())
+			Ω(broken.Extractors).Should(HaveKey("phash"))
+
+			// Images whose header claims too many pixels aren't decoded
+			oversize := store("oversize.jpg", mkoversizejpeg())
+			Ω(oversize.Hashes).Should(BeNil())
+			Ω(oversize.Failures).ShouldNot(HaveKey("phash"))
+		})
+
+		It("should find similar images and clusters of near duplicates", func() {
+			original := store("IMG_0001.jpg", mkpatternjpeg(mkpattern(640, 480, 2), 90))
+			copied := store("IMG_0001_small.jpg", mkpatternjpeg(ResizeImage(mkpattern(640, 480, 2), 160), 50))
+			other := store("IMG_0002.jpg", mkpatternjpeg(mkpattern(640, 480, 5), 90))
+			store("IMG_0003.jpg", mkpatternjpeg(mkpattern(640, 480, 1), 90))
+
+			matches, err := FindSimilar(original.Hashes.DCT, DefaultSimilarDistance)
+			Ω(err).Should(BeNil())
+			Ω(matches).Should(HaveLen(2))
+			Ω([]string{matches[0].Signature, matches[1].Signature}).Should(ConsistOf(original.Signature, copied.Signature))
+
+			clusters, err := NearDuplicates(DefaultSimilarDistance)
+			Ω(err).Should(BeNil())
+			Ω(clusters).Should(HaveLen(1))
+			Ω(clusters[0]).Should(HaveLen(2))
+
+			for _, match := range clusters[0] {
+				Ω(match.Signature).ShouldNot(Equal(other.Signature))
+			}
+
+			// Replacing a record replaces its index entry
+			other.Hashes = original.Hashes
+			Ω(other.Store()).Should(Succeed())
+
+			clusters, err = NearDuplicates(DefaultSimilarDistance)
+			Ω(err).Should(BeNil())
+			Ω(clusters[0]).Should(HaveLen(3))
+		})
+
+	})
+
+})
@@ -0,0 +1,317 @@
+// Signatures of the pixel data of images, which unlike the signature of the
+// file don't change when a tool edits the meta data of an image, so they link
+// the records of the same photograph with different tags
+
+package crate
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+const PixelNamespace = "pixels" // Namespace of the pixel signature index keys
+
+var ErrNoPixelData = errors.New("no pixel data found in the image")
+
+//=============================================================================
+
+// Computes the pixel signatures of JPEG and PNG images
+type PixelSignatureExtractor struct {
+	MimePrefixes
+}
+
+func init() {
+	RegisterExtractor(&PixelSignatureExtractor{MimePrefixes{"image/jpeg", "image/png"}})
+	RegisterIndex(new(PixelIndex))
+}
+
+func (ext *PixelSignatureExtractor) Name() string {
+	return "pixels"
+}
+
+func (ext *PixelSignatureExtractor) Version() string {
+	return "1"
+}
+
+// Images whose pixel data can't be found have no pixel signature, which
+// isn't a failure since re-extracting them would not change that
+func (ext *PixelSignatureExtractor) Extract(record FilePath) error {
+	img, ok := record.(*ImageMeta)
+	if !ok {
+		return nil
+	}
+
+	img.PixelSignature = ""
+	signature, err := img.PixelHash()
+	if err == ErrNoPixelData {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	img.PixelSignature = signature
+	return nil
+}
+
+// Returns the base64 encoded SHA1 hash of the pixel data of a JPEG or PNG
+func (img *ImageMeta) PixelHash() (string, error) {
+	file, err := os.Open(img.Path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	switch img.MimeType {
+	case "image/jpeg":
+		return HashJPEGScans(file)
+	case "image/png":
+		return HashPNGData(file)
+	default:
+		return "", ErrNoPixelData
+	}
+}
+
+//=============================================================================
+
+// Hashes the entropy coded scan data of a JPEG with the frame header and the
+// tables needed to decode it, skipping the APPn and COM segments that hold
+// the meta data and any data after the end of the image.
+func HashJPEGScans(r io.Reader) (string, error) {
+	sum := sha1.New()
+	found, _ := readJPEGPixels(r, sum)
+
+	// Truncated images are hashed up to where they end
+	return pixelSignature(sum, found)
+}
+
+// Hashes the header and the compressed image data of a PNG, skipping the
+// textual, EXIF and other ancillary chunks that hold the meta data.
+func HashPNGData(r io.Reader) (string, error) {
+	sum := sha1.New()
+	found, _ := readPNGPixels(r, sum)
+	return pixelSignature(sum, found)
+}
+
+// Encodes the sum as a signature if any pixel data was hashed
+func pixelSignature(sum hash.Hash, found bool) (string, error) {
+	if !found {
+		return "", ErrNoPixelData
+	}
+
+	return base64.StdEncoding.EncodeToString(sum.Sum(nil)), nil
+}
+
+// Writes the segments of a JPEG that hold its pixel data to w, and returns
+// whether it has a scan and whether it ends with an EOI marker
+func readJPEGPixels(r io.Reader, w io.Writer) (bool, bool) {
+	reader := bufio.NewReader(r)
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(reader, head); err != nil || head[0] != 0xff || head[1] != 0xd8 {
+		return false, false
+	}
+
+	scanning := false // Whether a scan has started
+	entropy := false  // Whether the bytes are entropy coded scan data
+
+	for {
+		// Scan data is written up to the next marker at once, anything else
+		// must be a marker
+		if entropy {
+			data, err := reader.ReadSlice(0xff)
+			if err == bufio.ErrBufferFull {
+				w.Write(data)
+				continue
+			} else if err != nil {
+				w.Write(data)
+				break
+			}
+			w.Write(data[:len(data)-1])
+		} else if b, err := reader.ReadByte(); err != nil || b != 0xff {
+			break
+		}
+
+		// Markers may be preceded by any number of fill bytes
+		kind, err := reader.ReadByte()
+		for err == nil && kind == 0xff {
+			kind, err = reader.ReadByte()
+		}
+
+		if err != nil {
+			break
+		}
+
+		switch {
+		case kind == 0x00 && entropy:
+			w.Write([]byte{0xff, 0x00}) // Stuffed 0xff of the scan data
+			continue
+		case kind >= 0xd0 && kind <= 0xd7 && entropy:
+			w.Write([]byte{0xff, kind}) // Restart markers of the scan data
+			continue
+		case kind == 0xd9:
+			return scanning, true
+		case kind == 0x01 || kind >= 0xd0 && kind <= 0xd8:
+			continue
+		}
+
+		entropy = false
+		if _, err := io.ReadFull(reader, head); err != nil {
+			break
+		}
+
+		size := int(binary.BigEndian.Uint16(head)) - 2
+		if size < 0 {
+			break
+		}
+
+		if kind >= 0xe0 && kind <= 0xef || kind == 0xfe {
+			if _, err := reader.Discard(size); err != nil {
+				break
+			}
+			continue
+		}
+
+		w.Write([]byte{0xff, kind})
+		w.Write(head)
+		if _, err := io.CopyN(w, reader, int64(size)); err != nil {
+			break
+		}
+
+		entropy = kind == 0xda
+		scanning = scanning || entropy
+	}
+
+	return scanning, false
+}
+
+// Writes the header and the image data chunks of a PNG to w, and returns
+// whether it has image data and whether it ends with an IEND chunk
+func readPNGPixels(r io.Reader, w io.Writer) (bool, bool) {
+	data := make([]byte, 8)
+	if _, err := io.ReadFull(r, data); err != nil || string(data) != PNGSignature {
+		return false, false
+	}
+
+	found := false
+	for {
+		if _, err := io.ReadFull(r, data); err != nil {
+			break
+		}
+
+		size := int64(binary.BigEndian.Uint32(data[:4]))
+		kind := string(data[4:8])
+		if kind == "IEND" {
+			return found, true
+		}
+
+		if kind != "IHDR" && kind != "IDAT" {
+			if err := discard(r, size+4); err != nil {
+				break
+			}
+			continue
+		}
+
+		found = found || kind == "IDAT"
+		w.Write(data)
+		if _, err := io.CopyN(w, r, size); err != nil {
+			break
+		}
+
+		if err := discard(r, 4); err != nil {
+			break
+		}
+	}
+
+	return found, false
+}
+
+//=============================================================================
+
+// Indexes the records of images by their pixel signature, see FindSamePixels
+type PixelIndex struct{}
+
+func (index *PixelIndex) Name() string {
+	return PixelNamespace
+}
+
+func (index *PixelIndex) Add(batch *leveldb.Batch, record FilePath) {
+	if img, ok := record.(*ImageMeta); ok && img.PixelSignature != "" {
+		batch.Put(indexKey(PixelNamespace, img.PixelSignature, img.Signature), nil)
+	}
+}
+
+func (index *PixelIndex) Remove(batch *leveldb.Batch, record FilePath) {
+	if img, ok := record.(*ImageMeta); ok && img.PixelSignature != "" {
+		batch.Delete(indexKey(PixelNamespace, img.PixelSignature, img.Signature))
+	}
+}
+
+// Finds the other records of images with the same pixel data as the image,
+// i.e. copies of it whose meta data has been edited
+func FindSamePixels(img *ImageMeta) ([]*ImageMeta, error) {
+	result := make([]*ImageMeta, 0)
+	if img.PixelSignature == "" {
+		return result, nil
+	}
+
+	iter := db.NewIterator(indexRange(PixelNamespace, img.PixelSignature, ""), nil)
+	defer iter.Release()
+
+	for iter.Next() {
+		signature := indexSignature(iter.Key())
+		if signature == img.Signature {
+			continue
+		}
+
+		record, err := Fetch(signature)
+		if err != nil {
+			return nil, err
+		}
+
+		if other, ok := record.(*ImageMeta); ok {
+			result = append(result, other)
+		}
+	}
+
+	return result, iter.Error()
+}
+
+//=============================================================================
+
+// A tag whose value differs between two records of an image
+type TagChange struct {
+	Tag    string // Name of the tag
+	Before string // Value of the tag in the first record, empty if unset
+	After  string // Value of the tag in the second record, empty if unset
+}
+
+// Returns the tags that were added, removed or changed from the tags of the
+// first image to those of the second, ordered by the name of the tag
+func DiffTags(before, after *ImageMeta) []*TagChange {
+	changes := make([]*TagChange, 0)
+	for tag, value := range before.Tags {
+		if after.Tags[tag] != value {
+			changes = append(changes, &TagChange{tag, value, after.Tags[tag]})
+		}
+	}
+
+	for tag, value := range after.Tags {
+		if _, ok := before.Tags[tag]; !ok && value != "" {
+			changes = append(changes, &TagChange{tag, "", value})
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Tag < changes[j].Tag
+	})
+
+	return changes
+}
@@ -0,0 +1,137 @@
+package crate_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	. "github.com/bbengfort/crate/crate"
+	"github.com/bbengfort/crate/crate/config"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("PixelSignature", func() {
+
+	// Hashes the scan data of the JPEG
+	scans := func(data []byte) string {
+		signature, err := HashJPEGScans(bytes.NewReader(data))
+		Ω(err).Should(BeNil())
+		return signature
+	}
+
+	It("should hash the scans of a JPEG without its meta data", func() {
+		original := scans(mkjpeg(64, 48))
+		Ω(original).ShouldNot(BeEmpty())
+
+		Ω(scans(mktaggedjpeg(64, 48, tascii(0x013b, "A. Photographer")))).Should(Equal(original))
+		Ω(scans(mkapp(mkjpeg(64, 48), 0xfe, []byte("a comment")))).Should(Equal(original))
+		Ω(scans(append(mkjpeg(64, 48), "trailing data"...))).Should(Equal(original))
+
+		Ω(scans(mkjpeg(48, 64))).ShouldNot(Equal(original))
+
+		_, err := HashJPEGScans(bytes.NewReader([]byte("not a JPEG")))
+		Ω(err).Should(Equal(ErrNoPixelData))
+	})
+
+	It("should hash the image data of a PNG without its meta data", func() {
+		original, err := HashPNGData(bytes.NewReader(mkpng(16, 8)))
+		Ω(err).Should(BeNil())
+
+		edited, err := HashPNGData(bytes.NewReader(mkpng(16, 8, mkpngchunk("tEXt", []byte("Author\x00Someone")))))
+		Ω(err).Should(BeNil())
+		Ω(edited).Should(Equal(original))
+
+		resized, err := HashPNGData(bytes.NewReader(mkpng(8, 16)))
+		Ω(err).Should(BeNil())
+		Ω(resized).ShouldNot(Equal(original))
+	})
+
+	It("should diff the tags of two records", func() {
+		before := &ImageMeta{Tags: TagMap{"Artist": "Someone", "Make": "Canon", "Rating": "3"}}
+		after := &ImageMeta{Tags: TagMap{"Make": "Canon", "Rating": "5", "Title": "Harbour"}}
+
+		Ω(DiffTags(before, after)).Should(Equal([]*TagChange{
+			{"Artist", "Someone", ""},
+			{"Rating", "3", "5"},
+			{"Title", "", "Harbour"},
+		}))
+
+		Ω(DiffTags(before, before)).Should(BeEmpty())
+	})
+
+	Describe("Index", func() {
+
+		var (
+			err      error  // Any errors in directory creation
+			testRoot string // Test directory to store temp fixtures
+			testHome string // Fake home directory in temp directory
+		)
+
+		// Writes the data to the temporary directory and stores it
+		store := func(name string, data []byte) *ImageMeta {
+			path := filepath.Join(testRoot, name)
+			Ω(ioutil.WriteFile(path, data, 0644)).Should(Succeed())
+
+			img := ImageFromPath(path)
+			Ω(img.Store()).Should(Succeed())
+			return img
+		}
+
+		BeforeEach(func() {
+			testRoot, err = ioutil.TempDir("", "ginkgo-")
+			Ω(err).Should(BeNil())
+
+			testHome = filepath.Join(testRoot, "Users", "jdoe")
+			err = os.MkdirAll(testHome, 0755)
+			Ω(err).Should(BeNil())
+
+			if runtime.GOOS == "windows" {
+				Ω(os.Setenv("USERPROFILE", testHome)).Should(BeNil())
+			} else {
+				Ω(os.Setenv("HOME", testHome)).Should(BeNil())
+			}
+
+			Ω(InitializeDatabase()).Should(BeNil())
+		})
+
+		AfterEach(func() {
+			CloseDatabase()
+			Ω(os.RemoveAll(testRoot)).Should(BeNil())
+
+			if runtime.GOOS == "windows" {
+				Ω(os.Unsetenv("USERPROFILE")).Should(BeNil())
+			} else {
+				Ω(os.Unsetenv("HOME")).Should(BeNil())
+			}
+
+			config.ClearPathCache()
+		})
+
+		It("should link the records of images with the same pixel data", func() {
+			original := store("IMG_0001.jpg", mktaggedjpeg(64, 48, tascii(0x013b, "Someone")))
+			edited := store("IMG_0001_edited.jpg", mktaggedjpeg(64, 48, tascii(0x013b, "A. Photographer")))
+			other := store("IMG_0002.jpg", mkjpeg(48, 64))
+
+			Ω(original.Signature).ShouldNot(Equal(edited.Signature))
+			Ω(original.PixelSignature).Should(Equal(edited.PixelSignature))
+			Ω(original.Extractors).Should(HaveKeyWithValue("pixels", "1"))
+
+			versions, err := FindSamePixels(original)
+			Ω(err).Should(BeNil())
+			Ω(versions).Should(HaveLen(1))
+			Ω(versions[0].Signature).Should(Equal(edited.Signature))
+
+			Ω(DiffTags(original, versions[0])).Should(ContainElement(&TagChange{"Artist", "Someone", "A. Photographer"}))
+
+			versions, err = FindSamePixels(other)
+			Ω(err).Should(BeNil())
+			Ω(versions).Should(BeEmpty())
+		})
+
+	})
+
+})
@@ -0,0 +1,182 @@
+// Reads the textual, EXIF and XMP chunks of PNG images, which screenshots and
+// exported images use to record the software and the time they were created
+
+package crate
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"time"
+)
+
+const PNGSignature = "\x89PNG\r\n\x1a\n"
+
+// The iTXt keyword of XMP packets embedded in PNG images
+const PNGXMPKeyword = "XML:com.adobe.xmp"
+
+// Layouts of the PNG Creation Time keyword, which should be RFC 1123 but is
+// often written in the EXIF or ISO 8601 layouts
+var PNGTimeLayouts = []string{
+	time.RFC1123Z, time.RFC1123, time.RFC822Z, time.RFC822, time.RFC3339,
+	"2006-01-02T15:04:05", "2006-01-02 15:04:05", ExifTimeLayout,
+	"Mon, 2 Jan 2006 15:04:05 -0700", "Mon, 2 Jan 2006 15:04:05 MST",
+}
+
+//=============================================================================
+
+// Reads the dimensions, APNG animation, textual chunks, eXIf chunk and XMP
+// packet of a PNG, the text of the textual chunks is keyed by their keyword.
+func ReadPNG(r io.Reader) (*ImageHeader, error) {
+	data := make([]byte, 8)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+
+	if string(data) != PNGSignature {
+		return nil, errors.New("not a PNG image")
+	}
+
+	header := &ImageHeader{Format: "PNG", Frames: 1, Text: make(map[string]string)}
+	for {
+		if _, err := io.ReadFull(r, data); err != nil {
+			break
+		}
+
+		size := int64(binary.BigEndian.Uint32(data[:4]))
+		kind := string(data[4:8])
+		if kind == "IEND" {
+			break
+		}
+
+		// Only the header, animation and metadata chunks are read
+		read := int64(0)
+		switch kind {
+		case "IHDR", "acTL", "fcTL", "tEXt", "zTXt", "iTXt", "eXIf":
+			read = size
+		}
+
+		if read > MaxChunkRead {
+			read = 0
+		}
+
+		payload := make([]byte, read)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			break
+		}
+
+		// Skip the rest of the chunk and its CRC
+		if err := discard(r, size-read+4); err != nil {
+			break
+		}
+
+		switch {
+		case kind == "IHDR" && len(payload) >= 8:
+			header.Width = int(binary.BigEndian.Uint32(payload[0:4]))
+			header.Height = int(binary.BigEndian.Uint32(payload[4:8]))
+
+		case kind == "acTL" && len(payload) >= 4:
+			header.Frames = int(binary.BigEndian.Uint32(payload[0:4]))
+
+		case kind == "fcTL" && len(payload) >= 24:
+			num := float64(binary.BigEndian.Uint16(payload[20:22]))
+			den := float64(binary.BigEndian.Uint16(payload[22:24]))
+			if den == 0 {
+				den = 100
+			}
+			header.Duration += num / den
+
+		case kind == "eXIf":
+			header.Exif = payload
+
+		case kind == "tEXt" || kind == "zTXt" || kind == "iTXt":
+			keyword, text, ok := pngText(kind, payload)
+			if !ok {
+				continue
+			}
+
+			if keyword == PNGXMPKeyword {
+				header.XMP = []byte(text)
+			} else if _, ok := header.Text[keyword]; !ok {
+				header.Text[keyword] = text
+			}
+		}
+	}
+
+	return header, nil
+}
+
+// Returns the keyword and the text of a textual chunk, decompressing zTXt and
+// compressed iTXt chunks. The text of tEXt and zTXt chunks is ISO-8859-1.
+func pngText(kind string, payload []byte) (string, string, bool) {
+	keyword, rest := splitID3Text(0, payload)
+	if rest == nil {
+		return "", "", false
+	}
+
+	switch kind {
+	case "tEXt":
+		text, _ := splitID3Text(0, rest)
+		return keyword, text, true
+
+	case "zTXt":
+		if len(rest) < 1 {
+			return "", "", false
+		}
+
+		data, err := inflate(rest[1:])
+		if err != nil {
+			return "", "", false
+		}
+
+		text, _ := splitID3Text(0, data)
+		return keyword, text, true
+
+	case "iTXt":
+		if len(rest) < 2 {
+			return "", "", false
+		}
+
+		// The language tag and translated keyword precede the UTF-8 text
+		compressed := rest[0] == 1
+		_, rest = splitID3Text(3, rest[2:])
+		_, rest = splitID3Text(3, rest)
+
+		if compressed {
+			data, err := inflate(rest)
+			if err != nil {
+				return "", "", false
+			}
+			rest = data
+		}
+
+		return keyword, string(rest), true
+	}
+
+	return "", "", false
+}
+
+// Decompresses zlib data of at most MaxChunkRead bytes
+func inflate(data []byte) ([]byte, error) {
+	reader, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	return ioutil.ReadAll(io.LimitReader(reader, MaxChunkRead))
+}
+
+// Parses the PNG Creation Time in the layouts that it is found in
+func ParsePNGTime(value string) (time.Time, bool) {
+	for _, layout := range PNGTimeLayouts {
+		if ts, err := time.Parse(layout, value); err == nil {
+			return ts, true
+		}
+	}
+
+	return time.Time{}, false
+}
@@ -0,0 +1,162 @@
+package crate_test
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"os"
+
+	. "github.com/bbengfort/crate/crate"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// Builds a PNG chunk with its length and CRC
+func mkpngchunk(kind string, payload ...[]byte) []byte {
+	data := append([]byte(kind), bytes.Join(payload, nil)...)
+	chunk := mkints(uint32(len(data) - 4))
+	chunk = append(chunk, data...)
+	return append(chunk, mkints(crc32.ChecksumIEEE(data))...)
+}
+
+// Compresses the text for zTXt and compressed iTXt chunks
+func mkzlib(text string) []byte {
+	buf := new(bytes.Buffer)
+	writer := zlib.NewWriter(buf)
+	writer.Write([]byte(text))
+	writer.Close()
+	return buf.Bytes()
+}
+
+// Encodes a PNG of the dimensions with the chunks inserted before the IEND
+func mkpng(width, height int, chunks ...[]byte) []byte {
+	buf := new(bytes.Buffer)
+	png.Encode(buf, image.NewGray(image.Rect(0, 0, width, height)))
+
+	data := buf.Bytes()
+	iend := data[len(data)-12:]
+	data = append([]byte{}, data[:len(data)-12]...)
+	return append(append(data, bytes.Join(chunks, nil)...), iend...)
+}
+
+var _ = Describe("PNG", func() {
+
+	var testRoot string // Temporary directory for the synthetic images
+
+	BeforeEach(func() {
+		var err error
+		testRoot, err = ioutil.TempDir("", "ginkgo-")
+		Ω(err).Should(BeNil())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(testRoot)
+	})
+
+	It("should parse the PNG creation time layouts", func() {
+		for _, value := range []string{
+			"Sun, 14 Jun 2015 09:30:00 +0000",
+			"14 Jun 15 09:30 +0000",
+			"2015-06-14T09:30:00Z",
+			"2015:06:14 09:30:00",
+		} {
+			ts, ok := ParsePNGTime(value)
+			Ω(ok).Should(BeTrue(), value)
+			Ω(JSONStamp(ts)).Should(Equal("2015-06-14T09:30:00+00:00"), value)
+		}
+
+		_, ok := ParsePNGTime("last tuesday")
+		Ω(ok).Should(BeFalse())
+	})
+
+	It("should read the textual chunks of a PNG", func() {
+		data := mkpng(12, 8,
+			mkpngchunk("tEXt", []byte("Software\x00GIMP 2.10")),
+			mkpngchunk("zTXt", []byte("Description\x00\x00"), mkzlib("Caf\xe9 terrace")),
+			mkpngchunk("iTXt", []byte("Title\x00\x01\x00en\x00Titel\x00"), mkzlib("Nachtcafé")))
+
+		header, err := ReadPNG(bytes.NewReader(data))
+		Ω(err).Should(BeNil())
+		Ω(header.Format).Should(Equal("PNG"))
+		Ω([]int{header.Width, header.Height}).Should(Equal([]int{12, 8}))
+		Ω(header.Text).Should(HaveKeyWithValue("Software", "GIMP 2.10"))
+		Ω(header.Text).Should(HaveKeyWithValue("Description", "Café terrace"))
+		Ω(header.Text).Should(HaveKeyWithValue("Title", "Nachtcafé"))
+	})
+
+	It("should read the frames and duration of an APNG", func() {
+		fctl := func(num uint16) []byte {
+			return mkpngchunk("fcTL", make([]byte, 20), mkints(num, uint16(1000), uint16(0)))
+		}
+
+		header, err := ReadPNG(bytes.NewReader(mkpng(4, 4,
+			mkpngchunk("acTL", mkints(uint32(2), uint32(0))), fctl(250), fctl(500))))
+		Ω(err).Should(BeNil())
+		Ω(header.Frames).Should(Equal(2))
+		Ω(header.Duration).Should(BeNumerically("~", 0.75, 0.0001))
+	})
+
+	It("should extract the software and creation time of a screenshot", func() {
+		img := extractImage(testRoot, "screenshot.png", mkpng(16, 9,
+			mkpngchunk("tEXt", []byte("Software\x00gnome-screenshot")),
+			mkpngchunk("tEXt", []byte("Creation Time\x00Sun, 14 Jun 2015 09:30:00 +0200"))))
+
+		Ω(img.Width).Should(Equal(16))
+		Ω(img.Tag("Format")).Should(Equal("PNG"))
+		Ω(img.Tag("Software")).Should(Equal("gnome-screenshot"))
+		Ω(img.Tag("DateTaken")).Should(Equal("2015-06-14T07:30:00+00:00"))
+
+		taken, ok := img.Taken()
+		Ω(ok).Should(BeTrue())
+		Ω(taken.Year()).Should(Equal(2015))
+	})
+
+	It("should prefer the eXIf chunk and XMP to the textual chunks", func() {
+		exif := mktiff(binary.BigEndian, nil,
+			tiffBlock{name: "ifd0", entries: []tiffEntry{
+				tascii(0x010f, "Apple"),
+				tascii(0x0131, "Photos 5.0"),
+				tref(0x8769, "exif"),
+			}},
+			tiffBlock{name: "exif", entries: []tiffEntry{
+				tascii(0x9003, "2020:02:29 17:45:00"),
+			}},
+		)
+
+		xmp := `<x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+<rdf:Description rdf:about="" xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:xmp="http://ns.adobe.com/xap/1.0/">
+<dc:creator><rdf:Seq><rdf:li>Mina Murray</rdf:li></rdf:Seq></dc:creator>
+<xmp:CreateDate>2021-01-01T00:00:00Z</xmp:CreateDate>
+</rdf:Description></rdf:RDF></x:xmpmeta>`
+
+		img := extractImage(testRoot, "export.png", mkpng(16, 9,
+			mkpngchunk("eXIf", exif),
+			mkpngchunk("iTXt", []byte(PNGXMPKeyword+"\x00\x00\x00\x00\x00"), []byte(xmp)),
+			mkpngchunk("tEXt", []byte("Author\x00Jonathan Harker")),
+			mkpngchunk("tEXt", []byte("Software\x00gnome-screenshot")),
+			mkpngchunk("tEXt", []byte("Creation Time\x002022:01:01 00:00:00"))))
+
+		Ω(img.Tag("CameraMake")).Should(Equal("Apple"))
+		Ω(img.Tag("Software")).Should(Equal("Photos 5.0"))
+		Ω(img.Tag("DateTaken")).Should(Equal("2020-02-29T17:45:00+00:00"))
+		Ω(img.Tag("Artist")).Should(Equal("Mina Murray"))
+	})
+
+	It("should fall back to the XMP create date", func() {
+		xmp := `<x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+<rdf:Description rdf:about="" xmlns:xmp="http://ns.adobe.com/xap/1.0/" xmp:CreateDate="2021-01-01T10:00:00+01:00"/>
+</rdf:RDF></x:xmpmeta>`
+
+		img := extractImage(testRoot, "export.png", mkpng(16, 9,
+			mkpngchunk("iTXt", []byte(PNGXMPKeyword+"\x00\x00\x00\x00\x00"), []byte(xmp)),
+			mkpngchunk("tEXt", []byte("Creation Time\x002022:01:01 00:00:00"))))
+
+		Ω(img.Tag("DateTaken")).Should(Equal("2021-01-01T09:00:00+00:00"))
+	})
+
+})
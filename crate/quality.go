@@ -0,0 +1,206 @@
+// Fully decodes images to find truncated and corrupt files, which reading the
+// header alone can't, and measures their sharpness and exposure
+
+package crate
+
+import (
+	"errors"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"time"
+)
+
+const (
+	BlurThreshold       = 100.0 // Sharpness below which an image is blurry
+	ClipThreshold       = 0.25  // Fraction of clipped pixels of badly exposed images
+	ContrastThreshold   = 0.04  // Deviation of the luminance of flat images
+	qualitySampleSize   = 1024  // Longest edge the image is reduced to before measuring
+	shadowLuminance     = 2.0 / 255
+	highlightsLuminance = 253.0 / 255
+)
+
+// Problems found in an image by a quality check
+const (
+	QualityUnreadable   = "unreadable"   // The image data can't be decoded
+	QualityTruncated    = "truncated"    // The image data ends before the image does
+	QualityBlurry       = "blurry"       // The sharpness is below the BlurThreshold
+	QualityUnderexposed = "underexposed" // Too many pixels are clipped to black
+	QualityOverexposed  = "overexposed"  // Too many pixels are clipped to white
+	QualityFlat         = "flat"         // The image has almost no contrast, e.g. a blank scan
+)
+
+var ErrNotCheckable = errors.New("image format can't be fully decoded")
+
+//=============================================================================
+
+// The result of fully decoding an image. Since the signature of an image is
+// the hash of its content, the result of a check never goes stale.
+type ImageQuality struct {
+	Checked    time.Time // When the image was checked
+	Error      string    // Why the image data couldn't be decoded, if it couldn't
+	Sharpness  float64   // Variance of the Laplacian of the luminance, low when blurry
+	Mean       float64   // Mean luminance from 0 (black) to 1 (white)
+	Deviation  float64   // Standard deviation of the luminance, low when flat
+	Shadows    float64   // Fraction of the pixels that are clipped to black
+	Highlights float64   // Fraction of the pixels that are clipped to white
+	Flags      []string  // Problems found by the check, e.g. truncated or blurry
+}
+
+// Whether the check found any problems with the image
+func (quality *ImageQuality) Suspicious() bool {
+	return len(quality.Flags) > 0
+}
+
+// Checks if the check found the problem with the image
+func (quality *ImageQuality) Flagged(flag string) bool {
+	for _, f := range quality.Flags {
+		if f == flag {
+			return true
+		}
+	}
+
+	return false
+}
+
+//=============================================================================
+
+// Fully decodes a JPEG, PNG or GIF image, flagging it if its data is
+// truncated or corrupt, and otherwise measures its sharpness and exposure.
+// JPEG and PNG images that don't end with their end marker are truncated,
+// images whose header claims more than MaxDecodePixels are unreadable.
+func CheckImage(img *ImageMeta) (*ImageQuality, error) {
+	var decode func(io.Reader) (image.Image, error)
+	var walk func(io.Reader, io.Writer) (bool, bool)
+
+	switch img.MimeType {
+	case "image/jpeg":
+		decode, walk = jpeg.Decode, readJPEGPixels
+	case "image/png":
+		decode, walk = png.Decode, readPNGPixels
+	case "image/gif":
+		decode = gif.Decode
+	default:
+		return nil, ErrNotCheckable
+	}
+
+	file, err := os.Open(img.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	complete := true
+	if walk != nil {
+		_, complete = walk(file, ioutil.Discard)
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+	}
+
+	var src image.Image
+	r, err := checkDecodeSize(file)
+	if err == nil {
+		src, err = decode(r)
+	}
+
+	if err != nil {
+		quality := &ImageQuality{Checked: time.Now(), Error: err.Error()}
+		if !complete || err == io.ErrUnexpectedEOF {
+			quality.Flags = []string{QualityTruncated}
+		} else {
+			quality.Flags = []string{QualityUnreadable}
+		}
+		return quality, nil
+	}
+
+	// Decoders may not need the end marker, so images without it are
+	// measured but flagged since their data may still be missing
+	quality := MeasureQuality(src)
+	quality.Checked = time.Now()
+	if !complete {
+		quality.Flags = append([]string{QualityTruncated}, quality.Flags...)
+	}
+
+	return quality, nil
+}
+
+// Measures the sharpness and the exposure of an image and flags it if it is
+// blurry, badly exposed or flat
+func MeasureQuality(src image.Image) *ImageQuality {
+	src = ResizeImage(src, qualitySampleSize)
+	bounds := src.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	pixels := grayscale(src, width, height)
+
+	quality := &ImageQuality{Flags: make([]string, 0)}
+	if len(pixels) == 0 {
+		return quality
+	}
+
+	// Exposure from the histogram of the luminance
+	var sum, squares float64
+	for _, px := range pixels {
+		sum += px
+		squares += px * px
+
+		if px <= shadowLuminance {
+			quality.Shadows++
+		} else if px >= highlightsLuminance {
+			quality.Highlights++
+		}
+	}
+
+	count := float64(len(pixels))
+	quality.Mean = sum / count
+	quality.Deviation = math.Sqrt(math.Max(0, squares/count-quality.Mean*quality.Mean))
+	quality.Shadows /= count
+	quality.Highlights /= count
+
+	// Sharpness from the edges found by the Laplacian, on a 0 to 255 scale
+	var lsum, lsquares, lcount float64
+	for y := 1; y < height-1; y++ {
+		for x := 1; x < width-1; x++ {
+			idx := y*width + x
+			laplacian := 255 * (pixels[idx-1] + pixels[idx+1] + pixels[idx-width] + pixels[idx+width] - 4*pixels[idx])
+			lsum += laplacian
+			lsquares += laplacian * laplacian
+			lcount++
+		}
+	}
+
+	if lcount > 0 {
+		lmean := lsum / lcount
+		quality.Sharpness = lsquares/lcount - lmean*lmean
+	}
+
+	if quality.Deviation < ContrastThreshold {
+		quality.Flags = append(quality.Flags, QualityFlat)
+	} else if quality.Sharpness < BlurThreshold {
+		quality.Flags = append(quality.Flags, QualityBlurry)
+	}
+
+	if quality.Shadows > ClipThreshold {
+		quality.Flags = append(quality.Flags, QualityUnderexposed)
+	}
+
+	if quality.Highlights > ClipThreshold {
+		quality.Flags = append(quality.Flags, QualityOverexposed)
+	}
+
+	return quality
+}
+
+// Keeps the quality check of the stored record of an image when it is
+// stored again, e.g. by a backup or re-extraction, since it is only run on
+// request and its result doesn't change as long as the signature doesn't.
+func (img *ImageMeta) preserveQuality(prev *ImageMeta) {
+	if img.Quality == nil {
+		img.Quality = prev.Quality
+	}
+}
@@ -0,0 +1,164 @@
+package crate_test
+
+import (
+	"image"
+	"image/color"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	. "github.com/bbengfort/crate/crate"
+	"github.com/bbengfort/crate/crate/config"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// Draws a checkerboard of squares of the size, which is sharp everywhere
+func mkcheckerboard(w, h, size int) image.Image {
+	src := image.NewGray(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			if (x/size+y/size)%2 == 0 {
+				src.SetGray(x, y, color.Gray{200})
+			} else {
+				src.SetGray(x, y, color.Gray{40})
+			}
+		}
+	}
+
+	return src
+}
+
+var _ = Describe("Quality", func() {
+
+	var testRoot string // Temporary directory for the images
+
+	BeforeEach(func() {
+		var err error
+		testRoot, err = ioutil.TempDir("", "ginkgo-")
+		Ω(err).Should(BeNil())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(testRoot)
+	})
+
+	It("should flag truncated JPEGs that have a valid header", func() {
+		data := mkpatternjpeg(mkcheckerboard(320, 240, 8), 90)
+		img := extractImage(testRoot, "scan_0001.jpg", data[:len(data)/2])
+		Ω(img.Width).Should(Equal(320))
+
+		quality, err := CheckImage(img)
+		Ω(err).Should(BeNil())
+		Ω(quality.Flags).Should(Equal([]string{QualityTruncated}))
+		Ω(quality.Error).ShouldNot(BeEmpty())
+		Ω(quality.Suspicious()).Should(BeTrue())
+
+		img = extractImage(testRoot, "scan_0002.jpg", data)
+		quality, err = CheckImage(img)
+		Ω(err).Should(BeNil())
+		Ω(quality.Error).Should(BeEmpty())
+		Ω(quality.Suspicious()).Should(BeFalse())
+		Ω(quality.Checked.IsZero()).Should(BeFalse())
+	})
+
+	It("should flag PNGs with corrupt image data", func() {
+		data := mkpng(64, 64)
+		data[len(data)-20] ^= 0xff
+
+		quality, err := CheckImage(extractImage(testRoot, "corrupt.png", data))
+		Ω(err).Should(BeNil())
+		Ω(quality.Flagged(QualityUnreadable)).Should(BeTrue())
+
+		// The header of a corrupt JPEG may claim any dimensions
+		quality, err = CheckImage(extractImage(testRoot, "oversize.jpg", mkoversizejpeg()))
+		Ω(err).Should(BeNil())
+		Ω(quality.Flagged(QualityUnreadable)).Should(BeTrue())
+		Ω(quality.Error).Should(Equal(ErrTooLarge.Error()))
+
+		_, err = CheckImage(extractImage(testRoot, "DSC_0001.NEF", mknef()))
+		Ω(err).Should(Equal(ErrNotCheckable))
+	})
+
+	It("should score sharp images above blurry ones", func() {
+		sharp := MeasureQuality(mkcheckerboard(320, 240, 4))
+		blurry := MeasureQuality(mkpattern(320, 240, 3))
+
+		Ω(sharp.Sharpness).Should(BeNumerically(">", BlurThreshold))
+		Ω(sharp.Flags).Should(BeEmpty())
+		Ω(blurry.Sharpness).Should(BeNumerically("<", BlurThreshold))
+		Ω(blurry.Flagged(QualityBlurry)).Should(BeTrue())
+	})
+
+	It("should measure the exposure from the luminance", func() {
+		board := MeasureQuality(mkcheckerboard(64, 64, 8))
+		Ω(board.Mean).Should(BeNumerically("~", 120.0/255, 0.01))
+		Ω(board.Deviation).Should(BeNumerically("~", 80.0/255, 0.01))
+		Ω(board.Shadows).Should(BeZero())
+		Ω(board.Highlights).Should(BeZero())
+
+		black := MeasureQuality(image.NewGray(image.Rect(0, 0, 64, 64)))
+		Ω(black.Flags).Should(Equal([]string{QualityFlat, QualityUnderexposed}))
+		Ω(black.Shadows).Should(Equal(1.0))
+
+		white := image.NewGray(image.Rect(0, 0, 64, 64))
+		for idx := range white.Pix {
+			white.Pix[idx] = 255
+		}
+		Ω(MeasureQuality(white).Flags).Should(Equal([]string{QualityFlat, QualityOverexposed}))
+	})
+
+	Describe("Storage", func() {
+
+		var testHome string // Fake home directory in temp directory
+
+		BeforeEach(func() {
+			testHome = filepath.Join(testRoot, "Users", "jdoe")
+			Ω(os.MkdirAll(testHome, 0755)).Should(Succeed())
+
+			if runtime.GOOS == "windows" {
+				Ω(os.Setenv("USERPROFILE", testHome)).Should(BeNil())
+			} else {
+				Ω(os.Setenv("HOME", testHome)).Should(BeNil())
+			}
+
+			Ω(InitializeDatabase()).Should(BeNil())
+		})
+
+		AfterEach(func() {
+			CloseDatabase()
+
+			if runtime.GOOS == "windows" {
+				Ω(os.Unsetenv("USERPROFILE")).Should(BeNil())
+			} else {
+				Ω(os.Unsetenv("HOME")).Should(BeNil())
+			}
+
+			config.ClearPathCache()
+		})
+
+		It("should keep the quality check when a record is stored again", func() {
+			data := mkpatternjpeg(mkcheckerboard(64, 48, 8), 90)
+			img := extractImage(testRoot, "IMG_0001.jpg", data[:len(data)-40])
+
+			quality, err := CheckImage(img)
+			Ω(err).Should(BeNil())
+			img.Quality = quality
+			Ω(img.Store()).Should(Succeed())
+
+			fresh, err := Reextract(img)
+			Ω(err).Should(BeNil())
+			Ω(fresh.(*ImageMeta).Quality).Should(BeNil())
+			Ω(fresh.Store()).Should(Succeed())
+
+			stored, err := Fetch(img.Signature)
+			Ω(err).Should(BeNil())
+			Ω(stored.(*ImageMeta).Quality).ShouldNot(BeNil())
+			Ω(stored.(*ImageMeta).Quality.Flags).Should(Equal([]string{QualityTruncated}))
+		})
+
+	})
+
+})
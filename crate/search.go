@@ -0,0 +1,431 @@
+// Query language and search over the meta data records in the database
+// A query is a whitespace separated list of field:value predicates, e.g.
+// 		near:31.51,-9.77~5km after:2015-01-01 CameraModel:"Nexus 5"
+
+package crate
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+const (
+	DefaultRadius = 1.0 // Radius in km of a near predicate without a radius
+)
+
+// Layouts accepted for dates in after and before predicates
+var QueryDateLayouts = []string{
+	JSONLayout,
+	"2006-01-02T15:04:05",
+	"2006-01-02",
+	"2006-01",
+	"2006",
+}
+
+//=============================================================================
+
+// A FilePath that carries EXIF style tags (e.g. ImageMeta)
+type TaggedPath interface {
+	FilePath
+	Tag(name string) string             // Returns the value of the tag or empty string
+	Location() (float64, float64, bool) // Returns the latitude and longitude if tagged
+	Taken() (time.Time, bool)           // Returns the DateTaken if tagged
+}
+
+// A single condition that a record must meet to match a query
+type Predicate interface {
+	Match(record FilePath) bool // Whether or not the record meets the condition
+}
+
+// A predicate that can be answered by the geohash index
+type GeoPredicate interface {
+	Predicate
+	Bounds() *BoundingBox // The box containing every record that could match
+}
+
+// A set of predicates that must all match (e.g. a conjunction)
+type Query struct {
+	Predicates []Predicate // The conditions that records must meet
+}
+
+//=============================================================================
+
+// Parse a query string into a Query, returns an error for bad predicates
+func ParseQuery(text string) (*Query, error) {
+	query := new(Query)
+
+	terms, err := splitTerms(text)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, term := range terms {
+		idx := strings.Index(term, ":")
+		if idx < 1 {
+			return nil, fmt.Errorf("could not parse \"%s\", use field:value", term)
+		}
+
+		pred, err := ParsePredicate(term[:idx], term[idx+1:])
+		if err != nil {
+			return nil, err
+		}
+
+		query.Add(pred)
+	}
+
+	return query, nil
+}
+
+// Parse a single field:value term into its Predicate. Unknown fields are
+// treated as tag names, so any tag on a record can be queried.
+func ParsePredicate(field, value string) (Predicate, error) {
+	switch strings.ToLower(field) {
+	case "near":
+		return parseNear(value)
+	case "bbox":
+		return parseBox(value)
+	case "after":
+		after, err := parseQueryDate(value)
+		if err != nil {
+			return nil, err
+		}
+		return &DatePredicate{After: after}, nil
+	case "before":
+		before, err := parseQueryDate(value)
+		if err != nil {
+			return nil, err
+		}
+		return &DatePredicate{Before: before}, nil
+	case "color":
+		return parseColor(value)
+	case "group":
+		return &GroupPredicate{ID: value}, nil
+	case "mime":
+		return &MimePredicate{value}, nil
+	case "name":
+		return &NamePredicate{value}, nil
+	default:
+		return &TagPredicate{field, value}, nil
+	}
+}
+
+// Add a predicate to the query
+func (query *Query) Add(pred Predicate) {
+	query.Predicates = append(query.Predicates, pred)
+}
+
+// Checks if the record matches every predicate in the query
+func (query *Query) Match(record FilePath) bool {
+	for _, pred := range query.Predicates {
+		if !pred.Match(record) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Returns the first predicate that can be answered by the geohash index
+func (query *Query) geo() GeoPredicate {
+	for _, pred := range query.Predicates {
+		if geo, ok := pred.(GeoPredicate); ok {
+			return geo
+		}
+	}
+
+	return nil
+}
+
+//=============================================================================
+
+// Returns all of the records in the database that match the query. If the
+// query has a location predicate the geohash index is used to find candidate
+// records, otherwise every record in the database is checked. Results near a
+// point are ordered by their distance from it.
+func Search(query *Query) ([]FilePath, error) {
+	results := make([]FilePath, 0)
+
+	if geo := query.geo(); geo != nil {
+		for _, signature := range geoCandidates(geo.Bounds()) {
+			// Index keys may outlive their record, e.g. if a write failed
+			record, err := Fetch(signature)
+			if err == leveldb.ErrNotFound {
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+
+			if query.Match(record) {
+				results = append(results, record)
+			}
+		}
+
+		if near, ok := geo.(*NearPredicate); ok {
+			sort.Sort(byDistance{results, near.Latitude, near.Longitude})
+		}
+
+		return results, nil
+	}
+
+	err := EachRecord(func(record FilePath) error {
+		if query.Match(record) {
+			results = append(results, record)
+		}
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
+
+//=============================================================================
+
+// Matches records located within Radius km of a point
+type NearPredicate struct {
+	Latitude  float64 // Latitude of the center point
+	Longitude float64 // Longitude of the center point
+	Radius    float64 // Radius in kilometers
+}
+
+func (pred *NearPredicate) Match(record FilePath) bool {
+	if tagged, ok := record.(TaggedPath); ok {
+		if lat, lon, ok := tagged.Location(); ok {
+			return Distance(pred.Latitude, pred.Longitude, lat, lon) <= pred.Radius
+		}
+	}
+
+	return false
+}
+
+func (pred *NearPredicate) Bounds() *BoundingBox {
+	return RadiusBox(pred.Latitude, pred.Longitude, pred.Radius)
+}
+
+// Matches records located inside of a bounding box
+type BoxPredicate struct {
+	Box *BoundingBox // The box the record must be located inside of
+}
+
+func (pred *BoxPredicate) Match(record FilePath) bool {
+	if tagged, ok := record.(TaggedPath); ok {
+		if lat, lon, ok := tagged.Location(); ok {
+			return pred.Box.Contains(lat, lon)
+		}
+	}
+
+	return false
+}
+
+func (pred *BoxPredicate) Bounds() *BoundingBox {
+	return pred.Box
+}
+
+// Matches records taken at or after After and before Before, zero is open
+type DatePredicate struct {
+	After  time.Time // Inclusive start of the range
+	Before time.Time // Exclusive end of the range
+}
+
+func (pred *DatePredicate) Match(record FilePath) bool {
+	if pred.After.IsZero() && pred.Before.IsZero() {
+		return true
+	}
+
+	if tagged, ok := record.(TaggedPath); ok {
+		if taken, ok := tagged.Taken(); ok {
+			if !pred.After.IsZero() && taken.Before(pred.After) {
+				return false
+			}
+
+			if !pred.Before.IsZero() && !taken.Before(pred.Before) {
+				return false
+			}
+
+			return true
+		}
+	}
+
+	return false
+}
+
+// Matches records with a tag value containing Value (case insensitive)
+type TagPredicate struct {
+	Name  string // The name of the tag, e.g. CameraModel
+	Value string // The text the tag value must contain
+}
+
+func (pred *TagPredicate) Match(record FilePath) bool {
+	if tagged, ok := record.(TaggedPath); ok {
+		value := tagged.Tag(pred.Name)
+		if value == "" {
+			return false
+		}
+
+		return strings.Contains(strings.ToLower(value), strings.ToLower(pred.Value))
+	}
+
+	return false
+}
+
+// Matches records whose MIME type matches a glob pattern, e.g. image/*
+type MimePredicate struct {
+	Pattern string // The glob pattern to match the MIME type against
+}
+
+func (pred *MimePredicate) Match(record FilePath) bool {
+	matched, _ := filepath.Match(pred.Pattern, record.File().MimeType)
+	return matched
+}
+
+// Matches records whose base name matches a glob pattern, e.g. *.jpg
+type NamePredicate struct {
+	Pattern string // The glob pattern to match the name against
+}
+
+func (pred *NamePredicate) Match(record FilePath) bool {
+	matched, _ := filepath.Match(strings.ToLower(pred.Pattern), strings.ToLower(record.Base()))
+	return matched
+}
+
+//=============================================================================
+
+// Splits a query on whitespace, keeping double quoted values together
+func splitTerms(text string) ([]string, error) {
+	terms := make([]string, 0)
+	term := make([]rune, 0)
+	quoted := false
+
+	for _, c := range text {
+		switch {
+		case c == '"':
+			quoted = !quoted
+		case !quoted && (c == ' ' || c == '\t' || c == '\n'):
+			if len(term) > 0 {
+				terms = append(terms, string(term))
+				term = term[:0]
+			}
+		default:
+			term = append(term, c)
+		}
+	}
+
+	if quoted {
+		return nil, errors.New("unterminated quote in query")
+	}
+
+	if len(term) > 0 {
+		terms = append(terms, string(term))
+	}
+
+	return terms, nil
+}
+
+// Parses a comma separated list of floats with the expected length
+func parseFloats(value string, count int) ([]float64, error) {
+	parts := strings.Split(value, ",")
+	if len(parts) != count {
+		return nil, fmt.Errorf("expected %d comma separated numbers in \"%s\"", count, value)
+	}
+
+	nums := make([]float64, count)
+	for idx, part := range parts {
+		num, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return nil, err
+		}
+		nums[idx] = num
+	}
+
+	return nums, nil
+}
+
+// Parses lat,lon~radius where radius has an optional km or m unit
+func parseNear(value string) (*NearPredicate, error) {
+	radius := DefaultRadius
+
+	if idx := strings.Index(value, "~"); idx >= 0 {
+		var err error
+		if radius, err = ParseDistance(value[idx+1:]); err != nil {
+			return nil, err
+		}
+		value = value[:idx]
+	}
+
+	coords, err := parseFloats(value, 2)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := NewBoundingBox(coords[0], coords[1], coords[0], coords[1]); err != nil {
+		return nil, err
+	}
+
+	return &NearPredicate{coords[0], coords[1], radius}, nil
+}
+
+// Parses minLat,minLon,maxLat,maxLon into a box predicate, a minLon east of
+// the maxLon is a box that wraps around the antimeridian
+func parseBox(value string) (*BoxPredicate, error) {
+	coords, err := parseFloats(value, 4)
+	if err != nil {
+		return nil, err
+	}
+
+	box, err := NewBoundingBox(coords[0], coords[1], coords[2], coords[3])
+	if err != nil {
+		return nil, err
+	}
+
+	return &BoxPredicate{box}, nil
+}
+
+// Parses a date in any of the QueryDateLayouts (UTC unless zoned)
+func parseQueryDate(value string) (time.Time, error) {
+	for _, layout := range QueryDateLayouts {
+		if dt, err := time.Parse(layout, value); err == nil {
+			return dt, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("could not parse date \"%s\"", value)
+}
+
+// Parses a distance such as 5km, 500m or 2 (kilometers) into kilometers
+func ParseDistance(value string) (float64, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	scale := 1.0
+
+	switch {
+	case strings.HasSuffix(value, "km"):
+		value = strings.TrimSuffix(value, "km")
+	case strings.HasSuffix(value, "m"):
+		value = strings.TrimSuffix(value, "m")
+		scale = 0.001
+	}
+
+	dist, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, fmt.Errorf("could not parse distance \"%s\"", value)
+	}
+
+	if math.IsNaN(dist) || math.IsInf(dist, 0) {
+		return 0, fmt.Errorf("could not parse distance \"%s\"", value)
+	}
+
+	if dist < 0 {
+		return 0, errors.New("distance must not be negative")
+	}
+
+	return dist * scale, nil
+}
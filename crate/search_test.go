@@ -0,0 +1,111 @@
+package crate_test
+
+import (
+	"time"
+
+	. "github.com/bbengfort/crate/crate"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Search", func() {
+
+	var (
+		coast *ImageMeta // An image record tagged with a location
+		notes *FileMeta  // A file record without any tags
+	)
+
+	BeforeEach(func() {
+		coast = new(ImageMeta)
+		coast.Path = "/photos/coast.jpg"
+		coast.MimeType = "image/jpeg"
+		coast.Tags = map[string]string{
+			"DateTaken":   "2015-01-05T09:57:20+00:00",
+			"Latitude":    "31.510427472222222",
+			"Longitude":   "-9.774266222222224",
+			"CameraModel": "Nexus 5",
+		}
+
+		notes = new(FileMeta)
+		notes.Path = "/documents/notes.txt"
+		notes.MimeType = "text/plain"
+	})
+
+	It("should parse a query into predicates", func() {
+		query, err := ParseQuery("near:31.51,-9.77~5km after:2015-01-01 CameraModel:\"Nexus 5\"")
+		Ω(err).Should(BeNil())
+		Ω(query.Predicates).Should(HaveLen(3))
+
+		near := query.Predicates[0].(*NearPredicate)
+		Ω(near.Latitude).Should(Equal(31.51))
+		Ω(near.Longitude).Should(Equal(-9.77))
+		Ω(near.Radius).Should(Equal(5.0))
+
+		tag := query.Predicates[2].(*TagPredicate)
+		Ω(tag.Name).Should(Equal("CameraModel"))
+		Ω(tag.Value).Should(Equal("Nexus 5"))
+	})
+
+	It("should not parse bad queries", func() {
+		for _, text := range []string{
+			"coast", "near:31.51", "near:91,0", "bbox:1,2,3", "bbox:NaN,0,1,1", "near:NaN,0", "near:0,0~Inf", "after:yesterday",
+			"near:31.5,-9.7~far", "CameraModel:\"Nexus",
+		} {
+			_, err := ParseQuery(text)
+			Ω(err).Should(HaveOccurred(), "parsed \"%s\"", text)
+		}
+	})
+
+	It("should parse distances", func() {
+		Ω(ParseDistance("5km")).Should(Equal(5.0))
+		Ω(ParseDistance("500m")).Should(Equal(0.5))
+		Ω(ParseDistance("2")).Should(Equal(2.0))
+	})
+
+	It("should match records near a point", func() {
+		query, _ := ParseQuery("near:31.5,-9.77~2km")
+		Ω(query.Match(coast)).Should(BeTrue())
+		Ω(query.Match(notes)).Should(BeFalse())
+
+		query, _ = ParseQuery("near:31.5,-9.77~500m")
+		Ω(query.Match(coast)).Should(BeFalse())
+	})
+
+	It("should match records inside of a box", func() {
+		query, _ := ParseQuery("bbox:32,-10,31,-9")
+		Ω(query.Match(coast)).Should(BeTrue())
+
+		query, _ = ParseQuery("bbox:30,-10,31,-9")
+		Ω(query.Match(coast)).Should(BeFalse())
+
+		// A western edge east of the eastern edge wraps around the antimeridian
+		query, _ = ParseQuery("bbox:31,-9,32,-10")
+		Ω(query.Match(coast)).Should(BeFalse())
+
+		query, _ = ParseQuery("bbox:31,170,32,-9")
+		Ω(query.Match(coast)).Should(BeTrue())
+	})
+
+	It("should match records in a date range", func() {
+		query, _ := ParseQuery("after:2015-01-05 before:2015-01-06")
+		Ω(query.Match(coast)).Should(BeTrue())
+		Ω(query.Match(notes)).Should(BeFalse())
+
+		query, _ = ParseQuery("before:2015-01-05")
+		Ω(query.Match(coast)).Should(BeFalse())
+
+		pred := &DatePredicate{time.Time{}, time.Time{}}
+		Ω(pred.Match(notes)).Should(BeTrue())
+	})
+
+	It("should match records by tag, name and mimetype", func() {
+		query, _ := ParseQuery("cameramodel:nexus name:*.JPG mime:image/*")
+		Ω(query.Match(coast)).Should(BeFalse())
+
+		query, _ = ParseQuery("CameraModel:nexus name:*.JPG mime:image/*")
+		Ω(query.Match(coast)).Should(BeTrue())
+		Ω(query.Match(notes)).Should(BeFalse())
+	})
+
+})
@@ -3,7 +3,12 @@
 package crate
 
 import (
+	"fmt"
+	"io"
+	"os"
 	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/bbengfort/crate/crate/config"
 )
@@ -48,6 +53,13 @@ func (service *CrateService) Init() {
 	service.initialized = true
 }
 
+// Close all the services initialized by Init, useful for defering close
+func (service *CrateService) Close() {
+	CloseDatabase()
+	CloseLoggers()
+	Magic.Close()
+}
+
 // Runs the backup utility service on a specified directory
 func (service *CrateService) Backup(dirPath string) {
 	if !service.initialized {
@@ -55,9 +67,7 @@ func (service *CrateService) Backup(dirPath string) {
 	}
 
 	// Defer closing of various utilities
-	defer CloseDatabase()
-	defer CloseLoggers()
-	defer Magic.Close()
+	defer service.Close()
 
 	rootPath, err := NewPath(dirPath)
 	if err != nil {
@@ -70,6 +80,10 @@ func (service *CrateService) Backup(dirPath string) {
 		// First log starting of backup on directory
 		eventLogger.Info("started backup on directory \"%s\"", root)
 
+		// The stored records are linked to their companions as the walk
+		// leaves each directory
+		linker := NewCompanionLinker()
+
 		root.Walk(func(path Path, err error) error {
 
 			// If there is an error, stop the walk
@@ -87,10 +101,12 @@ func (service *CrateService) Backup(dirPath string) {
 
 				if fm, ok := path.(*FileMeta); ok {
 
-					if img, ok := ConvertImageMeta(fm); ok {
-						img.Store()
-					} else {
-						fm.Store()
+					// The extractors claiming the MIME type define the record
+					record := NewRecord(fm)
+					if err := record.Store(); err != nil {
+						eventLogger.Error("could not store \"%s\": %s", path, err)
+					} else if err := linker.Add(record); err != nil {
+						eventLogger.Error("could not link the companions in \"%s\": %s", path.Dir(), err)
 					}
 
 				} else {
@@ -103,6 +119,12 @@ func (service *CrateService) Backup(dirPath string) {
 
 		})
 
+		// RAW+JPEG pairs, sidecars and Live Photos are stored as assets
+		if err := linker.Close(); err != nil {
+			eventLogger.Error("could not link the companions in \"%s\": %s", root, err)
+		}
+		eventLogger.Info("linked %d assets of companion files in \"%s\"", linker.Assets, root)
+
 		// Log the completion of the backup on directory
 		eventLogger.Info("finished backup on directory \"%s\"", root)
 
@@ -111,3 +133,734 @@ func (service *CrateService) Backup(dirPath string) {
 	}
 
 }
+
+// Searches the database with a query string and writes the matches to stdout
+func (service *CrateService) Search(text string, limit int, info bool) {
+	if !service.initialized {
+		service.Init()
+	}
+
+	defer service.Close()
+
+	query, err := ParseQuery(text)
+	if err != nil {
+		console.Fatal("Could not parse query \"%s\": %s", text, err)
+	}
+
+	results, err := Search(query)
+	if err != nil {
+		console.Fatal("Could not search the database: %s", err)
+	}
+
+	for idx, record := range results {
+		if limit > 0 && idx >= limit {
+			break
+		}
+
+		if info {
+			console.Log(record.Info())
+		} else {
+			console.Log("%s\t%s", record.File().Signature, record.File().Path)
+		}
+	}
+
+	eventLogger.Info("search \"%s\" matched %d records", text, len(results))
+}
+
+// Searches the full-text index and prints the ranked matches with snippets
+func (service *CrateService) Grep(text string, limit int) {
+	if !service.initialized {
+		service.Init()
+	}
+
+	defer service.Close()
+
+	matches, err := Grep(text, limit)
+	if err != nil {
+		console.Fatal("Could not search the full-text index: %s", err)
+	}
+
+	for _, match := range matches {
+		console.Log("%0.3f\t%s", match.Score, match.Record.File().Path)
+		for _, snippet := range match.Snippets {
+			console.Log("\t%s", snippet)
+		}
+	}
+
+	eventLogger.Info("grep \"%s\" matched %d records", text, len(matches))
+}
+
+// Geotags the images in a directory that have no GPS data from GPX track logs
+func (service *CrateService) Geotag(dirPath string, gpxPaths []string, offset, maxGap time.Duration, sidecars bool) {
+	if !service.initialized {
+		service.Init()
+	}
+
+	defer service.Close()
+
+	track, err := LoadTrack(gpxPaths...)
+	if err != nil {
+		console.Fatal("Could not load GPX track logs: %s", err)
+	}
+
+	rootPath, err := NewPath(dirPath)
+	if err != nil {
+		console.Fatal("Could not open path \"%s\": %s", dirPath, err)
+	}
+
+	root, ok := rootPath.(*Dir)
+	if !ok {
+		console.Fatal("Specified path is not a directory, \"%s\"", dirPath)
+	}
+
+	eventLogger.Info("started geotag on directory \"%s\" with %d track points", root, len(track.Points))
+	tagged := 0
+
+	root.Walk(func(path Path, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if path.Dir().IsHidden() {
+			return filepath.SkipDir
+		}
+
+		if !path.IsFile() || path.IsHidden() {
+			return nil
+		}
+
+		img, ok := ConvertImageMeta(path.(*FileMeta))
+		if !ok || !img.Geotag(track, offset, maxGap) {
+			return nil
+		}
+
+		if err := img.Store(); err != nil {
+			eventLogger.Error("could not store geotag for \"%s\": %s", img.Path, err)
+			return nil
+		}
+
+		tagged++
+		console.Log("%s\t%s,%s", img.Path, img.Tag("Latitude"), img.Tag("Longitude"))
+
+		if sidecars {
+			if _, err := img.WriteSidecar(); err != nil {
+				eventLogger.Warn("could not write sidecar for \"%s\": %s", img.Path, err)
+			}
+		}
+
+		return nil
+	})
+
+	eventLogger.Info("finished geotag on directory \"%s\", tagged %d images", root, tagged)
+}
+
+// Exports the locations of the records matching a query as GeoJSON or KML to
+// the output path, or to stdout if the path is empty.
+func (service *CrateService) Export(text string, format string, clustered bool, output string) {
+	if !service.initialized {
+		service.Init()
+	}
+
+	defer service.Close()
+
+	// The format is checked before the output is created
+	if err := CheckExportFormat(format); err != nil {
+		console.Fatal("Could not export records: %s", err)
+	}
+
+	query, err := ParseQuery(text)
+	if err != nil {
+		console.Fatal("Could not parse query \"%s\": %s", text, err)
+	}
+
+	results, err := Search(query)
+	if err != nil {
+		console.Fatal("Could not search the database: %s", err)
+	}
+
+	var w io.Writer = os.Stdout
+	if output != "" {
+		file, err := os.Create(output)
+		if err != nil {
+			console.Fatal("Could not create \"%s\": %s", output, err)
+		}
+		defer file.Close()
+		w = file
+	}
+
+	// The companions of a record are exported with it rather than on their own
+	results, assets, err := CollapseCompanions(results)
+	if err != nil {
+		console.Fatal("Could not fetch the companions of the records: %s", err)
+	}
+
+	if err := Export(w, results, assets, format, clustered); err != nil {
+		console.Fatal("Could not export records: %s", err)
+	}
+
+	eventLogger.Info("exported %d records matching \"%s\" as %s", len(results), text, format)
+}
+
+// Writes the embedded EXIF thumbnail of an image to the output path, or to
+// stdout if the path is empty, reading it from the EXIF without decoding the
+// image itself.
+func (service *CrateService) Thumbnail(imagePath string, output string) {
+	if !service.initialized {
+		service.Init()
+	}
+
+	defer service.Close()
+
+	path, err := NewPath(imagePath)
+	if err != nil {
+		console.Fatal("Could not open path \"%s\": %s", imagePath, err)
+	}
+
+	fm, ok := path.(*FileMeta)
+	if !ok {
+		console.Fatal("Specified path is not a file, \"%s\"", imagePath)
+	}
+
+	img, ok := NewRecord(fm).(*ImageMeta)
+	if !ok {
+		console.Fatal("Specified path is not an image, \"%s\"", imagePath)
+	}
+
+	exif, ok := img.GetExif()
+	if !ok {
+		console.Fatal("Could not read the EXIF of \"%s\"", imagePath)
+	}
+
+	data, err := exif.Thumbnail()
+	if err != nil {
+		console.Fatal("Could not extract the thumbnail of \"%s\": %s", imagePath, err)
+	}
+
+	var w io.Writer = os.Stdout
+	if output != "" {
+		file, err := os.Create(output)
+		if err != nil {
+			console.Fatal("Could not create \"%s\": %s", output, err)
+		}
+		defer file.Close()
+		w = file
+	}
+
+	if _, err := w.Write(data); err != nil {
+		console.Fatal("Could not write the thumbnail: %s", err)
+	}
+
+	eventLogger.Info("extracted the %d byte thumbnail of \"%s\"", len(data), imagePath)
+}
+
+// Generates the thumbnails of the size of the images matching a query into
+// the thumbnail cache, printing the path of the cached thumbnail of each.
+func (service *CrateService) Thumbnails(text string, size int) {
+	if !service.initialized {
+		service.Init()
+	}
+
+	defer service.Close()
+
+	cache, err := OpenThumbnailCache()
+	if err != nil {
+		console.Fatal("Could not open the thumbnail cache: %s", err)
+	}
+
+	query, err := ParseQuery(text)
+	if err != nil {
+		console.Fatal("Could not parse query \"%s\": %s", text, err)
+	}
+
+	results, err := Search(query)
+	if err != nil {
+		console.Fatal("Could not search the database: %s", err)
+	}
+
+	count := 0
+	for _, record := range results {
+		img, ok := record.(*ImageMeta)
+		if !ok {
+			continue
+		}
+
+		path, err := cache.Get(img, size)
+		if err != nil {
+			eventLogger.Warn("could not generate a thumbnail of \"%s\": %s", img.Path, err)
+			continue
+		}
+
+		count++
+		console.Log("%s\t%s", img.Path, path)
+	}
+
+	eventLogger.Info("cached %d thumbnails of %d pixels for \"%s\"", count, size, text)
+}
+
+// Prints the images whose perceptual hashes are within the distance of the
+// image at the path or, if there is no such file, the stored signature.
+func (service *CrateService) Similar(arg string, distance int, limit int) {
+	if !service.initialized {
+		service.Init()
+	}
+
+	defer service.Close()
+
+	img := service.resolveImage(arg)
+	if img.Hashes == nil {
+		console.Fatal("Could not compare \"%s\": %s", img.Path, ErrNoHashes)
+	}
+
+	matches, err := FindSimilar(img.Hashes.DCT, distance)
+	if err != nil {
+		console.Fatal("Could not search the perceptual hashes: %s", err)
+	}
+
+	count := 0
+	for _, match := range matches {
+		if match.Signature == img.Signature {
+			continue
+		}
+
+		if limit > 0 && count >= limit {
+			break
+		}
+
+		record, err := Fetch(match.Signature)
+		if err != nil {
+			eventLogger.Warn("could not fetch similar record %s: %s", match.Signature, err)
+			continue
+		}
+
+		count++
+		console.Log("%d\t%s\t%s", match.Distance, match.Signature, record.File().Path)
+	}
+
+	eventLogger.Info("found %d images similar to \"%s\"", count, img.Path)
+}
+
+// Prints the other records of the image at the path or with the signature
+// whose pixel data is the same, and the tags that differ from each of them.
+func (service *CrateService) Versions(arg string) {
+	if !service.initialized {
+		service.Init()
+	}
+
+	defer service.Close()
+
+	img := service.resolveImage(arg)
+	if img.PixelSignature == "" {
+		console.Fatal("Could not compare \"%s\": %s", img.Path, ErrNoPixelData)
+	}
+
+	versions, err := FindSamePixels(img)
+	if err != nil {
+		console.Fatal("Could not search the pixel signatures: %s", err)
+	}
+
+	for _, version := range versions {
+		console.Log("%s\t%s", version.Signature, version.Path)
+		for _, change := range DiffTags(img, version) {
+			console.Log("\t%s\t%q -> %q", change.Tag, change.Before, change.After)
+		}
+	}
+
+	eventLogger.Info("found %d versions of \"%s\" with the same pixel data", len(versions), img.Path)
+}
+
+// Prints the members of the asset that the file at the path or the record
+// with the signature belongs to, e.g. the JPEG and sidecar of a RAW
+func (service *CrateService) Companions(arg string) {
+	if !service.initialized {
+		service.Init()
+	}
+
+	defer service.Close()
+
+	signature := arg
+	if exists, _ := PathExists(arg); exists {
+		path, err := NewPath(arg)
+		if err != nil {
+			console.Fatal("Could not open path \"%s\": %s", arg, err)
+		}
+
+		fm, ok := path.(*FileMeta)
+		if !ok {
+			console.Fatal("Specified path is not a file, \"%s\"", arg)
+		}
+
+		fm.Populate()
+		signature = fm.Signature
+	}
+
+	asset, err := AssetOf(signature)
+	if err != nil {
+		console.Fatal("Could not find the companions of \"%s\": %s", arg, err)
+	}
+
+	for _, member := range asset.Members {
+		console.Log("%s\t%s\t%s", member.Role, member.Signature, member.Path)
+	}
+
+	eventLogger.Info("found %d members of the asset of \"%s\"", len(asset.Members), arg)
+}
+
+// Prints the clusters of images whose perceptual hashes are within the
+// distance of each other, each image with its distance from the first
+func (service *CrateService) NearDuplicates(distance int) {
+	if !service.initialized {
+		service.Init()
+	}
+
+	defer service.Close()
+
+	clusters, err := NearDuplicates(distance)
+	if err != nil {
+		console.Fatal("Could not cluster the perceptual hashes: %s", err)
+	}
+
+	for idx, cluster := range clusters {
+		console.Log("cluster %d: %d images", idx+1, len(cluster))
+		for _, match := range cluster {
+			path := ""
+			if record, err := Fetch(match.Signature); err == nil {
+				path = record.File().Path
+			}
+
+			console.Log("\t%d\t%s\t%s", match.Distance, match.Signature, path)
+		}
+	}
+
+	eventLogger.Info("found %d clusters of near duplicates within %d bits", len(clusters), distance)
+}
+
+// Fully decodes the images matching a query that haven't been checked (or all
+// of them if forced), storing the results, and prints the suspicious images
+// with their problems, or every checked image with its scores if all is set.
+func (service *CrateService) Check(text string, force bool, all bool) {
+	if !service.initialized {
+		service.Init()
+	}
+
+	defer service.Close()
+
+	query, err := ParseQuery(text)
+	if err != nil {
+		console.Fatal("Could not parse query \"%s\": %s", text, err)
+	}
+
+	results, err := Search(query)
+	if err != nil {
+		console.Fatal("Could not search the database: %s", err)
+	}
+
+	checked, suspicious := 0, 0
+	for _, record := range results {
+		img, ok := record.(*ImageMeta)
+		if !ok {
+			continue
+		}
+
+		if force || img.Quality == nil {
+			quality, err := CheckImage(img)
+			if err == ErrNotCheckable {
+				continue
+			} else if err != nil {
+				eventLogger.Warn("could not check \"%s\": %s", img.Path, err)
+				continue
+			}
+
+			img.Quality = quality
+			if err := img.Store(); err != nil {
+				console.Fatal("Could not store the quality of \"%s\": %s", img.Path, err)
+			}
+		}
+
+		checked++
+		quality := img.Quality
+		if quality.Suspicious() {
+			suspicious++
+		} else if !all {
+			continue
+		}
+
+		flags := strings.Join(quality.Flags, ",")
+		if quality.Error != "" {
+			console.Log("%s\t%s\t%s", img.Path, flags, quality.Error)
+		} else {
+			console.Log("%s\t%s\tsharpness=%0.1f mean=%0.2f deviation=%0.2f shadows=%0.2f highlights=%0.2f",
+				img.Path, flags, quality.Sharpness, quality.Mean, quality.Deviation, quality.Shadows, quality.Highlights)
+		}
+	}
+
+	eventLogger.Info("checked %d images for \"%s\", %d are suspicious", checked, text, suspicious)
+}
+
+// Groups the images in the database into bursts and events with the
+// thresholds of the configuration, replacing the stored groups
+func (service *CrateService) Regroup() {
+	if !service.initialized {
+		service.Init()
+	}
+
+	defer service.Close()
+
+	thresholds := &GroupThresholds{
+		BurstGap:    service.conf.BurstGap,
+		EventGap:    service.conf.EventGap,
+		EventRadius: service.conf.EventRadius,
+	}
+
+	groups, err := RegroupImages(thresholds)
+	if err != nil {
+		console.Fatal("Could not group the images: %s", err)
+	}
+
+	counts := make(map[string]int)
+	for _, group := range groups {
+		counts[group.Kind]++
+	}
+
+	console.Log("%d bursts and %d events", counts[GroupBurst], counts[GroupEvent])
+	eventLogger.Info("grouped images into %d bursts and %d events", counts[GroupBurst], counts[GroupEvent])
+}
+
+// Copies or, if link is set, hard links the images and videos in the source
+// directory, or the stored records matching the query if there is no source,
+// into the target by the template (the template of the config if it is
+// empty). A dry run prints the plan without changing any files, otherwise
+// the files are placed and the path of the journal that undoes it printed.
+func (service *CrateService) Organize(target, source, text, template string, link, dryRun bool) {
+	if !service.initialized {
+		service.Init()
+	}
+
+	defer service.Close()
+
+	if template == "" {
+		template = service.conf.OrganizeTemplate
+	}
+
+	tmpl, err := ParseTemplate(template)
+	if err != nil {
+		console.Fatal("Could not parse the template: %s", err)
+	}
+
+	root, err := filepath.Abs(target)
+	if err != nil {
+		console.Fatal("Could not resolve the target \"%s\": %s", target, err)
+	}
+
+	records := make([]FilePath, 0)
+	if source != "" {
+		// The walk yields paths under the source as given, so it is made
+		// absolute to find the target among them
+		if source, err = filepath.Abs(source); err != nil {
+			console.Fatal("Could not resolve the source: %s", err)
+		}
+
+		sourcePath, err := NewPath(source)
+		if err != nil {
+			console.Fatal("Could not open path \"%s\": %s", source, err)
+		}
+
+		dir, ok := sourcePath.(*Dir)
+		if !ok {
+			console.Fatal("Specified path is not a directory, \"%s\"", source)
+		}
+
+		dir.Walk(func(path Path, err error) error {
+			if err != nil {
+				return err
+			}
+
+			// Skip hidden directories and the target if it is in the source
+			if path.Dir().IsHidden() || (path.IsDir() && path.String() == root) {
+				return filepath.SkipDir
+			}
+
+			if fm, ok := path.(*FileMeta); ok && !path.IsHidden() {
+				record := NewRecord(fm)
+				record.Populate()
+				records = append(records, record)
+			}
+
+			return nil
+		})
+	} else {
+		query, err := ParseQuery(text)
+		if err != nil {
+			console.Fatal("Could not parse query \"%s\": %s", text, err)
+		}
+
+		results, err := Search(query)
+		if err != nil {
+			console.Fatal("Could not search the database: %s", err)
+		}
+
+		// The companions of the matches are organized with them
+		if records, err = WithCompanions(results); err != nil {
+			console.Fatal("Could not fetch the companions of the records: %s", err)
+		}
+	}
+
+	plan, err := PlanOrganize(records, root, tmpl, link)
+	if err != nil {
+		console.Fatal("Could not plan the organization of \"%s\": %s", root, err)
+	}
+
+	if dryRun {
+		for _, placement := range plan.Placements {
+			console.Log("%s\t%s\t%s", placement.Action, placement.Source, placement.Target)
+		}
+	}
+
+	summary := fmt.Sprintf("%d to copy, %d to link, %d already in place, %d duplicates, %d missing",
+		plan.Count(OrganizeCopy), plan.Count(OrganizeLink), plan.Count(OrganizeExists),
+		plan.Count(OrganizeDuplicate), plan.Count(OrganizeMissing))
+	console.Log("%s", summary)
+
+	if dryRun {
+		return
+	}
+
+	dir, err := config.CrateJournalPath()
+	if err != nil {
+		console.Fatal("Could not create the journal directory: %s", err)
+	}
+
+	journal := JournalPath(dir)
+	created, err := plan.Execute(journal)
+	if err != nil {
+		console.Fatal("Could not organize into \"%s\" after %d files, undo with %s: %s", root, created, journal, err)
+	}
+
+	console.Log("organized %d files, undo with %s", created, journal)
+	eventLogger.Info("organized %d files into \"%s\" (%s), journal at %s", created, root, summary, journal)
+}
+
+// Undoes an organize run by its journal, removing the files and directories
+// it created, and prints the files that were kept since they changed since
+func (service *CrateService) UndoOrganize(journal string) {
+	if !service.initialized {
+		service.Init()
+	}
+
+	defer service.Close()
+
+	kept, err := UndoOrganize(journal)
+	if err != nil {
+		console.Fatal("Could not undo the organize journal \"%s\": %s", journal, err)
+	}
+
+	for _, path := range kept {
+		console.Log("kept %s, it changed since it was organized", path)
+	}
+
+	eventLogger.Info("undid the organize journal %s, kept %d changed files", journal, len(kept))
+}
+
+// Prints the stored groups of the kind (every kind if it is empty) and, if
+// members is set, the paths of the images in each group
+func (service *CrateService) Groups(kind string, members bool) {
+	if !service.initialized {
+		service.Init()
+	}
+
+	defer service.Close()
+
+	groups, err := ListGroups(kind)
+	if err != nil {
+		console.Fatal("Could not list the groups: %s", err)
+	}
+
+	for _, group := range groups {
+		console.Log("%s\t%d\t%s\t%s\t%s", group.ID, len(group.Members),
+			JSONStamp(group.Start), JSONStamp(group.End), group.Camera)
+
+		if !members {
+			continue
+		}
+
+		for _, signature := range group.Members {
+			if record, err := Fetch(signature); err == nil {
+				console.Log("\t%s", record.File().Path)
+			}
+		}
+	}
+}
+
+// Returns the extracted record of the image at the path or, if there is no
+// such file, the stored record with the signature
+func (service *CrateService) resolveImage(arg string) *ImageMeta {
+	if exists, _ := PathExists(arg); exists {
+		path, err := NewPath(arg)
+		if err != nil {
+			console.Fatal("Could not open path \"%s\": %s", arg, err)
+		}
+
+		fm, ok := path.(*FileMeta)
+		if !ok {
+			console.Fatal("Specified path is not a file, \"%s\"", arg)
+		}
+
+		img, ok := NewRecord(fm).(*ImageMeta)
+		if !ok {
+			console.Fatal("Specified path is not an image, \"%s\"", arg)
+		}
+
+		img.Populate()
+		return img
+	}
+
+	record, err := Fetch(arg)
+	if err != nil {
+		console.Fatal("Could not find \"%s\" as a path or signature: %s", arg, err)
+	}
+
+	img, ok := record.(*ImageMeta)
+	if !ok {
+		console.Fatal("Record \"%s\" is not an image", arg)
+	}
+
+	return img
+}
+
+// Re-extracts the records produced by outdated extractors (or all records if
+// forced) from the files at their paths, e.g. after upgrading crate.
+func (service *CrateService) Reextract(force bool) {
+	if !service.initialized {
+		service.Init()
+	}
+
+	defer service.Close()
+
+	eventLogger.Info("started re-extraction of stale records")
+	updated := 0
+
+	err := EachRecord(func(record FilePath) error {
+		if !force && !Stale(record) {
+			return nil
+		}
+
+		fresh, err := Reextract(record)
+		if err != nil {
+			eventLogger.Warn("could not re-extract \"%s\": %s", record.File().Path, err)
+			return nil
+		}
+
+		if err := fresh.Store(); err != nil {
+			return err
+		}
+
+		updated++
+		console.Log("%s\t%s", fresh.File().Signature, fresh.File().Path)
+		return nil
+	})
+
+	if err != nil {
+		console.Fatal("Could not re-extract records: %s", err)
+	}
+
+	eventLogger.Info("finished re-extraction, updated %d records", updated)
+}
@@ -0,0 +1,523 @@
+// Meta data struct specifically for plain text files
+
+package crate
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+const (
+	TextChunkSize = 64 << 10 // Size of the chunks text files are streamed in
+)
+
+// Line ending styles of text files
+const (
+	LineEndingNone  = "none"  // The text has a single unterminated line
+	LineEndingLF    = "LF"    // Unix line endings
+	LineEndingCRLF  = "CRLF"  // Windows line endings
+	LineEndingCR    = "CR"    // Classic Mac OS line endings
+	LineEndingMixed = "mixed" // More than one style of line ending
+)
+
+// Byte order marks by the encoding they identify, longest first so that the
+// UTF-32LE mark isn't mistaken for the UTF-16LE mark it starts with.
+var byteOrderMarks = []struct {
+	encoding string
+	mark     []byte
+}{
+	{"utf-32le", []byte{0xff, 0xfe, 0x00, 0x00}},
+	{"utf-32be", []byte{0x00, 0x00, 0xfe, 0xff}},
+	{"utf-8", []byte{0xef, 0xbb, 0xbf}},
+	{"utf-16le", []byte{0xff, 0xfe}},
+	{"utf-16be", []byte{0xfe, 0xff}},
+}
+
+//=============================================================================
+
+type TextMeta struct {
+	FileMeta
+	Encoding   string // Detected encoding, e.g. us-ascii, utf-8 or windows-1252
+	BOM        bool   // The file starts with a byte order mark
+	LineEnding string // Line ending style: LF, CRLF, CR, mixed or none
+	Lines      int    // Number of lines including an unterminated last line
+	Words      int    // Number of whitespace separated words
+	ValidUTF8  bool   // The file is entirely valid UTF-8 (or ASCII)
+}
+
+// Converts a FileMeta into a TextMeta
+func ConvertTextMeta(fm *FileMeta) (*TextMeta, bool) {
+	if !new(TextExtractor).Claims(fm.MimeType) {
+		return nil, false
+	}
+
+	text := new(TextMeta)
+	text.FileMeta = *fm
+
+	return text, true
+}
+
+// Populates the fields on the TextMeta
+func (text *TextMeta) Populate() {
+	text.FileMeta.populateFile()
+	extract(text)
+}
+
+// Returns the text analysis fields as tags so they can be searched for, e.g.
+// ValidUTF8:false finds mis-encoded files
+func (text *TextMeta) Tag(name string) string {
+	switch name {
+	case "Encoding":
+		return text.Encoding
+	case "BOM":
+		return strconv.FormatBool(text.BOM)
+	case "LineEnding":
+		return text.LineEnding
+	case "Lines":
+		return strconv.Itoa(text.Lines)
+	case "Words":
+		return strconv.Itoa(text.Words)
+	case "ValidUTF8":
+		return strconv.FormatBool(text.ValidUTF8)
+	default:
+		return ""
+	}
+}
+
+// Text files have no location
+func (text *TextMeta) Location() (float64, float64, bool) {
+	return 0, 0, false
+}
+
+// Text files have no capture time
+func (text *TextMeta) Taken() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+// Writes the TextMeta to the database, where the key is the SHA1 hash
+func (text *TextMeta) Store() error {
+	if !text.populated {
+		text.Populate()
+	}
+
+	return storeRecord(text)
+}
+
+// Returns the byte serialization of the text meta for storage
+func (text *TextMeta) Byte() []byte {
+	data, err := json.Marshal(text)
+	if err != nil {
+		return nil
+	}
+
+	return data
+}
+
+// Prints out the info as a JSON indented pretty string
+func (text *TextMeta) Info() string {
+	if !text.populated {
+		text.Populate()
+	}
+
+	info, err := json.MarshalIndent(text, "", "  ")
+	if err != nil {
+		return ""
+	}
+
+	return string(info)
+}
+
+//=============================================================================
+
+// Analyzes the encoding, line endings and line and word counts of text files,
+// streaming them in chunks so that large files aren't read into memory.
+type TextExtractor struct{}
+
+func init() {
+	RegisterExtractor(new(TextExtractor))
+}
+
+func (ext *TextExtractor) Name() string {
+	return "text"
+}
+
+func (ext *TextExtractor) Version() string {
+	return "1"
+}
+
+func (ext *TextExtractor) Claims(mimetype string) bool {
+	return MimePrefixes{"text/"}.Claims(mimetype)
+}
+
+func (ext *TextExtractor) Convert(fm *FileMeta) FilePath {
+	if text, ok := ConvertTextMeta(fm); ok {
+		return text
+	}
+
+	return nil
+}
+
+func (ext *TextExtractor) Extract(record FilePath) error {
+	text, ok := record.(*TextMeta)
+	if !ok {
+		return errors.New("record is not a TextMeta")
+	}
+
+	file, err := os.Open(text.Path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return text.Analyze(file)
+}
+
+// Analyzes the text read from the reader
+func (text *TextMeta) Analyze(r io.Reader) error {
+	reader := bufio.NewReaderSize(r, TextChunkSize)
+
+	// Detect the byte order mark, which determines how the text is decoded
+	encoding := ""
+	head, _ := reader.Peek(4)
+	for _, bom := range byteOrderMarks {
+		if bytes.HasPrefix(head, bom.mark) {
+			encoding = bom.encoding
+			reader.Discard(len(bom.mark))
+			break
+		}
+	}
+
+	text.BOM = encoding != ""
+	counter := new(textCounter)
+
+	var err error
+	switch encoding {
+	case "utf-16le", "utf-16be", "utf-32le", "utf-32be":
+		err = counter.scanUnits(reader, encoding)
+	default:
+		err = counter.scanBytes(reader)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	counter.finish()
+	text.Lines = counter.lines()
+	text.Words = counter.words
+	text.LineEnding = counter.lineEnding()
+	text.ValidUTF8 = counter.valid // Never set when scanning UTF-16 or UTF-32
+
+	switch {
+	case encoding != "":
+		text.Encoding = encoding
+	case counter.valid && counter.ascii:
+		text.Encoding = "us-ascii"
+	case counter.valid:
+		text.Encoding = "utf-8"
+	case counter.c1:
+		// Legacy text with bytes in 0x80-0x9f, which are control characters in
+		// ISO-8859-1 but punctuation (e.g. curly quotes) in Windows-1252
+		text.Encoding = "windows-1252"
+	default:
+		text.Encoding = "iso-8859-1"
+	}
+
+	return nil
+}
+
+//=============================================================================
+
+// Counts the lines, line endings and words of a stream of runes
+type textCounter struct {
+	lf, crlf, cr int  // Number of each line ending
+	words        int  // Number of words
+	runes        int  // Number of runes
+	inWord       bool // The last rune was part of a word
+	prevCR       bool // The last rune was a carriage return
+	last         rune // The last rune
+	valid        bool // All the bytes were valid UTF-8
+	ascii        bool // All the bytes were ASCII
+	c1           bool // Invalid UTF-8 included bytes in the range 0x80-0x9f
+}
+
+// Counts the rune as part of the lines and words of the text
+func (tc *textCounter) add(r rune) {
+	if tc.prevCR {
+		if r == '\n' {
+			tc.crlf++
+		} else {
+			tc.cr++
+		}
+	} else if r == '\n' {
+		tc.lf++
+	}
+
+	tc.prevCR = r == '\r'
+
+	space := unicode.IsSpace(r)
+	if !space && !tc.inWord {
+		tc.words++
+	}
+
+	tc.inWord = !space
+	tc.last = r
+	tc.runes++
+}
+
+// Scans UTF-8 (or legacy 8 bit) text, carrying incomplete runes over from
+// the end of one chunk to the start of the next
+func (tc *textCounter) scanBytes(r io.Reader) error {
+	tc.valid, tc.ascii = true, true
+	chunk := make([]byte, TextChunkSize+utf8.UTFMax)
+	carry := 0
+
+	for {
+		n, err := r.Read(chunk[carry : carry+TextChunkSize])
+		n += carry
+		eof := err == io.EOF
+		if err != nil && !eof {
+			return err
+		}
+
+		data := chunk[:n]
+		for len(data) > 0 {
+			if data[0] < utf8.RuneSelf {
+				tc.add(rune(data[0]))
+				data = data[1:]
+				continue
+			}
+
+			tc.ascii = false
+			if !eof && !utf8.FullRune(data) {
+				break
+			}
+
+			char, size := utf8.DecodeRune(data)
+			if char == utf8.RuneError && size == 1 {
+				tc.valid = false
+				tc.c1 = tc.c1 || data[0] >= 0x80 && data[0] <= 0x9f
+			}
+
+			tc.add(char)
+			data = data[size:]
+		}
+
+		carry = copy(chunk, data)
+		if eof {
+			return nil
+		}
+	}
+}
+
+// Scans UTF-16 or UTF-32 text in the byte order of the encoding
+func (tc *textCounter) scanUnits(r io.Reader, encoding string) error {
+	var order binary.ByteOrder = binary.BigEndian
+	if strings.HasSuffix(encoding, "le") {
+		order = binary.LittleEndian
+	}
+
+	width := 2
+	if strings.HasPrefix(encoding, "utf-32") {
+		width = 4
+	}
+
+	unit := make([]byte, width)
+	var high rune
+
+	for {
+		if _, err := io.ReadFull(r, unit); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				if high != 0 || err == io.ErrUnexpectedEOF {
+					tc.add(unicode.ReplacementChar)
+				}
+				return nil
+			}
+			return err
+		}
+
+		var char rune
+		if width == 4 {
+			char = rune(order.Uint32(unit))
+		} else {
+			char = rune(order.Uint16(unit))
+		}
+
+		// Combine the surrogate pairs of UTF-16
+		switch {
+		case high != 0:
+			tc.add(utf16.DecodeRune(high, char))
+			high = 0
+		case width == 2 && utf16.IsSurrogate(char):
+			high = char
+		default:
+			tc.add(char)
+		}
+	}
+}
+
+// Counts a carriage return at the end of the text as a line ending
+func (tc *textCounter) finish() {
+	if tc.prevCR {
+		tc.cr++
+		tc.prevCR = false
+	}
+}
+
+// Returns the number of lines, counting an unterminated last line
+func (tc *textCounter) lines() int {
+	lines := tc.lf + tc.crlf + tc.cr
+	if tc.runes > 0 && tc.last != '\n' && tc.last != '\r' {
+		lines++
+	}
+
+	return lines
+}
+
+// Returns the line ending style of the text
+func (tc *textCounter) lineEnding() string {
+	styles := make([]string, 0, 3)
+	for _, style := range []struct {
+		count int
+		name  string
+	}{{tc.lf, LineEndingLF}, {tc.crlf, LineEndingCRLF}, {tc.cr, LineEndingCR}} {
+		if style.count > 0 {
+			styles = append(styles, style.name)
+		}
+	}
+
+	switch len(styles) {
+	case 0:
+		return LineEndingNone
+	case 1:
+		return styles[0]
+	default:
+		return LineEndingMixed
+	}
+}
+
+//=============================================================================
+
+// The characters of the bytes 0x80-0x9f in Windows-1252, where the bytes that
+// are undefined map to the control characters of the same value
+var windows1252 = [32]rune{
+	0x20ac, 0x81, 0x201a, 0x0192, 0x201e, 0x2026, 0x2020, 0x2021,
+	0x02c6, 0x2030, 0x0160, 0x2039, 0x0152, 0x8d, 0x017d, 0x8f,
+	0x90, 0x2018, 0x2019, 0x201c, 0x201d, 0x2022, 0x2013, 0x2014,
+	0x02dc, 0x2122, 0x0161, 0x203a, 0x0153, 0x9d, 0x017e, 0x0178,
+}
+
+// Transcodes text in the encoding detected by Analyze to UTF-8, skipping any
+// byte order mark
+func NewTextReader(r io.Reader, encoding string) io.Reader {
+	src := bufio.NewReaderSize(r, TextChunkSize)
+	head, _ := src.Peek(4)
+	for _, bom := range byteOrderMarks {
+		if bom.encoding == encoding && bytes.HasPrefix(head, bom.mark) {
+			src.Discard(len(bom.mark))
+			break
+		}
+	}
+
+	tr := &textReader{src: src}
+	switch encoding {
+	case "iso-8859-1", "windows-1252":
+		tr.next = func() (rune, error) {
+			b, err := src.ReadByte()
+			if encoding == "windows-1252" && b >= 0x80 && b <= 0x9f {
+				return windows1252[b-0x80], err
+			}
+			return rune(b), err
+		}
+	case "utf-16le", "utf-16be", "utf-32le", "utf-32be":
+		tr.next = tr.units(encoding)
+	default:
+		return src
+	}
+
+	return tr
+}
+
+// Reads the runes of a legacy or wide encoding as UTF-8
+type textReader struct {
+	src     *bufio.Reader        // The source text
+	next    func() (rune, error) // Decodes the next rune of the source
+	pending []byte               // Encoded bytes that didn't fit the last read
+	encoded [utf8.UTFMax]byte    // Holds the pending bytes of the last rune
+}
+
+func (tr *textReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		if len(tr.pending) > 0 {
+			copied := copy(p[n:], tr.pending)
+			tr.pending = tr.pending[copied:]
+			n += copied
+			continue
+		}
+
+		char, err := tr.next()
+		if err != nil {
+			if err == io.EOF && n > 0 {
+				return n, nil
+			}
+			return n, err
+		}
+
+		tr.pending = tr.encoded[:utf8.EncodeRune(tr.encoded[:], char)]
+	}
+
+	return n, nil
+}
+
+// Returns the function decoding the next rune of UTF-16 or UTF-32 text
+func (tr *textReader) units(encoding string) func() (rune, error) {
+	var order binary.ByteOrder = binary.BigEndian
+	if strings.HasSuffix(encoding, "le") {
+		order = binary.LittleEndian
+	}
+
+	width := 2
+	if strings.HasPrefix(encoding, "utf-32") {
+		width = 4
+	}
+
+	unit := make([]byte, width)
+	read := func() (rune, error) {
+		if _, err := io.ReadFull(tr.src, unit); err != nil {
+			if err == io.ErrUnexpectedEOF {
+				return unicode.ReplacementChar, nil
+			}
+			return 0, err
+		}
+
+		if width == 4 {
+			return rune(order.Uint32(unit)), nil
+		}
+		return rune(order.Uint16(unit)), nil
+	}
+
+	return func() (rune, error) {
+		char, err := read()
+		if err != nil || width == 4 || !utf16.IsSurrogate(char) {
+			return char, err
+		}
+
+		low, err := read()
+		if err != nil {
+			return unicode.ReplacementChar, nil
+		}
+		return utf16.DecodeRune(char, low), nil
+	}
+}
@@ -0,0 +1,93 @@
+package crate_test
+
+import (
+	"bytes"
+	"strings"
+
+	. "github.com/bbengfort/crate/crate"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Text", func() {
+
+	// Analyzes the text and returns the TextMeta
+	analyze := func(data []byte) *TextMeta {
+		text := new(TextMeta)
+		Ω(text.Analyze(bytes.NewReader(data))).Should(Succeed())
+		return text
+	}
+
+	It("should analyze the dracula fixture", func() {
+		node, err := NewPath("../fixtures/dracula.txt")
+		Ω(err).Should(BeNil())
+
+		record := NewRecord(node.(*FileMeta))
+		Ω(record).Should(BeAssignableToTypeOf(new(TextMeta)))
+		record.Populate()
+
+		text := record.(*TextMeta)
+		Ω(text.Encoding).Should(Equal("utf-8"))
+		Ω(text.BOM).Should(BeTrue())
+		Ω(text.ValidUTF8).Should(BeTrue())
+		Ω(text.LineEnding).Should(Equal(LineEndingCRLF))
+		Ω(text.Lines).Should(Equal(15973))
+		Ω(text.Words).Should(Equal(164423))
+	})
+
+	It("should detect ASCII and UTF-8 text", func() {
+		text := analyze([]byte("one two\nthree\n"))
+		Ω(text.Encoding).Should(Equal("us-ascii"))
+		Ω(text.ValidUTF8).Should(BeTrue())
+		Ω(text.BOM).Should(BeFalse())
+		Ω(text.Lines).Should(Equal(2))
+		Ω(text.Words).Should(Equal(3))
+
+		text = analyze([]byte("café au lait"))
+		Ω(text.Encoding).Should(Equal("utf-8"))
+		Ω(text.LineEnding).Should(Equal(LineEndingNone))
+		Ω(text.Lines).Should(Equal(1))
+		Ω(text.Words).Should(Equal(3))
+	})
+
+	It("should detect mis-encoded legacy text", func() {
+		text := analyze([]byte("caf\xe9 au lait\n"))
+		Ω(text.ValidUTF8).Should(BeFalse())
+		Ω(text.Encoding).Should(Equal("iso-8859-1"))
+
+		text = analyze([]byte("\x93quoted\x94\r\n"))
+		Ω(text.ValidUTF8).Should(BeFalse())
+		Ω(text.Encoding).Should(Equal("windows-1252"))
+		Ω(text.Tag("ValidUTF8")).Should(Equal("false"))
+	})
+
+	It("should detect UTF-16 by its byte order mark", func() {
+		text := analyze([]byte("\xff\xfeh\x00i\x00\r\x00\n\x00=\xd8\x00\xde\n\x00"))
+		Ω(text.Encoding).Should(Equal("utf-16le"))
+		Ω(text.BOM).Should(BeTrue())
+		Ω(text.ValidUTF8).Should(BeFalse())
+		Ω(text.LineEnding).Should(Equal(LineEndingMixed))
+		Ω(text.Lines).Should(Equal(2))
+		Ω(text.Words).Should(Equal(2))
+	})
+
+	It("should detect line ending styles", func() {
+		Ω(analyze([]byte("a\nb\n")).LineEnding).Should(Equal(LineEndingLF))
+		Ω(analyze([]byte("a\r\nb\r\n")).LineEnding).Should(Equal(LineEndingCRLF))
+		Ω(analyze([]byte("a\rb\r")).LineEnding).Should(Equal(LineEndingCR))
+		Ω(analyze([]byte("a\rb\r")).Lines).Should(Equal(2))
+		Ω(analyze([]byte("a\nb\r\n")).LineEnding).Should(Equal(LineEndingMixed))
+		Ω(analyze(nil).Lines).Should(Equal(0))
+	})
+
+	It("should stream runes and line endings split across chunks", func() {
+		data := strings.Repeat("x", TextChunkSize-1) + "\r\n" + strings.Repeat("é", TextChunkSize)
+		text := analyze([]byte(data))
+		Ω(text.ValidUTF8).Should(BeTrue())
+		Ω(text.LineEnding).Should(Equal(LineEndingCRLF))
+		Ω(text.Lines).Should(Equal(2))
+		Ω(text.Words).Should(Equal(2))
+	})
+
+})
@@ -0,0 +1,380 @@
+// Generates fixed size JPEG previews of images, honoring the EXIF orientation,
+// and caches them on disk by the signature of the image and the preview size
+
+package crate
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+
+	"github.com/bbengfort/crate/crate/config"
+
+	_ "image/gif"
+)
+
+const (
+	DefaultThumbnailSize = 256     // Longest edge of a thumbnail in pixels
+	MaxThumbnailSize     = 2048    // Largest thumbnail that will be generated
+	ThumbnailQuality     = 85      // JPEG quality of the cached thumbnails
+	ThumbnailExt         = ".jpg"  // Extension of the cached thumbnails
+	SampleSize           = 128     // Longest edge of the sample that pixel extractors analyze
+	MaxDecodePixels      = 1 << 28 // Most pixels of an image that will be decoded, 1GB as RGBA
+)
+
+var (
+	ErrNotDecodable = errors.New("image can't be decoded for a thumbnail")
+	ErrTooLarge     = errors.New("image is too large to decode")
+)
+
+//=============================================================================
+
+// A cache of thumbnails on disk, addressed by the signature of the image and
+// the size of the thumbnail. Since the content of an image defines its
+// signature, cached thumbnails never go stale and are reused across runs;
+// missing thumbnails are generated when they are first requested.
+type ThumbnailCache struct {
+	Root string // Directory of the cached thumbnails
+}
+
+// Creates a thumbnail cache in the directory
+func NewThumbnailCache(root string) *ThumbnailCache {
+	return &ThumbnailCache{Root: root}
+}
+
+// Opens the thumbnail cache in the crate directory
+func OpenThumbnailCache() (*ThumbnailCache, error) {
+	path, err := config.CrateThumbnailPath()
+	if err != nil {
+		return nil, err
+	}
+
+	return NewThumbnailCache(path), nil
+}
+
+// Returns the path of the thumbnail of the signature at the size, named by
+// the hex of the signature in a directory of its first byte, e.g.
+// 3f/3f2a..._256.jpg, since base64 signatures may contain slashes.
+func (cache *ThumbnailCache) Path(signature string, size int) (string, error) {
+	prefix, err := cache.prefix(signature)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%s_%d%s", prefix, size, ThumbnailExt), nil
+}
+
+// Returns the path of the thumbnail of the image at the size, generating it
+// if it isn't cached. Thumbnails are written to a temporary file that is
+// renamed into place, so concurrent readers never see a partial thumbnail.
+func (cache *ThumbnailCache) Get(img *ImageMeta, size int) (string, error) {
+	if size <= 0 || size > MaxThumbnailSize {
+		return "", fmt.Errorf("thumbnail size must be between 1 and %d", MaxThumbnailSize)
+	}
+
+	if img.Signature == "" {
+		return "", errors.New("image has no signature")
+	}
+
+	path, err := cache.Path(img.Signature, size)
+	if err != nil {
+		return "", err
+	}
+
+	if exists, err := PathExists(path); exists || err != nil {
+		return path, err
+	}
+
+	thumb, err := GenerateThumbnail(img, size)
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+
+	temp, err := ioutil.TempFile(filepath.Dir(path), ".thumbnail-")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(temp.Name())
+
+	if err := jpeg.Encode(temp, thumb, &jpeg.Options{Quality: ThumbnailQuality}); err != nil {
+		temp.Close()
+		return "", err
+	}
+
+	if err := temp.Close(); err != nil {
+		return "", err
+	}
+
+	return path, os.Rename(temp.Name(), path)
+}
+
+// Returns the JPEG data of the thumbnail of the image at the size,
+// generating it if it isn't cached
+func (cache *ThumbnailCache) Read(img *ImageMeta, size int) ([]byte, error) {
+	path, err := cache.Get(img, size)
+	if err != nil {
+		return nil, err
+	}
+
+	return ioutil.ReadFile(path)
+}
+
+// Removes the cached thumbnails of every size of the signature
+func (cache *ThumbnailCache) Remove(signature string) error {
+	prefix, err := cache.prefix(signature)
+	if err != nil {
+		return err
+	}
+
+	matches, err := filepath.Glob(prefix + "_*" + ThumbnailExt)
+	if err != nil {
+		return err
+	}
+
+	for _, match := range matches {
+		if err := os.Remove(match); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Returns the path of the thumbnails of the signature without their size
+func (cache *ThumbnailCache) prefix(signature string) (string, error) {
+	sum, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil || len(sum) == 0 {
+		return "", fmt.Errorf("invalid signature \"%s\"", signature)
+	}
+
+	key := hex.EncodeToString(sum)
+	return filepath.Join(cache.Root, key[:2], key), nil
+}
+
+//=============================================================================
+
+// Generates a thumbnail of the image that fits in a square of the size and
+// is upright according to its EXIF orientation, flattened on white.
+func GenerateThumbnail(img *ImageMeta, size int) (image.Image, error) {
+	src, err := img.decode()
+	if err != nil {
+		return nil, err
+	}
+
+	thumb := OrientImage(ResizeImage(src, size), img.orientation())
+
+	// JPEG has no alpha, so transparent pixels are drawn over white
+	bounds := thumb.Bounds()
+	flat := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(flat, flat.Bounds(), image.White, image.ZP, draw.Src)
+	draw.Draw(flat, flat.Bounds(), thumb, bounds.Min, draw.Over)
+	return flat, nil
+}
+
+// Returns the orientation of a populated image, or reads it from the EXIF or
+// HEIF properties of an image that hasn't been extracted
+func (img *ImageMeta) orientation() int {
+	if img.Orientation != 0 {
+		return img.Orientation
+	}
+
+	if img.IsHEIF() {
+		if heif, err := img.ReadHEIF(); err == nil {
+			if item, ok := heif.Items[heif.Primary]; ok {
+				return item.Orientation()
+			}
+		}
+		return 1
+	}
+
+	if exif, ok := img.GetExif(); ok {
+		return exif.Orientation()
+	}
+
+	return 1
+}
+
+// Decodes the image, the largest embedded preview of TIFF based images, or
+// the EXIF thumbnail of images that the image package can't decode
+func (img *ImageMeta) decode() (image.Image, error) {
+	file, err := os.Open(img.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	if img.IsTIFF() {
+		if tiff, err := ReadTIFF(file, filepath.Ext(img.Path)); err == nil {
+			if preview, ok := tiff.PreviewReader(file); ok {
+				if src, err := decodeImage(preview); err == nil {
+					return src, nil
+				}
+			}
+		}
+	} else if src, err := decodeImage(file); err == nil {
+		return src, nil
+	}
+
+	if exif, ok := img.GetExif(); ok {
+		if data, err := exif.Thumbnail(); err == nil {
+			if src, err := decodeImage(bytes.NewReader(data)); err == nil {
+				return src, nil
+			}
+		}
+	}
+
+	return nil, ErrNotDecodable
+}
+
+// Reads the header of the image from the reader and returns a reader of the
+// whole image if it has at most MaxDecodePixels. A corrupt header may claim
+// any dimensions and decoders allocate all of them before reading the data.
+func checkDecodeSize(r io.Reader) (io.Reader, error) {
+	header := new(bytes.Buffer)
+	config, _, err := image.DecodeConfig(io.TeeReader(r, header))
+	if err != nil {
+		return nil, err
+	}
+
+	if int64(config.Width)*int64(config.Height) > MaxDecodePixels {
+		return nil, ErrTooLarge
+	}
+
+	return io.MultiReader(header, r), nil
+}
+
+// Decodes the image unless its header claims more than MaxDecodePixels
+func decodeImage(r io.Reader) (image.Image, error) {
+	r, err := checkDecodeSize(r)
+	if err != nil {
+		return nil, err
+	}
+
+	src, _, err := image.Decode(r)
+	return src, err
+}
+
+// Returns the image decoded, upright and scaled down to fit in a square of
+// the SampleSize. The sample is kept on the record while it is extracted, so
+// the extractors that analyze the pixels of an image only decode it once, and
+// images larger than MaxDecodePixels are not decodable for any of them.
+func (img *ImageMeta) sample() (image.Image, error) {
+	if img.sampled == nil && img.sampleErr == nil {
+		if src, err := img.decode(); err == nil {
+			img.sampled = OrientImage(ResizeImage(src, SampleSize), img.orientation())
+		} else {
+			img.sampleErr = err
+		}
+	}
+
+	return img.sampled, img.sampleErr
+}
+
+// Drops the sample of the image once the extractors are done with it, so
+// records don't hold on to decoded pixels after they are extracted
+func (img *ImageMeta) releaseSample() {
+	img.sampled, img.sampleErr = nil, nil
+}
+
+// Scales the image down to fit in a square of the size by averaging the
+// pixels that each pixel of the result covers, smaller images aren't scaled
+func ResizeImage(src image.Image, size int) image.Image {
+	bounds := src.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	scale := math.Min(float64(size)/float64(width), float64(size)/float64(height))
+	if scale >= 1 {
+		return src
+	}
+
+	dw := int(math.Max(1, math.Round(float64(width)*scale)))
+	dh := int(math.Max(1, math.Round(float64(height)*scale)))
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+
+	for y := 0; y < dh; y++ {
+		y0 := bounds.Min.Y + y*height/dh
+		y1 := bounds.Min.Y + (y+1)*height/dh
+
+		for x := 0; x < dw; x++ {
+			x0 := bounds.Min.X + x*width/dw
+			x1 := bounds.Min.X + (x+1)*width/dw
+
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					r, g, b, a, n = r+uint64(cr), g+uint64(cg), b+uint64(cb), a+uint64(ca), n+1
+				}
+			}
+
+			if n == 0 {
+				continue
+			}
+
+			idx := dst.PixOffset(x, y)
+			dst.Pix[idx+0] = uint8(r / n >> 8)
+			dst.Pix[idx+1] = uint8(g / n >> 8)
+			dst.Pix[idx+2] = uint8(b / n >> 8)
+			dst.Pix[idx+3] = uint8(a / n >> 8)
+		}
+	}
+
+	return dst
+}
+
+// Rotates and mirrors the image to display an EXIF orientation upright:
+// 2 mirrors it, 3 rotates it 180°, 4 flips it, 5 transposes it, 6 rotates it
+// 90° clockwise, 7 transverses it and 8 rotates it 90° counterclockwise.
+func OrientImage(src image.Image, orientation int) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return src
+	}
+
+	bounds := src.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2:
+				dx, dy = w-1-x, y
+			case 3:
+				dx, dy = w-1-x, h-1-y
+			case 4:
+				dx, dy = x, h-1-y
+			case 5:
+				dx, dy = y, x
+			case 6:
+				dx, dy = h-1-y, x
+			case 7:
+				dx, dy = h-1-y, w-1-x
+			case 8:
+				dx, dy = y, w-1-x
+			}
+
+			dst.Set(dx, dy, src.At(bounds.Min.X+x, bounds.Min.Y+y))
+		}
+	}
+
+	return dst
+}
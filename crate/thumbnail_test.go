@@ -0,0 +1,160 @@
+package crate_test
+
+import (
+	"encoding/binary"
+	"image"
+	"image/color"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/bbengfort/crate/crate"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// Inserts an application segment with the payload after the SOI of a JPEG
+func mkapp(data []byte, marker byte, payload []byte) []byte {
+	segment := append([]byte{0xff, marker}, mkints(uint16(len(payload)+2))...)
+	segment = append(segment, payload...)
+	return append(append(append([]byte{}, data[:2]...), segment...), data[2:]...)
+}
+
+// Builds a JPEG of the dimensions with the IFD0 entries in its EXIF
+func mktaggedjpeg(width, height int, entries ...tiffEntry) []byte {
+	exif := mktiff(binary.BigEndian, nil,
+		tiffBlock{name: "ifd0", entries: append([]tiffEntry{tascii(0x010f, "Canon")}, entries...)},
+	)
+
+	return mkapp(mkjpeg(width, height), 0xe1, append([]byte("Exif\x00\x00"), exif...))
+}
+
+var _ = Describe("Thumbnail", func() {
+
+	var (
+		testRoot string          // Temporary directory for the images
+		cache    *ThumbnailCache // Thumbnail cache in the temporary directory
+	)
+
+	// Decodes the dimensions of the thumbnail at the path
+	dimensions := func(path string) []int {
+		file, err := os.Open(path)
+		Ω(err).Should(BeNil())
+		defer file.Close()
+
+		config, format, err := image.DecodeConfig(file)
+		Ω(err).Should(BeNil())
+		Ω(format).Should(Equal("jpeg"))
+		return []int{config.Width, config.Height}
+	}
+
+	BeforeEach(func() {
+		var err error
+		testRoot, err = ioutil.TempDir("", "ginkgo-")
+		Ω(err).Should(BeNil())
+
+		cache = NewThumbnailCache(filepath.Join(testRoot, "thumbnails"))
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(testRoot)
+	})
+
+	It("should scale images down to fit the size", func() {
+		src := image.NewRGBA(image.Rect(0, 0, 400, 100))
+		src.Set(0, 0, color.RGBA{255, 0, 0, 255})
+
+		thumb := ResizeImage(src, 100)
+		Ω(thumb.Bounds().Dx()).Should(Equal(100))
+		Ω(thumb.Bounds().Dy()).Should(Equal(25))
+
+		// The first pixel averages a 4x4 block with one red pixel
+		r, _, _, a := thumb.At(0, 0).RGBA()
+		Ω(r >> 8).Should(BeNumerically("~", 255/16, 1))
+		Ω(a >> 8).Should(BeNumerically("~", 255/16, 1))
+
+		Ω(ResizeImage(src, 1000)).Should(BeIdenticalTo(src))
+	})
+
+	It("should orient images upright", func() {
+		src := image.NewRGBA(image.Rect(0, 0, 3, 2))
+		src.Set(0, 0, color.RGBA{255, 0, 0, 255})
+
+		corners := map[int][2]int{
+			2: {2, 0}, 3: {2, 1}, 4: {0, 1}, 5: {0, 0}, 6: {1, 0}, 7: {1, 2}, 8: {0, 2},
+		}
+
+		for orientation, corner := range corners {
+			dst := OrientImage(src, orientation)
+			if orientation >= 5 {
+				Ω(dst.Bounds().Size()).Should(Equal(image.Pt(2, 3)))
+			} else {
+				Ω(dst.Bounds().Size()).Should(Equal(image.Pt(3, 2)))
+			}
+
+			r, _, _, _ := dst.At(corner[0], corner[1]).RGBA()
+			Ω(r>>8).Should(Equal(uint32(255)), "orientation %d", orientation)
+		}
+
+		Ω(OrientImage(src, 1)).Should(BeIdenticalTo(src))
+	})
+
+	It("should cache thumbnails by signature and size", func() {
+		img := extractImage(testRoot, "IMG_0001.jpg", mkjpeg(640, 480))
+
+		path, err := cache.Get(img, 160)
+		Ω(err).Should(BeNil())
+		Ω(path).Should(HavePrefix(cache.Root))
+		Ω(path).Should(HaveSuffix("_160.jpg"))
+		Ω(dimensions(path)).Should(Equal([]int{160, 120}))
+
+		expected, err := cache.Path(img.Signature, 160)
+		Ω(err).Should(BeNil())
+		Ω(path).Should(Equal(expected))
+
+		// Cached thumbnails are reused rather than regenerated
+		Ω(ioutil.WriteFile(path, []byte("cached"), 0644)).Should(Succeed())
+		data, err := cache.Read(img, 160)
+		Ω(err).Should(BeNil())
+		Ω(string(data)).Should(Equal("cached"))
+
+		// And regenerated when they are missing
+		Ω(cache.Remove(img.Signature)).Should(Succeed())
+		Ω(PathExists(path)).Should(BeFalse())
+
+		path, err = cache.Get(img, 160)
+		Ω(err).Should(BeNil())
+		Ω(dimensions(path)).Should(Equal([]int{160, 120}))
+	})
+
+	It("should honor the EXIF orientation", func() {
+		img := extractImage(testRoot, "IMG_0002.jpg", mktaggedjpeg(64, 48, tshort(0x0112, 6)))
+
+		path, err := cache.Get(img, 32)
+		Ω(err).Should(BeNil())
+		Ω(dimensions(path)).Should(Equal([]int{24, 32}))
+	})
+
+	It("should use the preview of RAW images", func() {
+		img := extractImage(testRoot, "DSC_0001.NEF", mknef())
+
+		path, err := cache.Get(img, 32)
+		Ω(err).Should(BeNil())
+		Ω(dimensions(path)).Should(Equal([]int{32, 24}))
+	})
+
+	It("should not generate thumbnails of invalid sizes or undecodable images", func() {
+		img := extractImage(testRoot, "IMG_0001.jpg", mkjpeg(64, 48))
+		_, err := cache.Get(img, 0)
+		Ω(err).Should(HaveOccurred())
+
+		_, err = cache.Get(img, MaxThumbnailSize+1)
+		Ω(err).Should(HaveOccurred())
+
+		img = extractImage(testRoot, "broken.jpg", []byte("\xff\xd8\xff\xe0 not really a JPEG"))
+		_, err = GenerateThumbnail(img, 32)
+		Ω(err).Should(Equal(ErrNotDecodable))
+	})
+
+})
@@ -0,0 +1,366 @@
+// Reads the image file directories (IFDs) of TIFF files and of the camera RAW
+// formats based on TIFF (CR2, NEF, ARW and DNG) to find their dimensions and
+// the embedded JPEG previews without decoding any of the image data
+
+package crate
+
+import (
+	"encoding/binary"
+	"errors"
+	"image"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	MaxIFDs       = 64   // Most IFDs that will be read from a single file
+	MaxIFDEntries = 1024 // Most entries that will be read from a single IFD
+	MaxIFDValues  = 1024 // Most values that will be read for a single entry
+)
+
+// TIFF tags that describe the images stored in an IFD
+const (
+	tiffNewSubfileType = 0x00fe
+	tiffImageWidth     = 0x0100
+	tiffImageHeight    = 0x0101
+	tiffCompression    = 0x0103
+	tiffStripOffsets   = 0x0111
+	tiffStripCounts    = 0x0117
+	tiffSubIFDs        = 0x014a
+	tiffJPEGOffset     = 0x0201
+	tiffJPEGLength     = 0x0202
+	tiffExifIFD        = 0x8769
+	tiffDNGVersion     = 0xc612
+	exifPixelXDim      = 0xa002
+	exifPixelYDim      = 0xa003
+)
+
+// Camera RAW and TIFF formats by their mimetype and their file extension
+var (
+	TIFFMimeTypes = map[string]string{
+		"image/tiff":        "TIFF",
+		"image/x-canon-cr2": "CR2",
+		"image/x-nikon-nef": "NEF",
+		"image/x-sony-arw":  "ARW",
+		"image/x-adobe-dng": "DNG",
+	}
+
+	TIFFExtensions = map[string]string{
+		".tif": "TIFF", ".tiff": "TIFF", ".cr2": "CR2", ".nef": "NEF", ".arw": "ARW", ".dng": "DNG",
+	}
+)
+
+var ErrMalformedTIFF = errors.New("malformed TIFF image file directory")
+
+//=============================================================================
+
+// Checks if an Image is a TIFF file or a camera RAW file based on TIFF
+func (img *ImageMeta) IsTIFF() bool {
+	if !img.IsImage() {
+		return false
+	}
+
+	if _, ok := TIFFMimeTypes[img.MimeType]; ok {
+		return true
+	}
+
+	_, ok := TIFFExtensions[strings.ToLower(filepath.Ext(img.Path))]
+	return ok
+}
+
+// Checks if an image is a camera RAW rather than a plain TIFF
+func (img *ImageMeta) IsRaw() bool {
+	if !img.IsTIFF() {
+		return false
+	}
+
+	if format, ok := TIFFMimeTypes[img.MimeType]; ok && format != "TIFF" {
+		return true
+	}
+
+	format := TIFFExtensions[strings.ToLower(filepath.Ext(img.Path))]
+	return format != "" && format != "TIFF"
+}
+
+// Reads the format and the dimensions of the embedded preview of a TIFF
+// based image into the ImageMeta
+func (img *ImageMeta) extractTIFF() error {
+	file, err := os.Open(img.Path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	tiff, err := ReadTIFF(file, filepath.Ext(img.Path))
+	if err != nil {
+		return err
+	}
+
+	img.Tags["Format"] = tiff.Format
+	img.PreviewWidth, img.PreviewHeight, _ = tiff.Preview(file)
+	return nil
+}
+
+//=============================================================================
+
+// An image file directory with the integer values of its entries
+type IFD struct {
+	Offset int64               // Offset of the IFD in the file
+	Values map[uint16][]uint32 // Integer values of the entries by tag
+}
+
+// Returns the first value of the entry with the tag
+func (ifd *IFD) Get(tag uint16) (uint32, bool) {
+	if values := ifd.Values[tag]; len(values) > 0 {
+		return values[0], true
+	}
+
+	return 0, false
+}
+
+// Returns the width and height of the image stored in the IFD
+func (ifd *IFD) Dimensions() (int, int, bool) {
+	width, wok := ifd.Get(tiffImageWidth)
+	height, hok := ifd.Get(tiffImageHeight)
+	return int(width), int(height), wok && hok && width > 0 && height > 0
+}
+
+// Checks if the IFD stores a reduced resolution version of another image
+func (ifd *IFD) IsReduced() bool {
+	subfile, _ := ifd.Get(tiffNewSubfileType)
+	return subfile&1 != 0
+}
+
+// The IFDs of a TIFF based file, SubIFDs are flattened into the list in the
+// order they are found and the EXIF IFD is kept apart as it isn't an image.
+type TIFF struct {
+	Order  binary.ByteOrder // Byte order of the file
+	Format string           // TIFF, CR2, NEF, ARW or DNG
+	IFDs   []*IFD           // The image IFDs of the file
+	Exif   *IFD             // The EXIF IFD of the first image, if any
+}
+
+// Reads the IFD chain and SubIFDs of a TIFF based file, the format is found
+// from the structure of the file or its extension (NEF and ARW are otherwise
+// indistinguishable from a TIFF).
+func ReadTIFF(r io.ReaderAt, ext string) (*TIFF, error) {
+	header := make([]byte, 16)
+	if _, err := r.ReadAt(header[:8], 0); err != nil {
+		return nil, err
+	}
+
+	tiff := &TIFF{Format: "TIFF"}
+	switch string(header[:4]) {
+	case "II*\x00":
+		tiff.Order = binary.LittleEndian
+	case "MM\x00*":
+		tiff.Order = binary.BigEndian
+	default:
+		return nil, errors.New("not a TIFF based file")
+	}
+
+	if format, ok := TIFFExtensions[strings.ToLower(ext)]; ok {
+		tiff.Format = format
+	}
+
+	// CR2 files mark the header and point to the raw IFD after the IFD0 pointer
+	if _, err := r.ReadAt(header[8:16], 8); err == nil && string(header[8:10]) == "CR" {
+		tiff.Format = "CR2"
+	}
+
+	seen := make(map[int64]bool)
+	queue := []int64{int64(tiff.Order.Uint32(header[4:8]))}
+
+	for len(queue) > 0 && len(tiff.IFDs) < MaxIFDs {
+		offset := queue[0]
+		queue = queue[1:]
+
+		if offset == 0 || seen[offset] {
+			continue
+		}
+		seen[offset] = true
+
+		ifd, next, err := tiff.readIFD(r, offset)
+		if err != nil {
+			if len(tiff.IFDs) == 0 {
+				return nil, err
+			}
+			break
+		}
+
+		tiff.IFDs = append(tiff.IFDs, ifd)
+		for _, sub := range ifd.Values[tiffSubIFDs] {
+			queue = append(queue, int64(sub))
+		}
+		queue = append(queue, next)
+
+		if _, ok := ifd.Get(tiffDNGVersion); ok {
+			tiff.Format = "DNG"
+		}
+
+		if exif, ok := ifd.Get(tiffExifIFD); ok && tiff.Exif == nil {
+			tiff.Exif, _, _ = tiff.readIFD(r, int64(exif))
+		}
+	}
+
+	return tiff, nil
+}
+
+// Returns the dimensions of the largest full resolution image of the file,
+// falling back to the largest image or the EXIF pixel dimensions, as the
+// raw image of a CR2 doesn't record its size in its IFD.
+func (tiff *TIFF) Dimensions() (int, int, bool) {
+	width, height := 0, 0
+	for _, reduced := range []bool{false, true} {
+		for _, ifd := range tiff.IFDs {
+			if ifd.IsReduced() && !reduced {
+				continue
+			}
+
+			if w, h, ok := ifd.Dimensions(); ok && w*h > width*height {
+				width, height = w, h
+			}
+		}
+
+		if width > 0 {
+			return width, height, true
+		}
+	}
+
+	if tiff.Exif != nil {
+		w, wok := tiff.Exif.Get(exifPixelXDim)
+		h, hok := tiff.Exif.Get(exifPixelYDim)
+		if wok && hok && w > 0 && h > 0 {
+			return int(w), int(h), true
+		}
+	}
+
+	return 0, 0, false
+}
+
+// Returns the dimensions of the largest embedded JPEG preview of the file,
+// read from the JPEG headers of the previews rather than the IFDs.
+func (tiff *TIFF) Preview(r io.ReaderAt) (int, int, bool) {
+	_, _, width, height := tiff.largestPreview(r)
+	return width, height, width > 0
+}
+
+// Returns a reader of the largest embedded JPEG preview of the file
+func (tiff *TIFF) PreviewReader(r io.ReaderAt) (io.Reader, bool) {
+	offset, length, width, _ := tiff.largestPreview(r)
+	return io.NewSectionReader(r, offset, length), width > 0
+}
+
+// Returns the offset, length and dimensions of the largest decodable JPEG
+// stored by the IFDs of the file
+func (tiff *TIFF) largestPreview(r io.ReaderAt) (int64, int64, int, int) {
+	var offset, length int64
+	width, height := 0, 0
+	for idx, ifd := range tiff.IFDs {
+		start, size := ifd.jpeg(tiff.Format == "CR2" && idx == 0)
+		if size == 0 {
+			continue
+		}
+
+		config, _, err := image.DecodeConfig(io.NewSectionReader(r, start, size))
+		if err == nil && config.Width*config.Height > width*height {
+			offset, length = start, size
+			width, height = config.Width, config.Height
+		}
+	}
+
+	return offset, length, width, height
+}
+
+// Reads the integer values of the entries of the IFD at the offset and
+// returns the offset of the next IFD in the chain
+func (tiff *TIFF) readIFD(r io.ReaderAt, offset int64) (*IFD, int64, error) {
+	buf := make([]byte, 2)
+	if _, err := r.ReadAt(buf, offset); err != nil {
+		return nil, 0, err
+	}
+
+	count := int(tiff.Order.Uint16(buf))
+	if count == 0 || count > MaxIFDEntries {
+		return nil, 0, ErrMalformedTIFF
+	}
+
+	entries := make([]byte, count*12+4)
+	if _, err := r.ReadAt(entries, offset+2); err != nil {
+		return nil, 0, err
+	}
+
+	ifd := &IFD{Offset: offset, Values: make(map[uint16][]uint32)}
+	for idx := 0; idx < count; idx++ {
+		entry := entries[idx*12 : idx*12+12]
+		tag := tiff.Order.Uint16(entry[0:2])
+		kind := tiff.Order.Uint16(entry[2:4])
+		n := int(tiff.Order.Uint32(entry[4:8]))
+
+		var size int
+		switch kind {
+		case 1: // BYTE
+			size = 1
+		case 3: // SHORT
+			size = 2
+		case 4, 13: // LONG, IFD
+			size = 4
+		default:
+			continue
+		}
+
+		if n == 0 || n > MaxIFDValues {
+			continue
+		}
+
+		data := entry[8:12]
+		if n*size > 4 {
+			data = make([]byte, n*size)
+			if _, err := r.ReadAt(data, int64(tiff.Order.Uint32(entry[8:12]))); err != nil {
+				continue
+			}
+		}
+
+		values := make([]uint32, n)
+		for vdx := range values {
+			switch size {
+			case 1:
+				values[vdx] = uint32(data[vdx])
+			case 2:
+				values[vdx] = uint32(tiff.Order.Uint16(data[vdx*2:]))
+			case 4:
+				values[vdx] = tiff.Order.Uint32(data[vdx*4:])
+			}
+		}
+
+		ifd.Values[tag] = values
+	}
+
+	next := int64(tiff.Order.Uint32(entries[count*12:]))
+	return ifd, next, nil
+}
+
+// Returns the offset and length of a JPEG stored by the IFD, either as a
+// JPEG interchange format thumbnail or as the single strip of a reduced
+// resolution (or CR2 preview) image with JPEG compression.
+func (ifd *IFD) jpeg(preview bool) (int64, int64) {
+	if offset, ok := ifd.Get(tiffJPEGOffset); ok {
+		if length, ok := ifd.Get(tiffJPEGLength); ok {
+			return int64(offset), int64(length)
+		}
+	}
+
+	compression, _ := ifd.Get(tiffCompression)
+	if (compression != 6 && compression != 7) || !(preview || ifd.IsReduced()) {
+		return 0, 0
+	}
+
+	offsets, counts := ifd.Values[tiffStripOffsets], ifd.Values[tiffStripCounts]
+	if len(offsets) != 1 || len(counts) != 1 {
+		return 0, 0
+	}
+
+	return int64(offsets[0]), int64(counts[0])
+}
@@ -0,0 +1,321 @@
+package crate_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/jpeg"
+	"io/ioutil"
+	"os"
+
+	. "github.com/bbengfort/crate/crate"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// An entry of a synthetic IFD, refs are resolved to the offsets of blocks
+type tiffEntry struct {
+	tag   uint16
+	kind  uint16
+	count int
+	data  []byte
+	refs  []string
+	size  string
+}
+
+// A synthetic IFD (if it has entries) or data block of a TIFF
+type tiffBlock struct {
+	name    string
+	next    string
+	entries []tiffEntry
+	data    []byte
+}
+
+func tshort(tag uint16, values ...uint16) tiffEntry {
+	return tiffEntry{tag: tag, kind: 3, count: len(values), data: mkints(values)}
+}
+
+func tlong(tag uint16, values ...uint32) tiffEntry {
+	return tiffEntry{tag: tag, kind: 4, count: len(values), data: mkints(values)}
+}
+
+func trational(tag uint16, values ...uint32) tiffEntry {
+	return tiffEntry{tag: tag, kind: 5, count: len(values) / 2, data: mkints(values)}
+}
+
+func tascii(tag uint16, text string) tiffEntry {
+	return tiffEntry{tag: tag, kind: 2, count: len(text) + 1, data: append([]byte(text), 0)}
+}
+
+func tundef(tag uint16, data []byte) tiffEntry {
+	return tiffEntry{tag: tag, kind: 7, count: len(data), data: data}
+}
+
+func tref(tag uint16, names ...string) tiffEntry {
+	return tiffEntry{tag: tag, kind: 4, count: len(names), data: make([]byte, 4*len(names)), refs: names}
+}
+
+func tsize(tag uint16, name string) tiffEntry {
+	return tiffEntry{tag: tag, kind: 4, count: 1, data: make([]byte, 4), size: name}
+}
+
+// Lays out a TIFF with the blocks in order after the header and the extra
+// header bytes, IFD0 is the first block. The values of the tshort and tlong
+// entries are written big endian by mkints, so only MM files can use them.
+func mktiff(order binary.ByteOrder, extra []byte, blocks ...tiffBlock) []byte {
+	length := func(block tiffBlock) int {
+		if len(block.entries) == 0 {
+			return len(block.data) + len(block.data)%2
+		}
+
+		size := 6 + 12*len(block.entries)
+		for _, entry := range block.entries {
+			if len(entry.data) > 4 {
+				size += len(entry.data) + len(entry.data)%2
+			}
+		}
+		return size
+	}
+
+	offsets := make(map[string]int)
+	sizes := make(map[string]int)
+	offset := 8 + len(extra)
+	for _, block := range blocks {
+		offsets[block.name] = offset
+		sizes[block.name] = len(block.data)
+		offset += length(block)
+	}
+
+	buf := new(bytes.Buffer)
+	if order == binary.LittleEndian {
+		buf.WriteString("II*\x00")
+	} else {
+		buf.WriteString("MM\x00*")
+	}
+	binary.Write(buf, order, uint32(8+len(extra)))
+	buf.Write(extra)
+
+	for _, block := range blocks {
+		if len(block.entries) == 0 {
+			buf.Write(block.data)
+			buf.Write(make([]byte, len(block.data)%2))
+			continue
+		}
+
+		overflow := new(bytes.Buffer)
+		start := offsets[block.name] + 6 + 12*len(block.entries)
+
+		binary.Write(buf, order, uint16(len(block.entries)))
+		for _, entry := range block.entries {
+			data := entry.data
+			for idx, ref := range entry.refs {
+				order.PutUint32(data[idx*4:], uint32(offsets[ref]))
+			}
+			if entry.size != "" {
+				order.PutUint32(data, uint32(sizes[entry.size]))
+			}
+
+			binary.Write(buf, order, entry.tag)
+			binary.Write(buf, order, entry.kind)
+			binary.Write(buf, order, uint32(entry.count))
+
+			if len(data) > 4 {
+				binary.Write(buf, order, uint32(start+overflow.Len()))
+				overflow.Write(data)
+				overflow.Write(make([]byte, len(data)%2))
+			} else {
+				buf.Write(append(data, make([]byte, 4-len(data))...))
+			}
+		}
+
+		next := uint32(0)
+		if block.next != "" {
+			next = uint32(offsets[block.next])
+		}
+		binary.Write(buf, order, next)
+		buf.Write(overflow.Bytes())
+	}
+
+	return buf.Bytes()
+}
+
+// Encodes a gray JPEG with the dimensions to embed as a preview
+func mkjpeg(width, height int) []byte {
+	buf := new(bytes.Buffer)
+	jpeg.Encode(buf, image.NewGray(image.Rect(0, 0, width, height)), nil)
+	return buf.Bytes()
+}
+
+// Builds a big endian NEF with a thumbnail IFD0, a JPEG preview and raw
+// image in SubIFDs, an EXIF IFD and a Nikon maker note
+func mknef() []byte {
+	note := mktiff(binary.BigEndian, nil, tiffBlock{name: "ifd0", entries: []tiffEntry{
+		tascii(0x001d, "3004567"),
+		tlong(0x00a7, 1234),
+	}})
+	note = append([]byte("Nikon\x00\x02\x10\x00\x00"), note...)
+
+	return mktiff(binary.BigEndian, nil,
+		tiffBlock{name: "ifd0", entries: []tiffEntry{
+			tlong(0x00fe, 1),
+			tshort(0x0100, 160),
+			tshort(0x0101, 120),
+			tascii(0x010f, "NIKON CORPORATION"),
+			tascii(0x0110, "NIKON D750"),
+			tref(0x014a, "preview", "raw"),
+			tref(0x8769, "exif"),
+		}},
+		tiffBlock{name: "preview", entries: []tiffEntry{
+			tlong(0x00fe, 1),
+			tref(0x0201, "jpeg"),
+			tsize(0x0202, "jpeg"),
+		}},
+		tiffBlock{name: "raw", entries: []tiffEntry{
+			tlong(0x00fe, 0),
+			tlong(0x0100, 6032),
+			tlong(0x0101, 4032),
+			tshort(0x0103, 34713),
+			tref(0x0111, "data"),
+			tsize(0x0117, "data"),
+		}},
+		tiffBlock{name: "exif", entries: []tiffEntry{
+			tascii(0x9003, "2015:01:02 10:30:00"),
+			tundef(0x927c, note),
+		}},
+		tiffBlock{name: "jpeg", data: mkjpeg(64, 48)},
+		tiffBlock{name: "data", data: make([]byte, 256)},
+	)
+}
+
+var _ = Describe("TIFF", func() {
+
+	var testRoot string // Temporary directory for the synthetic images
+
+	BeforeEach(func() {
+		var err error
+		testRoot, err = ioutil.TempDir("", "ginkgo-")
+		Ω(err).Should(BeNil())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(testRoot)
+	})
+
+	It("should read the IFDs and SubIFDs of a TIFF", func() {
+		tiff, err := ReadTIFF(bytes.NewReader(mknef()), ".nef")
+		Ω(err).Should(BeNil())
+		Ω(tiff.Format).Should(Equal("NEF"))
+		Ω(tiff.Order).Should(Equal(binary.BigEndian))
+		Ω(tiff.IFDs).Should(HaveLen(3))
+		Ω(tiff.Exif).ShouldNot(BeNil())
+
+		width, height, ok := tiff.Dimensions()
+		Ω(ok).Should(BeTrue())
+		Ω([]int{width, height}).Should(Equal([]int{6032, 4032}))
+
+		width, height, ok = tiff.Preview(bytes.NewReader(mknef()))
+		Ω(ok).Should(BeTrue())
+		Ω([]int{width, height}).Should(Equal([]int{64, 48}))
+	})
+
+	It("should not read files that aren't TIFF based", func() {
+		_, err := ReadTIFF(bytes.NewReader(mkjpeg(8, 8)), ".jpg")
+		Ω(err).ShouldNot(BeNil())
+	})
+
+	It("should extract the EXIF, maker note and preview of a NEF", func() {
+		img := extractImage(testRoot, "DSC_0001.NEF", mknef())
+
+		Ω(img.IsTIFF()).Should(BeTrue())
+		Ω(img.Width).Should(Equal(6032))
+		Ω(img.Height).Should(Equal(4032))
+		Ω(img.PreviewWidth).Should(Equal(64))
+		Ω(img.PreviewHeight).Should(Equal(48))
+
+		Ω(img.Tag("Format")).Should(Equal("NEF"))
+		Ω(img.Tag("CameraMake")).Should(Equal("NIKON CORPORATION"))
+		Ω(img.Tag("CameraModel")).Should(Equal("NIKON D750"))
+		Ω(img.Tag("DateTaken")).Should(Equal("2015-01-02T10:30:00+00:00"))
+		Ω(img.Tag("SerialNumber")).Should(Equal("3004567"))
+		Ω(img.Tag("ShutterCount")).Should(Equal("1234"))
+	})
+
+	It("should not extract the EXIF of a NEF with a truncated maker note", func() {
+		data := mktiff(binary.BigEndian, nil,
+			tiffBlock{name: "ifd0", entries: []tiffEntry{
+				tascii(0x010f, "NIKON CORPORATION"),
+				tref(0x8769, "exif"),
+			}},
+			tiffBlock{name: "exif", entries: []tiffEntry{
+				tundef(0x927c, []byte("Nikon\x00\x02")),
+			}},
+		)
+
+		img := extractImage(testRoot, "DSC_0002.NEF", data)
+		Ω(img.Tag("CameraMake")).Should(BeEmpty())
+
+		_, ok := img.GetExif()
+		Ω(ok).Should(BeFalse())
+	})
+
+	It("should detect a CR2 by its header and use its IFD0 preview", func() {
+		canon := new(bytes.Buffer)
+		binary.Write(canon, binary.BigEndian, uint16(1))
+		binary.Write(canon, binary.BigEndian, []uint16{0x000c, 4})
+		binary.Write(canon, binary.BigEndian, []uint32{1, 2801201502, 0})
+
+		data := mktiff(binary.BigEndian, []byte("CR\x02\x00\x00\x00\x00\x00"),
+			tiffBlock{name: "ifd0", next: "ifd1", entries: []tiffEntry{
+				tshort(0x0100, 5472),
+				tshort(0x0101, 3648),
+				tshort(0x0103, 6),
+				tascii(0x010f, "Canon"),
+				tascii(0x0110, "Canon EOS 5D Mark IV"),
+				tref(0x0111, "preview"),
+				tsize(0x0117, "preview"),
+				tref(0x8769, "exif"),
+			}},
+			tiffBlock{name: "ifd1", entries: []tiffEntry{
+				tref(0x0201, "thumbnail"),
+				tsize(0x0202, "thumbnail"),
+			}},
+			tiffBlock{name: "exif", entries: []tiffEntry{
+				tascii(0x9003, "2015:06:14 09:30:00"),
+				tundef(0x927c, canon.Bytes()),
+			}},
+			tiffBlock{name: "preview", data: mkjpeg(96, 64)},
+			tiffBlock{name: "thumbnail", data: mkjpeg(32, 24)},
+		)
+
+		img := extractImage(testRoot, "IMG_0001.CR2", data)
+		Ω(img.Tag("Format")).Should(Equal("CR2"))
+		Ω(img.Width).Should(Equal(5472))
+		Ω(img.Height).Should(Equal(3648))
+		Ω(img.PreviewWidth).Should(Equal(96))
+		Ω(img.PreviewHeight).Should(Equal(64))
+		Ω(img.Tag("CameraMake")).Should(Equal("Canon"))
+		Ω(img.Tag("SerialNumber")).Should(Equal("2801201502"))
+	})
+
+	It("should fall back to the EXIF pixel dimensions", func() {
+		data := mktiff(binary.BigEndian, nil,
+			tiffBlock{name: "ifd0", entries: []tiffEntry{
+				tref(0x8769, "exif"),
+			}},
+			tiffBlock{name: "exif", entries: []tiffEntry{
+				tlong(0xa002, 4000),
+				tlong(0xa003, 3000),
+			}},
+		)
+
+		tiff, err := ReadTIFF(bytes.NewReader(data), ".arw")
+		Ω(err).Should(BeNil())
+		Ω(tiff.Format).Should(Equal("ARW"))
+
+		width, height, ok := tiff.Dimensions()
+		Ω(ok).Should(BeTrue())
+		Ω([]int{width, height}).Should(Equal([]int{4000, 3000}))
+	})
+
+})
@@ -79,6 +79,12 @@ func JSONStamp(t time.Time) string {
 	return ""
 }
 
+// Returns the wall clock time of t in its own zone as a UTC time, which is how
+// capture times are stored since the EXIF times of most cameras have no zone
+func WallClock(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC)
+}
+
 //=============================================================================
 
 // Watch for CTRL+C and terminate the server
@@ -0,0 +1,375 @@
+// Meta data struct specifically for MP4 and QuickTime videos
+
+package crate
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ISO6709Pattern = regexp.MustCompile(`^([+-]\d+(?:\.\d+)?)([+-]\d+(?:\.\d+)?)`)
+)
+
+//=============================================================================
+
+type VideoMeta struct {
+	FileMeta
+	Width      int     // Width of the video track
+	Height     int     // Height of the video track
+	Duration   float64 // Duration of the movie in seconds
+	VideoCodec string  // Sample entry type of the video track, e.g. avc1
+	AudioCodec string  // Sample entry type of the audio track, e.g. mp4a
+	FrameRate  float64 // Average frames per second of the video track
+	Tags       TagMap  // DateTaken, location and device tags like an image
+}
+
+// Converts a FileMeta into a VideoMeta
+func ConvertVideoMeta(fm *FileMeta) (*VideoMeta, bool) {
+	if !new(VideoExtractor).Claims(fm.MimeType) {
+		return nil, false
+	}
+
+	video := new(VideoMeta)
+	video.FileMeta = *fm
+
+	return video, true
+}
+
+// Populates the fields on the VideoMeta
+func (video *VideoMeta) Populate() {
+	video.FileMeta.populateFile()
+	extract(video)
+}
+
+// Returns the value of a tag or an empty string if it isn't set
+func (video *VideoMeta) Tag(name string) string {
+	return video.Tags[name]
+}
+
+// Returns the latitude and longitude the video was recorded at, if tagged
+func (video *VideoMeta) Location() (float64, float64, bool) {
+	return video.Tags.Location()
+}
+
+// Returns the time the video was recorded, if tagged
+func (video *VideoMeta) Taken() (time.Time, bool) {
+	return video.Tags.Taken()
+}
+
+// Writes the VideoMeta to the database, where the key is the SHA1 hash
+func (video *VideoMeta) Store() error {
+	if !video.populated {
+		video.Populate()
+	}
+
+	return storeRecord(video)
+}
+
+// Returns the byte serialization of the video meta for storage
+func (video *VideoMeta) Byte() []byte {
+	data, err := json.Marshal(video)
+	if err != nil {
+		return nil
+	}
+
+	return data
+}
+
+// Prints out the info as a JSON indented pretty string
+func (video *VideoMeta) Info() string {
+	if !video.populated {
+		video.Populate()
+	}
+
+	info, err := json.MarshalIndent(video, "", "  ")
+	if err != nil {
+		return ""
+	}
+
+	return string(info)
+}
+
+//=============================================================================
+
+// Extracts the movie header, tracks and QuickTime user data of MP4 and MOV
+// files by walking their boxes, without decoding any of the media.
+type VideoExtractor struct{}
+
+func init() {
+	RegisterExtractor(new(VideoExtractor))
+}
+
+func (ext *VideoExtractor) Name() string {
+	return "video"
+}
+
+func (ext *VideoExtractor) Version() string {
+	return "3"
+}
+
+func (ext *VideoExtractor) Claims(mimetype string) bool {
+	return MimePrefixes{"video/mp4", "video/quicktime", "video/3gpp", "video/x-m4v"}.Claims(mimetype)
+}
+
+func (ext *VideoExtractor) Convert(fm *FileMeta) FilePath {
+	if video, ok := ConvertVideoMeta(fm); ok {
+		return video
+	}
+
+	return nil
+}
+
+func (ext *VideoExtractor) Extract(record FilePath) error {
+	video, ok := record.(*VideoMeta)
+	if !ok {
+		return errors.New("record is not a VideoMeta")
+	}
+
+	file, err := os.Open(video.Path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	finfo, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	video.Tags = make(TagMap)
+	return video.parse(file, finfo.Size())
+}
+
+//=============================================================================
+
+// Parses the movie box of the file into the fields of the video
+func (video *VideoMeta) parse(r io.ReaderAt, size int64) error {
+	boxes, err := ReadBoxes(r, 0, size)
+	if err != nil && len(boxes) == 0 {
+		return err
+	}
+
+	moov, ok := FindBox(boxes, "moov")
+	if !ok {
+		return errors.New("no moov box in the file")
+	}
+
+	children, err := moov.Children(r, 0)
+	if err != nil {
+		return err
+	}
+
+	// The movie header holds the duration and the creation time in UTC. Like
+	// EXIF times, the capture time is the wall clock where it was taken, which
+	// is only known from the user data or Apple keys below, so until then the
+	// UTC wall clock is kept, whatever the zone of the computer running this.
+	if mvhd, ok := FindBox(children, "mvhd"); ok {
+		if data, err := mvhd.Read(r); err == nil {
+			created, timescale, duration := parseMediaHeader(data)
+			if timescale > 0 {
+				video.Duration = float64(duration) / float64(timescale)
+			}
+			if !created.IsZero() {
+				video.Tags["DateTaken"] = JSONStamp(created.UTC())
+			}
+		}
+	}
+
+	for _, trak := range children {
+		if trak.Type == "trak" {
+			video.parseTrack(r, trak)
+		}
+	}
+
+	// QuickTime user data written by most cameras and Android phones
+	if udta, ok := FindBox(children, "udta"); ok {
+		if atoms, err := udta.Children(r, 0); err == nil {
+			video.parseUserData(r, atoms)
+		}
+	}
+
+	// QuickTime metadata with reverse DNS keys written by Apple devices
+	if meta, ok := FindBox(children, "meta"); ok {
+		video.parseMetadata(ReadItemList(r, meta))
+	}
+
+	if _, _, ok := video.Location(); ok {
+		video.Tags["GeoSource"] = GeoSourceExif
+	}
+
+	return nil
+}
+
+// Parses a track for its dimensions, codec and frame rate
+func (video *VideoMeta) parseTrack(r io.ReaderAt, trak Box) {
+	mdia, ok := FindPath(r, []Box{trak}, "trak", "mdia")
+	if !ok {
+		return
+	}
+
+	children, err := mdia.Children(r, 0)
+	if err != nil {
+		return
+	}
+
+	handler := ""
+	if hdlr, ok := FindBox(children, "hdlr"); ok {
+		if data, err := hdlr.Read(r); err == nil && len(data) >= 12 {
+			handler = string(data[8:12])
+		}
+	}
+
+	codec := ""
+	if stsd, ok := FindPath(r, children, "minf", "stbl", "stsd"); ok {
+		if entries, err := stsd.Children(r, 8); err == nil && len(entries) > 0 {
+			codec = strings.TrimSpace(entries[0].Type)
+		}
+	}
+
+	switch handler {
+	case "soun":
+		if video.AudioCodec == "" {
+			video.AudioCodec = codec
+		}
+
+	case "vide":
+		if video.VideoCodec != "" {
+			return
+		}
+		video.VideoCodec = codec
+
+		// The track header stores the display size as 16.16 fixed point
+		if tkhd, ok := FindPath(r, []Box{trak}, "trak", "tkhd"); ok {
+			if data, err := tkhd.Read(r); err == nil && len(data) >= 84 {
+				video.Width = int(binary.BigEndian.Uint32(data[len(data)-8:]) >> 16)
+				video.Height = int(binary.BigEndian.Uint32(data[len(data)-4:]) >> 16)
+			}
+		}
+
+		// The frame rate is the number of samples over the media duration
+		var timescale, duration uint64
+		if mdhd, ok := FindBox(children, "mdhd"); ok {
+			if data, err := mdhd.Read(r); err == nil {
+				_, timescale, duration = parseMediaHeader(data)
+			}
+		}
+
+		if stts, ok := FindPath(r, children, "minf", "stbl", "stts"); ok && duration > 0 {
+			if data, err := stts.Read(r); err == nil && len(data) >= 8 {
+				var samples uint64
+				count := int(binary.BigEndian.Uint32(data[4:8]))
+				for idx := 0; idx < count && 8+idx*8+8 <= len(data); idx++ {
+					samples += uint64(binary.BigEndian.Uint32(data[8+idx*8:]))
+				}
+
+				video.FrameRate = float64(samples) * float64(timescale) / float64(duration)
+			}
+		}
+	}
+}
+
+// Parses the QuickTime user data text atoms, e.g. "\xa9xyz" for the location
+func (video *VideoMeta) parseUserData(r io.ReaderAt, atoms []Box) {
+	for _, atom := range atoms {
+		switch atom.Type {
+		case "\xa9xyz":
+			video.setLocation(ReadUserText(r, atom))
+		case "\xa9mak":
+			video.Tags["CameraMake"] = ReadUserText(r, atom)
+		case "\xa9mod":
+			video.Tags["CameraModel"] = ReadUserText(r, atom)
+		case "\xa9swr":
+			video.Tags["Software"] = ReadUserText(r, atom)
+		case "\xa9day":
+			video.setTaken(ReadUserText(r, atom))
+		}
+	}
+}
+
+// Parses the Apple QuickTime metadata keys, which take precedence over the
+// movie header and user data since they record the local creation time.
+func (video *VideoMeta) parseMetadata(items map[string]ItemData) {
+	for key, item := range items {
+		switch key {
+		case "com.apple.quicktime.location.ISO6709":
+			video.setLocation(item.String())
+		case "com.apple.quicktime.make":
+			video.Tags["CameraMake"] = item.String()
+		case "com.apple.quicktime.model":
+			video.Tags["CameraModel"] = item.String()
+		case "com.apple.quicktime.software":
+			video.Tags["Software"] = item.String()
+		case "com.apple.quicktime.creationdate":
+			video.setTaken(item.String())
+		case "com.apple.quicktime.content.identifier":
+			video.Tags["ContentIdentifier"] = item.String()
+		}
+	}
+}
+
+// Sets the location tags from an ISO 6709 string, e.g. +37.7858-122.4064/
+func (video *VideoMeta) setLocation(value string) {
+	if lat, lon, ok := ParseISO6709(value); ok {
+		video.Tags["Latitude"] = Ftoa(lat)
+		video.Tags["Longitude"] = Ftoa(lon)
+	}
+}
+
+// Sets the DateTaken tag from the wall clock of an ISO 8601 creation date
+func (video *VideoMeta) setTaken(value string) {
+	for _, layout := range []string{time.RFC3339, "2006-01-02T15:04:05-0700", "2006-01-02"} {
+		if taken, err := time.Parse(layout, value); err == nil {
+			video.Tags["DateTaken"] = JSONStamp(WallClock(taken))
+			return
+		}
+	}
+}
+
+//=============================================================================
+
+// Parses the creation time, timescale and duration of an mvhd or mdhd box
+func parseMediaHeader(data []byte) (time.Time, uint64, uint64) {
+	if len(data) >= 32 && data[0] == 1 {
+		created := binary.BigEndian.Uint64(data[4:12])
+		timescale := uint64(binary.BigEndian.Uint32(data[20:24]))
+		duration := binary.BigEndian.Uint64(data[24:32])
+		return QuickTime(created), timescale, duration
+	}
+
+	if len(data) >= 20 {
+		created := uint64(binary.BigEndian.Uint32(data[4:8]))
+		timescale := uint64(binary.BigEndian.Uint32(data[12:16]))
+		duration := uint64(binary.BigEndian.Uint32(data[16:20]))
+		return QuickTime(created), timescale, duration
+	}
+
+	return time.Time{}, 0, 0
+}
+
+// Parses the latitude and longitude of an ISO 6709 location string
+func ParseISO6709(value string) (float64, float64, bool) {
+	match := ISO6709Pattern.FindStringSubmatch(value)
+	if match == nil {
+		return 0, 0, false
+	}
+
+	lat, err := strconv.ParseFloat(match[1], 64)
+	if err != nil {
+		return 0, 0, false
+	}
+
+	lon, err := strconv.ParseFloat(match[2], 64)
+	if err != nil {
+		return 0, 0, false
+	}
+
+	return lat, lon, true
+}
@@ -0,0 +1,137 @@
+package crate_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/bbengfort/crate/crate"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// Builds a two second 1280x720 MP4 with a 30 fps avc1 track, an mp4a track
+// and QuickTime user data, but without any media data.
+func mkmp4() []byte {
+	created := uint32(3517119000) // 2015-06-14T09:30:00Z
+
+	mvhd := mkbox("mvhd", mkints(uint32(0), created, created, uint32(1000), uint32(2000)), make([]byte, 80))
+
+	tkhd := mkbox("tkhd", mkints(uint32(3), created, created, uint32(1), uint32(0), uint32(2000)),
+		make([]byte, 52), mkints(uint32(1280<<16), uint32(720<<16)))
+
+	track := func(handler, codec string, stts []byte, header []byte) []byte {
+		mdhd := mkbox("mdhd", mkints(uint32(0), created, created, uint32(15360), uint32(30720), uint32(0)))
+		hdlr := mkbox("hdlr", mkints(uint32(0), uint32(0)), []byte(handler), make([]byte, 13))
+		stsd := mkbox("stsd", mkints(uint32(0), uint32(1)), mkbox(codec, make([]byte, 78)))
+		stbl := mkbox("stbl", stsd, stts)
+		return mkbox("trak", header, mkbox("mdia", mdhd, hdlr, mkbox("minf", stbl)))
+	}
+
+	vide := track("vide", "avc1", mkbox("stts", mkints(uint32(0), uint32(1), uint32(60), uint32(512))), tkhd)
+	soun := track("soun", "mp4a", nil, nil)
+
+	udta := mkbox("udta",
+		mkbox("\xa9xyz", mkints(uint16(18), uint16(0x15c7)), []byte("+37.7858-122.4064/")),
+		mkbox("\xa9mak", mkints(uint16(7), uint16(0x15c7)), []byte("Samsung")),
+		mkbox("\xa9mod", mkints(uint16(8), uint16(0x15c7)), []byte("SM-G920F")))
+
+	data := mkbox("ftyp", []byte("isom"), mkints(uint32(512)), []byte("isomiso2avc1mp41"))
+	data = append(data, mkbox("moov", mvhd, vide, soun, udta)...)
+	return append(data, mkbox("mdat", make([]byte, 64))...)
+}
+
+// Returns an unpopulated FileMeta for the MP4 at the path
+func mkvideo(path string) *FileMeta {
+	fm := new(FileMeta)
+	fm.Path = path
+	fm.MimeType = "video/mp4"
+	return fm
+}
+
+var _ = Describe("Video", func() {
+
+	var testRoot string // Temporary directory for the synthetic videos
+	var path string     // Path to the synthetic MP4
+
+	BeforeEach(func() {
+		var err error
+		testRoot, err = ioutil.TempDir("", "ginkgo-")
+		Ω(err).Should(BeNil())
+
+		path = filepath.Join(testRoot, "VID_0001.mp4")
+		Ω(ioutil.WriteFile(path, mkmp4(), 0644)).Should(Succeed())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(testRoot)
+	})
+
+	It("should parse ISO 6709 locations", func() {
+		lat, lon, ok := ParseISO6709("+37.7858-122.4064+012.000/")
+		Ω(ok).Should(BeTrue())
+		Ω(lat).Should(Equal(37.7858))
+		Ω(lon).Should(Equal(-122.4064))
+
+		_, _, ok = ParseISO6709("nowhere")
+		Ω(ok).Should(BeFalse())
+	})
+
+	It("should create a VideoMeta record for MP4 files", func() {
+		fm := new(FileMeta)
+		fm.Path = path
+
+		record := NewRecord(fm)
+		Ω(record).Should(BeAssignableToTypeOf(new(VideoMeta)))
+	})
+
+	It("should extract the movie and track headers", func() {
+		video, ok := ConvertVideoMeta(mkvideo(path))
+		Ω(ok).Should(BeTrue())
+		video.Populate()
+
+		Ω(video.Extractors).Should(HaveKeyWithValue("video", "3"))
+		Ω(video.Duration).Should(Equal(2.0))
+		Ω(video.Width).Should(Equal(1280))
+		Ω(video.Height).Should(Equal(720))
+		Ω(video.VideoCodec).Should(Equal("avc1"))
+		Ω(video.AudioCodec).Should(Equal("mp4a"))
+		Ω(video.FrameRate).Should(Equal(30.0))
+	})
+
+	It("should surface the capture time, location and device as tags", func() {
+		video, _ := ConvertVideoMeta(mkvideo(path))
+		video.Populate()
+
+		// The movie header is in UTC, kept as the wall clock whatever the zone
+		Ω(video.Tag("DateTaken")).Should(Equal("2015-06-14T09:30:00+00:00"))
+		_, ok := video.Taken()
+		Ω(ok).Should(BeTrue())
+
+		lat, lon, ok := video.Location()
+		Ω(ok).Should(BeTrue())
+		Ω(lat).Should(Equal(37.7858))
+		Ω(lon).Should(Equal(-122.4064))
+
+		Ω(video.Tag("GeoSource")).Should(Equal(GeoSourceExif))
+		Ω(video.Tag("CameraMake")).Should(Equal("Samsung"))
+		Ω(video.Tag("CameraModel")).Should(Equal("SM-G920F"))
+
+		query, err := ParseQuery("near:37.78,-122.41~2km CameraMake:samsung")
+		Ω(err).Should(BeNil())
+		Ω(query.Match(video)).Should(BeTrue())
+	})
+
+	It("should take the capture time on the wall clock of the Apple creation date", func() {
+		Ω(ioutil.WriteFile(path, mklivemov("2015-01-05T09:57:20-0800", "9F0A6CBB"), 0644)).Should(Succeed())
+
+		fm := mkvideo(path)
+		fm.MimeType = "video/quicktime"
+		video, _ := ConvertVideoMeta(fm)
+		video.Populate()
+
+		Ω(video.Tag("DateTaken")).Should(Equal("2015-01-05T09:57:20+00:00"))
+	})
+
+})
@@ -0,0 +1,366 @@
+// Handles XMP packets embedded in files and sidecar files stored next to images
+
+package crate
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	XMPExt     = ".xmp"
+	MaxXMPScan = 1 << 20 // Bytes at the start of an image searched for XMP
+)
+
+const (
+	rdfNamespace = "http://www.w3.org/1999/02/22-rdf-syntax-ns#"
+	xmlNamespace = "http://www.w3.org/XML/1998/namespace"
+)
+
+// Preferred prefixes of the common XMP namespaces, other namespaces use the
+// prefix they are declared with in the packet
+var XMPNamespaces = map[string]string{
+	"http://purl.org/dc/elements/1.1/":            "dc",
+	"http://ns.adobe.com/xap/1.0/":                "xmp",
+	"http://ns.adobe.com/xap/1.0/mm/":             "xmpMM",
+	"http://ns.adobe.com/pdf/1.3/":                "pdf",
+	"http://ns.adobe.com/exif/1.0/":               "exif",
+	"http://ns.adobe.com/tiff/1.0/":               "tiff",
+	"http://ns.adobe.com/photoshop/1.0/":          "photoshop",
+	"http://iptc.org/std/Iptc4xmpCore/1.0/xmlns/": "Iptc4xmpCore",
+}
+
+// Layouts of the dates in XMP and other XML metadata, from most to least precise
+var XMPDateLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04Z07:00",
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02",
+	"2006-01",
+	"2006",
+}
+
+// The XMP properties of the image tags they set, in order of precedence. The
+// edits made in Lightroom and darktable replace the tags read from the EXIF,
+// while the create date and creator tool only fill in for a missing EXIF.
+var xmpImageTags = []struct {
+	tag      string
+	prop     string
+	fallback bool
+}{
+	{"Title", "dc:title", false},
+	{"ImageDescription", "dc:description", false},
+	{"Artist", "dc:creator", false},
+	{"Copyright", "dc:rights", false},
+	{"Rating", "xmp:Rating", false},
+	{"Label", "xmp:Label", false},
+	{"Keywords", "dc:subject", false},
+	{"Headline", "photoshop:Headline", false},
+	{"Credit", "photoshop:Credit", false},
+	{"City", "photoshop:City", false},
+	{"Sublocation", "Iptc4xmpCore:Location", false},
+	{"State", "photoshop:State", false},
+	{"Country", "photoshop:Country", false},
+	{"Software", "xmp:CreatorTool", true},
+	{"DateTaken", "xmp:CreateDate", true},
+	{"DateTaken", "photoshop:DateCreated", false},
+	{"DateTaken", "exif:DateTimeOriginal", false},
+}
+
+const xmpGPSTemplate = `<?xpacket begin="` + "\ufeff" + `" id="W5M0MpCehiHzreSzNTczkc9d"?>
+<x:xmpmeta xmlns:x="adobe:ns:meta/">
+ <rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+  <rdf:Description rdf:about=""
+    xmlns:exif="http://ns.adobe.com/exif/1.0/"
+    exif:GPSVersionID="2.2.0.0"
+    exif:GPSLatitude="%s"
+    exif:GPSLongitude="%s"/>
+ </rdf:RDF>
+</x:xmpmeta>
+<?xpacket end="w"?>
+`
+
+//=============================================================================
+
+// Returns the XMP packet embedded in the data, e.g. in a PDF or JPEG, if any
+func FindXMP(data []byte) []byte {
+	for _, tags := range [][2]string{{"<x:xmpmeta", "</x:xmpmeta>"}, {"<rdf:RDF", "</rdf:RDF>"}} {
+		start := bytes.Index(data, []byte(tags[0]))
+		if start < 0 {
+			continue
+		}
+
+		end := bytes.Index(data[start:], []byte(tags[1]))
+		if end < 0 {
+			continue
+		}
+
+		return data[start : start+end+len(tags[1])]
+	}
+
+	return nil
+}
+
+// Parses the properties of an XMP packet keyed by their prefixed name, e.g.
+// dc:title. Only the first alternative of rdf:Alt values (the default
+// language) is kept, the items of rdf:Seq and rdf:Bag values are joined by
+// "; ", and the fields of structures are flattened into properties.
+func ParseXMP(data []byte) (map[string]string, error) {
+	props := make(map[string]string)
+	prefixes := make(map[string]string)
+	stack := make([]xml.Name, 0)
+
+	prefix := func(name xml.Name) string {
+		if pfx, ok := XMPNamespaces[name.Space]; ok {
+			return pfx + ":" + name.Local
+		}
+		if pfx, ok := prefixes[name.Space]; ok {
+			return pfx + ":" + name.Local
+		}
+		return name.Space + ":" + name.Local
+	}
+
+	set := func(name xml.Name, value string, alt bool) {
+		key := prefix(name)
+		if prev, ok := props[key]; ok {
+			if alt {
+				return
+			}
+			value = prev + "; " + value
+		}
+		props[key] = value
+	}
+
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	decoder.Strict = false
+
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return props, err
+		}
+
+		switch token := token.(type) {
+		case xml.StartElement:
+			inside := len(stack) > 0 && describes(stack)
+
+			for _, attr := range token.Attr {
+				switch {
+				case attr.Name.Space == "xmlns":
+					prefixes[attr.Value] = attr.Name.Local
+				case attr.Name.Space == rdfNamespace || attr.Name.Space == xmlNamespace || attr.Name.Space == "":
+					continue
+				case token.Name.Space == rdfNamespace && token.Name.Local == "Description" || inside:
+					set(attr.Name, attr.Value, false)
+				}
+			}
+
+			stack = append(stack, token.Name)
+
+		case xml.EndElement:
+			if len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+
+		case xml.CharData:
+			value := strings.TrimSpace(string(token))
+			if value == "" || !describes(stack) {
+				continue
+			}
+
+			// The property is the nearest element that isn't an RDF construct
+			alt := false
+			for idx := len(stack) - 1; idx >= 0; idx-- {
+				if stack[idx].Space == rdfNamespace {
+					alt = alt || stack[idx].Local == "Alt"
+					continue
+				}
+
+				set(stack[idx], value, alt)
+				break
+			}
+		}
+	}
+
+	return props, nil
+}
+
+// Parses an XMP date, which may omit any of its trailing parts
+func ParseXMPDate(value string) (time.Time, bool) {
+	for _, layout := range XMPDateLayouts {
+		if date, err := time.Parse(layout, strings.TrimSpace(value)); err == nil {
+			return date, true
+		}
+	}
+
+	return time.Time{}, false
+}
+
+// Checks whether the innermost elements are within an rdf:Description
+func describes(stack []xml.Name) bool {
+	for idx := len(stack) - 1; idx >= 0; idx-- {
+		if stack[idx].Space == rdfNamespace && stack[idx].Local == "Description" {
+			return true
+		}
+	}
+
+	return false
+}
+
+//=============================================================================
+
+// Returns the XMP packet embedded in the image, read from the header of the
+// formats that have a header reader and otherwise searched for in the start
+// of the file, where JPEG and most RAW formats store it.
+func (img *ImageMeta) EmbeddedXMP() ([]byte, error) {
+	if _, ok := ImageHeaderReaders[img.MimeType]; ok {
+		header, err := img.ReadHeader()
+		if err != nil {
+			return nil, err
+		}
+		return header.XMP, nil
+	}
+
+	file, err := os.Open(img.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	data, err := ioutil.ReadAll(io.LimitReader(file, MaxXMPScan))
+	if err != nil {
+		return nil, err
+	}
+
+	return FindXMP(data), nil
+}
+
+// Returns the path of the XMP sidecar of the image if there is one
+func (img *ImageMeta) Sidecar() (string, bool) {
+	for _, path := range SidecarPaths(img.Path) {
+		if exists, _ := PathExists(path); exists {
+			return path, true
+		}
+	}
+
+	return "", false
+}
+
+// Merges the ratings, labels, keywords, titles, descriptions and capture
+// times of the embedded XMP and the sidecar of the image into its tags,
+// recording the source of each tag that is set.
+func (img *ImageMeta) extractXMP() {
+	props := make(map[string]string)
+	sources := make(map[string]string)
+
+	merge := func(data []byte, source string) {
+		if len(data) == 0 {
+			return
+		}
+
+		// Malformed packets still return the properties read before the error
+		parsed, _ := ParseXMP(data)
+		for prop, value := range parsed {
+			props[prop] = strings.TrimSpace(value)
+			sources[prop] = source
+		}
+	}
+
+	if data, err := img.EmbeddedXMP(); err == nil {
+		merge(data, TagSourceXMP)
+	}
+
+	if path, ok := img.Sidecar(); ok {
+		if data, err := ioutil.ReadFile(path); err == nil {
+			merge(data, TagSourceSidecar)
+		}
+	}
+
+	for _, mapping := range xmpImageTags {
+		value := props[mapping.prop]
+		if mapping.tag == "DateTaken" {
+			ts, ok := ParseXMPDate(value)
+			if !ok {
+				continue
+			}
+			value = JSONStamp(ts)
+		}
+
+		if value == "" {
+			continue
+		}
+
+		// Fallbacks only replace tags that are unset or read from PNG text
+		if mapping.fallback && img.Tags[mapping.tag] != "" && img.Sources[mapping.tag] != TagSourcePNG {
+			continue
+		}
+
+		img.Tags[mapping.tag] = value
+		img.Sources[mapping.tag] = sources[mapping.prop]
+	}
+}
+
+//=============================================================================
+
+// Returns the path of the XMP sidecar for an image, e.g. IMG_0001.xmp
+func SidecarPath(path string) string {
+	return strings.TrimSuffix(path, filepath.Ext(path)) + XMPExt
+}
+
+// Returns the paths a sidecar of the image may have, in the order they are
+// preferred: darktable appends .xmp to the name of the image, e.g.
+// IMG_0001.CR2.xmp, while Lightroom replaces its extension.
+func SidecarPaths(path string) []string {
+	base := strings.TrimSuffix(path, filepath.Ext(path))
+	return []string{
+		path + XMPExt, path + strings.ToUpper(XMPExt),
+		base + XMPExt, base + strings.ToUpper(XMPExt),
+	}
+}
+
+// Writes the location of the image to a new XMP sidecar next to the image.
+// Existing sidecars are never overwritten since they may hold other edits.
+func (img *ImageMeta) WriteSidecar() (string, error) {
+	lat, lon, ok := img.Location()
+	if !ok {
+		return "", errors.New("image has no location to write")
+	}
+
+	path := SidecarPath(img.Path)
+	if exists, err := PathExists(path); exists || err != nil {
+		if err != nil {
+			return "", err
+		}
+		return "", fmt.Errorf("sidecar already exists at \"%s\"", path)
+	}
+
+	data := fmt.Sprintf(xmpGPSTemplate, XMPCoordinate(lat, "N", "S"), XMPCoordinate(lon, "E", "W"))
+	return path, ioutil.WriteFile(path, []byte(data), 0644)
+}
+
+// Formats a coordinate in the XMP "DDD,MM.mmmmK" form, where K is the ref
+func XMPCoordinate(value float64, pos, neg string) string {
+	ref := pos
+	if value < 0 {
+		ref = neg
+		value = -value
+	}
+
+	degrees := math.Floor(value)
+	minutes := (value - degrees) * 60
+	return fmt.Sprintf("%d,%.6f%s", int(degrees), minutes, ref)
+}
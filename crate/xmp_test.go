@@ -0,0 +1,176 @@
+package crate_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/bbengfort/crate/crate"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("XMP", func() {
+
+	It("should find and parse XMP packets", func() {
+		data := []byte(`junk<x:xmpmeta xmlns:x="adobe:ns:meta/">
+ <rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+  <rdf:Description rdf:about="" xmlns:dc="http://purl.org/dc/elements/1.1/"
+    xmlns:xmp="http://ns.adobe.com/xap/1.0/" xmlns:lr="http://ns.adobe.com/lightroom/1.0/"
+    xmp:Rating="4">
+   <dc:title><rdf:Alt><rdf:li xml:lang="x-default">Coast</rdf:li><rdf:li xml:lang="fr">Côte</rdf:li></rdf:Alt></dc:title>
+   <dc:subject><rdf:Bag><rdf:li>sea</rdf:li><rdf:li>rocks</rdf:li></rdf:Bag></dc:subject>
+   <lr:hierarchicalSubject>places|coast</lr:hierarchicalSubject>
+  </rdf:Description>
+ </rdf:RDF>
+</x:xmpmeta>junk`)
+
+		packet := FindXMP(data)
+		Ω(string(packet)).Should(HavePrefix("<x:xmpmeta"))
+		Ω(string(packet)).Should(HaveSuffix("</x:xmpmeta>"))
+
+		props, err := ParseXMP(packet)
+		Ω(err).Should(BeNil())
+		Ω(props).Should(HaveKeyWithValue("xmp:Rating", "4"))
+		Ω(props).Should(HaveKeyWithValue("dc:title", "Coast"))
+		Ω(props).Should(HaveKeyWithValue("dc:subject", "sea; rocks"))
+		Ω(props).Should(HaveKeyWithValue("lr:hierarchicalSubject", "places|coast"))
+		Ω(props).ShouldNot(HaveKey("rdf:about"))
+
+		Ω(FindXMP([]byte("no packet"))).Should(BeNil())
+	})
+
+	It("should parse XMP dates", func() {
+		date, ok := ParseXMPDate("2015-06-14T09:30+02:00")
+		Ω(ok).Should(BeTrue())
+		Ω(date.UTC()).Should(Equal(time.Date(2015, 6, 14, 7, 30, 0, 0, time.UTC)))
+
+		date, ok = ParseXMPDate("2015-06")
+		Ω(ok).Should(BeTrue())
+		Ω(date).Should(Equal(time.Date(2015, 6, 1, 0, 0, 0, 0, time.UTC)))
+	})
+
+	It("should compute the sidecar path of an image", func() {
+		Ω(SidecarPath("/photos/IMG_0001.JPG")).Should(Equal("/photos/IMG_0001.xmp"))
+		Ω(SidecarPaths("/photos/IMG_0001.CR2")).Should(Equal([]string{
+			"/photos/IMG_0001.CR2.xmp", "/photos/IMG_0001.CR2.XMP",
+			"/photos/IMG_0001.xmp", "/photos/IMG_0001.XMP",
+		}))
+	})
+
+	Context("with embedded XMP and sidecars", func() {
+
+		var testRoot string // Temporary directory for the images and sidecars
+
+		// Wraps the properties in an XMP packet
+		mkxmp := func(props string) string {
+			return `<x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+<rdf:Description rdf:about="" xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:xmp="http://ns.adobe.com/xap/1.0/"
+  xmlns:photoshop="http://ns.adobe.com/photoshop/1.0/">` + props + `</rdf:Description></rdf:RDF></x:xmpmeta>`
+		}
+
+		// Writes a JPEG with the XMP packet in an APP1 segment and extracts it
+		extract := func(name, packet string) *ImageMeta {
+			payload := append([]byte("http://ns.adobe.com/xap/1.0/\x00"), packet...)
+			segment := append([]byte{0xff, 0xe1}, mkints(uint16(len(payload)+2))...)
+
+			data := mkjpeg(8, 8)
+			data = append(append(append([]byte{}, data[:2]...), append(segment, payload...)...), data[2:]...)
+
+			path := filepath.Join(testRoot, name)
+			Ω(ioutil.WriteFile(path, data, 0644)).Should(Succeed())
+
+			node, err := NewPath(path)
+			Ω(err).Should(BeNil())
+
+			record := NewRecord(node.(*FileMeta))
+			record.Populate()
+			return record.(*ImageMeta)
+		}
+
+		BeforeEach(func() {
+			var err error
+			testRoot, err = ioutil.TempDir("", "ginkgo-")
+			Ω(err).Should(BeNil())
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(testRoot)
+		})
+
+		It("should read the embedded XMP of an image", func() {
+			img := extract("IMG_0001.jpg", mkxmp(`<dc:title><rdf:Alt><rdf:li xml:lang="x-default">Coast</rdf:li></rdf:Alt></dc:title>
+<dc:subject><rdf:Bag><rdf:li>sea</rdf:li><rdf:li>rocks</rdf:li></rdf:Bag></dc:subject>
+<xmp:Rating>3</xmp:Rating>`))
+
+			Ω(img.Width).Should(Equal(8))
+			Ω(img.Tag("Title")).Should(Equal("Coast"))
+			Ω(img.Tag("Keywords")).Should(Equal("sea; rocks"))
+			Ω(img.Tag("Rating")).Should(Equal("3"))
+			Ω(img.Sources).Should(HaveKeyWithValue("Title", TagSourceXMP))
+			Ω(img.Sources).Should(HaveKeyWithValue("Rating", TagSourceXMP))
+		})
+
+		It("should prefer the sidecar to the embedded XMP", func() {
+			sidecar := mkxmp(`<xmp:Rating>5</xmp:Rating><xmp:Label>Red</xmp:Label>
+<photoshop:DateCreated>2015-06-14T09:30:00+02:00</photoshop:DateCreated>`)
+			Ω(ioutil.WriteFile(filepath.Join(testRoot, "IMG_0001.xmp"), []byte(sidecar), 0644)).Should(Succeed())
+
+			img := extract("IMG_0001.jpg", mkxmp(`<xmp:Rating>3</xmp:Rating>
+<dc:description><rdf:Alt><rdf:li xml:lang="x-default">Low tide</rdf:li></rdf:Alt></dc:description>`))
+
+			Ω(img.Tag("Rating")).Should(Equal("5"))
+			Ω(img.Tag("Label")).Should(Equal("Red"))
+			Ω(img.Tag("ImageDescription")).Should(Equal("Low tide"))
+			Ω(img.Tag("DateTaken")).Should(Equal("2015-06-14T07:30:00+00:00"))
+
+			Ω(img.Sources).Should(HaveKeyWithValue("Rating", TagSourceSidecar))
+			Ω(img.Sources).Should(HaveKeyWithValue("DateTaken", TagSourceSidecar))
+			Ω(img.Sources).Should(HaveKeyWithValue("ImageDescription", TagSourceXMP))
+
+			path, ok := img.Sidecar()
+			Ω(ok).Should(BeTrue())
+			Ω(path).Should(Equal(filepath.Join(testRoot, "IMG_0001.xmp")))
+		})
+
+		It("should prefer the darktable sidecar of the image", func() {
+			Ω(ioutil.WriteFile(filepath.Join(testRoot, "IMG_0001.xmp"), []byte(mkxmp(`<xmp:Rating>1</xmp:Rating>`)), 0644)).Should(Succeed())
+			Ω(ioutil.WriteFile(filepath.Join(testRoot, "IMG_0001.jpg.xmp"), []byte(mkxmp(`<xmp:Rating>2</xmp:Rating>`)), 0644)).Should(Succeed())
+
+			img := extract("IMG_0001.jpg", mkxmp(""))
+			Ω(img.Tag("Rating")).Should(Equal("2"))
+		})
+
+	})
+
+	It("should format coordinates for XMP", func() {
+		Ω(XMPCoordinate(31.5, "N", "S")).Should(Equal("31,30.000000N"))
+		Ω(XMPCoordinate(-9.775, "E", "W")).Should(Equal("9,46.500000W"))
+	})
+
+	It("should write a sidecar but never overwrite one", func() {
+		testRoot, err := ioutil.TempDir("", "ginkgo-")
+		Ω(err).Should(BeNil())
+		defer os.RemoveAll(testRoot)
+
+		img := new(ImageMeta)
+		img.Path = filepath.Join(testRoot, "IMG_0001.jpg")
+
+		_, err = img.WriteSidecar()
+		Ω(err).Should(HaveOccurred())
+
+		img.Tags = map[string]string{"Latitude": "31.5", "Longitude": "-9.775"}
+		path, err := img.WriteSidecar()
+		Ω(err).Should(BeNil())
+
+		data, err := ioutil.ReadFile(path)
+		Ω(err).Should(BeNil())
+		Ω(string(data)).Should(ContainSubstring("exif:GPSLatitude=\"31,30.000000N\""))
+
+		_, err = img.WriteSidecar()
+		Ω(err).Should(HaveOccurred())
+	})
+
+})
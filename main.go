@@ -4,6 +4,8 @@ package main
 
 import (
 	"os"
+	"strings"
+	"time"
 
 	"github.com/bbengfort/crate/crate"
 	"github.com/bbengfort/crate/crate/version"
@@ -24,6 +26,222 @@ func main() {
 		cli.BoolFlag{"debug", "set debug mode for vebose logging", ""},
 	}
 
+	app.Commands = []cli.Command{
+		{
+			Name:  "search",
+			Usage: "search the meta data with a query, e.g. near:31.51,-9.77~5km after:2015-01-01",
+			Flags: []cli.Flag{
+				cli.IntFlag{"limit", 0, "limit the number of results (0 for no limit)", ""},
+				cli.BoolFlag{"info", "print the full meta data of each result", ""},
+			},
+			Action: func(c *cli.Context) {
+				service := new(crate.CrateService)
+				service.Search(strings.Join(c.Args(), " "), c.Int("limit"), c.Bool("info"))
+			},
+		},
+		{
+			Name:  "grep",
+			Usage: "search the names, tags and text of the files for words, ranked by relevance",
+			Flags: []cli.Flag{
+				cli.IntFlag{"limit", 20, "limit the number of matches (0 for no limit)", ""},
+			},
+			Action: func(c *cli.Context) {
+				service := new(crate.CrateService)
+				service.Grep(strings.Join(c.Args(), " "), c.Int("limit"))
+			},
+		},
+		{
+			Name:  "geotag",
+			Usage: "geotag images in a directory without GPS from GPX track logs",
+			Flags: []cli.Flag{
+				cli.StringSliceFlag{"gpx", &cli.StringSlice{}, "path to a GPX track log (may be repeated)", ""},
+				cli.StringFlag{"offset", "0s", "camera clock minus UTC, e.g. 2h or -5h30m", ""},
+				cli.StringFlag{"max-gap", "5m", "maximum time to a track point to infer a location", ""},
+				cli.BoolFlag{"xmp", "also write the locations to new XMP sidecars", ""},
+			},
+			Action: func(c *cli.Context) {
+				offset, err := time.ParseDuration(c.String("offset"))
+				if err != nil {
+					console.Fatal("Could not parse offset: %s", err)
+				}
+
+				maxGap, err := time.ParseDuration(c.String("max-gap"))
+				if err != nil {
+					console.Fatal("Could not parse max gap: %s", err)
+				}
+
+				if len(c.StringSlice("gpx")) == 0 || len(c.Args()) == 0 {
+					console.Fatal("Specify a directory and at least one --gpx track log")
+				}
+
+				service := new(crate.CrateService)
+				service.Geotag(c.Args()[0], c.StringSlice("gpx"), offset, maxGap, c.Bool("xmp"))
+			},
+		},
+		{
+			Name:  "export",
+			Usage: "export the locations of records matching a search query to a map format",
+			Flags: []cli.Flag{
+				cli.StringFlag{"format", "geojson", "the export format, geojson or kml", ""},
+				cli.StringFlag{"output", "", "path to write the export to (default stdout)", ""},
+				cli.BoolFlag{"cluster", "export one placemark per day at its centroid", ""},
+			},
+			Action: func(c *cli.Context) {
+				service := new(crate.CrateService)
+				service.Export(strings.Join(c.Args(), " "), c.String("format"), c.Bool("cluster"), c.String("output"))
+			},
+		},
+		{
+			Name:  "thumbnail",
+			Usage: "extract the embedded EXIF thumbnail of an image without decoding it",
+			Flags: []cli.Flag{
+				cli.StringFlag{"output", "", "path to write the thumbnail to (default stdout)", ""},
+			},
+			Action: func(c *cli.Context) {
+				if len(c.Args()) == 0 {
+					console.Fatal("Specify the path of an image")
+				}
+
+				service := new(crate.CrateService)
+				service.Thumbnail(c.Args()[0], c.String("output"))
+			},
+		},
+		{
+			Name:  "thumbnails",
+			Usage: "generate and cache thumbnails of the images matching a search query",
+			Flags: []cli.Flag{
+				cli.IntFlag{"size", crate.DefaultThumbnailSize, "longest edge of the thumbnails in pixels", ""},
+			},
+			Action: func(c *cli.Context) {
+				service := new(crate.CrateService)
+				service.Thumbnails(strings.Join(c.Args(), " "), c.Int("size"))
+			},
+		},
+		{
+			Name:  "check",
+			Usage: "fully decode the images matching a search query to find corrupt, blurry or badly exposed ones",
+			Flags: []cli.Flag{
+				cli.BoolFlag{"force", "check images again that have already been checked", ""},
+				cli.BoolFlag{"all", "print the scores of every image rather than only the suspicious ones", ""},
+			},
+			Action: func(c *cli.Context) {
+				service := new(crate.CrateService)
+				service.Check(strings.Join(c.Args(), " "), c.Bool("force"), c.Bool("all"))
+			},
+		},
+		{
+			Name:  "group",
+			Usage: "group the images into bursts and events with the thresholds of the config",
+			Action: func(c *cli.Context) {
+				service := new(crate.CrateService)
+				service.Regroup()
+			},
+		},
+		{
+			Name:  "groups",
+			Usage: "list the bursts and events found by group, search group:<id> for their images",
+			Flags: []cli.Flag{
+				cli.StringFlag{"kind", "", "list only the groups of the kind, burst or event", ""},
+				cli.BoolFlag{"members", "print the paths of the images in each group", ""},
+			},
+			Action: func(c *cli.Context) {
+				service := new(crate.CrateService)
+				service.Groups(c.String("kind"), c.Bool("members"))
+			},
+		},
+		{
+			Name:  "organize",
+			Usage: "copy or link images and videos into a target tree by the date they were taken",
+			Flags: []cli.Flag{
+				cli.StringFlag{"template", "", "template of the paths in the target, defaults to the config", ""},
+				cli.StringFlag{"query", "", "organize the stored records matching the query if there is no source", ""},
+				cli.BoolFlag{"link", "hard link the files rather than copy them", ""},
+				cli.BoolFlag{"dry-run", "print the plan without changing any files", ""},
+				cli.StringFlag{"undo", "", "undo the organize run of the journal at the path", ""},
+			},
+			Action: func(c *cli.Context) {
+				service := new(crate.CrateService)
+				if c.String("undo") != "" {
+					service.UndoOrganize(c.String("undo"))
+					return
+				}
+
+				if len(c.Args()) == 0 {
+					console.Fatal("Specify the target directory and, optionally, the source directory")
+				}
+
+				source := ""
+				if len(c.Args()) > 1 {
+					source = c.Args()[1]
+				}
+
+				service.Organize(c.Args()[0], source, c.String("query"), c.String("template"), c.Bool("link"), c.Bool("dry-run"))
+			},
+		},
+		{
+			Name:  "similar",
+			Usage: "find the images that look like an image, by its path or signature",
+			Flags: []cli.Flag{
+				cli.IntFlag{"distance", crate.DefaultSimilarDistance, "most bits of the perceptual hashes that may differ", ""},
+				cli.IntFlag{"limit", 20, "maximum number of similar images to print", ""},
+			},
+			Action: func(c *cli.Context) {
+				if len(c.Args()) == 0 {
+					console.Fatal("Specify the path or signature of an image")
+				}
+
+				service := new(crate.CrateService)
+				service.Similar(c.Args()[0], c.Int("distance"), c.Int("limit"))
+			},
+		},
+		{
+			Name:  "versions",
+			Usage: "list the records with the same pixel data as an image and the tags that differ",
+			Action: func(c *cli.Context) {
+				if len(c.Args()) == 0 {
+					console.Fatal("Specify the path or signature of an image")
+				}
+
+				service := new(crate.CrateService)
+				service.Versions(c.Args()[0])
+			},
+		},
+		{
+			Name:  "companions",
+			Usage: "list the RAW, JPEG, sidecar and Live Photo files stored as one asset with a file",
+			Action: func(c *cli.Context) {
+				if len(c.Args()) == 0 {
+					console.Fatal("Specify the path or signature of a file")
+				}
+
+				service := new(crate.CrateService)
+				service.Companions(c.Args()[0])
+			},
+		},
+		{
+			Name:  "duplicates",
+			Usage: "report the clusters of near-duplicate images in the database",
+			Flags: []cli.Flag{
+				cli.IntFlag{"distance", crate.DefaultSimilarDistance, "most bits of the perceptual hashes that may differ", ""},
+			},
+			Action: func(c *cli.Context) {
+				service := new(crate.CrateService)
+				service.NearDuplicates(c.Int("distance"))
+			},
+		},
+		{
+			Name:  "reextract",
+			Usage: "re-extract records produced by outdated extractors",
+			Flags: []cli.Flag{
+				cli.BoolFlag{"all", "re-extract every record, not only the stale ones", ""},
+			},
+			Action: func(c *cli.Context) {
+				service := new(crate.CrateService)
+				service.Reextract(c.Bool("all"))
+			},
+		},
+	}
+
 	app.Action = func(c *cli.Context) {
 
 		// debug := c.Bool("debug")